@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/eymyong/drop/repo"
+	"github.com/eymyong/drop/repo/cryptclipboard"
+)
+
+// purgeExpired deletes expired clipboards and their blobs every interval,
+// so that they don't stay in storage once they are no longer served
+func purgeExpired(ctx context.Context, clipboards repo.RepositoryClipboard, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := clipboards.DeleteExpired(ctx)
+		if err != nil {
+			log.Println("failed to delete expired clipboards:", err)
+		}
+		if deleted > 0 {
+			log.Printf("deleted %d expired clipboards\n", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reencrypt moves all clipboards, and blobs in BLOB_DIR, to the newest key of the key ring.
+// It's run as `api reencrypt` with the same environment as the API,
+// which can keep serving with the new key ring meanwhile:
+//
+//  1. Add the new key version to ENCRYPTION_KEYS and restart the API
+//  2. Run `api reencrypt`
+//  3. Remove old key versions from ENCRYPTION_KEYS and restart the API
+func reencrypt() {
+	keys, err := envKeyRing()
+	if err != nil {
+		log.Fatalln("failed to load encryption keys:", err)
+	}
+	if keys == nil {
+		log.Fatalln("ENCRYPTION_KEYS or ENCRYPTION_KEYS_FILE is required")
+	}
+
+	repos, err := newRepositories(envStorageBackend(), envQuota())
+	if err != nil {
+		log.Fatalln("failed to init repositories:", err)
+	}
+
+	moved, err := cryptclipboard.Reencrypt(context.Background(), repos.clip, keys)
+	if err != nil {
+		log.Fatalf("reencrypt failed after %d clipboards: %v\n", moved, err)
+	}
+
+	log.Printf("re-encrypted %d clipboards with key version %d\n", moved, keys.Current())
+
+	blobs, err := newBlobStore(envBlobDir())
+	if err != nil {
+		log.Fatalln("failed to init blob store:", err)
+	}
+	if blobs == nil {
+		return
+	}
+
+	moved, err = cryptclipboard.ReencryptBlobs(context.Background(), blobs, keys)
+	if err != nil {
+		log.Fatalf("reencrypt failed after %d blobs: %v\n", moved, err)
+	}
+
+	log.Printf("re-encrypted %d blobs with key version %d\n", moved, keys.Current())
+}
@@ -1,13 +1,19 @@
 package handlerclipboard
 
 import (
+	"bufio"
 	"bytes"
-	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/eymyong/drop/cmd/api/handler/httperror"
+	"github.com/eymyong/drop/cmd/api/service"
 	"github.com/eymyong/drop/model"
 	"github.com/eymyong/drop/repo"
 	"github.com/google/uuid"
@@ -15,11 +21,37 @@ import (
 )
 
 type HandlerClipboard struct {
-	repoClipboard repo.RepositoryClipboard
+	repoClipboard repo.RepositoryClipboardStream
+	repoSpace     repo.RepositorySpace
+	// repoSession and repoDevice are checked by open streams,
+	// which outlive the auth middleware check
+	repoSession repo.RepositorySession
+	repoDevice  repo.RepositoryDevice
+	events      repo.ClipboardEvents
+	quota       repo.Quota
 }
 
-func NewClipboard(repoClipboard repo.RepositoryClipboard) *HandlerClipboard {
-	return &HandlerClipboard{repoClipboard: repoClipboard}
+// NewClipboard returns clipboard handlers. With nil events,
+// the clipboard stream is unavailable.
+//
+// All handlers work on the user's personal clipboards, or with ?space=,
+// on clipboards of a space the user is a member of.
+func NewClipboard(
+	repoClipboard repo.RepositoryClipboardStream,
+	repoSpace repo.RepositorySpace,
+	repoSession repo.RepositorySession,
+	repoDevice repo.RepositoryDevice,
+	events repo.ClipboardEvents,
+	quota repo.Quota,
+) *HandlerClipboard {
+	return &HandlerClipboard{
+		repoClipboard: repoClipboard,
+		repoSpace:     repoSpace,
+		repoSession:   repoSession,
+		repoDevice:    repoDevice,
+		events:        events,
+		quota:         quota,
+	}
 }
 
 func sendJson(w http.ResponseWriter, status int, data interface{}) {
@@ -40,58 +72,433 @@ func readBody(r *http.Request) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+const (
+	defaultLimit = 50
+	maxLimit     = 500
+)
+
+// queryLimit returns page size from ?limit=, capped at maxLimit
+func queryLimit(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return defaultLimit, nil
+	}
+
+	limit, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if limit <= 0 {
+		return 0, fmt.Errorf("limit must be positive, got %d", limit)
+	}
+
+	if limit > maxLimit {
+		return maxLimit, nil
+	}
+
+	return limit, nil
+}
+
+// queryTime parses RFC3339 time from query param key,
+// returning zero time if it's absent
+func queryTime(r *http.Request, key string) (time.Time, error) {
+	s := r.URL.Query().Get(key)
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// queryExpiry parses optional ?ttl= (e.g. 10m) and ?burn_after_read=
+func queryExpiry(r *http.Request) (time.Duration, bool, error) {
+	var (
+		ttl  time.Duration
+		burn bool
+		err  error
+	)
+
+	q := r.URL.Query()
+	if s := q.Get("ttl"); s != "" {
+		ttl, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if ttl <= 0 {
+			return 0, false, fmt.Errorf("ttl must be positive, got %s", s)
+		}
+	}
+
+	if s := q.Get("burn_after_read"); s != "" {
+		burn, err = strconv.ParseBool(s)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	return ttl, burn, nil
+}
+
+// contentType returns the normalized request Content-Type,
+// or model.DefaultMimeType if there's none
+func contentType(r *http.Request) (string, error) {
+	s := r.Header.Get("Content-Type")
+	if s == "" {
+		return model.DefaultMimeType, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(s)
+	if err != nil {
+		return "", err
+	}
+
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+// headerEnvelope carries model.Envelope of end-to-end encrypted content
+const headerEnvelope = "Clip-Envelope"
+
+// envelope returns the validated envelope sent by the client,
+// or nil for plaintext content
+func envelope(r *http.Request) (*model.Envelope, error) {
+	s := r.Header.Get(headerEnvelope)
+	if s == "" {
+		return nil, nil
+	}
+
+	e, err := model.ParseEnvelope(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// encryptedMimeType is the MIME type of all end-to-end encrypted content,
+// as the server can't tell what it is
+const encryptedMimeType = "application/octet-stream"
+
+// isText reports whether content of mimeType can be sent as JSON string
+func isText(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json"
+}
+
+// hideContent blanks out text of clipboards in listings if it's binary,
+// or if it's burn-after-read so that it can only be read once by id
+func hideContent(clipboards []model.Clipboard) []model.Clipboard {
+	for i := range clipboards {
+		if clipboards[i].BurnAfterRead {
+			clipboards[i].Text = ""
+		}
+
+		clipboards[i] = hideBinary(clipboards[i])
+	}
+
+	return clipboards
+}
+
+// hideBinary blanks out text of a clipboard read by id if it's binary
+func hideBinary(clipboard model.Clipboard) model.Clipboard {
+	if !isText(clipboard.MimeType) {
+		clipboard.Text = ""
+	}
+
+	return clipboard
+}
+
+// sendContent streams raw clipboard content from clipboards with its stored
+// Content-Type. Content is from users, so it must not run as a page of this origin.
+func sendContent(w http.ResponseWriter, r *http.Request, clipboards repo.RepositoryClipboardStream, clipboard model.Clipboard) {
+	rc, err := clipboards.Open(r.Context(), clipboard)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to open clipboard %s", clipboard.Id), err)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Content-Type", clipboard.MimeType)
+	w.Header().Set("Content-Length", strconv.FormatInt(clipboard.Size, 10))
+	w.Header().Set("ETag", `"`+clipboard.Checksum+`"`)
+	if clipboard.Envelope != nil {
+		w.Header().Set(headerEnvelope, clipboard.Envelope.String())
+	}
+	w.WriteHeader(http.StatusOK)
+
+	io.Copy(w, rc)
+}
+
+// ownerId returns the authenticated user id, or writes 401 if there's none
+func ownerId(w http.ResponseWriter, r *http.Request) (string, bool) {
+	claims, ok := service.ClaimsFromContext(r.Context())
+	if !ok || claims.UserId == "" {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthenticated",
+		})
+
+		return "", false
+	}
+
+	return claims.UserId, true
+}
+
+// deviceId returns the registered device of the authenticated session, if any
+func deviceId(r *http.Request) string {
+	claims, _ := service.ClaimsFromContext(r.Context())
+	return claims.DeviceId
+}
+
+// listClips lists clipboards of owner, only those created from
+// device ?device= if it's set
+func (h *HandlerClipboard) listClips(r *http.Request, owner string, limit int, cursor string) ([]model.Clipboard, string, error) {
+	device := r.URL.Query().Get("device")
+	if device != "" {
+		return h.repoClipboard.ListByDevice(r.Context(), owner, device, limit, cursor)
+	}
+
+	return h.repoClipboard.ListByOwner(r.Context(), owner, limit, cursor)
+}
+
+// listPage lists a page of clipboards of the space for ?limit=,
+// sending the error response if it fails
+func (h *HandlerClipboard) listPage(w http.ResponseWriter, r *http.Request, cursor string, failed string) ([]model.Clipboard, string, bool) {
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleReader)
+	if !ok {
+		return nil, "", false
+	}
+
+	limit, err := queryLimit(r)
+	if err != nil {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid limit",
+			"reason": err.Error(),
+		})
+		return nil, "", false
+	}
+
+	clipboards, next, err := h.listClips(r, owner, limit, cursor)
+	if err != nil {
+		httperror.Send(w, failed, err)
+		return nil, "", false
+	}
+
+	return clipboards, next, true
+}
+
+// CreateClip streams request body into a new clipboard,
+// so that large bodies are never buffered whole in memory
 func (h *HandlerClipboard) CreateClip(w http.ResponseWriter, r *http.Request) {
-	b, err := readBody(r)
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleWriter)
+	if !ok {
+		return
+	}
+
+	ttl, burn, err := queryExpiry(r)
 	if err != nil {
 		sendJson(w, http.StatusBadRequest, map[string]interface{}{
-			"error":  "failed to read body",
+			"error":  "invalid query",
 			"reason": err.Error(),
 		})
 		return
 	}
 
-	if len(b) == 0 {
+	mimeType, err := contentType(r)
+	if err != nil {
 		sendJson(w, http.StatusBadRequest, map[string]interface{}{
-			"error": "empty body",
+			"error":  "invalid content type",
+			"reason": err.Error(),
 		})
 		return
 	}
 
-	clipboard := model.Clipboard{
-		Id:   uuid.NewString(),
-		Text: string(b),
+	encrypted, err := envelope(r)
+	if err != nil {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid " + headerEnvelope,
+			"reason": err.Error(),
+		})
+		return
+	}
+	if encrypted != nil {
+		mimeType = encryptedMimeType
+	}
+
+	defer r.Body.Close()
+	body := bufio.NewReader(r.Body)
+	_, err = body.Peek(1)
+	if err == io.EOF {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error": "empty body",
+		})
+		return
 	}
-	ctx := context.Background()
-	err = h.repoClipboard.Create(ctx, clipboard)
 	if err != nil {
-		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
-			"error":  "failed to create clipboard",
+		sendJson(w, httperror.BodyStatusCode(err), map[string]interface{}{
+			"error":  "failed to read body",
 			"reason": err.Error(),
 		})
 		return
 	}
 
+	ctx := r.Context()
+	usage, ok := h.usage(ctx, w, owner, 1, 0)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	clipboard := model.Clipboard{
+		Id:            uuid.NewString(),
+		Content:       model.Content{MimeType: mimeType, Envelope: encrypted},
+		OwnerId:       owner,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		BurnAfterRead: burn,
+		DeviceId:      deviceId(r),
+	}
+	if ttl > 0 {
+		clipboard.ExpiresAt = now.Add(ttl)
+	}
+	clipboard, err = h.repoClipboard.CreateFrom(ctx, clipboard, limitQuota(body, h.quota, usage))
+	if err != nil {
+		httperror.Send(w, "failed to create clipboard", err)
+		return
+	}
+
 	sendJson(w, http.StatusCreated, map[string]interface{}{
 		"success": "ok",
-		"created": clipboard,
+		"created": hideContent([]model.Clipboard{clipboard})[0],
 	})
 }
 
+// GetAllClips pages through clipboards, newest first,
+// optionally only those created from ?device=
 func (h *HandlerClipboard) GetAllClips(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	clipboards, err := h.repoClipboard.GetAll(ctx)
+	clipboards, next, ok := h.listPage(w, r, r.URL.Query().Get("cursor"), "failed to get all clipboards")
+	if !ok {
+		return
+	}
+
+	sendJson(w, http.StatusOK, map[string]interface{}{
+		"clipboards":  hideContent(clipboards),
+		"next_cursor": next,
+	})
+}
+
+// GetRecentClips returns ?limit= most recent clipboards, newest first,
+// optionally only those created from ?device=
+func (h *HandlerClipboard) GetRecentClips(w http.ResponseWriter, r *http.Request) {
+	clipboards, _, ok := h.listPage(w, r, "", "failed to get recent clipboards")
+	if !ok {
+		return
+	}
+
+	sendJson(w, http.StatusOK, hideContent(clipboards))
+}
+
+// GetClipsInRange returns clipboards created between ?from= and ?to=
+// (RFC3339, to is exclusive), newest first,
+// optionally only those created from ?device=
+func (h *HandlerClipboard) GetClipsInRange(w http.ResponseWriter, r *http.Request) {
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleReader)
+	if !ok {
+		return
+	}
+
+	limit, err := queryLimit(r)
+	if err != nil {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid limit",
+			"reason": err.Error(),
+		})
+		return
+	}
+
+	from, err := queryTime(r, "from")
 	if err != nil {
-		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
-			"error":  "failed to get all todos",
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid from",
 			"reason": err.Error(),
 		})
 		return
 	}
 
-	sendJson(w, http.StatusOK, clipboards)
+	to, err := queryTime(r, "to")
+	if err != nil {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid to",
+			"reason": err.Error(),
+		})
+		return
+	}
+
+	ctx := r.Context()
+	var clipboards []model.Clipboard
+	if device := r.URL.Query().Get("device"); device != "" {
+		clipboards, err = h.repoClipboard.GetByDeviceInRange(ctx, owner, device, from, to, limit)
+	} else {
+		clipboards, err = h.repoClipboard.GetByOwnerInRange(ctx, owner, from, to, limit)
+	}
+	if err != nil {
+		httperror.Send(w, "failed to get clipboards in range", err)
+		return
+	}
+
+	sendJson(w, http.StatusOK, hideContent(clipboards))
+}
+
+// GetLatestClip returns the latest clipboard,
+// optionally the latest one created from ?device=
+func (h *HandlerClipboard) GetLatestClip(w http.ResponseWriter, r *http.Request) {
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleReader)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	clipboards, _, err := h.listClips(r, owner, 1, "")
+	if err != nil {
+		httperror.Send(w, "failed to get latest clipboard", err)
+		return
+	}
+
+	if len(clipboards) == 0 {
+		sendJson(w, http.StatusNotFound, map[string]interface{}{
+			"error": "no clipboards",
+		})
+		return
+	}
+
+	latest := clipboards[0]
+	if latest.BurnAfterRead {
+		// Reading the latest clipboard counts as a read
+		latest, err = h.repoClipboard.GetByIdAndOwner(ctx, latest.Id, owner)
+		if err != nil {
+			httperror.Send(w, "failed to get latest clipboard", err)
+			return
+		}
+	}
+
+	sendJson(w, http.StatusOK, hideBinary(latest))
 }
 
+// GetClipById serves raw clipboard content with its stored Content-Type,
+// or with ?format=json, the clipboard as JSON. Binary content is left out
+// of the JSON variant.
 func (h *HandlerClipboard) GetClipById(w http.ResponseWriter, r *http.Request) {
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleReader)
+	if !ok {
+		return
+	}
+
 	vars := mux.Vars(r)
 	id := vars["clipboard-id"]
 	if id == "" {
@@ -100,35 +507,56 @@ func (h *HandlerClipboard) GetClipById(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	ctx := context.Background()
-	clipboard, err := h.repoClipboard.GetById(ctx, id)
+	ctx := r.Context()
+	clipboard, err := h.repoClipboard.GetByIdAndOwner(ctx, id, owner)
 	if err != nil {
-		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
-			"error":  fmt.Sprintf("failed to get todo %s", id),
-			"reason": err.Error(),
-		})
+		httperror.Send(w, fmt.Sprintf("failed to get clipboard %s", id), err)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		// JSON never has blob content, and the blob of a burnt clipboard
+		// can't be read later, so it goes now
+		if clipboard.BurnAfterRead && clipboard.BlobKey != "" {
+			rc, err := h.repoClipboard.Open(ctx, clipboard)
+			if err == nil {
+				rc.Close()
+			}
+		}
+
+		sendJson(w, http.StatusOK, hideBinary(clipboard))
 		return
 	}
 
-	sendJson(w, http.StatusOK, clipboard)
+	sendContent(w, r, h.repoClipboard, clipboard)
 }
 
 func (h *HandlerClipboard) UpdateClipById(w http.ResponseWriter, r *http.Request) {
-	b, err := readBody(r)
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleWriter)
+	if !ok {
+		return
+	}
+
+	mimeType, err := contentType(r)
 	if err != nil {
 		sendJson(w, http.StatusBadRequest, map[string]interface{}{
-			"error":  "failed to read body",
+			"error":  "invalid content type",
 			"reason": err.Error(),
 		})
 		return
 	}
 
-	if len(b) == 0 {
+	encrypted, err := envelope(r)
+	if err != nil {
 		sendJson(w, http.StatusBadRequest, map[string]interface{}{
-			"error": "empty body",
+			"error":  "invalid " + headerEnvelope,
+			"reason": err.Error(),
 		})
 		return
 	}
+	if encrypted != nil {
+		mimeType = encryptedMimeType
+	}
 
 	vars := mux.Vars(r)
 	id := vars["clipboard-id"]
@@ -139,23 +567,50 @@ func (h *HandlerClipboard) UpdateClipById(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	ctx := context.Background()
-	err = h.repoClipboard.Update(ctx, id, string(b))
+	defer r.Body.Close()
+	body := bufio.NewReader(r.Body)
+	_, err = body.Peek(1)
+	if err == io.EOF {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error": "empty body",
+		})
+		return
+	}
 	if err != nil {
-		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
-			"error":  "failed to update",
+		sendJson(w, httperror.BodyStatusCode(err), map[string]interface{}{
+			"error":  "failed to read body",
 			"reason": err.Error(),
 		})
 		return
 	}
 
+	// New content replaces the old one, whose size we can't tell here
+	// without burning burn-after-read clipboards, so it's only capped early
+	// by the whole quota. The repository checks the exact usage.
+	ctx := r.Context()
+	content, err := h.repoClipboard.UpdateFrom(ctx, id, owner, model.Content{MimeType: mimeType, Envelope: encrypted}, limitQuota(body, h.quota, model.Usage{}))
+	if err != nil {
+		httperror.Send(w, "failed to update", err)
+		return
+	}
+
+	reason := fmt.Sprintf("%d bytes of %s", content.Size, mimeType)
+	if isText(mimeType) && content.BlobKey == "" {
+		reason = content.Text
+	}
+
 	sendJson(w, http.StatusOK, map[string]interface{}{
-		"sucess": fmt.Sprintf("update to id: %s", id),
-		"reason": string(b),
+		"success": fmt.Sprintf("update to id: %s", id),
+		"reason":  reason,
 	})
 }
 
 func (h *HandlerClipboard) DeleteClip(w http.ResponseWriter, r *http.Request) {
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleWriter)
+	if !ok {
+		return
+	}
+
 	vars := mux.Vars(r)
 	id := vars["clipboard-id"]
 	if id == "" {
@@ -164,13 +619,10 @@ func (h *HandlerClipboard) DeleteClip(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	ctx := context.Background()
-	err := h.repoClipboard.Delete(ctx, id)
+	ctx := r.Context()
+	err := h.repoClipboard.DeleteByIdAndOwner(ctx, id, owner)
 	if err != nil {
-		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
-			"error":  "failed to delete",
-			"reason": err.Error(),
-		})
+		httperror.Send(w, "failed to delete", err)
 		return
 	}
 
@@ -0,0 +1,76 @@
+package handlerclipboard
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/eymyong/drop/cmd/api/handler/httperror"
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+// quotaReader fails with repo.ErrQuotaBytes
+// once more than n bytes are read from r
+type quotaReader struct {
+	r io.Reader
+	n int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.n -= int64(n)
+	if q.n < 0 {
+		return n, fmt.Errorf("more than quota: %w", repo.ErrQuotaBytes)
+	}
+
+	return n, err
+}
+
+// limitQuota caps r to the bytes left in quota after usage, so that
+// uploads over quota stop early, before the repository checks it
+func limitQuota(r io.Reader, quota repo.Quota, usage model.Usage) io.Reader {
+	if quota.MaxBytes <= 0 {
+		return r
+	}
+
+	return &quotaReader{r: r, n: quota.MaxBytes - usage.Bytes}
+}
+
+// usage returns storage usage of owner, or writes error if it can't
+// store clips more clipboards of size bytes
+func (h *HandlerClipboard) usage(ctx context.Context, w http.ResponseWriter, owner string, clips int64, size int64) (model.Usage, bool) {
+	usage, err := h.repoClipboard.UsageByOwner(ctx, owner)
+	if err != nil {
+		httperror.Send(w, "failed to get storage usage", err)
+		return model.Usage{}, false
+	}
+
+	err = h.quota.Check(usage, clips, size)
+	if err != nil {
+		httperror.Send(w, "storage quota exceeded", err)
+		return model.Usage{}, false
+	}
+
+	return usage, true
+}
+
+// GetUsage returns storage usage and quota of the user or space
+func (h *HandlerClipboard) GetUsage(w http.ResponseWriter, r *http.Request) {
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleReader)
+	if !ok {
+		return
+	}
+
+	usage, err := h.repoClipboard.UsageByOwner(r.Context(), owner)
+	if err != nil {
+		httperror.Send(w, "failed to get storage usage", err)
+		return
+	}
+
+	sendJson(w, http.StatusOK, map[string]interface{}{
+		"usage": usage,
+		"quota": h.quota,
+	})
+}
@@ -0,0 +1,288 @@
+package handlerclipboard
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/eymyong/drop/cmd/api/handler/httperror"
+	"github.com/eymyong/drop/cmd/api/service"
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+// HandlerShare handles share links, which serve a clipboard
+// to anyone with the link at /s/{share-token}
+type HandlerShare struct {
+	repoShare       repo.RepositoryShare
+	repoClipboard   repo.RepositoryClipboardStream
+	repoSpace       repo.RepositorySpace
+	servicePassword service.Password
+}
+
+func NewShare(
+	repoShare repo.RepositoryShare,
+	repoClipboard repo.RepositoryClipboardStream,
+	repoSpace repo.RepositorySpace,
+	servicePassword service.Password,
+) *HandlerShare {
+	return &HandlerShare{
+		repoShare:       repoShare,
+		repoClipboard:   repoClipboard,
+		repoSpace:       repoSpace,
+		servicePassword: servicePassword,
+	}
+}
+
+// newShareToken returns 256-bit random token, so that links can't be guessed
+func newShareToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreateShare creates a share link of a clipboard with optional JSON body
+// {"password": "...", "ttl": "24h", "max_views": 3}.
+//
+// The clipboard is only checked to exist, not read, so that burn-after-read
+// clipboards are not burned by sharing them. Missing clipboards,
+// and clipboards of other users, are 404.
+func (h *HandlerShare) CreateShare(w http.ResponseWriter, r *http.Request) {
+	type requestShare struct {
+		Password string `json:"password"`
+		Ttl      string `json:"ttl"`
+		MaxViews int    `json:"max_views"`
+	}
+
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleWriter)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["clipboard-id"]
+	if id == "" {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error": "missing id",
+		})
+		return
+	}
+
+	b, err := readBody(r)
+	if err != nil {
+		sendJson(w, httperror.BodyStatusCode(err), map[string]interface{}{
+			"error":  "failed to read body",
+			"reason": err.Error(),
+		})
+		return
+	}
+
+	err = h.repoClipboard.CheckOwner(r.Context(), id, owner)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to get clipboard %s", id), err)
+		return
+	}
+
+	var req requestShare
+	if len(b) != 0 {
+		err = json.Unmarshal(b, &req)
+		if err != nil {
+			sendJson(w, http.StatusBadRequest, map[string]interface{}{
+				"error":  "invalid body",
+				"reason": err.Error(),
+			})
+			return
+		}
+	}
+
+	var ttl time.Duration
+	if req.Ttl != "" {
+		ttl, err = time.ParseDuration(req.Ttl)
+		if err == nil && ttl <= 0 {
+			err = fmt.Errorf("ttl must be positive, got %s", req.Ttl)
+		}
+		if err != nil {
+			sendJson(w, http.StatusBadRequest, map[string]interface{}{
+				"error":  "invalid body",
+				"reason": err.Error(),
+			})
+			return
+		}
+	}
+
+	if req.MaxViews < 0 {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid body",
+			"reason": "max_views must not be negative",
+		})
+		return
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
+			"error":  "failed to generate share token",
+			"reason": err.Error(),
+		})
+		return
+	}
+
+	now := time.Now()
+	share := model.Share{
+		Token:       token,
+		ClipboardId: id,
+		OwnerId:     owner,
+		CreatedAt:   now,
+		MaxViews:    req.MaxViews,
+		ViewsLeft:   req.MaxViews,
+	}
+	if ttl > 0 {
+		share.ExpiresAt = now.Add(ttl)
+	}
+
+	if req.Password != "" {
+		share.PasswordHash, err = h.servicePassword.Hash(req.Password)
+		if err != nil {
+			sendJson(w, http.StatusInternalServerError, map[string]interface{}{
+				"error":  "failed to hash password",
+				"reason": err.Error(),
+			})
+			return
+		}
+	}
+
+	err = h.repoShare.Create(r.Context(), share)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to share clipboard %s", id), err)
+		return
+	}
+
+	sendJson(w, http.StatusCreated, map[string]interface{}{
+		"success": "ok",
+		"created": share,
+		"url":     "/s/" + token,
+	})
+}
+
+// GetShares lists live share links of a clipboard
+func (h *HandlerShare) GetShares(w http.ResponseWriter, r *http.Request) {
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleReader)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["clipboard-id"]
+	shares, err := h.repoShare.GetAllByClipboard(r.Context(), id, owner)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to get shares of clipboard %s", id), err)
+		return
+	}
+
+	sendJson(w, http.StatusOK, shares)
+}
+
+// DeleteShare revokes a share link, which is 404 from then on
+func (h *HandlerShare) DeleteShare(w http.ResponseWriter, r *http.Request) {
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleWriter)
+	if !ok {
+		return
+	}
+
+	token := mux.Vars(r)["share-token"]
+	err := h.repoShare.DeleteByTokenAndOwner(r.Context(), token, owner)
+	if err != nil {
+		httperror.Send(w, "failed to delete share", err)
+		return
+	}
+
+	sendJson(w, http.StatusOK, map[string]interface{}{
+		"success": "ok",
+	})
+}
+
+// ViewShare is the public endpoint of share links, serving raw clipboard
+// content to anyone with the token. Passwords are taken from HTTP Basic auth,
+// so that browsers prompt for them, and the username is ignored.
+// Each response with content counts as one view. Each password attempt
+// is counted too, see repo.RepositoryShare.Attempt, and shares locked out
+// by too many attempts are 429 until model.Share.LockedUntil.
+func (h *HandlerShare) ViewShare(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["share-token"]
+
+	ctx := r.Context()
+	share, err := h.repoShare.GetByToken(ctx, token)
+	if err != nil {
+		httperror.Send(w, "failed to get share", err)
+		return
+	}
+
+	if share.HasPassword() {
+		_, password, _ := r.BasicAuth()
+
+		ok := false
+		if password != "" {
+			// Counted before the costly Verify, so that guesses are limited
+			// whether they run concurrently or not
+			err = h.repoShare.Attempt(ctx, token)
+			if err != nil {
+				if errors.Is(err, repo.ErrLocked) && share.LockedUntil.After(time.Now()) {
+					w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(share.LockedUntil).Seconds())+1))
+				}
+
+				httperror.Send(w, "failed to check share password", err)
+				return
+			}
+
+			ok, _, err = h.servicePassword.Verify(share.PasswordHash, password)
+			if err != nil {
+				sendJson(w, http.StatusInternalServerError, map[string]interface{}{
+					"error":  "failed to verify password",
+					"reason": err.Error(),
+				})
+				return
+			}
+		}
+
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="drop share", charset="UTF-8"`)
+			sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+				"error": "wrong or missing share password",
+			})
+			return
+		}
+	}
+
+	// Counted before reading the clipboard, so that burn-after-read
+	// clipboards are not burned by views over the limit
+	err = h.repoShare.View(ctx, token)
+	if err != nil {
+		httperror.Send(w, "failed to get share", err)
+		return
+	}
+
+	clipboard, err := h.repoClipboard.GetByIdAndOwner(ctx, share.ClipboardId, share.OwnerId)
+	if err != nil {
+		httperror.Send(w, "failed to get shared clipboard", err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if clipboard.Filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{
+			"filename": clipboard.Filename,
+		}))
+	}
+
+	sendContent(w, r, h.repoClipboard, clipboard)
+}
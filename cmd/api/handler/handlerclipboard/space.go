@@ -0,0 +1,48 @@
+package handlerclipboard
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/eymyong/drop/cmd/api/handler/httperror"
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+// spaceOwnerId returns the owner id of clipboards the request is about,
+// which is the space id from route var space-id or ?space=, or the user id
+// for the user's personal space if there's none. It writes 404 if the user
+// is not a member of the space, and 403 if their role is below need.
+func spaceOwnerId(w http.ResponseWriter, r *http.Request, spaces repo.RepositorySpace, need string) (string, bool) {
+	userId, ok := ownerId(w, r)
+	if !ok {
+		return "", false
+	}
+
+	spaceId := mux.Vars(r)["space-id"]
+	if spaceId == "" {
+		spaceId = r.URL.Query().Get("space")
+	}
+
+	if spaceId == "" || spaceId == userId {
+		return userId, true
+	}
+
+	member, err := spaces.GetMember(r.Context(), spaceId, userId)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to get space %s", spaceId), err)
+		return "", false
+	}
+
+	if !model.RoleCan(member.Role, need) {
+		sendJson(w, http.StatusForbidden, map[string]interface{}{
+			"error":  "forbidden",
+			"reason": fmt.Sprintf("role %s of space %s is required", need, spaceId),
+		})
+		return "", false
+	}
+
+	return spaceId, true
+}
@@ -0,0 +1,115 @@
+package handlerclipboard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/eymyong/drop/cmd/api/handler/httperror"
+	"github.com/eymyong/drop/cmd/api/service"
+	"github.com/eymyong/drop/model"
+)
+
+// sseRetry is how long clients wait before reconnecting, in milliseconds
+const sseRetry = 3000
+
+// Events streams the same events as Stream as Server-Sent Events.
+// Each event id can be sent back as Last-Event-ID header (or ?last_event_id=)
+// to receive the events missed since then, as long as they are still retained.
+// Like Stream, the response ends once the access token expires,
+// or after logout, device revocation or removal from the space.
+// EventSource can't set headers, so browsers authenticate with ?ticket=
+// from POST /users/stream-ticket.
+func (h *HandlerClipboard) Events(w http.ResponseWriter, r *http.Request) {
+	claims, ok := service.ClaimsFromContext(r.Context())
+	if !ok || claims.UserId == "" {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthenticated",
+		})
+		return
+	}
+
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleReader)
+	if !ok {
+		return
+	}
+
+	if h.events == nil {
+		sendJson(w, http.StatusNotImplemented, map[string]interface{}{
+			"error": "clipboard events are not supported by storage backend",
+		})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "streaming unsupported",
+		})
+		return
+	}
+
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("last_event_id")
+	}
+
+	ctx, cancel := context.WithDeadline(r.Context(), time.Unix(claims.ExpiresAt, 0))
+	defer cancel()
+
+	events, err := h.events.SubscribeAfter(ctx, owner, lastId)
+	if err != nil {
+		httperror.Send(w, "failed to subscribe to clipboard events", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+	flusher.Flush()
+
+	// Comments keep proxies from closing idle connections
+	ping := time.NewTicker(streamPingPeriod)
+	defer ping.Stop()
+
+	check := time.NewTicker(streamCheckPeriod)
+	defer check.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			b, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+
+			_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, b)
+			if err != nil {
+				return
+			}
+
+		case <-ping.C:
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+
+		case <-check.C:
+			err := h.checkStream(ctx, claims, owner)
+			if err != nil {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,193 @@
+package handlerclipboard
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/eymyong/drop/cmd/api/handler/httperror"
+	"github.com/eymyong/drop/cmd/api/service"
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+const (
+	streamWriteWait  = 10 * time.Second
+	streamPongWait   = 60 * time.Second
+	streamPingPeriod = 30 * time.Second
+	// streamCheckPeriod is how often open streams check that their session,
+	// device and space membership are still there
+	streamCheckPeriod = 30 * time.Second
+)
+
+// errStreamRevoked ends streams of sessions logged out, devices revoked,
+// or users removed from the space since the stream was opened
+var errStreamRevoked = errors.New("session, device or space membership revoked")
+
+const (
+	// Subprotocol is the WebSocket subprotocol of Stream
+	Subprotocol = "drop"
+	// SubprotocolBearer prefixes access tokens offered as subprotocols,
+	// by clients that can't set Authorization header on handshakes.
+	// Such clients must offer Subprotocol too, which is the one selected,
+	// so the token is never echoed back.
+	SubprotocolBearer = "bearer."
+)
+
+// Clients authenticate with bearer tokens, never cookies,
+// so cross-origin connections can't ride on a browser session
+var upgrader = websocket.Upgrader{
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: []string{Subprotocol},
+}
+
+// Stream pushes create, update and delete events of the user's clipboards,
+// or of the space's, as JSON WebSocket messages. The connection is closed
+// once the access token expires, and clients are expected to reconnect with a fresh one,
+// passing id of the last event received as ?last_event_id= to catch up.
+// It's also closed, within streamCheckPeriod, after logout, device revocation
+// or removal from the space.
+// Browsers authenticate with subprotocols "drop" and "bearer.<access-token>",
+// or with ?ticket= from POST /users/stream-ticket.
+func (h *HandlerClipboard) Stream(w http.ResponseWriter, r *http.Request) {
+	claims, ok := service.ClaimsFromContext(r.Context())
+	if !ok || claims.UserId == "" {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthenticated",
+		})
+		return
+	}
+
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleReader)
+	if !ok {
+		return
+	}
+
+	if h.events == nil {
+		sendJson(w, http.StatusNotImplemented, map[string]interface{}{
+			"error": "clipboard events are not supported by storage backend",
+		})
+		return
+	}
+
+	// The request context is done once the handler returns,
+	// so the connection lives on its own context
+	ctx, cancel := context.WithDeadline(context.Background(), time.Unix(claims.ExpiresAt, 0))
+	defer cancel()
+
+	// Subscribe before upgrading, so that failures are still plain HTTP errors
+	events, err := h.events.SubscribeAfter(ctx, owner, r.URL.Query().Get("last_event_id"))
+	if err != nil {
+		httperror.Send(w, "failed to subscribe to clipboard events", err)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade already replied with an HTTP error
+	}
+	defer conn.Close()
+
+	// Messages from clients are ignored, but they must be read
+	// to process pongs and to notice closed connections
+	conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	})
+	go func() {
+		defer cancel()
+		for {
+			_, _, err := conn.NextReader()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(streamPingPeriod)
+	defer ping.Stop()
+
+	check := time.NewTicker(streamCheckPeriod)
+	defer check.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				closeStream(conn, ctx.Err())
+				return
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			err := conn.WriteJSON(event)
+			if err != nil {
+				return
+			}
+
+		case <-ping.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait))
+			if err != nil {
+				return
+			}
+
+		case <-check.C:
+			err := h.checkStream(ctx, claims, owner)
+			if err != nil {
+				closeStream(conn, err)
+				return
+			}
+		}
+	}
+}
+
+// checkStream returns errStreamRevoked if the session of claims is gone,
+// its device is revoked, or the user is no longer a member of space owner
+func (h *HandlerClipboard) checkStream(ctx context.Context, claims service.Claims, owner string) error {
+	session, err := h.repoSession.GetById(ctx, claims.SessionId)
+	if errors.Is(err, repo.ErrNotFound) {
+		return errStreamRevoked
+	}
+	if err != nil {
+		return err
+	}
+
+	if session.DeviceId != "" {
+		device, err := h.repoDevice.GetById(ctx, session.DeviceId)
+		if errors.Is(err, repo.ErrNotFound) || (err == nil && device.UserId != session.UserId) {
+			return errStreamRevoked
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if owner != claims.UserId {
+		_, err = h.repoSpace.GetMember(ctx, owner, claims.UserId)
+		if errors.Is(err, repo.ErrNotFound) {
+			return errStreamRevoked
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closeStream sends close frame telling the client why the stream ended
+func closeStream(conn *websocket.Conn, err error) {
+	code, text := websocket.CloseInternalServerErr, "event subscription ended"
+	switch err {
+	case context.DeadlineExceeded:
+		code, text = websocket.ClosePolicyViolation, "access token expired"
+	case errStreamRevoked:
+		code, text = websocket.ClosePolicyViolation, err.Error()
+	case context.Canceled:
+		code, text = websocket.CloseNormalClosure, ""
+	}
+
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(streamWriteWait))
+}
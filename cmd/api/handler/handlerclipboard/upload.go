@@ -0,0 +1,203 @@
+package handlerclipboard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/eymyong/drop/cmd/api/handler/httperror"
+	"github.com/eymyong/drop/model"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// partContentType returns the normalized Content-Type of a multipart file,
+// sniffing it from data if the client did not send a specific one
+func partContentType(header string, data []byte) (string, error) {
+	if header == "" || header == "application/octet-stream" {
+		return http.DetectContentType(data), nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", err
+	}
+
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+// UploadFiles stores each file of multipart/form-data body as a clipboard,
+// in the order they were sent. Non-file form fields are ignored.
+func (h *HandlerClipboard) UploadFiles(w http.ResponseWriter, r *http.Request) {
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleWriter)
+	if !ok {
+		return
+	}
+
+	ttl, burn, err := queryExpiry(r)
+	if err != nil {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid query",
+			"reason": err.Error(),
+		})
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "expecting multipart/form-data",
+			"reason": err.Error(),
+		})
+		return
+	}
+
+	// Each file is streamed into its clipboard as it's read, so files
+	// already stored are deleted if a later one fails
+	ctx := r.Context()
+	usage, ok := h.usage(ctx, w, owner, 0, 0)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	clipboards := []model.Clipboard{}
+	fail := func(status int, data map[string]interface{}) {
+		for i := range clipboards {
+			h.repoClipboard.DeleteByIdAndOwner(ctx, clipboards[i].Id, owner)
+		}
+
+		sendJson(w, status, data)
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(httperror.BodyStatusCode(err), map[string]interface{}{
+				"error":  "failed to read multipart body",
+				"reason": err.Error(),
+			})
+			return
+		}
+
+		filename := part.FileName()
+		if filename == "" {
+			part.Close()
+			continue
+		}
+
+		err = h.quota.Check(usage, 1, 0)
+		if err != nil {
+			part.Close()
+			fail(httperror.StatusCode(err), map[string]interface{}{
+				"error":  fmt.Sprintf("storage quota exceeded by file %s", filename),
+				"reason": err.Error(),
+			})
+			return
+		}
+
+		// http.DetectContentType looks at most at the first 512 bytes
+		body := bufio.NewReaderSize(part, 512)
+		head, err := body.Peek(512)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			part.Close()
+			fail(httperror.BodyStatusCode(err), map[string]interface{}{
+				"error":  fmt.Sprintf("failed to read file %s", filename),
+				"reason": err.Error(),
+			})
+			return
+		}
+
+		mimeType, err := partContentType(part.Header.Get("Content-Type"), head)
+		if err != nil {
+			part.Close()
+			fail(http.StatusBadRequest, map[string]interface{}{
+				"error":  fmt.Sprintf("invalid content type of file %s", filename),
+				"reason": err.Error(),
+			})
+			return
+		}
+
+		clipboard := model.Clipboard{
+			Id:            uuid.NewString(),
+			Content:       model.Content{MimeType: mimeType},
+			Filename:      filename,
+			OwnerId:       owner,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+			BurnAfterRead: burn,
+			DeviceId:      deviceId(r),
+		}
+		if ttl > 0 {
+			clipboard.ExpiresAt = now.Add(ttl)
+		}
+
+		clipboard, err = h.repoClipboard.CreateFrom(ctx, clipboard, limitQuota(body, h.quota, usage))
+		part.Close()
+		if err != nil {
+			fail(httperror.StatusCode(err), map[string]interface{}{
+				"error":  fmt.Sprintf("failed to create clipboard for file %s", filename),
+				"reason": err.Error(),
+			})
+			return
+		}
+
+		clipboards = append(clipboards, clipboard)
+		usage.Clips++
+		usage.Bytes += clipboard.Size
+	}
+
+	if len(clipboards) == 0 {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error": "no files",
+		})
+		return
+	}
+
+	sendJson(w, http.StatusCreated, map[string]interface{}{
+		"success": "ok",
+		"created": hideContent(clipboards),
+	})
+}
+
+// DownloadFile serves clipboard content as an attachment, named after
+// the uploaded file, or the clipboard id for non-file clipboards
+func (h *HandlerClipboard) DownloadFile(w http.ResponseWriter, r *http.Request) {
+	owner, ok := spaceOwnerId(w, r, h.repoSpace, model.RoleReader)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	id := vars["clipboard-id"]
+	if id == "" {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error": "missing id",
+		})
+		return
+	}
+
+	ctx := r.Context()
+	clipboard, err := h.repoClipboard.GetByIdAndOwner(ctx, id, owner)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to get clipboard %s", id), err)
+		return
+	}
+
+	filename := clipboard.Filename
+	if filename == "" {
+		filename = clipboard.Id
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": filename,
+	}))
+
+	sendContent(w, r, h.repoClipboard, clipboard)
+}
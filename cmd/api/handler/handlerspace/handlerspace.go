@@ -0,0 +1,290 @@
+package handlerspace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/eymyong/drop/cmd/api/handler/httperror"
+	"github.com/eymyong/drop/cmd/api/service"
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+// HandlerSpace manages spaces and their members. Clipboards of a space
+// are handled by handlerclipboard with ?space=.
+type HandlerSpace struct {
+	repoSpace repo.RepositorySpace
+	repoUser  repo.RepositoryUser
+}
+
+func NewSpace(repoSpace repo.RepositorySpace, repoUser repo.RepositoryUser) *HandlerSpace {
+	return &HandlerSpace{repoSpace: repoSpace, repoUser: repoUser}
+}
+
+func sendJson(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(data)
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+
+	buf := bytes.NewBuffer(nil)
+	_, err := io.Copy(buf, r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// readJson decodes request body into v, or writes 400 or 413
+func readJson(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	b, err := readBody(r)
+	if err != nil {
+		sendJson(w, httperror.BodyStatusCode(err), map[string]interface{}{
+			"error":  "failed to read body",
+			"reason": err.Error(),
+		})
+		return false
+	}
+
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid body",
+			"reason": err.Error(),
+		})
+		return false
+	}
+
+	return true
+}
+
+func userId(w http.ResponseWriter, r *http.Request) (string, bool) {
+	claims, ok := service.ClaimsFromContext(r.Context())
+	if !ok || claims.UserId == "" {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthenticated",
+		})
+
+		return "", false
+	}
+
+	return claims.UserId, true
+}
+
+// member returns the user's membership of route var space-id, writing 404
+// if the user is not a member, and 403 if their role is below need
+func (h *HandlerSpace) member(w http.ResponseWriter, r *http.Request, need string) (model.Member, bool) {
+	user, ok := userId(w, r)
+	if !ok {
+		return model.Member{}, false
+	}
+
+	spaceId := mux.Vars(r)["space-id"]
+	member, err := h.repoSpace.GetMember(r.Context(), spaceId, user)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to get space %s", spaceId), err)
+		return model.Member{}, false
+	}
+
+	if !model.RoleCan(member.Role, need) {
+		sendJson(w, http.StatusForbidden, map[string]interface{}{
+			"error":  "forbidden",
+			"reason": fmt.Sprintf("role %s of space %s is required", need, spaceId),
+		})
+		return model.Member{}, false
+	}
+
+	return member, true
+}
+
+// CreateSpace creates a space owned by the user from body {"name": "..."}
+func (h *HandlerSpace) CreateSpace(w http.ResponseWriter, r *http.Request) {
+	type requestSpace struct {
+		Name string `json:"name"`
+	}
+
+	owner, ok := userId(w, r)
+	if !ok {
+		return
+	}
+
+	var req requestSpace
+	if !readJson(w, r, &req) {
+		return
+	}
+
+	if req.Name == "" {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid body",
+			"reason": "empty name",
+		})
+		return
+	}
+
+	space := model.Space{
+		Id:        uuid.NewString(),
+		Name:      req.Name,
+		OwnerId:   owner,
+		CreatedAt: time.Now(),
+	}
+
+	err := h.repoSpace.Create(r.Context(), space)
+	if err != nil {
+		httperror.Send(w, "failed to create space", err)
+		return
+	}
+
+	sendJson(w, http.StatusCreated, map[string]interface{}{
+		"success": "ok",
+		"created": space,
+	})
+}
+
+// GetSpaces returns spaces the user is a member of
+func (h *HandlerSpace) GetSpaces(w http.ResponseWriter, r *http.Request) {
+	user, ok := userId(w, r)
+	if !ok {
+		return
+	}
+
+	spaces, err := h.repoSpace.GetAllByMember(r.Context(), user)
+	if err != nil {
+		httperror.Send(w, "failed to get spaces", err)
+		return
+	}
+
+	sendJson(w, http.StatusOK, spaces)
+}
+
+// GetSpace returns a space with its members, to its members
+func (h *HandlerSpace) GetSpace(w http.ResponseWriter, r *http.Request) {
+	member, ok := h.member(w, r, model.RoleReader)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	space, err := h.repoSpace.GetById(ctx, member.SpaceId)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to get space %s", member.SpaceId), err)
+		return
+	}
+
+	members, err := h.repoSpace.GetMembers(ctx, member.SpaceId)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to get members of space %s", member.SpaceId), err)
+		return
+	}
+
+	sendJson(w, http.StatusOK, map[string]interface{}{
+		"space":   space,
+		"members": members,
+		"role":    member.Role,
+	})
+}
+
+// PutMember lets the space owner add a user to the space, or change
+// their role, with body {"username": "...", "role": "writer"}.
+// Role is reader if it's empty.
+func (h *HandlerSpace) PutMember(w http.ResponseWriter, r *http.Request) {
+	type requestMember struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+
+	owner, ok := h.member(w, r, model.RoleOwner)
+	if !ok {
+		return
+	}
+
+	var req requestMember
+	if !readJson(w, r, &req) {
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = model.RoleReader
+	}
+
+	if req.Role != model.RoleWriter && req.Role != model.RoleReader {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid body",
+			"reason": fmt.Sprintf("role must be %s or %s", model.RoleWriter, model.RoleReader),
+		})
+		return
+	}
+
+	ctx := r.Context()
+	user, err := h.repoUser.GetByUsername(ctx, req.Username)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to get user %s", req.Username), err)
+		return
+	}
+
+	if user.Id == owner.UserId {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid body",
+			"reason": "owner can't change their own role",
+		})
+		return
+	}
+
+	member := model.Member{SpaceId: owner.SpaceId, UserId: user.Id, Role: req.Role}
+	err = h.repoSpace.PutMember(ctx, member)
+	if err != nil {
+		httperror.Send(w, "failed to add member", err)
+		return
+	}
+
+	sendJson(w, http.StatusOK, map[string]interface{}{
+		"success": "ok",
+		"member":  member,
+	})
+}
+
+// DeleteMember lets the space owner remove a member,
+// and other members leave the space by removing themselves
+func (h *HandlerSpace) DeleteMember(w http.ResponseWriter, r *http.Request) {
+	member, ok := h.member(w, r, model.RoleReader)
+	if !ok {
+		return
+	}
+
+	target := mux.Vars(r)["user-id"]
+	if target != member.UserId && member.Role != model.RoleOwner {
+		sendJson(w, http.StatusForbidden, map[string]interface{}{
+			"error":  "forbidden",
+			"reason": fmt.Sprintf("role %s of space %s is required", model.RoleOwner, member.SpaceId),
+		})
+		return
+	}
+
+	if target == member.UserId && member.Role == model.RoleOwner {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error": "owner can't leave their space",
+		})
+		return
+	}
+
+	err := h.repoSpace.DeleteMember(r.Context(), member.SpaceId, target)
+	if err != nil {
+		httperror.Send(w, "failed to remove member", err)
+		return
+	}
+
+	sendJson(w, http.StatusOK, map[string]interface{}{
+		"success": "ok",
+	})
+}
@@ -0,0 +1,166 @@
+package handleruser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/eymyong/drop/cmd/api/handler/httperror"
+	"github.com/eymyong/drop/cmd/api/service"
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+// deviceAlive reports whether the device of session, if any, is still
+// registered to the session's user. Sessions of revoked devices are
+// rejected, instead of being found and deleted when the device is revoked.
+func deviceAlive(ctx context.Context, devices repo.RepositoryDevice, session model.Session) (bool, error) {
+	if session.DeviceId == "" {
+		return true, nil
+	}
+
+	device, err := devices.GetById(ctx, session.DeviceId)
+	if errors.Is(err, repo.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return device.UserId == session.UserId, nil
+}
+
+// RegisterDevice registers a device from body {"name": "...", "platform": "..."},
+// and makes the current session the device's. Clipboards created from then on
+// are attributed to the device, and other sessions can log in as the device
+// with its id.
+func (h *HandlerUser) RegisterDevice(w http.ResponseWriter, r *http.Request) {
+	type requestDevice struct {
+		Name     string `json:"name"`
+		Platform string `json:"platform"`
+	}
+
+	claims, ok := service.ClaimsFromContext(r.Context())
+	if !ok {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthenticated",
+		})
+
+		return
+	}
+
+	b, err := readBody(r)
+	if err != nil {
+		sendJson(w, httperror.BodyStatusCode(err), map[string]interface{}{
+			"error":  "failed to read body",
+			"reason": err.Error(),
+		})
+
+		return
+	}
+
+	var req requestDevice
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid body",
+			"reason": err.Error(),
+		})
+
+		return
+	}
+
+	if req.Name == "" {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid body",
+			"reason": "empty name",
+		})
+
+		return
+	}
+
+	now := time.Now()
+	device := model.Device{
+		Id:         uuid.NewString(),
+		UserId:     claims.UserId,
+		Name:       req.Name,
+		Platform:   req.Platform,
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+
+	ctx := r.Context()
+	err = h.repoDevice.Create(ctx, device)
+	if err != nil {
+		httperror.Send(w, "failed to register device", err)
+		return
+	}
+
+	session, err := h.repoSession.GetById(ctx, claims.SessionId)
+	if err == nil {
+		session.DeviceId = device.Id
+		err = h.repoSession.Update(ctx, session, session.RefreshHash)
+	}
+	if err != nil {
+		httperror.Send(w, "device registered, but failed to update session", err)
+		return
+	}
+
+	sendJson(w, http.StatusCreated, map[string]interface{}{
+		"success": "ok",
+		"created": device,
+	})
+}
+
+// GetDevices returns registered devices of the user, oldest first
+func (h *HandlerUser) GetDevices(w http.ResponseWriter, r *http.Request) {
+	claims, ok := service.ClaimsFromContext(r.Context())
+	if !ok {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthenticated",
+		})
+
+		return
+	}
+
+	devices, err := h.repoDevice.GetAllByUser(r.Context(), claims.UserId)
+	if err != nil {
+		httperror.Send(w, "failed to get devices", err)
+		return
+	}
+
+	sendJson(w, http.StatusOK, map[string]interface{}{
+		"devices": devices,
+		"current": claims.DeviceId,
+	})
+}
+
+// DeleteDevice revokes a device, e.g. a lost one. Its sessions can't be
+// used or refreshed from then on, and its clipboards are kept.
+func (h *HandlerUser) DeleteDevice(w http.ResponseWriter, r *http.Request) {
+	claims, ok := service.ClaimsFromContext(r.Context())
+	if !ok {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthenticated",
+		})
+
+		return
+	}
+
+	id := mux.Vars(r)["device-id"]
+	err := h.repoDevice.DeleteByIdAndUser(r.Context(), id, claims.UserId)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to revoke device %s", id), err)
+		return
+	}
+
+	sendJson(w, http.StatusOK, map[string]interface{}{
+		"success": "ok",
+	})
+}
@@ -4,30 +4,48 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 
+	"github.com/eymyong/drop/cmd/api/handler/httperror"
 	"github.com/eymyong/drop/cmd/api/service"
 	"github.com/eymyong/drop/model"
 	"github.com/eymyong/drop/repo"
 )
 
+// dummyPasswordHash is verified on logins of unknown usernames, so that they
+// take as long as logins of known ones, and usernames can't be found by timing.
+// It's an argon2id hash with the parameters of service.PasswordArgon2.
+const dummyPasswordHash = "$argon2id$v=19$m=65536,t=1,p=4$Tj+78w8aRqIG7Im58gFmqA$yryCNjgAOHWIZhCV0GanoK5g/4EFAMT5LK0N7g14G3A"
+
 type HandlerUser struct {
 	repoUser        repo.RepositoryUser
+	repoSession     repo.RepositorySession
+	repoDevice      repo.RepositoryDevice
 	servicePassword service.Password
+	serviceToken    service.Token
 }
 
 func NewUser(
 	repoUser repo.RepositoryUser,
+	repoSession repo.RepositorySession,
+	repoDevice repo.RepositoryDevice,
 	servicePassword service.Password,
+	serviceToken service.Token,
 ) *HandlerUser {
 	return &HandlerUser{
 		repoUser:        repoUser,
+		repoSession:     repoSession,
+		repoDevice:      repoDevice,
 		servicePassword: servicePassword,
+		serviceToken:    serviceToken,
 	}
 }
 
@@ -59,10 +77,11 @@ func (h *HandlerUser) Register(w http.ResponseWriter, r *http.Request) {
 
 	b, err := readBody(r)
 	if err != nil {
-		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+		sendJson(w, httperror.BodyStatusCode(err), map[string]interface{}{
 			"error":  "failed to read body",
 			"reason": err.Error(),
 		})
+		return
 	}
 
 	var req requestRegister
@@ -94,12 +113,14 @@ func (h *HandlerUser) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	password, err := h.servicePassword.EncryptBase64(req.Password)
+	password, err := h.servicePassword.Hash(req.Password)
 	if err != nil {
 		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
-			"error":  "failed to encrypt password",
+			"error":  "failed to hash password",
 			"reason": err.Error(),
 		})
+
+		return
 	}
 
 	user := model.User{
@@ -111,11 +132,7 @@ func (h *HandlerUser) Register(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	_, err = h.repoUser.Create(ctx, user)
 	if err != nil {
-		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
-			"error":  "failed to register user",
-			"reason": err.Error(),
-		})
-
+		httperror.Send(w, "failed to register user", err)
 		return
 	}
 
@@ -124,15 +141,18 @@ func (h *HandlerUser) Register(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// Login creates a session. With optional device_id of a registered device,
+// the session is of that device, and it's revoked along with the device.
 func (h *HandlerUser) Login(w http.ResponseWriter, r *http.Request) {
 	type requestLogin struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		DeviceId string `json:"device_id"`
 	}
 
 	b, err := readBody(r)
 	if err != nil {
-		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+		sendJson(w, httperror.BodyStatusCode(err), map[string]interface{}{
 			"error":  "failed to read body",
 			"reason": err.Error(),
 		})
@@ -152,16 +172,26 @@ func (h *HandlerUser) Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx := r.Context()
-	passwordBase64, err := h.repoUser.GetPassword(ctx, req.Username)
+	hash, err := h.repoUser.GetPassword(ctx, req.Username)
 	if err != nil {
-		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
+		h.servicePassword.Verify(dummyPasswordHash, req.Password)
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "login failed",
+		})
+
+		return
+	}
+
+	ok, rehash, err := h.servicePassword.Verify(string(hash), req.Password)
+	if err != nil || !ok {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
 			"error": "login failed",
 		})
 
 		return
 	}
 
-	password, err := h.servicePassword.DecryptBase64(string(passwordBase64))
+	user, err := h.repoUser.GetByUsername(ctx, req.Username)
 	if err != nil {
 		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
 			"error": "login failed",
@@ -170,20 +200,277 @@ func (h *HandlerUser) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if password != req.Password {
+	// Migrate passwords stored in old formats now that we have the plaintext.
+	// Failing to do so should not fail the login, we'll just try again next time.
+	if rehash {
+		newHash, err := h.servicePassword.Hash(req.Password)
+		if err == nil {
+			err = h.repoUser.UpdatePassword(ctx, user.Id, newHash)
+		}
+		if err != nil {
+			log.Printf("failed to rehash password for user '%s': %v", user.Id, err)
+		}
+	}
+
+	if req.DeviceId != "" {
+		device, err := h.repoDevice.GetById(ctx, req.DeviceId)
+		if err == nil && device.UserId != user.Id {
+			err = fmt.Errorf("device '%s' of another user: %w", req.DeviceId, repo.ErrNotFound)
+		}
+		if err != nil {
+			httperror.Send(w, fmt.Sprintf("failed to get device %s", req.DeviceId), err)
+			return
+		}
+	}
+
+	tokens, err := h.newSession(ctx, user.Id, req.DeviceId)
+	if err != nil {
 		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
-			"error": "login failed",
+			"error":  "failed to create session",
+			"reason": err.Error(),
 		})
 
 		return
 	}
 
 	sendJson(w, http.StatusOK, map[string]interface{}{
-		"success":  "ok",
-		"username": req.Username,
+		"success": "ok",
+		"user":    user,
+		"tokens":  tokens,
 	})
 }
 
+func (h *HandlerUser) Refresh(w http.ResponseWriter, r *http.Request) {
+	type requestRefresh struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	b, err := readBody(r)
+	if err != nil {
+		sendJson(w, httperror.BodyStatusCode(err), map[string]interface{}{
+			"error":  "failed to read body",
+			"reason": err.Error(),
+		})
+
+		return
+	}
+
+	var req requestRefresh
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid body",
+			"reason": err.Error(),
+		})
+
+		return
+	}
+
+	sessionId, hash, err := h.serviceToken.ParseRefresh(req.RefreshToken)
+	if err != nil {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "invalid refresh token",
+		})
+
+		return
+	}
+
+	ctx := r.Context()
+	session, err := h.repoSession.GetById(ctx, sessionId)
+	if err != nil || !service.EqualHash(session.RefreshHash, hash) || time.Now().After(session.ExpiresAt) {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "invalid refresh token",
+		})
+
+		return
+	}
+
+	alive, err := deviceAlive(ctx, h.repoDevice, session)
+	if err != nil {
+		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
+			"error":  "failed to refresh session",
+			"reason": err.Error(),
+		})
+
+		return
+	}
+
+	if !alive {
+		err = h.repoSession.Delete(ctx, session.Id)
+		if err != nil {
+			log.Printf("failed to delete session '%s' of revoked device: %v", session.Id, err)
+		}
+
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "device revoked",
+		})
+
+		return
+	}
+
+	// Rotate the refresh token so that a stolen one can only be used once,
+	// even by concurrent requests
+	tokens, err := h.renewSession(ctx, session)
+	if errors.Is(err, repo.ErrConflict) || errors.Is(err, repo.ErrNotFound) {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "invalid refresh token",
+		})
+
+		return
+	}
+	if err != nil {
+		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
+			"error":  "failed to refresh session",
+			"reason": err.Error(),
+		})
+
+		return
+	}
+
+	sendJson(w, http.StatusOK, map[string]interface{}{
+		"success": "ok",
+		"tokens":  tokens,
+	})
+}
+
+func (h *HandlerUser) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := service.ClaimsFromContext(r.Context())
+	if !ok {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthenticated",
+		})
+
+		return
+	}
+
+	err := h.repoSession.Delete(r.Context(), claims.SessionId)
+	if err != nil {
+		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
+			"error":  "failed to logout",
+			"reason": err.Error(),
+		})
+
+		return
+	}
+
+	sendJson(w, http.StatusOK, map[string]interface{}{
+		"success": "logged out",
+	})
+}
+
+// StreamTicket issues a one-time ticket for opening clipboard streams
+// with ?ticket=, for clients that can't set Authorization header.
+// The stream still ends once the access token used here expires.
+func (h *HandlerUser) StreamTicket(w http.ResponseWriter, r *http.Request) {
+	claims, ok := service.ClaimsFromContext(r.Context())
+	if !ok {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthenticated",
+		})
+
+		return
+	}
+
+	ticket, exp, err := h.serviceToken.SignTicket(claims)
+	if err != nil {
+		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
+			"error":  "failed to issue stream ticket",
+			"reason": err.Error(),
+		})
+
+		return
+	}
+
+	sendJson(w, http.StatusOK, map[string]interface{}{
+		"ticket":     ticket,
+		"expires_at": exp,
+	})
+}
+
+type sessionTokens struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+func (h *HandlerUser) newSession(ctx context.Context, userId string, deviceId string) (sessionTokens, error) {
+	session := model.Session{
+		Id:       uuid.NewString(),
+		UserId:   userId,
+		DeviceId: deviceId,
+	}
+
+	refresh, hash, err := h.serviceToken.NewRefresh(session.Id)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+
+	session.RefreshHash = hash
+	session.ExpiresAt = time.Now().Add(h.serviceToken.RefreshTTL())
+
+	err = h.repoSession.Create(ctx, session)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+
+	return h.signTokens(session, refresh)
+}
+
+// renewSession rotates the refresh token of session, which is
+// repo.ErrConflict if it was already rotated since session was read
+func (h *HandlerUser) renewSession(ctx context.Context, session model.Session) (sessionTokens, error) {
+	refresh, hash, err := h.serviceToken.NewRefresh(session.Id)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+
+	oldHash := session.RefreshHash
+	session.RefreshHash = hash
+	session.ExpiresAt = time.Now().Add(h.serviceToken.RefreshTTL())
+
+	err = h.repoSession.Update(ctx, session, oldHash)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+
+	return h.signTokens(session, refresh)
+}
+
+func (h *HandlerUser) signTokens(session model.Session, refresh string) (sessionTokens, error) {
+	access, exp, err := h.serviceToken.SignAccess(session.UserId, session.Id)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+
+	return sessionTokens{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresAt:    exp,
+	}, nil
+}
+
+// authorize only allows the authenticated user to access their own user-id
+func authorize(w http.ResponseWriter, r *http.Request, id string) bool {
+	claims, ok := service.ClaimsFromContext(r.Context())
+	if !ok {
+		sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "unauthenticated",
+		})
+
+		return false
+	}
+
+	if claims.UserId != id {
+		sendJson(w, http.StatusForbidden, map[string]interface{}{
+			"error": fmt.Sprintf("not allowed to access user '%s'", id),
+		})
+
+		return false
+	}
+
+	return true
+}
+
 func (h *HandlerUser) GetUserById(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["user-id"]
@@ -195,14 +482,14 @@ func (h *HandlerUser) GetUserById(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
+	if !authorize(w, r, id) {
+		return
+	}
+
+	ctx := r.Context()
 	user, err := h.repoUser.GetById(ctx, id)
 	if err != nil {
-		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
-			"error":  fmt.Sprintf("failed to get user: %s", id),
-			"reason": err.Error(),
-		})
-
+		httperror.Send(w, fmt.Sprintf("failed to get user: %s", id), err)
 		return
 	}
 
@@ -215,7 +502,7 @@ func (h *HandlerUser) GetUserById(w http.ResponseWriter, r *http.Request) {
 func (h *HandlerUser) UpdateUsername(w http.ResponseWriter, r *http.Request) {
 	b, err := readBody(r)
 	if err != nil {
-		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+		sendJson(w, httperror.BodyStatusCode(err), map[string]interface{}{
 			"error":  "failed to read body",
 			"reason": err.Error(),
 		})
@@ -233,6 +520,10 @@ func (h *HandlerUser) UpdateUsername(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !authorize(w, r, id) {
+		return
+	}
+
 	if len(b) == 0 {
 		sendJson(w, http.StatusBadRequest, map[string]interface{}{
 			"error": "empty body",
@@ -245,11 +536,7 @@ func (h *HandlerUser) UpdateUsername(w http.ResponseWriter, r *http.Request) {
 
 	err = h.repoUser.UpdateUsername(ctx, id, newUsername)
 	if err != nil {
-		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
-			"error":  fmt.Sprintf("failed to update userId '%s'", id),
-			"reason": err.Error(),
-		})
-
+		httperror.Send(w, fmt.Sprintf("failed to update userId '%s'", id), err)
 		return
 	}
 
@@ -259,10 +546,11 @@ func (h *HandlerUser) UpdateUsername(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *HandlerUser) UpdatePassword(w http.ResponseWriter, r *http.Request) {
-	sendJson(w, 500, "not implemented")
-}
+	type requestUpdatePassword struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
 
-func (h *HandlerUser) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["user-id"]
 	if id == "" {
@@ -273,16 +561,127 @@ func (h *HandlerUser) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
-	err := h.repoUser.Delete(ctx, id)
+	if !authorize(w, r, id) {
+		return
+	}
+
+	b, err := readBody(r)
+	if err != nil {
+		sendJson(w, httperror.BodyStatusCode(err), map[string]interface{}{
+			"error":  "failed to read body",
+			"reason": err.Error(),
+		})
+
+		return
+	}
+
+	var req requestUpdatePassword
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid body",
+			"reason": err.Error(),
+		})
+
+		return
+	}
+
+	if req.NewPassword == "" {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid body",
+			"reason": "empty new_password",
+		})
+
+		return
+	}
+
+	ctx := r.Context()
+	user, err := h.repoUser.GetById(ctx, id)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to get user: %s", id), err)
+		return
+	}
+
+	ok, _, err := h.servicePassword.Verify(user.Password, req.CurrentPassword)
+	if err != nil || !ok {
+		sendJson(w, http.StatusForbidden, map[string]interface{}{
+			"error": "wrong current password",
+		})
+
+		return
+	}
+
+	hash, err := h.servicePassword.Hash(req.NewPassword)
 	if err != nil {
 		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
-			"error":  fmt.Sprintf("failed to delete userId '%s'", id),
+			"error":  "failed to hash password",
 			"reason": err.Error(),
 		})
 
 		return
 	}
 
+	err = h.repoUser.UpdatePassword(ctx, id, hash)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to update password for userId '%s'", id), err)
+		return
+	}
+
+	// Log out everywhere, including this session,
+	// and hand the caller a fresh session of the same device.
+	err = h.repoSession.DeleteByUserId(ctx, id)
+	if err != nil {
+		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
+			"error":  "password updated, but failed to invalidate sessions",
+			"reason": err.Error(),
+		})
+
+		return
+	}
+
+	claims, _ := service.ClaimsFromContext(ctx)
+	tokens, err := h.newSession(ctx, id, claims.DeviceId)
+	if err != nil {
+		sendJson(w, http.StatusInternalServerError, map[string]interface{}{
+			"error":  "password updated, but failed to create session",
+			"reason": err.Error(),
+		})
+
+		return
+	}
+
+	sendJson(w, http.StatusOK, map[string]interface{}{
+		"success": fmt.Sprintf("user id '%s' password updated", id),
+		"tokens":  tokens,
+	})
+}
+
+func (h *HandlerUser) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["user-id"]
+	if id == "" {
+		sendJson(w, http.StatusBadRequest, map[string]interface{}{
+			"error": "missing userId",
+		})
+
+		return
+	}
+
+	if !authorize(w, r, id) {
+		return
+	}
+
+	ctx := r.Context()
+	err := h.repoUser.Delete(ctx, id)
+	if err != nil {
+		httperror.Send(w, fmt.Sprintf("failed to delete userId '%s'", id), err)
+		return
+	}
+
+	err = h.repoSession.DeleteByUserId(ctx, id)
+	if err != nil {
+		log.Printf("failed to delete sessions of deleted user '%s': %v", id, err)
+	}
+
 	sendJson(w, http.StatusOK, "deleted userId: "+id)
 }
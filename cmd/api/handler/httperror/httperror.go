@@ -0,0 +1,63 @@
+// Package httperror maps errors from the repo layer to HTTP responses,
+// so that all handlers report the same error the same way.
+package httperror
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/eymyong/drop/repo"
+)
+
+// Response is the JSON body of all error responses
+type Response struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// StatusCode returns the HTTP status code for err
+func StatusCode(err error) int {
+	var errTooLarge *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &errTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, repo.ErrQuotaBytes):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, repo.ErrQuotaClips):
+		return http.StatusForbidden
+	case errors.Is(err, repo.ErrLocked):
+		return http.StatusTooManyRequests
+	case errors.Is(err, repo.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, repo.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, repo.ErrInvalid):
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// BodyStatusCode returns the HTTP status code for err from reading
+// request body, which is 413 if the body is over its limit
+func BodyStatusCode(err error) int {
+	var errTooLarge *http.MaxBytesError
+	if errors.As(err, &errTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
+
+// Send writes err with msg as the standard JSON error response
+func Send(w http.ResponseWriter, msg string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(StatusCode(err))
+
+	json.NewEncoder(w).Encode(Response{
+		Error:  msg,
+		Reason: err.Error(),
+	})
+}
@@ -0,0 +1,67 @@
+package httperror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eymyong/drop/repo"
+)
+
+func TestStatusCode(t *testing.T) {
+	tooLarge := &http.MaxBytesError{Limit: 1}
+
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{err: tooLarge, status: http.StatusRequestEntityTooLarge},
+		{err: fmt.Errorf("read body: %w", tooLarge), status: http.StatusRequestEntityTooLarge},
+		{err: repo.ErrQuotaBytes, status: http.StatusInsufficientStorage},
+		{err: repo.ErrQuotaClips, status: http.StatusForbidden},
+		{err: repo.ErrLocked, status: http.StatusTooManyRequests},
+		{err: repo.ErrNotFound, status: http.StatusNotFound},
+		{err: fmt.Errorf("clipboard 'foo': %w", repo.ErrNotFound), status: http.StatusNotFound},
+		{err: repo.ErrConflict, status: http.StatusConflict},
+		{err: repo.ErrInvalid, status: http.StatusBadRequest},
+		{err: errors.New("some error"), status: http.StatusInternalServerError},
+	}
+
+	for _, tc := range tests {
+		status := StatusCode(tc.err)
+		if status != tc.status {
+			t.Fatalf("expected %d for '%v', got %d", tc.status, tc.err, status)
+		}
+	}
+
+	if status := BodyStatusCode(tooLarge); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for body over limit, got %d", status)
+	}
+	if status := BodyStatusCode(errors.New("bad json")); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad body, got %d", status)
+	}
+}
+
+func TestSend(t *testing.T) {
+	w := httptest.NewRecorder()
+	Send(w, "failed to get clipboard", fmt.Errorf("clipboard 'foo': %w", repo.ErrNotFound))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected JSON response, got '%s'", ct)
+	}
+
+	var resp Response
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Error != "failed to get clipboard" || resp.Reason != "clipboard 'foo': not found" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
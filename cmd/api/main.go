@@ -1,19 +1,38 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 
 	"github.com/eymyong/drop/cmd/api/handler/handlerclipboard"
+	"github.com/eymyong/drop/cmd/api/handler/handlerspace"
 	"github.com/eymyong/drop/cmd/api/handler/handleruser"
 	"github.com/eymyong/drop/cmd/api/service"
+	"github.com/eymyong/drop/repo"
+	"github.com/eymyong/drop/repo/blobclipboard"
+	"github.com/eymyong/drop/repo/cryptclipboard"
+	"github.com/eymyong/drop/repo/fsblob"
+	"github.com/eymyong/drop/repo/memory"
 	"github.com/eymyong/drop/repo/redisclipboard"
+	"github.com/eymyong/drop/repo/redisdevice"
+	"github.com/eymyong/drop/repo/redissession"
+	"github.com/eymyong/drop/repo/redisshare"
+	"github.com/eymyong/drop/repo/redisspace"
+	"github.com/eymyong/drop/repo/redisticket"
 	"github.com/eymyong/drop/repo/redisuser"
+	"github.com/eymyong/drop/repo/sqlite"
 )
 
 func envRedisDb() int {
@@ -43,6 +62,8 @@ func envRedisAddr() string {
 	return addr
 }
 
+// envPasswordKeyAES is the key of the legacy AES password storage.
+// It's only needed to migrate users registered before argon2id.
 func envPasswordKeyAES() string {
 	const defaultKey = "my-secret-foobarbaz200030004000x"
 
@@ -54,50 +75,497 @@ func envPasswordKeyAES() string {
 	return k
 }
 
-func mw(next http.Handler) http.Handler {
+// envTokenSecret returns TOKEN_SECRET, or a random secret if it's unset.
+// With a random secret, all sessions are lost when the server restarts.
+func envTokenSecret() []byte {
+	k, ok := os.LookupEnv("TOKEN_SECRET")
+	if ok && len(k) >= 32 {
+		return []byte(k)
+	}
+
+	log.Println("TOKEN_SECRET is unset or shorter than 32 bytes, using random secret")
+
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic(err)
+	}
+
+	return secret
+}
+
+func sendJson(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(data)
+}
+
+// secretParams are query parameters never written to logs
+var secretParams = []string{"ticket", "access_token"}
+
+// logMw logs requests, with secrets in query redacted
+func logMw(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("==================")
-		fmt.Println("from mw", r.URL)
+		log.Printf("%s %s", r.Method, redactUrl(r.URL))
 
 		next.ServeHTTP(w, r)
 	})
 }
 
-func main() {
-	redisAddr := envRedisAddr()
-	redisDb := envRedisDb()
-	passwordKey := envPasswordKeyAES()
+func redactUrl(u *url.URL) string {
+	query := u.Query()
+	redacted := false
+	for _, param := range secretParams {
+		if query.Has(param) {
+			query.Set(param, "REDACTED")
+			redacted = true
+		}
+	}
+
+	if !redacted {
+		return u.String()
+	}
+
+	c := *u
+	c.RawQuery = query.Encode()
+
+	return c.String()
+}
+
+// lastSeenInterval is how often last seen time of a device is updated
+const lastSeenInterval = time.Minute
+
+// authMw rejects requests without a valid access token from a live session
+// of a device that's not revoked, and puts the token claims into request
+// context for the handlers.
+func authMw(serviceToken service.Token, repoSession repo.RepositorySession, repoDevice repo.RepositoryDevice) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			verify := serviceToken.VerifyAccess
+
+			// Browsers can't set headers on WebSocket handshakes or EventSource,
+			// so access tokens come in a WebSocket subprotocol, or streams are opened
+			// with one-time tickets. Access tokens are never accepted in URLs.
+			if !ok && isStream(r) {
+				token, ok = streamToken(r)
+				if !ok {
+					token, ok = r.URL.Query().Get("ticket"), true
+					verify = func(ticket string) (service.Claims, error) {
+						return serviceToken.VerifyTicket(r.Context(), ticket)
+					}
+				}
+			}
+
+			if !ok || token == "" {
+				sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+					"error": "missing bearer token",
+				})
+
+				return
+			}
+
+			claims, err := verify(token)
+			if err != nil {
+				sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+					"error":  "invalid token",
+					"reason": err.Error(),
+				})
+
+				return
+			}
+
+			session, err := repoSession.GetById(r.Context(), claims.SessionId)
+			if err != nil || session.UserId != claims.UserId {
+				sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+					"error": "session expired or logged out",
+				})
+
+				return
+			}
+
+			if session.DeviceId != "" {
+				device, err := repoDevice.GetById(r.Context(), session.DeviceId)
+				if err != nil || device.UserId != session.UserId {
+					sendJson(w, http.StatusUnauthorized, map[string]interface{}{
+						"error": "device revoked",
+					})
+
+					return
+				}
+
+				// Best effort, it's only informational
+				now := time.Now()
+				if now.Sub(device.LastSeenAt) > lastSeenInterval {
+					err = repoDevice.UpdateLastSeen(r.Context(), device.Id, now)
+					if err != nil {
+						log.Printf("failed to update last seen of device '%s': %v", device.Id, err)
+					}
+				}
+
+				claims.DeviceId = device.Id
+			}
+
+			ctx := service.ContextWithClaims(r.Context(), claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func isStream(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r) || r.Header.Get("Accept") == "text/event-stream"
+}
+
+// streamToken returns access token offered as WebSocket subprotocol
+// handlerclipboard.SubprotocolBearer followed by the token
+func streamToken(r *http.Request) (string, bool) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		return "", false
+	}
+
+	for _, protocol := range websocket.Subprotocols(r) {
+		token, ok := strings.CutPrefix(protocol, handlerclipboard.SubprotocolBearer)
+		if ok {
+			return token, true
+		}
+	}
+
+	return "", false
+}
+
+func envSqlitePath() string {
+	const defaultPath = "drop.db"
+
+	path, ok := os.LookupEnv("SQLITE_PATH")
+	if !ok || path == "" {
+		return defaultPath
+	}
+
+	return path
+}
+
+// envStorageBackend is one of "redis", "sqlite" or "memory"
+func envStorageBackend() string {
+	const defaultBackend = "redis"
+
+	backend, ok := os.LookupEnv("STORAGE_BACKEND")
+	if !ok || backend == "" {
+		return defaultBackend
+	}
+
+	return backend
+}
+
+// envBlobDir is the directory of the filesystem blob store,
+// which is disabled if BLOB_DIR is unset
+func envBlobDir() string {
+	return os.Getenv("BLOB_DIR")
+}
+
+// envInt64 returns non-negative integer env key, or defaultValue
+// if it's unset or invalid
+func envInt64(key string, defaultValue int64) int64 {
+	s, ok := os.LookupEnv(key)
+	if !ok || s == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return defaultValue
+	}
+
+	return n
+}
+
+// envPurgeInterval is how often expired clipboards and their blobs
+// are deleted, from PURGE_INTERVAL like "5m"
+func envPurgeInterval() time.Duration {
+	const defaultInterval = 5 * time.Minute
+
+	d, err := time.ParseDuration(os.Getenv("PURGE_INTERVAL"))
+	if err != nil || d <= 0 {
+		return defaultInterval
+	}
+
+	return d
+}
+
+// envBlobThreshold is the size in bytes above which clipboard content
+// is kept in the blob store
+func envBlobThreshold() int64 {
+	return envInt64("BLOB_THRESHOLD", 256<<10)
+}
 
-	repoClip := redisclipboard.New(redisAddr, redisDb)
-	repoUser := redisuser.New(redisAddr, redisDb)
-	servicePassword := service.NewServicePassword(passwordKey)
+// bodyLimits are the maximum request body sizes in bytes of each kind of route
+type bodyLimits struct {
+	json   int64
+	clip   int64
+	upload int64
+}
+
+func envBodyLimits() bodyLimits {
+	return bodyLimits{
+		json:   envInt64("BODY_LIMIT_JSON", 64<<10),
+		clip:   envInt64("BODY_LIMIT_CLIP", 32<<20),
+		upload: envInt64("BODY_LIMIT_UPLOAD", 256<<20),
+	}
+}
+
+// envQuota is the storage quota of each user, 0 is unlimited
+func envQuota() repo.Quota {
+	return repo.Quota{
+		MaxBytes: envInt64("QUOTA_MAX_BYTES", 1<<30),
+		MaxClips: envInt64("QUOTA_MAX_CLIPS", 10000),
+	}
+}
+
+// limitBody rejects request bodies larger than limit bytes with 413
+func limitBody(limit int64, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			sendJson(w, http.StatusRequestEntityTooLarge, map[string]interface{}{
+				"error":  "request body too large",
+				"reason": fmt.Sprintf("limit is %d bytes", limit),
+			})
 
-	hClip := handlerclipboard.NewClipboard(repoClip)
-	hUser := handleruser.NewUser(repoUser, servicePassword)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// envKeyRing returns the key ring of at-rest encryption from ENCRYPTION_KEYS,
+// or from file ENCRYPTION_KEYS_FILE, formatted as in cryptclipboard.ParseKeyRing.
+// It returns nil key ring if both are unset, and clipboards are stored unencrypted.
+func envKeyRing() (*cryptclipboard.KeyRing, error) {
+	keys := os.Getenv("ENCRYPTION_KEYS")
+	if path := os.Getenv("ENCRYPTION_KEYS_FILE"); keys == "" && path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read ENCRYPTION_KEYS_FILE err: %w", err)
+		}
+
+		keys = string(b)
+	}
+
+	if keys == "" {
+		return nil, nil
+	}
+
+	return cryptclipboard.ParseKeyRing(keys)
+}
+
+// encrypted wraps clipboards with at-rest encryption if keys is not nil
+func encrypted(clipboards repo.RepositoryClipboard, keys *cryptclipboard.KeyRing) repo.RepositoryClipboard {
+	if keys == nil {
+		return clipboards
+	}
+
+	return cryptclipboard.New(clipboards, keys)
+}
+
+func newBlobStore(dir string) (repo.BlobStore, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	return fsblob.New(dir)
+}
+
+// encryptedBlobs wraps blobs with at-rest encryption if keys is not nil
+func encryptedBlobs(blobs repo.BlobStore, keys *cryptclipboard.KeyRing) repo.BlobStore {
+	if blobs == nil || keys == nil {
+		return blobs
+	}
+
+	return cryptclipboard.NewBlobStore(blobs, keys)
+}
+
+type repositories struct {
+	clip    repo.RepositoryClipboard
+	user    repo.RepositoryUser
+	session repo.RepositorySession
+	share   repo.RepositoryShare
+	space   repo.RepositorySpace
+	device  repo.RepositoryDevice
+	ticket  repo.RepositoryTicket
+
+	// events is nil for backends that can't fan out clipboard events
+	// across API instances
+	events repo.ClipboardEvents
+}
 
+func newRepositories(backend string, quota repo.Quota) (repositories, error) {
+	switch backend {
+	case "redis":
+		redisAddr := envRedisAddr()
+		redisDb := envRedisDb()
+
+		clip := redisclipboard.NewWithQuota(redisAddr, redisDb, quota)
+
+		return repositories{
+			clip:    clip,
+			user:    redisuser.New(redisAddr, redisDb),
+			session: redissession.New(redisAddr, redisDb),
+			share:   redisshare.New(redisAddr, redisDb),
+			space:   redisspace.New(redisAddr, redisDb),
+			device:  redisdevice.New(redisAddr, redisDb),
+			ticket:  redisticket.New(redisAddr, redisDb),
+			events:  clip.(repo.ClipboardEvents),
+		}, nil
+
+	case "sqlite":
+		db, err := sqlite.Open(envSqlitePath())
+		if err != nil {
+			return repositories{}, err
+		}
+
+		return repositories{
+			clip:    sqlite.NewClipboardWithQuota(db, quota),
+			user:    sqlite.NewUser(db),
+			session: sqlite.NewSession(db),
+			share:   sqlite.NewShare(db),
+			space:   sqlite.NewSpace(db),
+			device:  sqlite.NewDevice(db),
+			ticket:  sqlite.NewTicket(db),
+		}, nil
+
+	case "memory":
+		return repositories{
+			clip:    memory.NewClipboardWithQuota(quota),
+			user:    memory.NewUser(),
+			session: memory.NewSession(),
+			share:   memory.NewShare(),
+			space:   memory.NewSpace(),
+			device:  memory.NewDevice(),
+			ticket:  memory.NewTicket(),
+		}, nil
+	}
+
+	return repositories{}, fmt.Errorf("unknown STORAGE_BACKEND '%s'", backend)
+}
+
+func newRouter(
+	hClip *handlerclipboard.HandlerClipboard,
+	hShare *handlerclipboard.HandlerShare,
+	hSpace *handlerspace.HandlerSpace,
+	hUser *handleruser.HandlerUser,
+	auth mux.MiddlewareFunc,
+	limits bodyLimits,
+) *mux.Router {
 	r := mux.NewRouter()
 
-	r.Use(mw)
+	r.Use(logMw)
 
 	r.HandleFunc("/foo", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("from foo")
 		fmt.Fprintf(w, "ok")
 	})
 
-	r.HandleFunc("/clipboards/create", hClip.CreateClip).Methods(http.MethodPost)
-	r.HandleFunc("/clipboards/get-all", hClip.GetAllClips).Methods(http.MethodGet)
-	r.HandleFunc("/clipboards/get/{clipboard-id}", hClip.GetClipById).Methods(http.MethodGet)
-	r.HandleFunc("/clipboards/update/{clipboard-id}", hClip.UpdateClipById).Methods(http.MethodPatch)
-	r.HandleFunc("/clipboards/delete/{clipboard-id}", hClip.DeleteClip).Methods(http.MethodDelete)
+	r.Handle("/users/register", limitBody(limits.json, hUser.Register)).Methods(http.MethodPost)
+	r.Handle("/users/login", limitBody(limits.json, hUser.Login)).Methods(http.MethodPost)
+	r.Handle("/users/refresh", limitBody(limits.json, hUser.Refresh)).Methods(http.MethodPost)
+
+	// Share links are public
+	r.HandleFunc("/s/{share-token}", hShare.ViewShare).Methods(http.MethodGet)
+
+	clipRouter := r.PathPrefix("/clipboards").Subrouter()
+	clipRouter.Use(auth)
+	clipRouter.Handle("/create", limitBody(limits.clip, hClip.CreateClip)).Methods(http.MethodPost)
+	clipRouter.Handle("/upload", limitBody(limits.upload, hClip.UploadFiles)).Methods(http.MethodPost)
+	clipRouter.HandleFunc("/usage", hClip.GetUsage).Methods(http.MethodGet)
+	clipRouter.HandleFunc("/stream", hClip.Stream).Methods(http.MethodGet)
+	clipRouter.HandleFunc("/events", hClip.Events).Methods(http.MethodGet)
+	clipRouter.HandleFunc("/get-all", hClip.GetAllClips).Methods(http.MethodGet)
+	clipRouter.HandleFunc("/history/recent", hClip.GetRecentClips).Methods(http.MethodGet)
+	clipRouter.HandleFunc("/history/range", hClip.GetClipsInRange).Methods(http.MethodGet)
+	clipRouter.HandleFunc("/history/latest", hClip.GetLatestClip).Methods(http.MethodGet)
+	clipRouter.HandleFunc("/get/{clipboard-id}", hClip.GetClipById).Methods(http.MethodGet)
+	clipRouter.HandleFunc("/download/{clipboard-id}", hClip.DownloadFile).Methods(http.MethodGet)
+	clipRouter.Handle("/update/{clipboard-id}", limitBody(limits.clip, hClip.UpdateClipById)).Methods(http.MethodPatch)
+	clipRouter.HandleFunc("/delete/{clipboard-id}", hClip.DeleteClip).Methods(http.MethodDelete)
+	clipRouter.Handle("/share/{clipboard-id}", limitBody(limits.json, hShare.CreateShare)).Methods(http.MethodPost)
+	clipRouter.HandleFunc("/shares/{clipboard-id}", hShare.GetShares).Methods(http.MethodGet)
+	clipRouter.HandleFunc("/unshare/{share-token}", hShare.DeleteShare).Methods(http.MethodDelete)
+
+	spaceRouter := r.PathPrefix("/spaces").Subrouter()
+	spaceRouter.Use(auth)
+	spaceRouter.Handle("/create", limitBody(limits.json, hSpace.CreateSpace)).Methods(http.MethodPost)
+	spaceRouter.HandleFunc("/get-all", hSpace.GetSpaces).Methods(http.MethodGet)
+	spaceRouter.HandleFunc("/get/{space-id}", hSpace.GetSpace).Methods(http.MethodGet)
+	spaceRouter.HandleFunc("/clips/{space-id}", hClip.GetAllClips).Methods(http.MethodGet)
+	spaceRouter.Handle("/members/{space-id}", limitBody(limits.json, hSpace.PutMember)).Methods(http.MethodPut)
+	spaceRouter.HandleFunc("/members/{space-id}/{user-id}", hSpace.DeleteMember).Methods(http.MethodDelete)
+
+	userRouter := r.PathPrefix("/users").Subrouter()
+	userRouter.Use(auth)
+	userRouter.HandleFunc("/logout", hUser.Logout).Methods(http.MethodPost)
+	userRouter.HandleFunc("/stream-ticket", hUser.StreamTicket).Methods(http.MethodPost)
+	userRouter.Handle("/devices", limitBody(limits.json, hUser.RegisterDevice)).Methods(http.MethodPost)
+	userRouter.HandleFunc("/devices", hUser.GetDevices).Methods(http.MethodGet)
+	userRouter.HandleFunc("/devices/{device-id}", hUser.DeleteDevice).Methods(http.MethodDelete)
+	userRouter.HandleFunc("/get/{user-id}", hUser.GetUserById).Methods(http.MethodGet)
+	userRouter.Handle("/update/username/{user-id}", limitBody(limits.json, hUser.UpdateUsername)).Methods(http.MethodPatch)
+	userRouter.Handle("/update/password/{user-id}", limitBody(limits.json, hUser.UpdatePassword)).Methods(http.MethodPatch)
+	userRouter.HandleFunc("/delete/{user-id}", hUser.DeleteUser).Methods(http.MethodDelete)
+
+	return r
+}
+
+// newApi returns the router of all handlers, on top of repos,
+// with clipboards as the clipboard repository
+func newApi(
+	repos repositories,
+	clipboards repo.RepositoryClipboardStream,
+	servicePassword service.Password,
+	serviceToken service.Token,
+	quota repo.Quota,
+	limits bodyLimits,
+) *mux.Router {
+	hClip := handlerclipboard.NewClipboard(clipboards, repos.space, repos.session, repos.device, repos.events, quota)
+	hShare := handlerclipboard.NewShare(repos.share, clipboards, repos.space, servicePassword)
+	hSpace := handlerspace.NewSpace(repos.space, repos.user)
+	hUser := handleruser.NewUser(repos.user, repos.session, repos.device, servicePassword, serviceToken)
+
+	return newRouter(hClip, hShare, hSpace, hUser, authMw(serviceToken, repos.session, repos.device), limits)
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		reencrypt()
+		return
+	}
+
+	passwordKey := envPasswordKeyAES()
+	tokenSecret := envTokenSecret()
+
+	repos, err := newRepositories(envStorageBackend(), envQuota())
+	if err != nil {
+		log.Fatalln("failed to init repositories:", err)
+	}
+
+	blobs, err := newBlobStore(envBlobDir())
+	if err != nil {
+		log.Fatalln("failed to init blob store:", err)
+	}
+
+	keys, err := envKeyRing()
+	if err != nil {
+		log.Fatalln("failed to load encryption keys:", err)
+	}
+
+	servicePassword := service.NewServicePasswordArgon2(service.NewServicePassword(passwordKey))
+	serviceToken := service.NewServiceToken(tokenSecret, 15*time.Minute, 30*24*time.Hour, repos.ticket)
+
+	clipboards := blobclipboard.New(encrypted(repos.clip, keys), encryptedBlobs(blobs, keys), envBlobThreshold())
+	go purgeExpired(context.Background(), clipboards, envPurgeInterval())
 
-	r.HandleFunc("/users/register", hUser.Register).Methods(http.MethodPost)
-	r.HandleFunc("/users/login", hUser.Login).Methods(http.MethodPost)
-	r.HandleFunc("/users/get/{user-id}", hUser.GetUserById).Methods(http.MethodGet)
-	r.HandleFunc("/users/update/username/{user-id}", hUser.UpdateUsername).Methods(http.MethodPatch)
-	r.HandleFunc("/users/update/password/{user-id}", hUser.UpdatePassword).Methods(http.MethodPatch)
-	r.HandleFunc("/users/delete/{user-id}", hUser.DeleteUser).Methods(http.MethodDelete)
+	r := newApi(repos, clipboards, servicePassword, serviceToken, envQuota(), envBodyLimits())
 
-	err := http.ListenAndServe(":8000", r)
+	err = http.ListenAndServe(":8000", r)
 	if err != nil {
 		log.Println("server error:", err)
 	}
@@ -0,0 +1,796 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+
+	"github.com/eymyong/drop/cmd/api/handler/handlerclipboard"
+	"github.com/eymyong/drop/cmd/api/service"
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+	"github.com/eymyong/drop/repo/blobclipboard"
+	"github.com/eymyong/drop/repo/redisclipboard"
+)
+
+const testPasswordKey = "0123456789abcdef0123456789abcdef"
+
+// testApi is the API on memory repositories without blob store
+type testApi struct {
+	t       *testing.T
+	handler http.Handler
+	repos   repositories
+	token   service.Token
+}
+
+func newTestApi(t *testing.T, quota repo.Quota, limits bodyLimits) *testApi {
+	repos, err := newRepositories("memory", quota)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return newTestApiRepos(t, repos, quota, limits)
+}
+
+// newTestApiEvents is testApi with clipboards on miniredis,
+// since only redis clipboards have events
+func newTestApiEvents(t *testing.T) *testApi {
+	repos, err := newRepositories("memory", repo.Quota{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	clip := redisclipboard.New(miniredis.RunT(t).Addr(), 0)
+	repos.clip = clip
+	repos.events = clip.(repo.ClipboardEvents)
+
+	return newTestApiRepos(t, repos, repo.Quota{}, testLimits)
+}
+
+func newTestApiRepos(t *testing.T, repos repositories, quota repo.Quota, limits bodyLimits) *testApi {
+	servicePassword := service.NewServicePasswordArgon2(service.NewServicePassword(testPasswordKey))
+	serviceToken := service.NewServiceToken([]byte(strings.Repeat("s", 32)), 15*time.Minute, time.Hour, repos.ticket)
+	clipboards := blobclipboard.New(repos.clip, nil, 0)
+
+	return &testApi{
+		t:       t,
+		handler: newApi(repos, clipboards, servicePassword, serviceToken, quota, limits),
+		repos:   repos,
+		token:   serviceToken,
+	}
+}
+
+var testLimits = bodyLimits{json: 1 << 10, clip: 1 << 10, upload: 1 << 10}
+
+type testTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// do sends request with body and bearer token, if any
+func (a *testApi) do(method, path, token string, body string, header ...string) *httptest.ResponseRecorder {
+	a.t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	a.handler.ServeHTTP(w, req)
+
+	return w
+}
+
+// expect sends request like do, and fails unless it's status
+func (a *testApi) expect(status int, method, path, token string, body string, header ...string) *httptest.ResponseRecorder {
+	a.t.Helper()
+
+	w := a.do(method, path, token, body, header...)
+	if w.Code != status {
+		a.t.Fatalf("%s %s: expected status %d, got %d: %s", method, path, status, w.Code, w.Body.String())
+	}
+
+	return w
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+
+	err := json.Unmarshal(w.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("unexpected error decoding '%s': %v", w.Body.String(), err)
+	}
+}
+
+// signUp registers and logs in username, and returns its user id and tokens
+func (a *testApi) signUp(username string) (string, testTokens) {
+	a.t.Helper()
+
+	body := fmt.Sprintf(`{"username": "%s", "password": "pass-%s"}`, username, username)
+	a.expect(http.StatusCreated, http.MethodPost, "/users/register", "", body)
+
+	return a.login(username, "")
+}
+
+func (a *testApi) login(username string, deviceId string) (string, testTokens) {
+	a.t.Helper()
+
+	body := fmt.Sprintf(`{"username": "%s", "password": "pass-%s", "device_id": "%s"}`, username, username, deviceId)
+	var resp struct {
+		User   model.User `json:"user"`
+		Tokens testTokens `json:"tokens"`
+	}
+	decode(a.t, a.expect(http.StatusOK, http.MethodPost, "/users/login", "", body), &resp)
+
+	return resp.User.Id, resp.Tokens
+}
+
+// createClip creates clipboard of text, in space if it's not empty, and returns its id
+func (a *testApi) createClip(token string, space string, text string) string {
+	a.t.Helper()
+
+	path := "/clipboards/create"
+	if space != "" {
+		path += "?space=" + space
+	}
+
+	var resp struct {
+		Created model.Clipboard `json:"created"`
+	}
+	decode(a.t, a.expect(http.StatusCreated, http.MethodPost, path, token, text), &resp)
+
+	return resp.Created.Id
+}
+
+func TestAuth(t *testing.T) {
+	a := newTestApi(t, repo.Quota{}, testLimits)
+	_, tokens := a.signUp("yong")
+
+	a.expect(http.StatusUnauthorized, http.MethodGet, "/clipboards/get-all", "", "")
+	a.expect(http.StatusUnauthorized, http.MethodGet, "/clipboards/get-all", "not-a-token", "")
+	a.expect(http.StatusUnauthorized, http.MethodGet, "/clipboards/get-all", "", "", "Authorization", tokens.AccessToken)
+	a.expect(http.StatusOK, http.MethodGet, "/clipboards/get-all", tokens.AccessToken, "")
+
+	// Access tokens are never accepted in URLs
+	sse := []string{"Accept", "text/event-stream"}
+	a.expect(http.StatusUnauthorized, http.MethodGet, "/clipboards/events?access_token="+tokens.AccessToken, "", "", sse...)
+
+	// Stream tickets only open streams, once. Memory backends have no events,
+	// so being past auth is 501.
+	var ticket struct {
+		Ticket string `json:"ticket"`
+	}
+	decode(t, a.expect(http.StatusOK, http.MethodPost, "/users/stream-ticket", tokens.AccessToken, ""), &ticket)
+
+	a.expect(http.StatusUnauthorized, http.MethodGet, "/clipboards/get-all", ticket.Ticket, "")
+	a.expect(http.StatusUnauthorized, http.MethodGet, "/clipboards/get-all?ticket="+ticket.Ticket, "", "")
+	a.expect(http.StatusNotImplemented, http.MethodGet, "/clipboards/events?ticket="+ticket.Ticket, "", "", sse...)
+	a.expect(http.StatusUnauthorized, http.MethodGet, "/clipboards/events?ticket="+ticket.Ticket, "", "", sse...)
+
+	ws := []string{"Connection", "Upgrade", "Upgrade", "websocket", "Sec-WebSocket-Version", "13", "Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ=="}
+	a.expect(http.StatusNotImplemented, http.MethodGet, "/clipboards/stream", "", "", append(ws, "Sec-WebSocket-Protocol", "drop, bearer."+tokens.AccessToken)...)
+	a.expect(http.StatusUnauthorized, http.MethodGet, "/clipboards/stream", "", "", append(ws, "Sec-WebSocket-Protocol", "drop, bearer.not-a-token")...)
+	a.expect(http.StatusUnauthorized, http.MethodGet, "/clipboards/stream", "", "", ws...)
+
+	a.expect(http.StatusOK, http.MethodPost, "/users/logout", tokens.AccessToken, "")
+	a.expect(http.StatusUnauthorized, http.MethodGet, "/clipboards/get-all", tokens.AccessToken, "")
+}
+
+func TestRefresh(t *testing.T) {
+	a := newTestApi(t, repo.Quota{}, testLimits)
+	_, tokens := a.signUp("yong")
+
+	refresh := func(status int, token string) testTokens {
+		t.Helper()
+
+		var resp struct {
+			Tokens testTokens `json:"tokens"`
+		}
+		w := a.expect(status, http.MethodPost, "/users/refresh", "", fmt.Sprintf(`{"refresh_token": "%s"}`, token))
+		if status == http.StatusOK {
+			decode(t, w, &resp)
+		}
+
+		return resp.Tokens
+	}
+
+	rotated := refresh(http.StatusOK, tokens.RefreshToken)
+	if rotated.RefreshToken == "" || rotated.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("expected refresh token to be rotated, got %+v", rotated)
+	}
+	a.expect(http.StatusOK, http.MethodGet, "/clipboards/get-all", rotated.AccessToken, "")
+
+	// Refresh tokens can only be used once
+	refresh(http.StatusUnauthorized, tokens.RefreshToken)
+	refresh(http.StatusUnauthorized, "not-a-token")
+	rotated = refresh(http.StatusOK, rotated.RefreshToken)
+
+	// Even by concurrent requests
+	var (
+		wg    sync.WaitGroup
+		mut   sync.Mutex
+		codes = map[int]int{}
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			w := a.do(http.MethodPost, "/users/refresh", "", fmt.Sprintf(`{"refresh_token": "%s"}`, rotated.RefreshToken))
+			mut.Lock()
+			codes[w.Code]++
+			mut.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if codes[http.StatusOK] != 1 || codes[http.StatusUnauthorized] != 9 {
+		t.Fatalf("expected 1 refresh to win, got %v", codes)
+	}
+}
+
+func TestRehashPassword(t *testing.T) {
+	a := newTestApi(t, repo.Quota{}, testLimits)
+
+	legacy, err := service.NewServicePassword(testPasswordKey).Hash("pass-yong")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	_, err = a.repos.user.Create(ctx, model.User{Id: "yong-id", Username: "yong", Password: legacy})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	a.expect(http.StatusUnauthorized, http.MethodPost, "/users/login", "", `{"username": "yong", "password": "wrong"}`)
+
+	hash, err := a.repos.user.GetPassword(ctx, "yong")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(hash) != legacy {
+		t.Fatal("expected failed login not to rehash password")
+	}
+
+	a.login("yong", "")
+
+	hash, err = a.repos.user.GetPassword(ctx, "yong")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(string(hash), "$argon2id$") {
+		t.Fatalf("expected password to be rehashed with argon2id, got '%s'", hash)
+	}
+
+	// The new hash still logs in
+	a.login("yong", "")
+}
+
+func TestOwnership(t *testing.T) {
+	a := newTestApi(t, repo.Quota{}, testLimits)
+	_, yong := a.signUp("yong")
+	_, other := a.signUp("other")
+
+	id := a.createClip(yong.AccessToken, "", "yong's clipboard")
+
+	// Clipboards of other users look missing, not forbidden
+	a.expect(http.StatusNotFound, http.MethodGet, "/clipboards/get/"+id, other.AccessToken, "")
+	a.expect(http.StatusNotFound, http.MethodPatch, "/clipboards/update/"+id, other.AccessToken, "other's text")
+	a.expect(http.StatusNotFound, http.MethodDelete, "/clipboards/delete/"+id, other.AccessToken, "")
+
+	// Shares are of the sharer's clipboards only
+	a.expect(http.StatusNotFound, http.MethodPost, "/clipboards/share/"+id, other.AccessToken, "")
+	a.expect(http.StatusNotFound, http.MethodPost, "/clipboards/share/missing", yong.AccessToken, "")
+
+	w := a.expect(http.StatusOK, http.MethodGet, "/clipboards/get/"+id+"?format=raw", yong.AccessToken, "")
+	if w.Body.String() != "yong's clipboard" {
+		t.Fatalf("expected clipboard to be unchanged, got '%s'", w.Body.String())
+	}
+
+	var clips struct {
+		Clipboards []model.Clipboard `json:"clipboards"`
+	}
+	decode(t, a.expect(http.StatusOK, http.MethodGet, "/clipboards/get-all", other.AccessToken, ""), &clips)
+	if len(clips.Clipboards) != 0 {
+		t.Fatalf("expected no clipboards of other, got %+v", clips.Clipboards)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	a := newTestApi(t, repo.Quota{MaxBytes: 100, MaxClips: 2}, bodyLimits{json: 64, clip: 64, upload: 64})
+	_, tokens := a.signUp("yong")
+
+	a.expect(http.StatusBadRequest, http.MethodPost, "/users/register", "", `{"username": ""}`)
+	a.expect(http.StatusConflict, http.MethodPost, "/users/register", "", `{"username": "yong", "password": "again"}`)
+	a.expect(http.StatusRequestEntityTooLarge, http.MethodPost, "/users/register", "", `{"username": "`+strings.Repeat("y", 64)+`"}`)
+	a.expect(http.StatusNotFound, http.MethodGet, "/clipboards/get/missing", tokens.AccessToken, "")
+
+	// Over the body limit
+	a.expect(http.StatusRequestEntityTooLarge, http.MethodPost, "/clipboards/create", tokens.AccessToken, strings.Repeat("x", 65))
+
+	// Over quota of bytes, then of clipboards
+	a.createClip(tokens.AccessToken, "", strings.Repeat("x", 60))
+	a.expect(http.StatusInsufficientStorage, http.MethodPost, "/clipboards/create", tokens.AccessToken, strings.Repeat("x", 60))
+	id := a.createClip(tokens.AccessToken, "", strings.Repeat("x", 30))
+	a.expect(http.StatusInsufficientStorage, http.MethodPatch, "/clipboards/update/"+id, tokens.AccessToken, strings.Repeat("x", 50))
+	a.expect(http.StatusOK, http.MethodPatch, "/clipboards/update/"+id, tokens.AccessToken, strings.Repeat("x", 40))
+	a.expect(http.StatusForbidden, http.MethodPost, "/clipboards/create", tokens.AccessToken, "one too many")
+
+	var resp struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}
+	decode(t, a.expect(http.StatusForbidden, http.MethodPost, "/clipboards/create", tokens.AccessToken, "x"), &resp)
+	if resp.Error == "" || resp.Reason == "" {
+		t.Fatalf("expected error and reason, got %+v", resp)
+	}
+}
+
+func TestSpace(t *testing.T) {
+	a := newTestApi(t, repo.Quota{}, testLimits)
+	_, owner := a.signUp("owner")
+	_, writer := a.signUp("writer")
+	_, outsider := a.signUp("outsider")
+
+	var space struct {
+		Created model.Space `json:"created"`
+	}
+	decode(t, a.expect(http.StatusCreated, http.MethodPost, "/spaces/create", owner.AccessToken, `{"name": "team"}`), &space)
+	spaceId := space.Created.Id
+
+	a.expect(http.StatusOK, http.MethodPut, "/spaces/members/"+spaceId, owner.AccessToken, `{"username": "writer", "role": "writer"}`)
+	a.expect(http.StatusForbidden, http.MethodPut, "/spaces/members/"+spaceId, writer.AccessToken, `{"username": "outsider", "role": "reader"}`)
+
+	id := a.createClip(writer.AccessToken, spaceId, "team clipboard")
+
+	w := a.expect(http.StatusOK, http.MethodGet, "/clipboards/get/"+id+"?format=raw&space="+spaceId, owner.AccessToken, "")
+	if w.Body.String() != "team clipboard" {
+		t.Fatalf("expected team clipboard, got '%s'", w.Body.String())
+	}
+
+	// Space clipboards are not personal clipboards of their creator
+	a.expect(http.StatusNotFound, http.MethodGet, "/clipboards/get/"+id, writer.AccessToken, "")
+
+	a.expect(http.StatusNotFound, http.MethodGet, "/spaces/clips/"+spaceId, outsider.AccessToken, "")
+	a.expect(http.StatusNotFound, http.MethodGet, "/clipboards/get/"+id+"?space="+spaceId, outsider.AccessToken, "")
+}
+
+func TestShareView(t *testing.T) {
+	a := newTestApi(t, repo.Quota{}, testLimits)
+	_, tokens := a.signUp("yong")
+	id := a.createClip(tokens.AccessToken, "", "shared text")
+
+	share := func(body string) string {
+		t.Helper()
+
+		var resp struct {
+			Created model.Share `json:"created"`
+		}
+		decode(t, a.expect(http.StatusCreated, http.MethodPost, "/clipboards/share/"+id, tokens.AccessToken, body), &resp)
+
+		return resp.Created.Token
+	}
+
+	once := share(`{"max_views": 1}`)
+	w := a.expect(http.StatusOK, http.MethodGet, "/s/"+once, "", "")
+	if w.Body.String() != "shared text" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("unexpected share view: %v '%s'", w.Header(), w.Body.String())
+	}
+	a.expect(http.StatusNotFound, http.MethodGet, "/s/"+once, "", "")
+	a.expect(http.StatusNotFound, http.MethodGet, "/s/missing", "", "")
+
+	basic := func(password string) []string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth("", password)
+		return []string{"Authorization", req.Header.Get("Authorization")}
+	}
+
+	protected := share(`{"password": "open sesame"}`)
+	w = a.expect(http.StatusUnauthorized, http.MethodGet, "/s/"+protected, "", "")
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatal("expected Basic auth challenge")
+	}
+	a.expect(http.StatusUnauthorized, http.MethodGet, "/s/"+protected, "", "", basic("wrong")...)
+	a.expect(http.StatusOK, http.MethodGet, "/s/"+protected, "", "", basic("open sesame")...)
+
+	// Guessing locks the share out, even for the right password
+	for i := 0; i <= model.ShareFreeAttempts; i++ {
+		a.expect(http.StatusUnauthorized, http.MethodGet, "/s/"+protected, "", "", basic("wrong")...)
+	}
+	w = a.expect(http.StatusTooManyRequests, http.MethodGet, "/s/"+protected, "", "", basic("open sesame")...)
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After of locked out share")
+	}
+
+	// Shares of deleted clipboards are gone too
+	last := share("")
+	a.expect(http.StatusOK, http.MethodDelete, "/clipboards/delete/"+id, tokens.AccessToken, "")
+	a.expect(http.StatusNotFound, http.MethodGet, "/s/"+last, "", "")
+	a.expect(http.StatusNotFound, http.MethodPost, "/clipboards/share/"+id, tokens.AccessToken, "")
+}
+
+func TestDeviceRevocation(t *testing.T) {
+	a := newTestApi(t, repo.Quota{}, testLimits)
+	_, tokens := a.signUp("yong")
+	_, other := a.signUp("other")
+
+	var resp struct {
+		Created model.Device `json:"created"`
+	}
+	decode(t, a.expect(http.StatusCreated, http.MethodPost, "/users/devices", tokens.AccessToken, `{"name": "phone"}`), &resp)
+	deviceId := resp.Created.Id
+
+	// Another session logs in as the device
+	_, laptop := a.login("yong", deviceId)
+	a.expect(http.StatusOK, http.MethodGet, "/clipboards/get-all", laptop.AccessToken, "")
+
+	a.expect(http.StatusNotFound, http.MethodDelete, "/users/devices/"+deviceId, other.AccessToken, "")
+	a.expect(http.StatusOK, http.MethodDelete, "/users/devices/"+deviceId, laptop.AccessToken, "")
+
+	// All sessions of the device are revoked
+	for _, tokens := range []testTokens{tokens, laptop} {
+		a.expect(http.StatusUnauthorized, http.MethodGet, "/clipboards/get-all", tokens.AccessToken, "")
+		a.expect(http.StatusUnauthorized, http.MethodPost, "/users/refresh", "", fmt.Sprintf(`{"refresh_token": "%s"}`, tokens.RefreshToken))
+	}
+
+	a.expect(http.StatusNotFound, http.MethodPost, "/users/login", "", fmt.Sprintf(`{"username": "yong", "password": "pass-yong", "device_id": "%s"}`, deviceId))
+}
+
+func TestSpaceRoles(t *testing.T) {
+	a := newTestApi(t, repo.Quota{}, testLimits)
+	_, owner := a.signUp("owner")
+	_, writer := a.signUp("writer")
+	_, reader := a.signUp("reader")
+	_, outsider := a.signUp("outsider")
+
+	var space struct {
+		Created model.Space `json:"created"`
+	}
+	decode(t, a.expect(http.StatusCreated, http.MethodPost, "/spaces/create", owner.AccessToken, `{"name": "team"}`), &space)
+	spaceId := space.Created.Id
+
+	for _, member := range []string{`{"username": "writer", "role": "writer"}`, `{"username": "reader", "role": "reader"}`} {
+		a.expect(http.StatusOK, http.MethodPut, "/spaces/members/"+spaceId, owner.AccessToken, member)
+	}
+
+	q := "?space=" + spaceId
+	tests := []struct {
+		user   testTokens
+		read   int
+		write  int
+		delete int
+	}{
+		{user: owner, read: http.StatusOK, write: http.StatusOK, delete: http.StatusOK},
+		{user: writer, read: http.StatusOK, write: http.StatusOK, delete: http.StatusOK},
+		{user: reader, read: http.StatusOK, write: http.StatusForbidden, delete: http.StatusForbidden},
+		{user: outsider, read: http.StatusNotFound, write: http.StatusNotFound, delete: http.StatusNotFound},
+	}
+
+	for _, tc := range tests {
+		id := a.createClip(owner.AccessToken, spaceId, "team clipboard")
+		token := tc.user.AccessToken
+
+		a.expect(tc.read, http.MethodGet, "/clipboards/get/"+id+q, token, "")
+		a.expect(tc.read, http.MethodGet, "/clipboards/get-all"+q, token, "")
+		a.expect(tc.read, http.MethodGet, "/clipboards/history/latest"+q, token, "")
+		a.expect(tc.read, http.MethodGet, "/clipboards/shares/"+id+q, token, "")
+		a.expect(tc.read, http.MethodGet, "/spaces/clips/"+spaceId, token, "")
+
+		created := http.StatusCreated
+		if tc.write != http.StatusOK {
+			created = tc.write
+		}
+		a.expect(created, http.MethodPost, "/clipboards/create"+q, token, "new clipboard")
+		a.expect(tc.write, http.MethodPatch, "/clipboards/update/"+id+q, token, "updated clipboard")
+		a.expect(created, http.MethodPost, "/clipboards/share/"+id+q, token, "")
+		a.expect(tc.delete, http.MethodDelete, "/clipboards/delete/"+id+q, token, "")
+
+		// Space clipboards are not reachable as personal clipboards either
+		if tc.delete != http.StatusOK {
+			a.expect(http.StatusNotFound, http.MethodDelete, "/clipboards/delete/"+id, token, "")
+			a.expect(http.StatusOK, http.MethodGet, "/clipboards/get/"+id+q, owner.AccessToken, "")
+		}
+	}
+
+	// Non-members can't tell spaces from missing ones
+	a.expect(http.StatusNotFound, http.MethodGet, "/spaces/get/"+spaceId, outsider.AccessToken, "")
+	a.expect(http.StatusNotFound, http.MethodGet, "/clipboards/get-all?space=missing", owner.AccessToken, "")
+	a.expect(http.StatusNotFound, http.MethodPost, "/clipboards/create?space=missing", owner.AccessToken, "clipboard")
+}
+
+// multipartBody returns multipart/form-data body with a non-file field
+// and files, given as pairs of filename and content, and its Content-Type
+func multipartBody(t *testing.T, files ...string) (string, string) {
+	t.Helper()
+
+	var b strings.Builder
+	mw := multipart.NewWriter(&b)
+	err := mw.WriteField("note", "not a file")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; i+1 < len(files); i += 2 {
+		part, err := mw.CreateFormFile("file", files[i])
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		_, err = io.WriteString(part, files[i+1])
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	err = mw.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return b.String(), mw.FormDataContentType()
+}
+
+func TestUpload(t *testing.T) {
+	a := newTestApi(t, repo.Quota{MaxClips: 3}, testLimits)
+	_, tokens := a.signUp("yong")
+
+	expectClips := func(n int) {
+		t.Helper()
+
+		var clips struct {
+			Clipboards []model.Clipboard `json:"clipboards"`
+		}
+		decode(t, a.expect(http.StatusOK, http.MethodGet, "/clipboards/get-all", tokens.AccessToken, ""), &clips)
+		if len(clips.Clipboards) != n {
+			t.Fatalf("expected %d clipboards, got %+v", n, clips.Clipboards)
+		}
+
+		var usage struct {
+			Usage model.Usage `json:"usage"`
+		}
+		decode(t, a.expect(http.StatusOK, http.MethodGet, "/clipboards/usage", tokens.AccessToken, ""), &usage)
+		if usage.Usage.Clips != int64(n) {
+			t.Fatalf("expected usage of %d clipboards, got %+v", n, usage.Usage)
+		}
+	}
+
+	body, contentType := multipartBody(t, "a.txt", "first file", "b.txt", "second file")
+	var resp struct {
+		Created []model.Clipboard `json:"created"`
+	}
+	decode(t, a.expect(http.StatusCreated, http.MethodPost, "/clipboards/upload", tokens.AccessToken, body, "Content-Type", contentType), &resp)
+	if len(resp.Created) != 2 || resp.Created[0].Filename != "a.txt" || resp.Created[1].Filename != "b.txt" {
+		t.Fatalf("expected clipboards of a.txt and b.txt, got %+v", resp.Created)
+	}
+	expectClips(2)
+
+	w := a.expect(http.StatusOK, http.MethodGet, "/clipboards/download/"+resp.Created[0].Id, tokens.AccessToken, "")
+	if w.Body.String() != "first file" {
+		t.Fatalf("unexpected content '%s'", w.Body.String())
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), "a.txt") {
+		t.Fatalf("expected attachment a.txt, got '%s'", w.Header().Get("Content-Disposition"))
+	}
+
+	// Files already stored are deleted if a later one fails
+	body, contentType = multipartBody(t, "c.txt", "fits quota", "d.txt", "one too many")
+	a.expect(http.StatusForbidden, http.MethodPost, "/clipboards/upload", tokens.AccessToken, body, "Content-Type", contentType)
+	expectClips(2)
+
+	body, contentType = multipartBody(t, "c.txt", "fits limit", "d.txt", strings.Repeat("x", int(testLimits.upload)))
+	a.expect(http.StatusRequestEntityTooLarge, http.MethodPost, "/clipboards/upload", tokens.AccessToken, body, "Content-Type", contentType)
+	expectClips(2)
+
+	body, contentType = multipartBody(t)
+	a.expect(http.StatusBadRequest, http.MethodPost, "/clipboards/upload", tokens.AccessToken, body, "Content-Type", contentType)
+	a.expect(http.StatusBadRequest, http.MethodPost, "/clipboards/upload", tokens.AccessToken, "not multipart")
+}
+
+// streamTicket returns a new stream ticket of token
+func (a *testApi) streamTicket(token string) string {
+	a.t.Helper()
+
+	var resp struct {
+		Ticket string `json:"ticket"`
+	}
+	decode(a.t, a.expect(http.StatusOK, http.MethodPost, "/users/stream-ticket", token, ""), &resp)
+
+	return resp.Ticket
+}
+
+// sseEvent is an event read from Server-Sent Events
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// nextEvent reads the next Server-Sent Event with data,
+// skipping retry fields and comments
+func nextEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+
+	var event sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected error reading events: %v", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if event.data != "" {
+				return event
+			}
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			event.id = value
+		case "event":
+			event.event = value
+		case "data":
+			event.data = value
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	sse := []string{"Accept", "text/event-stream"}
+
+	m := newTestApi(t, repo.Quota{}, testLimits)
+	_, tokens := m.signUp("yong")
+	m.expect(http.StatusNotImplemented, http.MethodGet, "/clipboards/events", tokens.AccessToken, "", sse...)
+
+	a := newTestApiEvents(t)
+	_, tokens = a.signUp("yong")
+
+	server := httptest.NewServer(a.handler)
+	defer server.Close()
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	open := func(path string, header ...string) (*http.Response, *bufio.Reader) {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		header = append(header, sse...)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			t.Fatalf("GET %s: expected status 200, got %d", path, resp.StatusCode)
+		}
+		if resp.Header.Get("Content-Type") != "text/event-stream" {
+			resp.Body.Close()
+			t.Fatalf("unexpected Content-Type '%s'", resp.Header.Get("Content-Type"))
+		}
+
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	expectEvent := func(r *bufio.Reader, id string) sseEvent {
+		t.Helper()
+
+		event := nextEvent(t, r)
+		var data model.ClipboardEvent
+		err := json.Unmarshal([]byte(event.data), &data)
+		if err != nil {
+			t.Fatalf("unexpected error decoding '%s': %v", event.data, err)
+		}
+		if event.id == "" || event.id != data.Id || event.event != model.EventCreate || data.Type != model.EventCreate || data.ClipboardId != id {
+			t.Fatalf("expected create event of %s, got %+v", id, event)
+		}
+
+		return event
+	}
+
+	resp, r := open("/clipboards/events", "Authorization", "Bearer "+tokens.AccessToken)
+	event := expectEvent(r, a.createClip(tokens.AccessToken, "", "first"))
+	resp.Body.Close()
+
+	// Events missed while disconnected are replayed after Last-Event-ID
+	id := a.createClip(tokens.AccessToken, "", "missed")
+	resp, r = open("/clipboards/events?ticket="+a.streamTicket(tokens.AccessToken), "Last-Event-ID", event.id)
+	defer resp.Body.Close()
+	expectEvent(r, id)
+	expectEvent(r, a.createClip(tokens.AccessToken, "", "live"))
+}
+
+func TestStream(t *testing.T) {
+	ws := []string{"Connection", "Upgrade", "Upgrade", "websocket", "Sec-WebSocket-Version", "13", "Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ=="}
+
+	m := newTestApi(t, repo.Quota{}, testLimits)
+	_, tokens := m.signUp("yong")
+	m.expect(http.StatusNotImplemented, http.MethodGet, "/clipboards/stream", tokens.AccessToken, "", ws...)
+
+	a := newTestApiEvents(t)
+	_, tokens = a.signUp("yong")
+
+	server := httptest.NewServer(a.handler)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/clipboards/stream"
+
+	dial := func(query string, protocols ...string) (*websocket.Conn, int) {
+		t.Helper()
+
+		dialer := websocket.Dialer{Subprotocols: protocols, HandshakeTimeout: 10 * time.Second}
+		conn, resp, err := dialer.Dial(url+query, nil)
+		if err == websocket.ErrBadHandshake {
+			return nil, resp.StatusCode
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return conn, resp.StatusCode
+	}
+
+	expectEvent := func(conn *websocket.Conn, id string) {
+		t.Helper()
+
+		var event model.ClipboardEvent
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		err := conn.ReadJSON(&event)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if event.Id == "" || event.Type != model.EventCreate || event.ClipboardId != id {
+			t.Fatalf("expected create event of %s, got %+v", id, event)
+		}
+	}
+
+	// Subprotocol auth selects the plain subprotocol, never the token
+	conn, _ := dial("", handlerclipboard.Subprotocol, handlerclipboard.SubprotocolBearer+tokens.AccessToken)
+	defer conn.Close()
+	if conn.Subprotocol() != handlerclipboard.Subprotocol {
+		t.Fatalf("expected subprotocol '%s', got '%s'", handlerclipboard.Subprotocol, conn.Subprotocol())
+	}
+	expectEvent(conn, a.createClip(tokens.AccessToken, "", "first"))
+
+	_, status := dial("", handlerclipboard.Subprotocol, handlerclipboard.SubprotocolBearer+"not-a-token")
+	if status != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 for bad token, got %d", status)
+	}
+
+	// Tickets open one stream
+	ticket := a.streamTicket(tokens.AccessToken)
+	other, _ := dial("?ticket=" + ticket)
+	defer other.Close()
+
+	id := a.createClip(tokens.AccessToken, "", "second")
+	expectEvent(conn, id)
+	expectEvent(other, id)
+
+	_, status = dial("?ticket=" + ticket)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 for used ticket, got %d", status)
+	}
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+var ErrPasswordHashFormat = errors.New("bad password hash format")
+
+// PasswordArgon2 hashes passwords with argon2id in PHC string format:
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>
+//
+// Hashes not in this format are verified with legacy, if any,
+// and always reported for rehash.
+type PasswordArgon2 struct {
+	legacy Password
+}
+
+func NewServicePasswordArgon2(legacy Password) *PasswordArgon2 {
+	return &PasswordArgon2{legacy: legacy}
+}
+
+func (s *PasswordArgon2) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (s *PasswordArgon2) Verify(hash string, password string) (bool, bool, error) {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		if s.legacy == nil {
+			return false, false, ErrPasswordHashFormat
+		}
+
+		ok, _, err := s.legacy.Verify(hash, password)
+		return ok, true, err
+	}
+
+	var (
+		version               int
+		memory, time          uint32
+		threads               uint8
+		saltBase64, keyBase64 string
+	)
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, false, ErrPasswordHashFormat
+	}
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, false, ErrPasswordHashFormat
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return false, false, ErrPasswordHashFormat
+	}
+
+	saltBase64, keyBase64 = parts[4], parts[5]
+	salt, err := base64.RawStdEncoding.DecodeString(saltBase64)
+	if err != nil {
+		return false, false, ErrPasswordHashFormat
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(keyBase64)
+	if err != nil {
+		return false, false, ErrPasswordHashFormat
+	}
+
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, false, nil
+	}
+
+	rehash := memory != argon2Memory || time != argon2Time || threads != argon2Threads || len(key) != argon2KeyLen
+
+	return true, rehash, nil
+}
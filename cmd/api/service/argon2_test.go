@@ -0,0 +1,102 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestPasswordArgon2(t *testing.T) {
+	s := NewServicePasswordArgon2(nil)
+
+	hash, err := s.Hash("password")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=1,p=4$") || strings.Contains(hash, "password") {
+		t.Fatalf("unexpected hash '%s'", hash)
+	}
+
+	other, _ := s.Hash("password")
+	if other == hash {
+		t.Fatal("expected hashes to be salted")
+	}
+
+	ok, rehash, err := s.Verify(hash, "password")
+	if err != nil || !ok || rehash {
+		t.Fatalf("expected password to match without rehash, got %v %v %v", ok, rehash, err)
+	}
+
+	ok, _, err = s.Verify(hash, "wrong")
+	if err != nil || ok {
+		t.Fatalf("expected wrong password not to match, got %v %v", ok, err)
+	}
+
+	// Parameters are part of the hash
+	edited := strings.Replace(hash, "m=65536,t=1,p=4", "m=32768,t=1,p=4", 1)
+	ok, _, err = s.Verify(edited, "password")
+	if err != nil || ok {
+		t.Fatalf("expected edited parameters not to match, got %v %v", ok, err)
+	}
+
+	// Hashes with older parameters still verify, and are reported for rehash
+	salt := []byte("0123456789abcdef")
+	weaker := fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, 32*1024, 1, 2,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("password"), salt, 1, 32*1024, 2, argon2KeyLen)),
+	)
+	ok, rehash, err = s.Verify(weaker, "password")
+	if err != nil || !ok || !rehash {
+		t.Fatalf("expected outdated hash to match with rehash, got %v %v %v", ok, rehash, err)
+	}
+
+	for _, bad := range []string{
+		"$argon2id$",
+		"$argon2id$v=18$m=65536,t=1,p=4$c2FsdA$a2V5",
+		"$argon2id$v=19$m=x,t=1,p=4$c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536,t=1,p=4$!$a2V5",
+		"not a hash",
+	} {
+		_, _, err = s.Verify(bad, "password")
+		if !errors.Is(err, ErrPasswordHashFormat) {
+			t.Fatalf("expected ErrPasswordHashFormat for '%s', got %v", bad, err)
+		}
+	}
+}
+
+func TestPasswordArgon2Legacy(t *testing.T) {
+	legacy := NewServicePassword("0123456789abcdef0123456789abcdef")
+	s := NewServicePasswordArgon2(legacy)
+
+	old, err := legacy.Hash("password")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ok, rehash, err := s.Verify(old, "password")
+	if err != nil || !ok || !rehash {
+		t.Fatalf("expected legacy password to match with rehash, got %v %v %v", ok, rehash, err)
+	}
+
+	ok, _, err = s.Verify(old, "wrong")
+	if err != nil || ok {
+		t.Fatalf("expected wrong password not to match, got %v %v", ok, err)
+	}
+
+	// Migrated hashes are argon2id, and no longer need rehash
+	hash, err := s.Hash("password")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ok, rehash, err = s.Verify(hash, "password")
+	if err != nil || !ok || rehash {
+		t.Fatalf("expected migrated password to match without rehash, got %v %v %v", ok, rehash, err)
+	}
+}
@@ -2,15 +2,22 @@ package service
 
 import (
 	"bytes"
+	"crypto/subtle"
 
 	"github.com/soyart/gfc/pkg/gfc"
 )
 
 type Password interface {
-	EncryptBase64(password string) (string, error)
-	DecryptBase64(ciphertext string) (string, error)
+	// Hash returns the stored form of password
+	Hash(password string) (string, error)
+	// Verify checks password against its stored hash in constant time.
+	// rehash is true if hash is in an outdated format, and callers
+	// should replace it with a new one from Hash.
+	Verify(hash string, password string) (ok bool, rehash bool, err error)
 }
 
+// PasswordImpl is the legacy reversible password storage with AES-GCM.
+// It's only kept to verify and migrate passwords stored before PasswordArgon2.
 type PasswordImpl struct {
 	keyAES string
 }
@@ -21,6 +28,21 @@ func NewServicePassword(keyAES string) *PasswordImpl {
 	}
 }
 
+func (s *PasswordImpl) Hash(password string) (string, error) {
+	return s.EncryptBase64(password)
+}
+
+func (s *PasswordImpl) Verify(hash string, password string) (bool, bool, error) {
+	plaintext, err := s.DecryptBase64(hash)
+	if err != nil {
+		return false, false, err
+	}
+
+	ok := subtle.ConstantTimeCompare([]byte(plaintext), []byte(password)) == 1
+
+	return ok, true, nil
+}
+
 func (s *PasswordImpl) EncryptBase64(password string) (string, error) {
 	buf := bytes.NewBufferString(password)
 	ciphertext, err := gfc.EncryptGCM(buf, []byte(s.keyAES))
@@ -0,0 +1,267 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/eymyong/drop/repo"
+)
+
+var (
+	ErrTokenInvalid = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Claims is what we carry inside an access token.
+type Claims struct {
+	UserId    string `json:"sub"`
+	SessionId string `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// Scope is empty for access tokens, and ScopeStream for stream tickets
+	Scope string `json:"scope,omitempty"`
+	// TicketId is the unique id of a stream ticket
+	TicketId string `json:"jti,omitempty"`
+	// DeviceId is the registered device of the session. It's not in the
+	// token, but set by the auth middleware from the session.
+	DeviceId string `json:"-"`
+}
+
+// ScopeStream is the scope of stream tickets
+const ScopeStream = "stream"
+
+// TicketTTL is how long a stream ticket can be used after it's issued
+const TicketTTL = 30 * time.Second
+
+type Token interface {
+	// SignAccess mints a signed access token (HS256 JWT) for the session.
+	SignAccess(userId, sessionId string) (string, time.Time, error)
+	// VerifyAccess checks signature and expiry of an access token.
+	VerifyAccess(token string) (Claims, error)
+	// SignTicket mints a stream ticket from claims of an access token,
+	// for clients that can't send headers when opening streams,
+	// so that access tokens never end up in URLs.
+	SignTicket(claims Claims) (string, time.Time, error)
+	// VerifyTicket checks a stream ticket, which can only be used once,
+	// within TicketTTL, even across API instances sharing the ticket
+	// repository. The returned claims expire with the access token
+	// the ticket was issued for.
+	VerifyTicket(ctx context.Context, ticket string) (Claims, error)
+	// NewRefresh returns a random refresh token for the session
+	// and its hash to be stored server-side.
+	NewRefresh(sessionId string) (token string, hash string, err error)
+	// ParseRefresh returns session id and hash of a refresh token.
+	ParseRefresh(token string) (sessionId string, hash string, err error)
+	RefreshTTL() time.Duration
+}
+
+type TokenImpl struct {
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	now        func() time.Time
+	// tickets remembers used stream tickets until they expire
+	tickets repo.RepositoryTicket
+}
+
+func NewServiceToken(secret []byte, accessTTL, refreshTTL time.Duration, tickets repo.RepositoryTicket) *TokenImpl {
+	return &TokenImpl{
+		secret:     secret,
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		now:        time.Now,
+		tickets:    tickets,
+	}
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (s *TokenImpl) SignAccess(userId, sessionId string) (string, time.Time, error) {
+	now := s.now()
+	exp := now.Add(s.accessTTL)
+	token, err := s.signClaims(Claims{
+		UserId:    userId,
+		SessionId: sessionId,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: exp.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, exp, nil
+}
+
+func (s *TokenImpl) VerifyAccess(token string) (Claims, error) {
+	claims, err := s.verifyClaims(token)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	// Stream tickets are not access tokens
+	if claims.Scope != "" {
+		return Claims{}, ErrTokenInvalid
+	}
+
+	return claims, nil
+}
+
+func (s *TokenImpl) SignTicket(claims Claims) (string, time.Time, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := s.now()
+	ticket, err := s.signClaims(Claims{
+		UserId:    claims.UserId,
+		SessionId: claims.SessionId,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: claims.ExpiresAt,
+		Scope:     ScopeStream,
+		TicketId:  base64.RawURLEncoding.EncodeToString(id),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return ticket, now.Add(TicketTTL), nil
+}
+
+func (s *TokenImpl) VerifyTicket(ctx context.Context, ticket string) (Claims, error) {
+	claims, err := s.verifyClaims(ticket)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	if claims.Scope != ScopeStream || claims.TicketId == "" {
+		return Claims{}, ErrTokenInvalid
+	}
+
+	usableUntil := time.Unix(claims.IssuedAt, 0).Add(TicketTTL)
+	if !s.now().Before(usableUntil) {
+		return Claims{}, ErrTokenExpired
+	}
+
+	err = s.tickets.Use(ctx, claims.TicketId, usableUntil)
+	if errors.Is(err, repo.ErrConflict) {
+		return Claims{}, ErrTokenInvalid
+	}
+	if err != nil {
+		return Claims{}, err
+	}
+
+	return claims, nil
+}
+
+func (s *TokenImpl) signClaims(claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(s.sign(unsigned)), nil
+}
+
+// verifyClaims checks signature and expiry of token of any scope
+func (s *TokenImpl) verifyClaims(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return Claims{}, ErrTokenInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrTokenInvalid
+	}
+
+	if !hmac.Equal(sig, s.sign(parts[0]+"."+parts[1])) {
+		return Claims{}, ErrTokenInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, ErrTokenInvalid
+	}
+
+	var claims Claims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return Claims{}, ErrTokenInvalid
+	}
+
+	if claims.UserId == "" || claims.SessionId == "" {
+		return Claims{}, ErrTokenInvalid
+	}
+
+	if s.now().Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrTokenExpired
+	}
+
+	return claims, nil
+}
+
+func (s *TokenImpl) NewRefresh(sessionId string) (string, string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	return sessionId + "." + secret, hashRefresh(secret), nil
+}
+
+func (s *TokenImpl) ParseRefresh(token string) (string, string, error) {
+	sessionId, secret, ok := strings.Cut(token, ".")
+	if !ok || sessionId == "" || secret == "" {
+		return "", "", ErrTokenInvalid
+	}
+
+	return sessionId, hashRefresh(secret), nil
+}
+
+func (s *TokenImpl) RefreshTTL() time.Duration {
+	return s.refreshTTL
+}
+
+func (s *TokenImpl) sign(unsigned string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(unsigned))
+
+	return mac.Sum(nil)
+}
+
+func hashRefresh(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// EqualHash compares 2 refresh token hashes in constant time
+func EqualHash(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+type ctxKeyClaims struct{}
+
+func ContextWithClaims(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, ctxKeyClaims{}, claims)
+}
+
+func ClaimsFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(ctxKeyClaims{}).(Claims)
+	return claims, ok
+}
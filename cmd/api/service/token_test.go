@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eymyong/drop/repo/memory"
+)
+
+func testToken(now *time.Time) *TokenImpl {
+	s := NewServiceToken([]byte(strings.Repeat("s", 32)), time.Minute, time.Hour, memory.NewTicket())
+	s.now = func() time.Time { return *now }
+
+	return s
+}
+
+func TestAccess(t *testing.T) {
+	now := time.Now()
+	s := testToken(&now)
+
+	token, exp, err := s.SignAccess("user", "session")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !exp.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected expiry after access TTL, got %s", exp)
+	}
+
+	claims, err := s.VerifyAccess(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claims.UserId != "user" || claims.SessionId != "session" || claims.ExpiresAt != exp.Unix() {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	other := NewServiceToken([]byte(strings.Repeat("o", 32)), time.Minute, time.Hour, memory.NewTicket())
+	_, err = other.VerifyAccess(token)
+	if !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("expected ErrTokenInvalid for another secret, got %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	for _, bad := range []string{
+		"",
+		"not-a-token",
+		parts[0] + "." + parts[1],
+		parts[0] + "." + parts[1] + "x." + parts[2],
+		"x" + token,
+	} {
+		_, err = s.VerifyAccess(bad)
+		if !errors.Is(err, ErrTokenInvalid) {
+			t.Fatalf("expected ErrTokenInvalid for '%s', got %v", bad, err)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	_, err = s.VerifyAccess(token)
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("expected ErrTokenExpired, got %v", err)
+	}
+}
+
+func TestTicket(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	s := testToken(&now)
+
+	access, _, err := s.SignAccess("user", "session")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	claims, err := s.VerifyAccess(access)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ticket, exp, err := s.SignTicket(claims)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !exp.Equal(now.Add(TicketTTL)) {
+		t.Fatalf("expected ticket to be usable for TicketTTL, got %s", exp)
+	}
+
+	// Tickets are not access tokens
+	_, err = s.VerifyAccess(ticket)
+	if !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("expected ErrTokenInvalid for ticket as access token, got %v", err)
+	}
+	_, err = s.VerifyTicket(ctx, access)
+	if !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("expected ErrTokenInvalid for access token as ticket, got %v", err)
+	}
+
+	got, err := s.VerifyTicket(ctx, ticket)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.UserId != "user" || got.SessionId != "session" || got.ExpiresAt != claims.ExpiresAt {
+		t.Fatalf("expected claims of access token, got %+v", got)
+	}
+
+	_, err = s.VerifyTicket(ctx, ticket)
+	if !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("expected ErrTokenInvalid for used ticket, got %v", err)
+	}
+
+	unused, _, err := s.SignTicket(claims)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now = now.Add(TicketTTL)
+	_, err = s.VerifyTicket(ctx, unused)
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("expected ErrTokenExpired for old ticket, got %v", err)
+	}
+
+	// Another instance sharing the ticket repository rejects used tickets too
+	other := NewServiceToken(s.secret, time.Minute, time.Hour, s.tickets)
+	other.now = s.now
+
+	now = now.Add(-TicketTTL)
+	shared, _, _ := s.SignTicket(claims)
+	_, err = s.VerifyTicket(ctx, shared)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = other.VerifyTicket(ctx, shared)
+	if !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("expected ErrTokenInvalid for ticket used with another instance, got %v", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	now := time.Now()
+	s := testToken(&now)
+
+	token, hash, err := s.NewRefresh("session")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(hash, strings.TrimPrefix(token, "session.")) {
+		t.Fatal("expected hash not to contain the secret")
+	}
+
+	sessionId, parsed, err := s.ParseRefresh(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sessionId != "session" || !EqualHash(parsed, hash) {
+		t.Fatalf("expected session and hash of token, got '%s' '%s'", sessionId, parsed)
+	}
+
+	other, otherHash, _ := s.NewRefresh("session")
+	if other == token || EqualHash(otherHash, hash) {
+		t.Fatal("expected refresh tokens to be random")
+	}
+
+	for _, bad := range []string{"", "session", "session.", ".secret"} {
+		_, _, err = s.ParseRefresh(bad)
+		if !errors.Is(err, ErrTokenInvalid) {
+			t.Fatalf("expected ErrTokenInvalid for '%s', got %v", bad, err)
+		}
+	}
+}
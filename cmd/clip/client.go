@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eymyong/drop/model"
+)
+
+// errLoggedOut is returned when there's no session to use or refresh
+var errLoggedOut = errors.New("not logged in, run clip login")
+
+// apiError is an error response of the API
+type apiError struct {
+	Status int
+	Err    string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+func (e *apiError) Error() string {
+	if e.Err == "" {
+		return fmt.Sprintf("server responded %d", e.Status)
+	}
+
+	if e.Reason == "" {
+		return e.Err
+	}
+
+	return e.Err + ": " + e.Reason
+}
+
+func readError(resp *http.Response) error {
+	apiErr := &apiError{Status: resp.StatusCode}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(apiErr)
+
+	return apiErr
+}
+
+// client calls the API with the session in config,
+// saving refreshed tokens back to configPath
+type client struct {
+	http       *http.Client
+	config     config
+	configPath string
+}
+
+func (c *client) url(path string, query url.Values) string {
+	u := strings.TrimRight(c.config.Server, "/") + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+
+	return u
+}
+
+func (c *client) login(ctx context.Context, username string, password string) error {
+	b, err := json.Marshal(map[string]string{
+		"username": username,
+		"password": password,
+	})
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		User   model.User `json:"user"`
+		Tokens tokens     `json:"tokens"`
+	}
+	err = c.post(ctx, "/users/login", b, &resp)
+	if err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+
+	// The key is derived for another user
+	if resp.User.Id != c.config.UserId {
+		c.config.E2EKey = ""
+	}
+
+	c.config.UserId = resp.User.Id
+	c.config.Username = username
+	c.setTokens(resp.Tokens)
+
+	return saveConfig(c.configPath, c.config)
+}
+
+type tokens struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+func (c *client) setTokens(t tokens) {
+	c.config.AccessToken = t.AccessToken
+	c.config.RefreshToken = t.RefreshToken
+	c.config.ExpiresAt = t.ExpiresAt
+}
+
+// refresh renews the session, so the old refresh token is useless afterwards
+func (c *client) refresh(ctx context.Context) error {
+	if c.config.RefreshToken == "" {
+		return errLoggedOut
+	}
+
+	b, err := json.Marshal(map[string]string{
+		"refresh_token": c.config.RefreshToken,
+	})
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Tokens tokens `json:"tokens"`
+	}
+	err = c.post(ctx, "/users/refresh", b, &resp)
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusUnauthorized {
+		return errLoggedOut
+	}
+	if err != nil {
+		return fmt.Errorf("refresh session failed: %w", err)
+	}
+
+	c.setTokens(resp.Tokens)
+
+	return saveConfig(c.configPath, c.config)
+}
+
+// post sends unauthenticated JSON body and decodes JSON response into v
+func (c *client) post(ctx context.Context, path string, body []byte, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(path, nil), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return readError(resp)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// do sends req with the access token, refreshing it first if it's expired.
+// Requests that can be replayed are retried once with a refreshed token
+// if the server rejects the current one. Error responses are returned
+// as *apiError, so the response is only returned on success.
+func (c *client) do(req *http.Request) (*http.Response, error) {
+	if c.config.AccessToken == "" {
+		return nil, errLoggedOut
+	}
+
+	ctx := req.Context()
+	if time.Now().Add(10 * time.Second).After(c.config.ExpiresAt) {
+		err := c.refresh(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	replayable := req.Body == nil || req.GetBody != nil
+	if resp.StatusCode == http.StatusUnauthorized && replayable {
+		resp.Body.Close()
+
+		err = c.refresh(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		retry := req.Clone(ctx)
+		if req.GetBody != nil {
+			retry.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err = c.send(retry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, readError(resp)
+	}
+
+	return resp, nil
+}
+
+func (c *client) send(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+c.config.AccessToken)
+	return c.http.Do(req)
+}
+
+// getJson GETs path and decodes JSON response into v
+func (c *client) getJson(ctx context.Context, path string, query url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(path, query), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type copyOptions struct {
+	ttl  time.Duration
+	burn bool
+}
+
+func (o copyOptions) query() url.Values {
+	q := url.Values{}
+	if o.ttl > 0 {
+		q.Set("ttl", o.ttl.String())
+	}
+	if o.burn {
+		q.Set("burn_after_read", "true")
+	}
+
+	return q
+}
+
+// headerEnvelope carries model.Envelope of end-to-end encrypted content
+const headerEnvelope = "Clip-Envelope"
+
+// create streams content of mimeType into a new clipboard.
+// Encrypted content comes with its envelope.
+func (c *client) create(ctx context.Context, content io.Reader, mimeType string, envelope *model.Envelope, opts copyOptions) (model.Clipboard, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("/clipboards/create", opts.query()), content)
+	if err != nil {
+		return model.Clipboard{}, err
+	}
+	req.Header.Set("Content-Type", mimeType)
+	if envelope != nil {
+		req.Header.Set(headerEnvelope, envelope.String())
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return model.Clipboard{}, err
+	}
+	defer resp.Body.Close()
+
+	var created struct {
+		Created model.Clipboard `json:"created"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	if err != nil {
+		return model.Clipboard{}, fmt.Errorf("invalid response: %w", err)
+	}
+
+	return created.Created, nil
+}
+
+// upload streams file content as multipart body, so that the clipboard
+// keeps filename and the server sniffs its type
+func (c *client) upload(ctx context.Context, filename string, content io.Reader, opts copyOptions) (model.Clipboard, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", filename)
+		if err == nil {
+			_, err = io.Copy(part, content)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("/clipboards/upload", opts.query()), pr)
+	if err != nil {
+		pr.Close()
+		return model.Clipboard{}, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	resp, err := c.do(req)
+	pr.Close()
+	if err != nil {
+		return model.Clipboard{}, err
+	}
+	defer resp.Body.Close()
+
+	var created struct {
+		Created []model.Clipboard `json:"created"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	if err != nil || len(created.Created) != 1 {
+		return model.Clipboard{}, fmt.Errorf("invalid response: %v", err)
+	}
+
+	return created.Created[0], nil
+}
+
+// open returns a reader of raw content of clipboard id,
+// and its envelope if the content is encrypted
+func (c *client) open(ctx context.Context, id string) (io.ReadCloser, *model.Envelope, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("/clipboards/get/"+url.PathEscape(id), nil), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := resp.Header.Get(headerEnvelope)
+	if s == "" {
+		return resp.Body, nil, nil
+	}
+
+	envelope, err := model.ParseEnvelope(s)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("invalid response: %w", err)
+	}
+
+	return resp.Body, &envelope, nil
+}
+
+// recent returns up to limit most recent clipboards, newest first
+func (c *client) recent(ctx context.Context, limit int) ([]model.Clipboard, error) {
+	var clips []model.Clipboard
+	err := c.getJson(ctx, "/clipboards/history/recent", url.Values{"limit": {strconv.Itoa(limit)}}, &clips)
+
+	return clips, err
+}
+
+func (c *client) remove(ctx context.Context, id string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.url("/clipboards/delete/"+url.PathEscape(id), nil), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultServer = "http://localhost:8000"
+
+// config is the session of the CLI, saved between commands
+type config struct {
+	Server       string    `json:"server"`
+	UserId       string    `json:"user_id"`
+	Username     string    `json:"username"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	// E2EKey is base64 of the end-to-end encryption key set by clip key
+	E2EKey string `json:"e2e_key,omitempty"`
+}
+
+// configPath is clip/config.json in XDG_CONFIG_HOME,
+// or in the default user config dir if it's unset
+func configPath() (string, error) {
+	dir, ok := os.LookupEnv("XDG_CONFIG_HOME")
+	if !ok || dir == "" {
+		var err error
+		dir, err = os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("no config dir: %w", err)
+		}
+	}
+
+	return filepath.Join(dir, "clip", "config.json"), nil
+}
+
+// loadConfig returns empty config if there's no config file yet
+func loadConfig(path string) (config, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config{}, nil
+	}
+	if err != nil {
+		return config{}, fmt.Errorf("read config err: %w", err)
+	}
+
+	var conf config
+	err = json.Unmarshal(b, &conf)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	return conf, nil
+}
+
+// saveConfig writes conf readable only by the user, as it holds tokens
+func saveConfig(path string, conf config) error {
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return fmt.Errorf("mkdir config dir err: %w", err)
+	}
+
+	b, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(path, b, 0o600)
+	if err != nil {
+		return fmt.Errorf("write config err: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,491 @@
+// Command clip copies and pastes clipboards through the drop API.
+//
+//	clip [-server URL] login USERNAME
+//	clip key
+//	clip copy [-ttl DURATION] [-burn] [-e] [FILE]
+//	clip paste [ID]
+//	clip list [-n COUNT]
+//	clip rm ID...
+//	clip watch [-json]
+//
+// The session is kept in $XDG_CONFIG_HOME/clip/config.json, along with
+// the end-to-end encryption key derived by clip key. Clipboards copied with -e
+// are encrypted with it, and paste decrypts them.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/eymyong/drop/e2e"
+	"github.com/eymyong/drop/model"
+)
+
+const usage = `usage: clip [-server URL] COMMAND [ARGS]
+
+commands:
+  login USERNAME      log in, reading password from terminal or stdin
+  key                 derive end-to-end encryption key from a passphrase
+  copy [FILE]         copy FILE, or stdin, to a new clipboard
+  paste [ID]          write clipboard ID, or the latest one, to stdout
+  list                list recent clipboards
+  rm ID...            delete clipboards
+  watch               print clipboard changes as they happen
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "clip:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("clip", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	server := fs.String("server", "", "API base URL, saved by login")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+
+	conf, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *server != "":
+		conf.Server = *server
+	case conf.Server == "":
+		conf.Server = os.Getenv("CLIP_SERVER")
+	}
+	if conf.Server == "" {
+		conf.Server = defaultServer
+	}
+
+	c := &client{
+		http:       http.DefaultClient,
+		config:     conf,
+		configPath: path,
+	}
+
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "login":
+		return cmdLogin(ctx, c, cmdArgs, stdin, stderr)
+	case "key":
+		return cmdKey(c, cmdArgs, stdin, stderr)
+	case "copy":
+		return cmdCopy(ctx, c, cmdArgs, stdin, stdout, stderr)
+	case "paste":
+		return cmdPaste(ctx, c, cmdArgs, stdout, stderr)
+	case "list":
+		return cmdList(ctx, c, cmdArgs, stdout, stderr)
+	case "rm":
+		return cmdRm(ctx, c, cmdArgs, stderr)
+	case "watch":
+		return cmdWatch(ctx, c, cmdArgs, stdout, stderr)
+	}
+
+	fs.Usage()
+	return fmt.Errorf("unknown command '%s'", cmd)
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("clip "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	return fs
+}
+
+func cmdLogin(ctx context.Context, c *client, args []string, stdin io.Reader, stderr io.Writer) error {
+	fs := newFlagSet("login", stderr)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: clip login USERNAME")
+	}
+
+	password, err := readPassword(stdin, stderr)
+	if err != nil {
+		return err
+	}
+
+	err = c.login(ctx, fs.Arg(0), password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stderr, "logged in to %s as %s\n", c.config.Server, fs.Arg(0))
+
+	return nil
+}
+
+// cmdKey derives the key from passphrase and user id, so that
+// all devices of the user logged in with the same passphrase share it
+func cmdKey(c *client, args []string, stdin io.Reader, stderr io.Writer) error {
+	fs := newFlagSet("key", stderr)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if c.config.UserId == "" {
+		return errLoggedOut
+	}
+
+	passphrase, err := readSecret("Passphrase", stdin, stderr)
+	if err != nil {
+		return err
+	}
+
+	key, err := e2e.DeriveKey(passphrase, c.config.UserId)
+	if err != nil {
+		return err
+	}
+
+	c.config.E2EKey = base64.StdEncoding.EncodeToString(key.Bytes())
+	err = saveConfig(c.configPath, c.config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stderr, "saved key %s\n", key.Id())
+
+	return nil
+}
+
+// key returns the key saved by clip key
+func (c *client) key() (e2e.Key, error) {
+	if c.config.E2EKey == "" {
+		return e2e.Key{}, errors.New("no encryption key, run clip key")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(c.config.E2EKey)
+	if err != nil {
+		return e2e.Key{}, fmt.Errorf("invalid key in config: %w", err)
+	}
+
+	return e2e.NewKey(raw)
+}
+
+func readPassword(stdin io.Reader, stderr io.Writer) (string, error) {
+	return readSecret("Password", stdin, stderr)
+}
+
+// readSecret prompts for secret without echo if stdin is a terminal,
+// or reads its first line otherwise
+func readSecret(prompt string, stdin io.Reader, stderr io.Writer) (string, error) {
+	if f, ok := stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(stderr, prompt+": ")
+		b, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(stderr)
+
+		return string(b), err
+	}
+
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("read %s err: %w", strings.ToLower(prompt), err)
+	}
+
+	secret := strings.TrimRight(line, "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("empty %s", strings.ToLower(prompt))
+	}
+
+	return secret, nil
+}
+
+func cmdCopy(ctx context.Context, c *client, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("copy", stderr)
+	ttl := fs.Duration("ttl", 0, "delete the clipboard after `duration`")
+	burn := fs.Bool("burn", false, "delete the clipboard once it's read")
+	mimeType := fs.String("type", "", "content type of stdin, sniffed if empty")
+	encrypt := fs.Bool("e", false, "encrypt end-to-end with the key from clip key")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	opts := copyOptions{ttl: *ttl, burn: *burn}
+
+	if *encrypt {
+		return copyEncrypted(ctx, c, fs.Args(), stdin, stdout, opts)
+	}
+
+	var clip model.Clipboard
+	switch fs.NArg() {
+	case 0:
+		body := bufio.NewReaderSize(stdin, 512)
+		if *mimeType == "" {
+			// http.DetectContentType looks at most at the first 512 bytes
+			head, err := body.Peek(512)
+			if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+				return fmt.Errorf("read stdin err: %w", err)
+			}
+
+			*mimeType = http.DetectContentType(head)
+		}
+
+		clip, err = c.create(ctx, body, *mimeType, nil, opts)
+
+	case 1:
+		var f *os.File
+		f, err = os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		clip, err = c.upload(ctx, filepath.Base(fs.Arg(0)), f, opts)
+
+	default:
+		return errors.New("usage: clip copy [FILE]")
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(stdout, clip.Id)
+
+	return nil
+}
+
+// copyEncrypted copies FILE in args, or stdin, encrypted as a whole,
+// so it's read into memory first. Filenames of encrypted files
+// are not sent to the server.
+func copyEncrypted(ctx context.Context, c *client, args []string, stdin io.Reader, stdout io.Writer, opts copyOptions) error {
+	key, err := c.key()
+	if err != nil {
+		return err
+	}
+
+	var plaintext []byte
+	switch len(args) {
+	case 0:
+		plaintext, err = io.ReadAll(stdin)
+	case 1:
+		plaintext, err = os.ReadFile(args[0])
+	default:
+		return errors.New("usage: clip copy -e [FILE]")
+	}
+	if err != nil {
+		return err
+	}
+
+	ciphertext, envelope, err := key.Seal(plaintext)
+	if err != nil {
+		return err
+	}
+
+	clip, err := c.create(ctx, bytes.NewReader(ciphertext), "application/octet-stream", &envelope, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(stdout, clip.Id)
+
+	return nil
+}
+
+func cmdPaste(ctx context.Context, c *client, args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("paste", stderr)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var id string
+	switch fs.NArg() {
+	case 0:
+		// Listing doesn't burn burn-after-read clipboards,
+		// and raw content is never mangled by JSON
+		latest, err := c.recent(ctx, 1)
+		if err != nil {
+			return err
+		}
+
+		if len(latest) == 0 {
+			return errors.New("no clipboards")
+		}
+
+		id = latest[0].Id
+
+	case 1:
+		id = fs.Arg(0)
+
+	default:
+		return errors.New("usage: clip paste [ID]")
+	}
+
+	content, envelope, err := c.open(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	if envelope == nil {
+		_, err = io.Copy(stdout, content)
+		return err
+	}
+
+	key, err := c.key()
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := key.Open(ciphertext, *envelope)
+	if err != nil {
+		return err
+	}
+
+	_, err = stdout.Write(plaintext)
+
+	return err
+}
+
+func cmdList(ctx context.Context, c *client, args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("list", stderr)
+	n := fs.Int("n", 20, "list at most `count` clipboards")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	clips, err := c.recent(ctx, *n)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCREATED\tSIZE\tTYPE\tCONTENT")
+	for _, clip := range clips {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n",
+			clip.Id,
+			clip.CreatedAt.Local().Format(time.DateTime),
+			clip.Size,
+			mediaType(clip.MimeType),
+			preview(clip),
+		)
+	}
+
+	return tw.Flush()
+}
+
+func mediaType(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return mimeType
+	}
+
+	return mediaType
+}
+
+// preview is filename of uploaded clipboards,
+// or the start of the first line of text clipboards
+func preview(clip model.Clipboard) string {
+	const maxPreview = 40
+
+	switch {
+	case clip.Filename != "":
+		return clip.Filename
+	case clip.Envelope != nil:
+		return "(encrypted)"
+	case clip.BurnAfterRead:
+		return "(burn after read)"
+	}
+
+	line, _, _ := strings.Cut(clip.Text, "\n")
+	if r := []rune(line); len(r) > maxPreview {
+		line = string(r[:maxPreview]) + "..."
+	}
+
+	return line
+}
+
+func cmdRm(ctx context.Context, c *client, args []string, stderr io.Writer) error {
+	fs := newFlagSet("rm", stderr)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return errors.New("usage: clip rm ID...")
+	}
+
+	for _, id := range fs.Args() {
+		err := c.remove(ctx, id)
+		if err != nil {
+			return fmt.Errorf("rm %s: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+func cmdWatch(ctx context.Context, c *client, args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := newFlagSet("watch", stderr)
+	asJson := fs.Bool("json", false, "print events as JSON lines")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(stdout)
+
+	return c.watch(ctx, func(event model.ClipboardEvent) error {
+		if *asJson {
+			return enc.Encode(event)
+		}
+
+		_, err := fmt.Fprintf(stdout, "%s\t%s\t%s\n", event.Time.Local().Format(time.DateTime), event.Type, event.ClipboardId)
+		return err
+	})
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/eymyong/drop/e2e"
+	"github.com/eymyong/drop/model"
+)
+
+// fakeApi implements the routes used by clip in memory
+type fakeApi struct {
+	mu      sync.Mutex
+	token   int
+	ttl     time.Duration
+	refresh int
+	clips   []model.Clipboard
+	events  []model.ClipboardEvent
+	// lastEventIds are Last-Event-ID headers of /clipboards/events requests
+	lastEventIds []string
+}
+
+func (f *fakeApi) tokens() map[string]interface{} {
+	f.token++
+	return map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":       "user-yong",
+			"username": "yong",
+		},
+		"tokens": map[string]interface{}{
+			"access_token":  fmt.Sprintf("access-%d", f.token),
+			"refresh_token": fmt.Sprintf("refresh-%d", f.token),
+			"expires_at":    time.Now().Add(f.ttl),
+		},
+	}
+}
+
+func (f *fakeApi) router() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/users/login", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["username"] != "yong" || req["password"] != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad credentials"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(f.tokens())
+	}).Methods(http.MethodPost)
+
+	r.HandleFunc("/users/refresh", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["refresh_token"] != fmt.Sprintf("refresh-%d", f.token) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		f.refresh++
+		json.NewEncoder(w).Encode(f.tokens())
+	}).Methods(http.MethodPost)
+
+	clips := r.PathPrefix("/clipboards").Subrouter()
+	clips.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f.mu.Lock()
+			ok := r.Header.Get("Authorization") == fmt.Sprintf("Bearer access-%d", f.token)
+			f.mu.Unlock()
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	clips.HandleFunc("/create", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		content := model.NewContent(string(b), r.Header.Get("Content-Type"))
+		if s := r.Header.Get(headerEnvelope); s != "" {
+			envelope, err := model.ParseEnvelope(s)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			content.Envelope = &envelope
+		}
+
+		clip := f.add(model.Clipboard{Content: content})
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"created": clip})
+	}).Methods(http.MethodPost)
+
+	clips.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		b, _ := io.ReadAll(file)
+		clip := f.add(model.Clipboard{Content: model.NewContent(string(b), http.DetectContentType(b)), Filename: header.Filename})
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"created": []model.Clipboard{clip}})
+	}).Methods(http.MethodPost)
+
+	clips.HandleFunc("/history/recent", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		recent := []model.Clipboard{}
+		for i := len(f.clips) - 1; i >= 0 && len(recent) < limit; i-- {
+			recent = append(recent, f.clips[i])
+		}
+		json.NewEncoder(w).Encode(recent)
+	}).Methods(http.MethodGet)
+
+	clips.HandleFunc("/get/{clipboard-id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		for _, clip := range f.clips {
+			if clip.Id == mux.Vars(r)["clipboard-id"] {
+				w.Header().Set("Content-Type", clip.MimeType)
+				if clip.Envelope != nil {
+					w.Header().Set(headerEnvelope, clip.Envelope.String())
+				}
+				io.WriteString(w, clip.Text)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+	}).Methods(http.MethodGet)
+
+	clips.HandleFunc("/delete/{clipboard-id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		for i, clip := range f.clips {
+			if clip.Id == mux.Vars(r)["clipboard-id"] {
+				f.clips = append(f.clips[:i], f.clips[i+1:]...)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}).Methods(http.MethodDelete)
+
+	// Each response sends the events after Last-Event-ID, and ends
+	clips.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		lastId := r.Header.Get("Last-Event-ID")
+		f.lastEventIds = append(f.lastEventIds, lastId)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "retry: 3000\n\n: ping\n\n")
+		for _, event := range f.events {
+			if event.Id <= lastId {
+				continue
+			}
+
+			b, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, b)
+		}
+	}).Methods(http.MethodGet)
+
+	return r
+}
+
+func (f *fakeApi) add(clip model.Clipboard) model.Clipboard {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	clip.Id = fmt.Sprintf("clip-%d", len(f.clips)+1)
+	clip.OwnerId = "yong"
+	clip.CreatedAt = time.Now()
+	f.clips = append(f.clips, clip)
+
+	return clip
+}
+
+func setup(t *testing.T, ttl time.Duration) (*fakeApi, string) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("CLIP_SERVER", "")
+
+	f := &fakeApi{ttl: ttl}
+	srv := httptest.NewServer(f.router())
+	t.Cleanup(srv.Close)
+
+	_, _, err := runClip(t, "secret\n", "-server", srv.URL, "login", "yong")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	return f, srv.URL
+}
+
+func runClip(t *testing.T, stdin string, args ...string) (string, string, error) {
+	t.Helper()
+
+	stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	err := run(context.Background(), args, strings.NewReader(stdin), stdout, stderr)
+
+	return stdout.String(), stderr.String(), err
+}
+
+func TestLogin(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	srv := httptest.NewServer((&fakeApi{ttl: time.Hour}).router())
+	defer srv.Close()
+
+	_, _, err := runClip(t, "wrong\n", "-server", srv.URL, "login", "yong")
+	if err == nil || !strings.Contains(err.Error(), "bad credentials") {
+		t.Fatalf("expected bad credentials, got %v", err)
+	}
+
+	_, _, err = runClip(t, "", "list")
+	if err != errLoggedOut {
+		t.Fatalf("expected errLoggedOut, got %v", err)
+	}
+
+	_, _, err = runClip(t, "secret\n", "-server", srv.URL, "login", "yong")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	path := filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "clip", "config.json")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("expected config file: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected config mode 0600, got %v", info.Mode().Perm())
+	}
+
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conf.Server != srv.URL || conf.AccessToken != "access-1" || conf.RefreshToken != "refresh-1" {
+		t.Fatalf("unexpected config %+v", conf)
+	}
+}
+
+func TestCopyPaste(t *testing.T) {
+	f, _ := setup(t, time.Hour)
+
+	out, _, err := runClip(t, "hello\nworld", "copy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "clip-1\n" {
+		t.Fatalf("expected id of new clipboard, got %q", out)
+	}
+	if f.clips[0].MimeType != model.DefaultMimeType {
+		t.Fatalf("expected sniffed text type, got %s", f.clips[0].MimeType)
+	}
+
+	file := filepath.Join(t.TempDir(), "notes.txt")
+	os.WriteFile(file, []byte("from file"), 0o600)
+	_, _, err = runClip(t, "", "copy", file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.clips[1].Filename != "notes.txt" || f.clips[1].Text != "from file" {
+		t.Fatalf("expected uploaded file, got %+v", f.clips[1])
+	}
+
+	out, _, err = runClip(t, "", "paste")
+	if err != nil || out != "from file" {
+		t.Fatalf("expected latest content, got %q, %v", out, err)
+	}
+
+	out, _, err = runClip(t, "", "paste", "clip-1")
+	if err != nil || out != "hello\nworld" {
+		t.Fatalf("expected clip-1 content, got %q, %v", out, err)
+	}
+
+	out, _, err = runClip(t, "", "list")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "notes.txt") || !strings.Contains(lines[2], "hello") {
+		t.Fatalf("unexpected list:\n%s", out)
+	}
+
+	_, _, err = runClip(t, "", "rm", "clip-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, _, err = runClip(t, "", "paste", "clip-1")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	// Tokens are already expired when they're issued
+	f, _ := setup(t, -time.Minute)
+
+	_, _, err := runClip(t, "", "list")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.refresh != 1 {
+		t.Fatalf("expected 1 refresh, got %d", f.refresh)
+	}
+
+	// The next command uses the refreshed session saved in config
+	_, _, err = runClip(t, "", "list")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.refresh != 2 {
+		t.Fatalf("expected 2 refreshes, got %d", f.refresh)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	f, _ := setup(t, time.Hour)
+	f.events = []model.ClipboardEvent{
+		{Id: "1-0", Type: model.EventCreate, ClipboardId: "clip-1"},
+		{Id: "2-0", Type: model.EventDelete, ClipboardId: "clip-1"},
+	}
+
+	path, _ := configPath()
+	conf, _ := loadConfig(path)
+	c := &client{http: http.DefaultClient, config: conf, configPath: path}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	received := []string{}
+	err := c.watch(ctx, func(event model.ClipboardEvent) error {
+		received = append(received, event.Type+" "+event.ClipboardId)
+		if len(received) == 2 {
+			// Arrives once watch reconnects after the first response ended
+			f.mu.Lock()
+			f.events = append(f.events, model.ClipboardEvent{Id: "3-0", Type: model.EventCreate, ClipboardId: "clip-2"})
+			f.mu.Unlock()
+		}
+		if len(received) == 3 {
+			return errStopWatch
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "create clip-1,delete clip-1,create clip-2"
+	if strings.Join(received, ",") != expected {
+		t.Fatalf("expected %s, got %s", expected, strings.Join(received, ","))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lastEventIds[0] != "" || f.lastEventIds[len(f.lastEventIds)-1] != "2-0" {
+		t.Fatalf("expected watch to resume after 2-0, got %v", f.lastEventIds)
+	}
+}
+
+func TestWatchEmpty(t *testing.T) {
+	f, _ := setup(t, time.Hour)
+
+	path, _ := configPath()
+	conf, _ := loadConfig(path)
+	c := &client{http: http.DefaultClient, config: conf, configPath: path}
+
+	// Responses without events are not retried right away
+	ctx, cancel := context.WithTimeout(context.Background(), watchRetry/2)
+	defer cancel()
+
+	err := c.watch(ctx, func(event model.ClipboardEvent) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.lastEventIds) != 1 {
+		t.Fatalf("expected 1 request before retry, got %d", len(f.lastEventIds))
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	f, _ := setup(t, time.Hour)
+
+	_, _, err := runClip(t, "secret", "copy", "-e")
+	if err == nil || !strings.Contains(err.Error(), "clip key") {
+		t.Fatalf("expected missing key error, got %v", err)
+	}
+
+	_, _, err = runClip(t, "correct horse\n", "key")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, _, err = runClip(t, "top secret", "copy", "-e")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stored := f.clips[0]
+	if stored.Envelope == nil || strings.Contains(stored.Text, "top secret") {
+		t.Fatalf("expected server to only get ciphertext, got %+v", stored)
+	}
+
+	out, _, err := runClip(t, "", "paste")
+	if err != nil || out != "top secret" {
+		t.Fatalf("expected decrypted content, got %q, %v", out, err)
+	}
+
+	out, _, err = runClip(t, "", "list")
+	if err != nil || !strings.Contains(out, "(encrypted)") {
+		t.Fatalf("expected encrypted clipboard in list, got %q, %v", out, err)
+	}
+
+	_, _, err = runClip(t, "wrong horse\n", "key")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, _, err = runClip(t, "", "paste", stored.Id)
+	if !errors.Is(err, e2e.ErrWrongKey) {
+		t.Fatalf("expected e2e.ErrWrongKey, got %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eymyong/drop/model"
+)
+
+// watchRetry is how long watch waits before reconnecting after an error,
+// or after a response that ended without events
+const watchRetry = 3 * time.Second
+
+// watch calls fn with each clipboard event until ctx is done.
+// The server ends the stream when the access token expires,
+// so watch reconnects with a fresh one, resuming after the last event.
+func (c *client) watch(ctx context.Context, fn func(model.ClipboardEvent) error) error {
+	lastId := ""
+	for {
+		received := false
+		err := c.readEvents(ctx, lastId, func(event model.ClipboardEvent) error {
+			lastId = event.Id
+			received = true
+			return fn(event)
+		})
+
+		var apiErr *apiError
+		switch {
+		case ctx.Err() != nil:
+			return nil
+
+		// Unlike server errors, these won't go away by retrying
+		case errors.Is(err, errLoggedOut), errors.As(err, &apiErr) && (apiErr.Status/100 == 4 || apiErr.Status == http.StatusNotImplemented):
+			return err
+
+		case errors.Is(err, errStopWatch):
+			return nil
+		}
+
+		// Servers ending responses right away must not be hammered
+		if err != nil || !received {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(watchRetry):
+			}
+		}
+	}
+}
+
+// errStopWatch is returned by watch callbacks to stop watching without error
+var errStopWatch = errors.New("stop watch")
+
+// readEvents reads one Server-Sent Events response of /clipboards/events,
+// returning nil once the server ends it
+func (c *client) readEvents(ctx context.Context, lastId string, fn func(model.ClipboardEvent) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("/clipboards/events", nil), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastId != "" {
+		req.Header.Set("Last-Event-ID", lastId)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Only data lines matter, as events carry their id and type
+	data := strings.Builder{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" {
+			if s, ok := strings.CutPrefix(line, "data:"); ok {
+				data.WriteString(strings.TrimPrefix(s, " "))
+			}
+
+			continue
+		}
+
+		if data.Len() == 0 {
+			continue
+		}
+
+		var event model.ClipboardEvent
+		err := json.Unmarshal([]byte(data.String()), &event)
+		data.Reset()
+		if err != nil {
+			continue
+		}
+
+		err = fn(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
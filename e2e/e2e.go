@@ -0,0 +1,129 @@
+// Package e2e encrypts clipboard content on clients, with keys derived
+// from a passphrase that the server never sees. The server only stores
+// ciphertext and its model.Envelope.
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+
+	"github.com/eymyong/drop/model"
+)
+
+// Key derivation is done once per device, so it can afford
+// to be slower than password hashing on the server
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	keyLen        = 32
+)
+
+var (
+	ErrWrongKey = errors.New("clipboard was encrypted with another key")
+	ErrDecrypt  = errors.New("failed to decrypt clipboard, it may have been tampered with")
+)
+
+// Key is an AES-256-GCM key
+type Key struct {
+	raw  []byte
+	id   string
+	aead cipher.AEAD
+}
+
+// DeriveKey derives key of passphrase with argon2id. The salt is derived
+// from userId, so that all devices of the user derive the same key.
+func DeriveKey(passphrase string, userId string) (Key, error) {
+	if passphrase == "" || userId == "" {
+		return Key{}, errors.New("empty passphrase or user id")
+	}
+
+	salt := sha256.Sum256([]byte("drop-e2e:" + userId))
+	raw := argon2.IDKey([]byte(passphrase), salt[:], argon2Time, argon2Memory, argon2Threads, keyLen)
+
+	return NewKey(raw)
+}
+
+// NewKey returns key of raw bytes from Key.Bytes
+func NewKey(raw []byte) (Key, error) {
+	if len(raw) != keyLen {
+		return Key{}, fmt.Errorf("key must be %d bytes, got %d", keyLen, len(raw))
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return Key{}, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return Key{}, err
+	}
+
+	// The id is a MAC, so it reveals nothing about the key
+	mac := hmac.New(sha256.New, raw)
+	mac.Write([]byte("drop-e2e key id"))
+
+	return Key{
+		raw:  raw,
+		id:   hex.EncodeToString(mac.Sum(nil)[:8]),
+		aead: aead,
+	}, nil
+}
+
+func (k Key) Bytes() []byte { return k.raw }
+
+// Id is the model.Envelope KeyId of content encrypted with k
+func (k Key) Id() string { return k.id }
+
+// Seal encrypts plaintext with a random nonce. The envelope is authenticated
+// along with the ciphertext, so it can't be swapped either.
+func (k Key) Seal(plaintext []byte) ([]byte, model.Envelope, error) {
+	nonce := make([]byte, model.EnvelopeNonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, model.Envelope{}, err
+	}
+
+	e := model.Envelope{
+		Version: 1,
+		Alg:     model.EnvelopeAlg,
+		KeyId:   k.id,
+		Nonce:   base64.RawStdEncoding.EncodeToString(nonce),
+	}
+
+	return k.aead.Seal(nil, nonce, plaintext, []byte(e.String())), e, nil
+}
+
+// Open decrypts ciphertext sealed by Seal
+func (k Key) Open(ciphertext []byte, e model.Envelope) ([]byte, error) {
+	err := e.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if e.KeyId != k.id {
+		return nil, fmt.Errorf("%w '%s'", ErrWrongKey, e.KeyId)
+	}
+
+	nonce, err := base64.RawStdEncoding.DecodeString(e.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := k.aead.Open(nil, nonce, ciphertext, []byte(e.String()))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return plaintext, nil
+}
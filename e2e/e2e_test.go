@@ -0,0 +1,64 @@
+package e2e
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key, err := DeriveKey("correct horse", "user-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	plaintext := []byte("secret\x00clipboard")
+	ciphertext, envelope, err := key.Seal(plaintext)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = envelope.Validate()
+	if err != nil {
+		t.Fatalf("expected valid envelope, got %v", err)
+	}
+	if bytes.Contains(ciphertext, plaintext) {
+		t.Fatalf("expected ciphertext not to contain plaintext")
+	}
+
+	// Same passphrase and user on another device
+	other, err := DeriveKey("correct horse", "user-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := other.Open(ciphertext, envelope)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("expected plaintext, got %q, %v", got, err)
+	}
+
+	restored, err := NewKey(key.Bytes())
+	if err != nil || restored.Id() != key.Id() {
+		t.Fatalf("expected restored key %s, got %s, %v", key.Id(), restored.Id(), err)
+	}
+
+	wrong, _ := DeriveKey("correct horse", "user-2")
+	_, err = wrong.Open(ciphertext, envelope)
+	if !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+
+	ciphertext[0] ^= 1
+	_, err = key.Open(ciphertext, envelope)
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt for tampered ciphertext, got %v", err)
+	}
+	ciphertext[0] ^= 1
+
+	// The envelope is authenticated too
+	_, swapped, _ := key.Seal(nil)
+	_, err = key.Open(ciphertext, swapped)
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt for swapped envelope, got %v", err)
+	}
+}
@@ -1,12 +1,319 @@
 package model
 
-type Clipboard struct {
-	Id   string
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMimeType is the MIME type of clipboards created without one
+const DefaultMimeType = "text/plain; charset=utf-8"
+
+// Content is clipboard content with its metadata
+type Content struct {
+	// Text is the raw content, which may be binary.
+	// It's empty if the content is kept in a blob store.
 	Text string
+	// MimeType is the media type of the content, e.g. image/png
+	MimeType string
+	// Size is the length of the content in bytes
+	Size int64
+	// Checksum is hex-encoded SHA-256 of the content
+	Checksum string
+	// BlobKey is the blob store key of content too large to be kept in Text
+	BlobKey string `json:"-"`
+	// Envelope is set if Text is end-to-end encrypted
+	Envelope *Envelope `json:",omitempty"`
+	// KeyVersion is the version of the server key that Text is encrypted
+	// with at rest, 0 if Text is stored as it is
+	KeyVersion int `json:"-"`
+	// DataKey is the key of Text at rest, encrypted with key KeyVersion
+	DataKey string `json:"-"`
+}
+
+// NewContent returns content data of mimeType, with its size and checksum.
+// Empty mimeType defaults to DefaultMimeType.
+func NewContent(data string, mimeType string) Content {
+	if mimeType == "" {
+		mimeType = DefaultMimeType
+	}
+
+	return Content{
+		Text:     data,
+		MimeType: mimeType,
+		Size:     int64(len(data)),
+		Checksum: Checksum(data),
+	}
+}
+
+// Normalize returns c with default MIME type, and with Size and Checksum
+// derived from Text. Size and Checksum of blob content, or content encrypted
+// at rest, are kept as they are.
+func (c Content) Normalize() Content {
+	if c.BlobKey == "" && c.KeyVersion == 0 {
+		normalized := NewContent(c.Text, c.MimeType)
+		normalized.Envelope = c.Envelope
+
+		return normalized
+	}
+
+	if c.MimeType == "" {
+		c.MimeType = DefaultMimeType
+	}
+
+	return c
+}
+
+// Checksum returns hex-encoded SHA-256 of data
+func Checksum(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// EnvelopeAlg is the only supported Envelope algorithm,
+// AES-256-GCM with 96-bit nonce
+const EnvelopeAlg = "A256GCM"
+
+// EnvelopeNonceSize is the nonce length in bytes of EnvelopeAlg
+const EnvelopeNonceSize = 12
+
+var ErrEnvelopeFormat = errors.New("bad envelope format")
+
+// Envelope tells clients how to decrypt end-to-end encrypted content.
+// Keys never leave clients, so the server can only check its format.
+type Envelope struct {
+	Version int    `json:"v"`
+	Alg     string `json:"alg"`
+	// KeyId identifies the key, so that clients can tell a wrong key
+	// from tampered content
+	KeyId string `json:"kid"`
+	// Nonce is base64-encoded (standard, unpadded)
+	Nonce string `json:"nonce"`
+}
+
+// Validate checks e is a well-formed version 1 envelope
+func (e Envelope) Validate() error {
+	if e.Version != 1 {
+		return fmt.Errorf("%w: unsupported version %d", ErrEnvelopeFormat, e.Version)
+	}
+
+	if e.Alg != EnvelopeAlg {
+		return fmt.Errorf("%w: unsupported alg '%s'", ErrEnvelopeFormat, e.Alg)
+	}
+
+	if e.KeyId == "" || len(e.KeyId) > 64 || strings.Trim(e.KeyId, "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-_") != "" {
+		return fmt.Errorf("%w: bad kid '%s'", ErrEnvelopeFormat, e.KeyId)
+	}
+
+	nonce, err := base64.RawStdEncoding.DecodeString(e.Nonce)
+	if err != nil || len(nonce) != EnvelopeNonceSize {
+		return fmt.Errorf("%w: nonce must be %d bytes of base64", ErrEnvelopeFormat, EnvelopeNonceSize)
+	}
+
+	return nil
+}
+
+// String formats e as HTTP header value, e.g.
+// v=1; alg=A256GCM; kid=1f2e3d4c5b6a7988; nonce=AAECAwQFBgcICQoL
+func (e Envelope) String() string {
+	return fmt.Sprintf("v=%d; alg=%s; kid=%s; nonce=%s", e.Version, e.Alg, e.KeyId, e.Nonce)
+}
+
+// ParseEnvelope parses and validates envelope formatted by Envelope.String
+func ParseEnvelope(s string) (Envelope, error) {
+	var e Envelope
+	for _, param := range strings.Split(s, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			return Envelope{}, fmt.Errorf("%w: bad param '%s'", ErrEnvelopeFormat, param)
+		}
+
+		switch k {
+		case "v":
+			version, err := strconv.Atoi(v)
+			if err != nil {
+				return Envelope{}, fmt.Errorf("%w: bad version '%s'", ErrEnvelopeFormat, v)
+			}
+			e.Version = version
+
+		case "alg":
+			e.Alg = v
+		case "kid":
+			e.KeyId = v
+		case "nonce":
+			e.Nonce = v
+		}
+	}
+
+	err := e.Validate()
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return e, nil
+}
+
+type Clipboard struct {
+	Id string
+	Content
+	// Filename is the name of the uploaded file, empty for non-file clipboards
+	Filename  string
+	OwnerId   string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// ExpiresAt is when the clipboard is deleted, zero means never
+	ExpiresAt time.Time
+	// BurnAfterRead clipboards are deleted when first read by id
+	BurnAfterRead bool
+	// DeviceId is the device the clipboard was created from,
+	// empty if it's from a session without a registered device
+	DeviceId string
+}
+
+// Types of ClipboardEvent
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// ClipboardEvent is a change to a clipboard, pushed to devices of its owner.
+// It does not carry content, which clients fetch by id.
+type ClipboardEvent struct {
+	// Id increases with each event of the owner, and is empty
+	// for events not yet stored
+	Id          string    `json:"id,omitempty"`
+	Type        string    `json:"type"`
+	ClipboardId string    `json:"clipboard_id"`
+	OwnerId     string    `json:"owner_id"`
+	Time        time.Time `json:"time"`
+}
+
+// Usage is the storage used by clipboards of a user
+type Usage struct {
+	Clips int64 `json:"clips"`
+	Bytes int64 `json:"bytes"`
 }
 
 type User struct {
 	Id       string `json:"id"`
 	Username string `json:"username"`
-	Password string `json:"password"`
+	Password string `json:"-"`
+}
+
+type Session struct {
+	Id          string    `json:"id"`
+	UserId      string    `json:"user_id"`
+	RefreshHash string    `json:"-"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	// DeviceId is the registered device of the session, if any.
+	// Sessions of a revoked device are no longer valid.
+	DeviceId string `json:"device_id,omitempty"`
+}
+
+// Device is a registered device of a user
+type Device struct {
+	Id     string `json:"id"`
+	UserId string `json:"user_id"`
+	Name   string `json:"name"`
+	// Platform is free-form, e.g. linux, android
+	Platform   string    `json:"platform"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// Share is a public link to a clipboard, for people without an account
+type Share struct {
+	// Token is the random, unguessable part of the link
+	Token        string    `json:"token"`
+	ClipboardId  string    `json:"clipboard_id"`
+	OwnerId      string    `json:"owner_id"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	// ExpiresAt is when the share is deleted, zero means never
+	ExpiresAt time.Time `json:"expires_at"`
+	// MaxViews is the number of times the share can be viewed, 0 is unlimited.
+	// ViewsLeft counts down from MaxViews, and the share is deleted at 0.
+	MaxViews  int `json:"max_views"`
+	ViewsLeft int `json:"views_left"`
+	// FailedAttempts counts password attempts since the last view,
+	// and LockedUntil is when the next attempt is allowed
+	FailedAttempts int       `json:"-"`
+	LockedUntil    time.Time `json:"-"`
+}
+
+const (
+	// ShareFreeAttempts is the number of password attempts of a share
+	// allowed before each attempt locks it out
+	ShareFreeAttempts = 5
+	// ShareMaxLockout caps lockouts of shares
+	ShareMaxLockout = time.Hour
+)
+
+// ShareLockout returns how long a share is locked out after its failed-th
+// password attempt: none for the first ShareFreeAttempts, then a second,
+// doubling with each attempt up to ShareMaxLockout
+func ShareLockout(failed int) time.Duration {
+	over := failed - ShareFreeAttempts
+	if over <= 0 {
+		return 0
+	}
+
+	if over > 12 {
+		return ShareMaxLockout
+	}
+
+	return min(time.Second<<(over-1), ShareMaxLockout)
+}
+
+// HasPassword reports whether viewers must give a password
+func (s Share) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+// Roles of space members, from most to least privileged
+const (
+	// RoleOwner manages members, and is the only role that can't be removed
+	RoleOwner = "owner"
+	// RoleWriter creates, updates and deletes clipboards of the space
+	RoleWriter = "writer"
+	// RoleReader only reads clipboards of the space
+	RoleReader = "reader"
+)
+
+var roleRanks = map[string]int{
+	RoleReader: 1,
+	RoleWriter: 2,
+	RoleOwner:  3,
+}
+
+// ValidRole reports whether role is one of the roles above
+func ValidRole(role string) bool {
+	return roleRanks[role] != 0
+}
+
+// RoleCan reports whether role has at least the privileges of need
+func RoleCan(role string, need string) bool {
+	return ValidRole(role) && roleRanks[role] >= roleRanks[need]
+}
+
+// Space is a clipboard shared by its members. Clipboards of a space are
+// owned by the space, i.e. their OwnerId is the space id. A user's personal
+// space is identified by the user id, and has no Space record.
+type Space struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	OwnerId   string    `json:"owner_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Member struct {
+	SpaceId string `json:"space_id"`
+	UserId  string `json:"user_id"`
+	Role    string `json:"role"`
 }
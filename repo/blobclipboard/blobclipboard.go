@@ -0,0 +1,332 @@
+package blobclipboard
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+// RepoBlobClipboard wraps a RepositoryClipboard, keeping content larger
+// than threshold in a BlobStore, and only its metadata in the wrapped
+// repository. Each content gets its own blob, keyed by clipboard id
+// and a random suffix.
+//
+// Content of blob clipboards returned by the repository is empty,
+// and must be read with Open. Blobs of burn-after-read clipboards are
+// deleted once they are read with Open, as the clipboards are already
+// deleted by GetById and GetByIdAndOwner.
+//
+// Blobs of expired clipboards are removed from the store by DeleteExpired.
+type RepoBlobClipboard struct {
+	repo.RepositoryClipboard
+	store     repo.BlobStore
+	threshold int64
+}
+
+// New returns a streaming clipboard repository on top of clipboards.
+// With nil store, all content is kept in clipboards.
+func New(clipboards repo.RepositoryClipboard, store repo.BlobStore, threshold int64) repo.RepositoryClipboardStream {
+	return &RepoBlobClipboard{
+		RepositoryClipboard: clipboards,
+		store:               store,
+		threshold:           threshold,
+	}
+}
+
+func (r *RepoBlobClipboard) offload(size int64) bool {
+	return r.store != nil && size > r.threshold
+}
+
+func (r *RepoBlobClipboard) Create(ctx context.Context, clip model.Clipboard) error {
+	if clip.BlobKey != "" || !r.offload(int64(len(clip.Text))) {
+		return r.RepositoryClipboard.Create(ctx, clip)
+	}
+
+	_, err := r.CreateFrom(ctx, clip, strings.NewReader(clip.Text))
+	return err
+}
+
+func (r *RepoBlobClipboard) CreateFrom(ctx context.Context, clip model.Clipboard, src io.Reader) (model.Clipboard, error) {
+	if clip.Id == "" {
+		return model.Clipboard{}, fmt.Errorf("empty clipboard id: %w", repo.ErrInvalid)
+	}
+
+	content, err := r.write(ctx, clip.Id, clip.Content, src)
+	if err != nil {
+		return model.Clipboard{}, err
+	}
+
+	clip.Content = content
+	err = r.RepositoryClipboard.Create(ctx, clip)
+	if err != nil {
+		r.deleteBlob(ctx, content.BlobKey)
+		return model.Clipboard{}, err
+	}
+
+	return clip, nil
+}
+
+// write reads content of clipboard id from src, and returns it with
+// MimeType and Envelope of content. Content larger than threshold is put
+// in a new blob, which is never referenced by any clipboard yet.
+func (r *RepoBlobClipboard) write(ctx context.Context, id string, content model.Content, src io.Reader) (model.Content, error) {
+	// Only content larger than threshold is streamed to the blob store,
+	// and we can only tell after reading threshold+1 bytes
+	limit := src
+	if r.store != nil {
+		limit = io.LimitReader(src, r.threshold+1)
+	}
+
+	head, err := io.ReadAll(limit)
+	if err != nil {
+		return model.Content{}, fmt.Errorf("read clipboard content err: %w", err)
+	}
+
+	if !r.offload(int64(len(head))) {
+		return model.Content{
+			Text:     string(head),
+			MimeType: content.MimeType,
+			Envelope: content.Envelope,
+		}.Normalize(), nil
+	}
+
+	key, err := newBlobKey(id)
+	if err != nil {
+		return model.Content{}, err
+	}
+
+	h := sha256.New()
+	n, err := r.store.Put(ctx, key, io.TeeReader(io.MultiReader(bytes.NewReader(head), src), h))
+	if err != nil {
+		r.store.Delete(ctx, key)
+		return model.Content{}, fmt.Errorf("put blob err: %w", err)
+	}
+
+	return model.Content{
+		MimeType: content.MimeType,
+		Size:     n,
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+		BlobKey:  key,
+		Envelope: content.Envelope,
+	}.Normalize(), nil
+}
+
+// newBlobKey returns a random blob key of clipboard id, so that new content
+// never overwrites the blob its clipboard still points to
+func newBlobKey(id string) (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("random blob key err: %w", err)
+	}
+
+	return id + "." + hex.EncodeToString(b), nil
+}
+
+// deleteBlob deletes blob key, if any
+func (r *RepoBlobClipboard) deleteBlob(ctx context.Context, key string) error {
+	if key == "" || r.store == nil {
+		return nil
+	}
+
+	return r.store.Delete(ctx, key)
+}
+
+func (r *RepoBlobClipboard) Open(ctx context.Context, clip model.Clipboard) (io.ReadCloser, error) {
+	if clip.BlobKey == "" {
+		return io.NopCloser(strings.NewReader(clip.Text)), nil
+	}
+
+	if r.store == nil {
+		return nil, fmt.Errorf("no blob store for blob '%s': %w", clip.BlobKey, repo.ErrNotFound)
+	}
+
+	rc, err := r.store.Get(ctx, clip.BlobKey)
+	if err != nil || !clip.BurnAfterRead {
+		return rc, err
+	}
+
+	// Burn-after-read clipboards are only opened once they are burnt,
+	// and their blob goes too once it's read, even if the request is gone
+	return burntBlob{
+		ReadCloser: rc,
+		del: func() error {
+			return r.store.Delete(context.WithoutCancel(ctx), clip.BlobKey)
+		},
+	}, nil
+}
+
+// burntBlob deletes its blob once it's closed
+type burntBlob struct {
+	io.ReadCloser
+	del func() error
+}
+
+func (b burntBlob) Close() error {
+	err := b.ReadCloser.Close()
+	errDelete := b.del()
+	if err != nil {
+		return err
+	}
+
+	return errDelete
+}
+
+func (r *RepoBlobClipboard) Update(ctx context.Context, id string, content model.Content) error {
+	content = content.Normalize()
+	_, err := r.update(ctx, id, content, strings.NewReader(content.Text), func(content model.Content) error {
+		return r.RepositoryClipboard.Update(ctx, id, content)
+	})
+
+	return err
+}
+
+func (r *RepoBlobClipboard) UpdateByIdAndOwner(ctx context.Context, id string, ownerId string, content model.Content) error {
+	content = content.Normalize()
+	_, err := r.UpdateFrom(ctx, id, ownerId, content, strings.NewReader(content.Text))
+
+	return err
+}
+
+func (r *RepoBlobClipboard) UpdateFrom(ctx context.Context, id string, ownerId string, content model.Content, src io.Reader) (model.Content, error) {
+	return r.update(ctx, id, content, src, func(content model.Content) error {
+		return r.RepositoryClipboard.UpdateByIdAndOwner(ctx, id, ownerId, content)
+	})
+}
+
+// update writes content read from src to a new blob if it's large,
+// then points clipboard id to it with updateFn, and only then deletes
+// the old blob. Readers never see metadata of a blob that is not there yet,
+// and a failed update, e.g. of the owner check, leaves the clipboard as it was.
+func (r *RepoBlobClipboard) update(ctx context.Context, id string, content model.Content, src io.Reader, updateFn func(model.Content) error) (model.Content, error) {
+	old := ""
+	if r.store != nil {
+		var err error
+		old, err = r.RepositoryClipboard.GetBlobKey(ctx, id)
+		if err != nil {
+			return model.Content{}, err
+		}
+	}
+
+	content, err := r.write(ctx, id, content, src)
+	if err != nil {
+		return model.Content{}, err
+	}
+
+	err = updateFn(content)
+	if err != nil {
+		r.deleteBlob(ctx, content.BlobKey)
+		return model.Content{}, err
+	}
+
+	err = r.deleteBlob(ctx, old)
+	if err != nil {
+		return model.Content{}, err
+	}
+
+	return content, nil
+}
+
+func (r *RepoBlobClipboard) Delete(ctx context.Context, id string) error {
+	return r.delete(ctx, id, func() error {
+		return r.RepositoryClipboard.Delete(ctx, id)
+	})
+}
+
+func (r *RepoBlobClipboard) DeleteByIdAndOwner(ctx context.Context, id string, ownerId string) error {
+	return r.delete(ctx, id, func() error {
+		return r.RepositoryClipboard.DeleteByIdAndOwner(ctx, id, ownerId)
+	})
+}
+
+// delete deletes clipboard id with deleteFn, and then its blob
+func (r *RepoBlobClipboard) delete(ctx context.Context, id string, deleteFn func() error) error {
+	key := ""
+	if r.store != nil {
+		var err error
+		key, err = r.RepositoryClipboard.GetBlobKey(ctx, id)
+		if err != nil && !errors.Is(err, repo.ErrNotFound) {
+			return err
+		}
+	}
+
+	err := deleteFn()
+	if err != nil {
+		return err
+	}
+
+	return r.deleteBlob(ctx, key)
+}
+
+// orphanGrace is how old a blob must be before DeleteExpired removes it
+// for not being referenced, so that blobs written just before their
+// clipboard is created are not removed
+const orphanGrace = 10 * time.Minute
+
+// DeleteExpired also deletes blobs no longer referenced by any clipboard,
+// which covers blobs of clipboards that expired in the wrapped repository,
+// and blobs left behind by failed writes and updates.
+//
+// Blobs are checked against the blob key of the clipboard in their own key,
+// so clipboards are not read, let alone decrypted. A blob that can't be
+// checked is logged and kept, to be checked again next time.
+func (r *RepoBlobClipboard) DeleteExpired(ctx context.Context) (int, error) {
+	deleted, err := r.RepositoryClipboard.DeleteExpired(ctx)
+	if err != nil || r.store == nil {
+		return deleted, err
+	}
+
+	keys, err := r.store.Keys(ctx, time.Now().Add(-orphanGrace))
+	if err != nil {
+		return deleted, err
+	}
+
+	for _, key := range keys {
+		orphan, err := r.orphan(ctx, key)
+		if err != nil {
+			log.Printf("failed to check blob '%s': %v", key, err)
+			continue
+		}
+
+		if !orphan {
+			continue
+		}
+
+		err = r.store.Delete(ctx, key)
+		if err != nil {
+			log.Printf("failed to delete orphan blob '%s': %v", key, err)
+		}
+	}
+
+	return deleted, nil
+}
+
+// orphan returns whether blob key is not referenced by its clipboard,
+// whose id is the key up to the random suffix added by newBlobKey
+func (r *RepoBlobClipboard) orphan(ctx context.Context, key string) (bool, error) {
+	i := strings.LastIndex(key, ".")
+	if i <= 0 {
+		return true, nil
+	}
+
+	current, err := r.RepositoryClipboard.GetBlobKey(ctx, key[:i])
+	if errors.Is(err, repo.ErrNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return current != key, nil
+}
@@ -0,0 +1,313 @@
+package blobclipboard
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+	"github.com/eymyong/drop/repo/fsblob"
+	"github.com/eymyong/drop/repo/memory"
+	"github.com/eymyong/drop/repo/repotest"
+)
+
+const threshold = 8
+
+func newTest(t *testing.T) (repo.RepositoryClipboardStream, repo.BlobStore) {
+	store, err := fsblob.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return New(memory.NewClipboard(), store, threshold), store
+}
+
+// The conformance suite expects content in Text, so nothing is offloaded here
+func TestConformance(t *testing.T) {
+	repotest.TestClipboard(t, func(t *testing.T) repo.RepositoryClipboard {
+		store, err := fsblob.New(t.TempDir())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return New(memory.NewClipboard(), store, 1<<20)
+	})
+}
+
+func TestBlob(t *testing.T) {
+	ctx := context.Background()
+	r, store := newTest(t)
+
+	small := "small"
+	large := strings.Repeat("large", 10)
+
+	clip, err := r.CreateFrom(ctx, model.Clipboard{Id: "small", OwnerId: "yong"}, strings.NewReader(small))
+	mustNil(t, err)
+	if clip.BlobKey != "" || clip.Text != small {
+		t.Fatalf("expected small content to be kept in repo: %+v", clip)
+	}
+
+	clip, err = r.CreateFrom(ctx, model.Clipboard{Id: "large", OwnerId: "yong"}, strings.NewReader(large))
+	mustNil(t, err)
+	expectBlob(t, r, clip, large)
+
+	got, err := r.GetByIdAndOwner(ctx, "large", "yong")
+	mustNil(t, err)
+	if got.Text != "" {
+		t.Fatalf("expected no text for blob clipboard: %+v", got)
+	}
+	expectBlob(t, r, got, large)
+
+	// Create with large Text is offloaded too
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "large-2", Content: model.Content{Text: large}, OwnerId: "yong"}))
+	got, err = r.GetById(ctx, "large-2")
+	mustNil(t, err)
+	expectBlob(t, r, got, large)
+
+	// Other users can't overwrite the blob
+	err = r.UpdateByIdAndOwner(ctx, "large", "other", model.NewContent(strings.Repeat("x", 20), ""))
+	if !errors.Is(err, repo.ErrNotFound) {
+		t.Fatalf("expected repo.ErrNotFound, got %v", err)
+	}
+	expectBlob(t, r, clip, large)
+	expectKeys(t, store, clip.BlobKey, got.BlobKey)
+
+	// New content gets a new blob, and the old one is deleted
+	larger := large + large
+	mustNil(t, r.UpdateByIdAndOwner(ctx, "large", "yong", model.NewContent(larger, "")))
+	updated, err := r.GetById(ctx, "large")
+	mustNil(t, err)
+	expectBlob(t, r, updated, larger)
+	if updated.BlobKey == clip.BlobKey {
+		t.Fatalf("expected new blob key, got '%s'", updated.BlobKey)
+	}
+	expectNoBlob(t, store, clip.BlobKey)
+
+	// Shrinking content moves it back into repo
+	mustNil(t, r.Update(ctx, "large", model.NewContent(small, "")))
+	got2, err := r.GetById(ctx, "large")
+	mustNil(t, err)
+	if got2.BlobKey != "" || got2.Text != small {
+		t.Fatalf("expected small content to be kept in repo: %+v", got2)
+	}
+	expectNoBlob(t, store, updated.BlobKey)
+
+	mustNil(t, r.DeleteByIdAndOwner(ctx, "large-2", "yong"))
+	expectNoBlob(t, store, got.BlobKey)
+
+	// Burn-after-read blobs are streamed, and deleted once they are read
+	clip, err = r.CreateFrom(ctx, model.Clipboard{Id: "burn", OwnerId: "yong", BurnAfterRead: true}, strings.NewReader(large))
+	mustNil(t, err)
+
+	got, err = r.GetByIdAndOwner(ctx, "burn", "yong")
+	mustNil(t, err)
+	if got.Text != "" || got.BlobKey != clip.BlobKey || got.Checksum != model.Checksum(large) {
+		t.Fatalf("unexpected burnt clipboard: %+v", got)
+	}
+
+	_, err = r.GetByIdAndOwner(ctx, "burn", "yong")
+	if !errors.Is(err, repo.ErrNotFound) {
+		t.Fatalf("expected second read to be not found, got %v", err)
+	}
+
+	expectBlob(t, r, got, large)
+	expectNoBlob(t, store, clip.BlobKey)
+	expectKeys(t, store)
+}
+
+// failReader fails after reading its content
+type failReader struct {
+	r io.Reader
+}
+
+func (f failReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+
+	return n, err
+}
+
+func TestUpdateFrom(t *testing.T) {
+	ctx := context.Background()
+	r, store := newTest(t)
+
+	large := strings.Repeat("large", 10)
+	clip, err := r.CreateFrom(ctx, model.Clipboard{Id: "large", OwnerId: "yong"}, strings.NewReader(large))
+	mustNil(t, err)
+
+	// A failed upload leaves the clipboard and its blob as they were
+	_, err = r.UpdateFrom(ctx, "large", "yong", model.Content{}, failReader{strings.NewReader(large + large)})
+	if err == nil {
+		t.Fatal("expected error from failed upload")
+	}
+
+	got, err := r.GetById(ctx, "large")
+	mustNil(t, err)
+	if got.BlobKey != clip.BlobKey {
+		t.Fatalf("expected blob key '%s', got '%s'", clip.BlobKey, got.BlobKey)
+	}
+	expectBlob(t, r, got, large)
+	expectKeys(t, store, clip.BlobKey)
+
+	_, err = r.UpdateFrom(ctx, "missing", "yong", model.Content{}, strings.NewReader(large))
+	if !errors.Is(err, repo.ErrNotFound) {
+		t.Fatalf("expected repo.ErrNotFound, got %v", err)
+	}
+
+	larger := large + large
+	content, err := r.UpdateFrom(ctx, "large", "yong", model.Content{MimeType: "image/png"}, strings.NewReader(larger))
+	mustNil(t, err)
+	if content.MimeType != "image/png" {
+		t.Fatalf("unexpected content: %+v", content)
+	}
+
+	got, err = r.GetById(ctx, "large")
+	mustNil(t, err)
+	if got.Content != content {
+		t.Fatalf("expected content %+v, got %+v", content, got.Content)
+	}
+	expectBlob(t, r, got, larger)
+	expectKeys(t, store, content.BlobKey)
+
+	content, err = r.UpdateFrom(ctx, "large", "yong", model.Content{}, strings.NewReader("small"))
+	mustNil(t, err)
+	if content.BlobKey != "" || content.Text != "small" {
+		t.Fatalf("expected small content to be kept in repo: %+v", content)
+	}
+	expectKeys(t, store)
+}
+
+func TestDeleteExpired(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := fsblob.New(dir)
+	mustNil(t, err)
+
+	r := New(brokenClipboard{memory.NewClipboard()}, store, threshold)
+
+	large := strings.Repeat("large", 10)
+	expired, err := r.CreateFrom(ctx, model.Clipboard{Id: "expired", OwnerId: "yong", ExpiresAt: time.Now().Add(-time.Second)}, strings.NewReader(large))
+	mustNil(t, err)
+	alive, err := r.CreateFrom(ctx, model.Clipboard{Id: "alive", OwnerId: "yong"}, strings.NewReader(large))
+	mustNil(t, err)
+
+	// Written a while ago, and referenced by nothing
+	orphans := []string{"orphan", "missing.0123456789abcdef", "alive.0123456789abcdef"}
+	for _, key := range append(orphans, "broken.0123456789abcdef") {
+		_, err = store.Put(ctx, key, strings.NewReader(large))
+		mustNil(t, err)
+	}
+
+	old := time.Now().Add(-2 * orphanGrace)
+	for _, key := range append([]string{expired.BlobKey, alive.BlobKey, "broken.0123456789abcdef"}, orphans...) {
+		mustNil(t, os.Chtimes(filepath.Join(dir, key), old, old))
+	}
+
+	// Fresh blobs of clipboards yet to be created are kept
+	_, err = store.Put(ctx, "fresh", strings.NewReader(large))
+	mustNil(t, err)
+
+	deleted, err := r.DeleteExpired(ctx)
+	mustNil(t, err)
+	if deleted != 1 {
+		t.Fatalf("expected 1 clipboard deleted, got %d", deleted)
+	}
+
+	expectNoBlob(t, store, expired.BlobKey)
+	for _, key := range orphans {
+		expectNoBlob(t, store, key)
+	}
+
+	// Blobs that can't be checked are kept
+	expectKeys(t, store, alive.BlobKey, "broken.0123456789abcdef", "fresh")
+}
+
+// brokenClipboard fails to get blob key of clipboard "broken",
+// e.g. like a backend that is down
+type brokenClipboard struct {
+	repo.RepositoryClipboard
+}
+
+func (r brokenClipboard) GetBlobKey(ctx context.Context, id string) (string, error) {
+	if id == "broken" {
+		return "", errors.New("backend is down")
+	}
+
+	return r.RepositoryClipboard.GetBlobKey(ctx, id)
+}
+
+func TestNoStore(t *testing.T) {
+	ctx := context.Background()
+	r := New(memory.NewClipboard(), nil, threshold)
+
+	large := strings.Repeat("large", 10)
+	clip, err := r.CreateFrom(ctx, model.Clipboard{Id: "large", OwnerId: "yong"}, strings.NewReader(large))
+	mustNil(t, err)
+	if clip.BlobKey != "" || clip.Text != large {
+		t.Fatalf("expected content to be kept in repo: %+v", clip)
+	}
+
+	mustNil(t, r.Update(ctx, "large", model.NewContent(large+large, "")))
+	mustNil(t, r.Delete(ctx, "large"))
+}
+
+func expectBlob(t *testing.T, r repo.RepositoryClipboardStream, clip model.Clipboard, content string) {
+	t.Helper()
+
+	if clip.BlobKey == "" {
+		t.Fatalf("expected blob clipboard: %+v", clip)
+	}
+	if clip.Size != int64(len(content)) || clip.Checksum != model.Checksum(content) {
+		t.Fatalf("unexpected blob metadata: %+v", clip)
+	}
+
+	rc, err := r.Open(context.Background(), clip)
+	mustNil(t, err)
+	defer rc.Close()
+
+	b, err := io.ReadAll(rc)
+	mustNil(t, err)
+	if string(b) != content {
+		t.Fatalf("expected blob %q, got %q", content, b)
+	}
+}
+
+func expectNoBlob(t *testing.T, store repo.BlobStore, key string) {
+	t.Helper()
+
+	_, err := store.Get(context.Background(), key)
+	if !errors.Is(err, repo.ErrNotFound) {
+		t.Fatalf("expected blob '%s' to be deleted, got %v", key, err)
+	}
+}
+
+// expectKeys expects exactly keys in store
+func expectKeys(t *testing.T, store repo.BlobStore, keys ...string) {
+	t.Helper()
+
+	got, err := store.Keys(context.Background(), time.Now().Add(time.Hour))
+	mustNil(t, err)
+
+	sort.Strings(got)
+	sort.Strings(keys)
+	if strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("expected blobs %v, got %v", keys, got)
+	}
+}
+
+func mustNil(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
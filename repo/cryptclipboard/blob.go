@@ -0,0 +1,333 @@
+package cryptclipboard
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/eymyong/drop/repo"
+)
+
+const (
+	// blobMagic starts every sealed blob. Blobs without it were written
+	// before encryption was enabled, and are read as they are.
+	blobMagic = "DROPBLB1"
+	// blobChunk is the size of plaintext chunks sealed separately,
+	// so that blobs are encrypted and decrypted as streams
+	blobChunk = 64 << 10
+	// blobNoncePrefix is the random part of chunk nonces,
+	// followed by 4 bytes of chunk counter
+	blobNoncePrefix = 8
+)
+
+var errBlobCorrupt = errors.New("corrupt sealed blob")
+
+// RepoCryptBlob wraps a BlobStore, encrypting blobs at rest like RepoCryptClipboard
+// does clipboard text: each blob is encrypted with its own random data key,
+// which is itself encrypted with the current key of the key ring.
+//
+// A sealed blob is blobMagic, followed by the key version (uint32) and
+// the wrapped data key (uint16 length and bytes), the nonce prefix, and
+// then the content in AES-256-GCM sealed chunks of blobChunk bytes.
+// The last chunk is authenticated as such, and may be empty,
+// so truncated blobs fail to decrypt.
+type RepoCryptBlob struct {
+	repo.BlobStore
+	keys *KeyRing
+}
+
+func NewBlobStore(store repo.BlobStore, keys *KeyRing) repo.BlobStore {
+	return &RepoCryptBlob{
+		BlobStore: store,
+		keys:      keys,
+	}
+}
+
+// Put returns the number of plaintext bytes read from src
+func (r *RepoCryptBlob) Put(ctx context.Context, key string, src io.Reader) (int64, error) {
+	sealer, err := newBlobSealer(r.keys, src)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = r.BlobStore.Put(ctx, key, sealer)
+	if err != nil {
+		return 0, err
+	}
+
+	return sealer.n, nil
+}
+
+func (r *RepoCryptBlob) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, err := r.BlobStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	opener, _, err := openBlob(r.keys, rc)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("blob '%s': %w", key, err)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{opener, rc}, nil
+}
+
+// ReencryptBlobs moves all blobs of store, the wrapped blob store,
+// to the current key of keys, by writing them again. Unlike Reencrypt,
+// it also encrypts the blob content, not only its data key.
+//
+// A blob deleted while it's being written again is left behind,
+// to be removed by blobclipboard as an unreferenced blob.
+// It returns the number of blobs moved.
+func ReencryptBlobs(ctx context.Context, store repo.BlobStore, keys *KeyRing) (int, error) {
+	blobKeys, err := store.Keys(ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	sealed := NewBlobStore(store, keys)
+	moved := 0
+	for _, key := range blobKeys {
+		ok, err := reencryptBlob(ctx, store, sealed, keys, key)
+		if errors.Is(err, repo.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return moved, fmt.Errorf("blob '%s': %w", key, err)
+		}
+
+		if ok {
+			moved++
+		}
+	}
+
+	return moved, nil
+}
+
+func reencryptBlob(ctx context.Context, store repo.BlobStore, sealed repo.BlobStore, keys *KeyRing, key string) (bool, error) {
+	rc, err := store.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	opener, version, err := openBlob(keys, rc)
+	if err != nil {
+		return false, err
+	}
+
+	if version == keys.Current() {
+		return false, nil
+	}
+
+	_, err = sealed.Put(ctx, key, opener)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// blobSealer reads plaintext from src, and sealed blob from Read
+type blobSealer struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte
+	// out is sealed content not yet read
+	out  bytes.Buffer
+	done bool
+	// n is the number of plaintext bytes read from src
+	n int64
+}
+
+func newBlobSealer(keys *KeyRing, src io.Reader) (*blobSealer, error) {
+	dataKey := make([]byte, keyLen)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := wrap(keys, keys.Current(), dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newBlobAead(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, blobNoncePrefix)
+	_, err = rand.Read(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &blobSealer{
+		src:    src,
+		aead:   aead,
+		prefix: prefix,
+		chunk:  make([]byte, blobChunk),
+	}
+
+	s.out.WriteString(blobMagic)
+	binary.Write(&s.out, binary.BigEndian, uint32(keys.Current()))
+	binary.Write(&s.out, binary.BigEndian, uint16(len(wrapped)))
+	s.out.WriteString(wrapped)
+	s.out.Write(prefix)
+
+	return s, nil
+}
+
+func (s *blobSealer) Read(p []byte) (int, error) {
+	for s.out.Len() == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(s.src, s.chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		// Only a short chunk, or an empty one after full chunks, is the last
+		last := n < blobChunk
+		s.out.Write(s.aead.Seal(nil, blobNonce(s.prefix, s.counter), s.chunk[:n], blobAd(last)))
+		s.counter++
+		s.n += int64(n)
+		s.done = last
+	}
+
+	return s.out.Read(p)
+}
+
+// openBlob reads header of sealed blob from src, and returns reader of
+// its plaintext and its key version. Blobs that are not sealed are
+// returned as they are, with key version 0.
+func openBlob(keys *KeyRing, src io.Reader) (io.Reader, int, error) {
+	magic := make([]byte, len(blobMagic))
+	n, err := io.ReadFull(src, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, 0, err
+	}
+
+	if string(magic[:n]) != blobMagic {
+		return io.MultiReader(bytes.NewReader(magic[:n]), src), 0, nil
+	}
+
+	var header struct {
+		Version    uint32
+		WrappedLen uint16
+	}
+	err = binary.Read(src, binary.BigEndian, &header)
+	if err != nil {
+		return nil, 0, errBlobCorrupt
+	}
+
+	wrapped := make([]byte, header.WrappedLen)
+	prefix := make([]byte, blobNoncePrefix)
+	_, err = io.ReadFull(src, wrapped)
+	if err == nil {
+		_, err = io.ReadFull(src, prefix)
+	}
+	if err != nil {
+		return nil, 0, errBlobCorrupt
+	}
+
+	version := int(header.Version)
+	dataKey, err := unwrap(keys, version, string(wrapped))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	aead, err := newBlobAead(dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &blobOpener{
+		src:    src,
+		aead:   aead,
+		prefix: prefix,
+		chunk:  make([]byte, blobChunk+aead.Overhead()),
+	}, version, nil
+}
+
+// blobOpener reads sealed chunks from src, and plaintext from Read
+type blobOpener struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte
+	// out is plaintext not yet read
+	out  []byte
+	done bool
+}
+
+func (o *blobOpener) Read(p []byte) (int, error) {
+	for len(o.out) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(o.src, o.chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		last := n < len(o.chunk)
+		plaintext, err := o.aead.Open(o.chunk[:0], blobNonce(o.prefix, o.counter), o.chunk[:n], blobAd(last))
+		if err != nil {
+			return 0, errBlobCorrupt
+		}
+
+		o.out = plaintext
+		o.counter++
+		o.done = last
+	}
+
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+
+	return n, nil
+}
+
+func newBlobAead(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func blobNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, len(prefix)+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], counter)
+
+	return nonce
+}
+
+// blobAd is additional data of chunks, telling the last chunk apart
+func blobAd(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
@@ -0,0 +1,228 @@
+package cryptclipboard
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+	"github.com/eymyong/drop/repo/blobclipboard"
+	"github.com/eymyong/drop/repo/fsblob"
+	"github.com/eymyong/drop/repo/memory"
+)
+
+func testFsBlob(t *testing.T) (repo.BlobStore, string) {
+	dir := t.TempDir()
+	store, err := fsblob.New(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return store, dir
+}
+
+func readBlob(t *testing.T, store repo.BlobStore, key string) (string, error) {
+	rc, err := store.Get(context.Background(), key)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	b, err := io.ReadAll(rc)
+	return string(b), err
+}
+
+func TestBlobStore(t *testing.T) {
+	ctx := context.Background()
+	inner, dir := testFsBlob(t)
+	store := NewBlobStore(inner, testRing(t, 1))
+
+	secret := strings.Repeat("secret blob ", 100)
+	for _, data := range []string{
+		"",
+		secret,
+		strings.Repeat("x", blobChunk),
+		strings.Repeat("y", 3*blobChunk+7),
+	} {
+		n, err := store.Put(ctx, "blob", strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n != int64(len(data)) {
+			t.Fatalf("expected %d bytes written, got %d", len(data), n)
+		}
+
+		got, err := readBlob(t, store, "blob")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != data {
+			t.Fatalf("expected %d bytes read back, got %d", len(data), len(got))
+		}
+	}
+
+	_, err := store.Put(ctx, "secret", strings.NewReader(secret))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(dir, "secret"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Contains(raw, []byte("secret")) || !bytes.HasPrefix(raw, []byte(blobMagic)) {
+		t.Fatal("expected blob file to be sealed")
+	}
+
+	// Another key ring can't read it
+	_, err = readBlob(t, NewBlobStore(inner, testRing(t, 2)), "secret")
+	if err == nil {
+		t.Fatal("expected error reading without key")
+	}
+
+	// Truncated or tampered blobs fail to read
+	for _, corrupt := range [][]byte{
+		raw[:len(raw)-1],
+		raw[:len(raw)-16],
+		append(bytes.Clone(raw[:len(raw)-1]), raw[len(raw)-1]^1),
+	} {
+		err = os.WriteFile(filepath.Join(dir, "corrupt"), corrupt, 0o600)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		_, err = readBlob(t, store, "corrupt")
+		if !errors.Is(err, errBlobCorrupt) {
+			t.Fatalf("expected errBlobCorrupt, got %v", err)
+		}
+	}
+
+	// Written before encryption was enabled
+	for _, data := range []string{"", "old", "old plaintext blob"} {
+		_, err = inner.Put(ctx, "plain", strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		got, err := readBlob(t, store, "plain")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != data {
+			t.Fatalf("expected '%s', got '%s'", data, got)
+		}
+	}
+}
+
+func TestBlobClipboard(t *testing.T) {
+	ctx := context.Background()
+	ring := testRing(t, 1)
+	inner, dir := testFsBlob(t)
+	clipboards := memory.NewClipboard()
+	r := blobclipboard.New(New(clipboards, ring), NewBlobStore(inner, ring), 8)
+
+	text := "secret text larger than threshold"
+	clip, err := r.CreateFrom(ctx, model.Clipboard{Id: "clip", OwnerId: "yong"}, strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if clip.BlobKey == "" || clip.Size != int64(len(text)) || clip.Checksum != model.Checksum(text) {
+		t.Fatalf("unexpected blob content %+v", clip.Content)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(dir, clip.BlobKey))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Fatal("expected blob file not to be plaintext")
+	}
+
+	stored, err := clipboards.GetById(ctx, "clip")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.Checksum == model.Checksum(text) {
+		t.Fatal("expected checksum not to be stored as it is")
+	}
+
+	got, err := r.GetById(ctx, "clip")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Checksum != model.Checksum(text) {
+		t.Fatalf("expected checksum of plaintext, got %+v", got.Content)
+	}
+
+	rc, err := r.Open(ctx, got)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rc.Close()
+
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(b) != text {
+		t.Fatalf("expected '%s', got '%s'", text, b)
+	}
+}
+
+func TestReencryptBlobs(t *testing.T) {
+	ctx := context.Background()
+	inner, dir := testFsBlob(t)
+
+	_, err := inner.Put(ctx, "plain", strings.NewReader("plain blob"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = NewBlobStore(inner, testRing(t, 1)).Put(ctx, "old", strings.NewReader("old key"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ring := testRing(t, 1, 2)
+	moved, err := ReencryptBlobs(ctx, inner, ring)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if moved != 2 {
+		t.Fatalf("expected 2 blobs moved, got %d", moved)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(dir, "plain"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Contains(raw, []byte("plain")) {
+		t.Fatal("expected blob file not to be plaintext")
+	}
+
+	// Key version 1 can be dropped now
+	store := NewBlobStore(inner, testRing(t, 2))
+	for key, data := range map[string]string{"plain": "plain blob", "old": "old key"} {
+		got, err := readBlob(t, store, key)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != data {
+			t.Fatalf("expected '%s', got '%s'", data, got)
+		}
+	}
+
+	moved, err = ReencryptBlobs(ctx, inner, ring)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if moved != 0 {
+		t.Fatalf("expected nothing to move, got %d", moved)
+	}
+}
@@ -0,0 +1,364 @@
+package cryptclipboard
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/soyart/gfc/pkg/gfc"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+// RepoCryptClipboard wraps a RepositoryClipboard, encrypting clipboard text
+// at rest with envelope encryption: each content is encrypted with its own
+// random data key, which is itself encrypted with the current key of the
+// key ring, and stored along with its key version. The checksum of content
+// is encrypted with the data key too, as it would otherwise confirm guesses
+// of the plaintext. Size is kept as it is for quotas, which is no more
+// than what the length of the ciphertext tells.
+//
+// Content kept in a blob store only has its checksum encrypted here,
+// its blob is encrypted by RepoCryptBlob. End-to-end encrypted content
+// is stored as it is.
+type RepoCryptClipboard struct {
+	repo.RepositoryClipboard
+	keys *KeyRing
+}
+
+func New(clipboards repo.RepositoryClipboard, keys *KeyRing) repo.RepositoryClipboard {
+	return &RepoCryptClipboard{
+		RepositoryClipboard: clipboards,
+		keys:                keys,
+	}
+}
+
+// encrypt returns content to be stored, normalized from plaintext
+func encrypt(keys *KeyRing, content model.Content) (model.Content, error) {
+	content = content.Normalize()
+	if (content.Text == "" && content.BlobKey == "") || content.Envelope != nil || content.KeyVersion != 0 {
+		return content, nil
+	}
+
+	dataKey := make([]byte, keyLen)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return model.Content{}, err
+	}
+
+	if content.BlobKey == "" {
+		ciphertext, err := gfc.EncryptGCM(bytes.NewBufferString(content.Text), dataKey)
+		if err != nil {
+			return model.Content{}, fmt.Errorf("encrypt clipboard err: %w", err)
+		}
+
+		content.Text = string(ciphertext.Bytes())
+	}
+
+	content.Checksum, err = sealChecksum(dataKey, content.Checksum)
+	if err != nil {
+		return model.Content{}, err
+	}
+
+	content.KeyVersion = keys.Current()
+	content.DataKey, err = wrap(keys, keys.Current(), dataKey)
+	if err != nil {
+		return model.Content{}, err
+	}
+
+	return content, nil
+}
+
+// decrypt returns plaintext content of stored content
+func decrypt(keys *KeyRing, content model.Content) (model.Content, error) {
+	if content.KeyVersion == 0 {
+		return content, nil
+	}
+
+	dataKey, err := unwrap(keys, content.KeyVersion, content.DataKey)
+	if err != nil {
+		return model.Content{}, err
+	}
+
+	if content.BlobKey == "" {
+		plaintext, err := gfc.DecryptGCM(bytes.NewBufferString(content.Text), dataKey)
+		if err != nil {
+			return model.Content{}, fmt.Errorf("decrypt clipboard err: %w", err)
+		}
+
+		content.Text = string(plaintext.Bytes())
+	}
+
+	content.Checksum, err = openChecksum(dataKey, content.Checksum)
+	if err != nil {
+		return model.Content{}, err
+	}
+
+	content.KeyVersion = 0
+	content.DataKey = ""
+
+	return content, nil
+}
+
+// plainChecksum reports whether checksum is stored as it is,
+// as by versions that didn't encrypt checksums
+func plainChecksum(checksum string) bool {
+	return len(checksum) == sha256.Size*2
+}
+
+// sealChecksum encrypts checksum with dataKey, returning it as base64
+func sealChecksum(dataKey []byte, checksum string) (string, error) {
+	if checksum == "" || !plainChecksum(checksum) {
+		return checksum, nil
+	}
+
+	sealed, err := gfc.EncryptGCM(bytes.NewBufferString(checksum), dataKey)
+	if err != nil {
+		return "", fmt.Errorf("encrypt checksum err: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(sealed.Bytes()), nil
+}
+
+func openChecksum(dataKey []byte, sealed string) (string, error) {
+	if sealed == "" || plainChecksum(sealed) {
+		return sealed, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", fmt.Errorf("bad checksum: %w", err)
+	}
+
+	checksum, err := gfc.DecryptGCM(bytes.NewBuffer(b), dataKey)
+	if err != nil {
+		return "", fmt.Errorf("decrypt checksum err: %w", err)
+	}
+
+	return string(checksum.Bytes()), nil
+}
+
+// wrap encrypts dataKey with key version, returning it as base64
+func wrap(keys *KeyRing, version int, dataKey []byte) (string, error) {
+	key, err := keys.key(version)
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := gfc.EncryptGCM(bytes.NewBuffer(dataKey), key)
+	if err != nil {
+		return "", fmt.Errorf("wrap data key err: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(wrapped.Bytes()), nil
+}
+
+func unwrap(keys *KeyRing, version int, wrapped string) ([]byte, error) {
+	key, err := keys.key(version)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("bad data key: %w", err)
+	}
+
+	dataKey, err := gfc.DecryptGCM(bytes.NewBuffer(b), key)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key err: %w", err)
+	}
+
+	return dataKey.Bytes(), nil
+}
+
+func (r *RepoCryptClipboard) decryptClip(clip model.Clipboard, err error) (model.Clipboard, error) {
+	if err != nil {
+		return model.Clipboard{}, err
+	}
+
+	clip.Content, err = decrypt(r.keys, clip.Content)
+	if err != nil {
+		return model.Clipboard{}, fmt.Errorf("clipboard '%s': %w", clip.Id, err)
+	}
+
+	return clip, nil
+}
+
+func (r *RepoCryptClipboard) decryptClips(clips []model.Clipboard, err error) ([]model.Clipboard, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range clips {
+		clips[i], err = r.decryptClip(clips[i], nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return clips, nil
+}
+
+func (r *RepoCryptClipboard) Create(ctx context.Context, clip model.Clipboard) error {
+	var err error
+	clip.Content, err = encrypt(r.keys, clip.Content)
+	if err != nil {
+		return err
+	}
+
+	return r.RepositoryClipboard.Create(ctx, clip)
+}
+
+func (r *RepoCryptClipboard) GetAll(ctx context.Context) ([]model.Clipboard, error) {
+	return r.decryptClips(r.RepositoryClipboard.GetAll(ctx))
+}
+
+func (r *RepoCryptClipboard) GetById(ctx context.Context, id string) (model.Clipboard, error) {
+	return r.decryptClip(r.RepositoryClipboard.GetById(ctx, id))
+}
+
+func (r *RepoCryptClipboard) GetAllByOwner(ctx context.Context, ownerId string) ([]model.Clipboard, error) {
+	return r.decryptClips(r.RepositoryClipboard.GetAllByOwner(ctx, ownerId))
+}
+
+func (r *RepoCryptClipboard) ListByOwner(ctx context.Context, ownerId string, limit int, cursor string) ([]model.Clipboard, string, error) {
+	clips, next, err := r.RepositoryClipboard.ListByOwner(ctx, ownerId, limit, cursor)
+	clips, err = r.decryptClips(clips, err)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return clips, next, nil
+}
+
+func (r *RepoCryptClipboard) ListByDevice(ctx context.Context, ownerId string, deviceId string, limit int, cursor string) ([]model.Clipboard, string, error) {
+	clips, next, err := r.RepositoryClipboard.ListByDevice(ctx, ownerId, deviceId, limit, cursor)
+	clips, err = r.decryptClips(clips, err)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return clips, next, nil
+}
+
+func (r *RepoCryptClipboard) GetByOwnerInRange(ctx context.Context, ownerId string, from, to time.Time, limit int) ([]model.Clipboard, error) {
+	return r.decryptClips(r.RepositoryClipboard.GetByOwnerInRange(ctx, ownerId, from, to, limit))
+}
+
+func (r *RepoCryptClipboard) GetByDeviceInRange(ctx context.Context, ownerId string, deviceId string, from, to time.Time, limit int) ([]model.Clipboard, error) {
+	return r.decryptClips(r.RepositoryClipboard.GetByDeviceInRange(ctx, ownerId, deviceId, from, to, limit))
+}
+
+func (r *RepoCryptClipboard) GetByIdAndOwner(ctx context.Context, id string, ownerId string) (model.Clipboard, error) {
+	return r.decryptClip(r.RepositoryClipboard.GetByIdAndOwner(ctx, id, ownerId))
+}
+
+func (r *RepoCryptClipboard) Update(ctx context.Context, id string, content model.Content) error {
+	content, err := encrypt(r.keys, content)
+	if err != nil {
+		return err
+	}
+
+	return r.RepositoryClipboard.Update(ctx, id, content)
+}
+
+func (r *RepoCryptClipboard) UpdateByIdAndOwner(ctx context.Context, id string, ownerId string, content model.Content) error {
+	content, err := encrypt(r.keys, content)
+	if err != nil {
+		return err
+	}
+
+	return r.RepositoryClipboard.UpdateByIdAndOwner(ctx, id, ownerId, content)
+}
+
+// CompareAndSwapContent encrypts new if it's plaintext. Unlike new, old must
+// be content as stored by the wrapped repository, as content returned by r
+// is decrypted.
+func (r *RepoCryptClipboard) CompareAndSwapContent(ctx context.Context, id string, old model.Content, new model.Content) error {
+	new, err := encrypt(r.keys, new)
+	if err != nil {
+		return err
+	}
+
+	return r.RepositoryClipboard.CompareAndSwapContent(ctx, id, old, new)
+}
+
+// Reencrypt moves all clipboards of clipboards, the wrapped repository,
+// to the current key of keys: plaintext content is encrypted, and data keys
+// of content encrypted with older keys are encrypted again, along with
+// checksums of content encrypted before checksums were.
+// Blobs are moved separately with ReencryptBlobs.
+//
+// It's safe to run while the API is serving with the same key ring,
+// as clipboards changed in the meantime are skipped, and already encrypted
+// with the current key by the API. It returns the number of clipboards moved.
+func Reencrypt(ctx context.Context, clipboards repo.RepositoryClipboard, keys *KeyRing) (int, error) {
+	clips, err := clipboards.GetAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, clip := range clips {
+		if clip.KeyVersion == keys.Current() && !plainChecksum(clip.Checksum) {
+			continue
+		}
+
+		var content model.Content
+		if clip.KeyVersion == 0 {
+			content, err = encrypt(keys, clip.Content)
+		} else {
+			content, err = rewrap(keys, clip.Content)
+		}
+		if err != nil {
+			return moved, fmt.Errorf("clipboard '%s': %w", clip.Id, err)
+		}
+
+		// Not encrypted at rest, e.g. end-to-end encrypted content
+		if content.KeyVersion == 0 {
+			continue
+		}
+
+		err = clipboards.CompareAndSwapContent(ctx, clip.Id, clip.Content, content)
+		if errors.Is(err, repo.ErrConflict) || errors.Is(err, repo.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return moved, err
+		}
+
+		moved++
+	}
+
+	return moved, nil
+}
+
+// rewrap encrypts data key of content with the current key,
+// leaving its text as it is
+func rewrap(keys *KeyRing, content model.Content) (model.Content, error) {
+	dataKey, err := unwrap(keys, content.KeyVersion, content.DataKey)
+	if err != nil {
+		return model.Content{}, err
+	}
+
+	content.Checksum, err = sealChecksum(dataKey, content.Checksum)
+	if err != nil {
+		return model.Content{}, err
+	}
+
+	content.DataKey, err = wrap(keys, keys.Current(), dataKey)
+	if err != nil {
+		return model.Content{}, err
+	}
+
+	content.KeyVersion = keys.Current()
+
+	return content, nil
+}
@@ -0,0 +1,249 @@
+package cryptclipboard
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo/memory"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, keyLen)
+}
+
+func testRing(t *testing.T, versions ...int) *KeyRing {
+	keys := map[int][]byte{}
+	for _, v := range versions {
+		keys[v] = testKey(byte(v))
+	}
+
+	ring, err := NewKeyRing(keys)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return ring
+}
+
+func TestEncrypt(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.NewClipboard()
+	r := New(inner, testRing(t, 1))
+
+	content := model.NewContent("secret text", "")
+	err := r.Create(ctx, model.Clipboard{Id: "clip", Content: content, OwnerId: "yong"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stored, err := inner.GetById(ctx, "clip")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(stored.Text, "secret") || stored.KeyVersion != 1 || stored.DataKey == "" {
+		t.Fatalf("expected encrypted content to be stored, got %+v", stored.Content)
+	}
+	if stored.Size != content.Size {
+		t.Fatalf("expected size of plaintext, got %+v", stored.Content)
+	}
+	if stored.Checksum == "" || stored.Checksum == content.Checksum {
+		t.Fatalf("expected encrypted checksum to be stored, got %+v", stored.Content)
+	}
+
+	got, err := r.GetById(ctx, "clip")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Content != content {
+		t.Fatalf("expected content %+v, got %+v", content, got.Content)
+	}
+
+	err = r.UpdateByIdAndOwner(ctx, "clip", "yong", model.NewContent("new secret", ""))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	clips, err := r.GetAllByOwner(ctx, "yong")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(clips) != 1 || clips[0].Text != "new secret" {
+		t.Fatalf("unexpected clipboards: %+v", clips)
+	}
+
+	// Another key ring can't read it
+	_, err = New(inner, testRing(t, 2)).GetById(ctx, "clip")
+	if err == nil {
+		t.Fatal("expected error decrypting without key")
+	}
+}
+
+func TestSkip(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.NewClipboard()
+	r := New(inner, testRing(t, 1))
+
+	envelope := &model.Envelope{Version: 1, Alg: model.EnvelopeAlg, KeyId: "kid", Nonce: base64.RawStdEncoding.EncodeToString(make([]byte, model.EnvelopeNonceSize))}
+	e2e := model.NewContent("\x00ciphertext", "application/octet-stream")
+	e2e.Envelope = envelope
+
+	for id, content := range map[string]model.Content{"e2e": e2e, "empty": {}} {
+		err := r.Create(ctx, model.Clipboard{Id: id, Content: content, OwnerId: "yong"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		stored, err := inner.GetById(ctx, id)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if stored.KeyVersion != 0 {
+			t.Fatalf("expected %s not to be encrypted, got %+v", id, stored.Content)
+		}
+	}
+}
+
+func TestEncryptBlobChecksum(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.NewClipboard()
+	r := New(inner, testRing(t, 1))
+
+	blob := model.Content{MimeType: model.DefaultMimeType, Size: 100, Checksum: model.Checksum("blob"), BlobKey: "blob"}
+	err := r.Create(ctx, model.Clipboard{Id: "blob", Content: blob, OwnerId: "yong"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stored, err := inner.GetById(ctx, "blob")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.KeyVersion != 1 || stored.Checksum == blob.Checksum || stored.Text != "" || stored.Size != blob.Size || stored.BlobKey != blob.BlobKey {
+		t.Fatalf("expected only checksum of blob content to be encrypted, got %+v", stored.Content)
+	}
+
+	got, err := r.GetById(ctx, "blob")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Content != blob {
+		t.Fatalf("expected content %+v, got %+v", blob, got.Content)
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.NewClipboard()
+
+	// Written before encryption was enabled
+	err := inner.Create(ctx, model.Clipboard{Id: "plain", Content: model.NewContent("plain", ""), OwnerId: "yong"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = New(inner, testRing(t, 1)).Create(ctx, model.Clipboard{Id: "old", Content: model.NewContent("old key", ""), OwnerId: "yong"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	before, err := inner.GetById(ctx, "old")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Encrypted with the current key before checksums were
+	ring := testRing(t, 1, 2)
+	legacy, err := encrypt(ring, model.NewContent("legacy", ""))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	legacy.Checksum = model.Checksum("legacy")
+	err = inner.Create(ctx, model.Clipboard{Id: "legacy", Content: legacy, OwnerId: "yong"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	moved, err := Reencrypt(ctx, inner, ring)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if moved != 3 {
+		t.Fatalf("expected 3 clipboards moved, got %d", moved)
+	}
+
+	after, err := inner.GetById(ctx, "legacy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if after.Text != legacy.Text || after.Checksum == legacy.Checksum {
+		t.Fatalf("expected only checksum to be encrypted, got %+v", after.Content)
+	}
+
+	after, err = inner.GetById(ctx, "old")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if after.KeyVersion != 2 || after.Text != before.Text || after.DataKey == before.DataKey {
+		t.Fatalf("expected only data key to be encrypted again, got %+v", after.Content)
+	}
+
+	// Key version 1 can be dropped now
+	r := New(inner, testRing(t, 2))
+	for id, text := range map[string]string{"plain": "plain", "old": "old key", "legacy": "legacy"} {
+		clip, err := r.GetById(ctx, id)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if clip.Text != text || clip.Checksum != model.Checksum(text) {
+			t.Fatalf("expected text '%s' and its checksum, got %+v", text, clip.Content)
+		}
+	}
+
+	moved, err = Reencrypt(ctx, inner, ring)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if moved != 0 {
+		t.Fatalf("expected nothing to move, got %d", moved)
+	}
+}
+
+func TestParseKeyRing(t *testing.T) {
+	k1 := base64.StdEncoding.EncodeToString(testKey(1))
+	k2 := base64.StdEncoding.EncodeToString(testKey(2))
+
+	ring, err := ParseKeyRing("# keys\n1:" + k1 + "\n\n2:" + k2 + "\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ring.Current() != 2 {
+		t.Fatalf("expected current version 2, got %d", ring.Current())
+	}
+
+	ring, err = ParseKeyRing("2:" + k2 + ", 1:" + k1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ring.Current() != 2 {
+		t.Fatalf("expected current version 2, got %d", ring.Current())
+	}
+
+	for _, s := range []string{
+		"",
+		k1,
+		"0:" + k1,
+		"x:" + k1,
+		"1:" + k1 + ",1:" + k2,
+		"1:not-base64",
+		"1:" + base64.StdEncoding.EncodeToString([]byte("short")),
+	} {
+		_, err := ParseKeyRing(s)
+		if err == nil {
+			t.Fatalf("expected error parsing '%s'", s)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package cryptclipboard
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// keyLen is the length of AES-256 keys, as required by gfc
+const keyLen = 32
+
+// KeyRing holds all versions of the server key. New content is always
+// encrypted with the current key, the one with the highest version,
+// and older keys are kept to decrypt content not yet re-encrypted.
+type KeyRing struct {
+	keys    map[int][]byte
+	current int
+}
+
+// NewKeyRing returns key ring of keys by version, which must be positive
+func NewKeyRing(keys map[int][]byte) (*KeyRing, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("empty key ring")
+	}
+
+	ring := &KeyRing{keys: make(map[int][]byte, len(keys))}
+	for version, key := range keys {
+		if version <= 0 {
+			return nil, fmt.Errorf("key version must be positive, got %d", version)
+		}
+
+		if len(key) != keyLen {
+			return nil, fmt.Errorf("key version %d must be %d bytes, got %d", version, keyLen, len(key))
+		}
+
+		ring.keys[version] = key
+		if version > ring.current {
+			ring.current = version
+		}
+	}
+
+	return ring, nil
+}
+
+// ParseKeyRing parses keys formatted as VERSION:BASE64KEY,
+// separated by commas or newlines, e.g. "1:<key>,2:<key>".
+// Blank lines and lines starting with # are skipped.
+func ParseKeyRing(s string) (*KeyRing, error) {
+	keys := map[int][]byte{}
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		v, k, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errors.New("key must be VERSION:BASE64KEY")
+		}
+
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad key version '%s'", v)
+		}
+
+		if _, ok := keys[version]; ok {
+			return nil, fmt.Errorf("duplicate key version %d", version)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("bad base64 of key version %d", version)
+		}
+
+		keys[version] = key
+	}
+
+	return NewKeyRing(keys)
+}
+
+// Current returns version of the key new content is encrypted with
+func (k *KeyRing) Current() int {
+	return k.current
+}
+
+func (k *KeyRing) key(version int) ([]byte, error) {
+	key, ok := k.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("no key version %d in key ring", version)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,37 @@
+package repo
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cursors point at the last clipboard of a page by its creation time and id,
+// so that pages stay stable when new clipboards are created in between.
+// Clients must treat them as opaque strings.
+
+func EncodeCursor(createdAt time.Time, id string) string {
+	s := strconv.FormatInt(createdAt.UnixNano(), 10) + ":" + id
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func DecodeCursor(cursor string) (time.Time, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("bad cursor '%s': %w", cursor, ErrInvalid)
+	}
+
+	nanos, id, ok := strings.Cut(string(b), ":")
+	if !ok || id == "" {
+		return time.Time{}, "", fmt.Errorf("bad cursor '%s': %w", cursor, ErrInvalid)
+	}
+
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("bad cursor '%s': %w", cursor, ErrInvalid)
+	}
+
+	return time.Unix(0, n), id, nil
+}
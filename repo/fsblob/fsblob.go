@@ -0,0 +1,131 @@
+package fsblob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/eymyong/drop/repo"
+)
+
+// RepoFsBlob stores each blob as a file named after its key in dir
+type RepoFsBlob struct {
+	dir string
+}
+
+func New(dir string) (repo.BlobStore, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("mkdir blob dir err: %w", err)
+	}
+
+	return &RepoFsBlob{dir: dir}, nil
+}
+
+// path returns file path of key, which must not escape dir
+func (r *RepoFsBlob) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("bad blob key '%s': %w", key, repo.ErrInvalid)
+	}
+
+	return filepath.Join(r.dir, key), nil
+}
+
+// Put writes to a temporary file first and renames it to key,
+// so that readers never see partially written blobs
+func (r *RepoFsBlob) Put(ctx context.Context, key string, src io.Reader) (int64, error) {
+	path, err := r.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(r.dir, ".tmp-*")
+	if err != nil {
+		return 0, fmt.Errorf("create temp blob err: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, src)
+	if err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("write blob '%s' err: %w", key, err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return 0, fmt.Errorf("close blob '%s' err: %w", key, err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return 0, fmt.Errorf("rename blob '%s' err: %w", key, err)
+	}
+
+	return n, nil
+}
+
+func (r *RepoFsBlob) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := r.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no blob '%s': %w", key, repo.ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open blob '%s' err: %w", key, err)
+	}
+
+	return f, nil
+}
+
+func (r *RepoFsBlob) Delete(ctx context.Context, key string) error {
+	path, err := r.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove blob '%s' err: %w", key, err)
+	}
+
+	return nil
+}
+
+// Keys includes temporary files left by interrupted Puts
+func (r *RepoFsBlob) Keys(ctx context.Context, before time.Time) ([]string, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, fmt.Errorf("read blob dir err: %w", err)
+	}
+
+	keys := []string{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stat blob '%s' err: %w", entry.Name(), err)
+		}
+
+		if info.ModTime().Before(before) {
+			keys = append(keys, entry.Name())
+		}
+	}
+
+	return keys, nil
+}
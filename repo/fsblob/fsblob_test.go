@@ -0,0 +1,66 @@
+package fsblob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/eymyong/drop/repo"
+)
+
+func TestFsBlob(t *testing.T) {
+	ctx := context.Background()
+	r, err := New(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = r.Get(ctx, "missing")
+	if !errors.Is(err, repo.ErrNotFound) {
+		t.Fatalf("expected repo.ErrNotFound, got %v", err)
+	}
+
+	for _, key := range []string{"", ".", "..", "../escape", `a\b`} {
+		_, err = r.Put(ctx, key, strings.NewReader("x"))
+		if !errors.Is(err, repo.ErrInvalid) {
+			t.Fatalf("expected repo.ErrInvalid for key %q, got %v", key, err)
+		}
+	}
+
+	n, err := r.Put(ctx, "blob-1", strings.NewReader("old"))
+	if err != nil || n != 3 {
+		t.Fatalf("unexpected put result: %d, %v", n, err)
+	}
+
+	_, err = r.Put(ctx, "blob-1", strings.NewReader("new content"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rc, err := r.Get(ctx, "blob-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(b) != "new content" {
+		t.Fatalf("unexpected blob: %q, %v", b, err)
+	}
+
+	if err = r.Delete(ctx, "blob-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = r.Get(ctx, "blob-1")
+	if !errors.Is(err, repo.ErrNotFound) {
+		t.Fatalf("expected repo.ErrNotFound, got %v", err)
+	}
+
+	// Deleting missing blobs is not an error
+	if err = r.Delete(ctx, "blob-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,420 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoMemoryClipboard struct {
+	mut   sync.RWMutex
+	clips map[string]model.Clipboard
+	quota repo.Quota
+}
+
+func NewClipboard() repo.RepositoryClipboard {
+	return NewClipboardWithQuota(repo.Quota{})
+}
+
+func NewClipboardWithQuota(quota repo.Quota) repo.RepositoryClipboard {
+	return &RepoMemoryClipboard{clips: make(map[string]model.Clipboard), quota: quota}
+}
+
+func (r *RepoMemoryClipboard) Create(ctx context.Context, clip model.Clipboard) error {
+	if clip.Id == "" {
+		return fmt.Errorf("empty clipboard id: %w", repo.ErrInvalid)
+	}
+
+	now := time.Now()
+	if clip.CreatedAt.IsZero() {
+		clip.CreatedAt = now
+	}
+	if clip.UpdatedAt.IsZero() {
+		clip.UpdatedAt = clip.CreatedAt
+	}
+
+	clip.Content = clip.Content.Normalize()
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	if old, ok := r.clips[clip.Id]; ok && alive(old, now) {
+		return fmt.Errorf("clipboard id '%s' is already taken: %w", clip.Id, repo.ErrConflict)
+	}
+
+	err := r.checkQuota(clip.OwnerId, 1, clip.Size)
+	if err != nil {
+		return err
+	}
+
+	r.clips[clip.Id] = clip
+
+	return nil
+}
+
+func (r *RepoMemoryClipboard) GetAll(ctx context.Context) ([]model.Clipboard, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	now := time.Now()
+	clipboards := []model.Clipboard{}
+	for _, clip := range r.clips {
+		if alive(clip, now) {
+			clipboards = append(clipboards, clip)
+		}
+	}
+
+	return clipboards, nil
+}
+
+func (r *RepoMemoryClipboard) GetAllByOwner(ctx context.Context, ownerId string) ([]model.Clipboard, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	now := time.Now()
+	clipboards := []model.Clipboard{}
+	for _, clip := range r.clips {
+		if clip.OwnerId == ownerId && alive(clip, now) {
+			clipboards = append(clipboards, clip)
+		}
+	}
+
+	return clipboards, nil
+}
+
+func (r *RepoMemoryClipboard) ListByOwner(ctx context.Context, ownerId string, limit int, cursor string) ([]model.Clipboard, string, error) {
+	clipboards, _ := r.GetAllByOwner(ctx, ownerId)
+	return paginate(clipboards, limit, cursor)
+}
+
+func (r *RepoMemoryClipboard) ListByDevice(ctx context.Context, ownerId string, deviceId string, limit int, cursor string) ([]model.Clipboard, string, error) {
+	clipboards, _ := r.GetAllByOwner(ctx, ownerId)
+
+	fromDevice := []model.Clipboard{}
+	for i := range clipboards {
+		if clipboards[i].DeviceId == deviceId {
+			fromDevice = append(fromDevice, clipboards[i])
+		}
+	}
+
+	return paginate(fromDevice, limit, cursor)
+}
+
+// paginate returns a page of at most limit clipboards, newest first, after cursor
+func paginate(clipboards []model.Clipboard, limit int, cursor string) ([]model.Clipboard, string, error) {
+	if limit <= 0 {
+		return []model.Clipboard{}, "", fmt.Errorf("bad limit %d: %w", limit, repo.ErrInvalid)
+	}
+
+	var (
+		afterTime time.Time
+		afterId   string
+	)
+
+	if cursor != "" {
+		var err error
+		afterTime, afterId, err = repo.DecodeCursor(cursor)
+		if err != nil {
+			return []model.Clipboard{}, "", err
+		}
+	}
+
+	sort.Slice(clipboards, func(i, j int) bool {
+		return newerThan(clipboards[i], clipboards[j].CreatedAt, clipboards[j].Id)
+	})
+
+	page := []model.Clipboard{}
+	for _, clip := range clipboards {
+		if cursor != "" && !newerThan(model.Clipboard{CreatedAt: afterTime, Id: afterId}, clip.CreatedAt, clip.Id) {
+			continue
+		}
+
+		page = append(page, clip)
+		if len(page) > limit {
+			break
+		}
+	}
+
+	next := ""
+	if len(page) > limit {
+		page = page[:limit]
+		last := page[limit-1]
+		next = repo.EncodeCursor(last.CreatedAt, last.Id)
+	}
+
+	return page, next, nil
+}
+
+func (r *RepoMemoryClipboard) GetByOwnerInRange(ctx context.Context, ownerId string, from, to time.Time, limit int) ([]model.Clipboard, error) {
+	clipboards, _ := r.GetAllByOwner(ctx, ownerId)
+	return inRange(clipboards, from, to, limit)
+}
+
+func (r *RepoMemoryClipboard) GetByDeviceInRange(ctx context.Context, ownerId string, deviceId string, from, to time.Time, limit int) ([]model.Clipboard, error) {
+	clipboards, _ := r.GetAllByOwner(ctx, ownerId)
+
+	fromDevice := []model.Clipboard{}
+	for i := range clipboards {
+		if clipboards[i].DeviceId == deviceId {
+			fromDevice = append(fromDevice, clipboards[i])
+		}
+	}
+
+	return inRange(fromDevice, from, to, limit)
+}
+
+// inRange returns at most limit clipboards created in [from, to), newest first
+func inRange(clipboards []model.Clipboard, from, to time.Time, limit int) ([]model.Clipboard, error) {
+	if limit <= 0 {
+		return []model.Clipboard{}, fmt.Errorf("bad limit %d: %w", limit, repo.ErrInvalid)
+	}
+
+	sort.Slice(clipboards, func(i, j int) bool {
+		return newerThan(clipboards[i], clipboards[j].CreatedAt, clipboards[j].Id)
+	})
+
+	result := []model.Clipboard{}
+	for _, clip := range clipboards {
+		if !from.IsZero() && clip.CreatedAt.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !clip.CreatedAt.Before(to) {
+			continue
+		}
+
+		result = append(result, clip)
+		if len(result) == limit {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func (r *RepoMemoryClipboard) UsageByOwner(ctx context.Context, ownerId string) (model.Usage, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	return r.usage(ownerId), nil
+}
+
+// usage returns usage of ownerId.
+// Callers must hold the lock.
+func (r *RepoMemoryClipboard) usage(ownerId string) model.Usage {
+	now := time.Now()
+	usage := model.Usage{}
+	for _, clip := range r.clips {
+		if clip.OwnerId == ownerId && alive(clip, now) {
+			usage.Clips++
+			usage.Bytes += clip.Size
+		}
+	}
+
+	return usage
+}
+
+// checkQuota returns error if ownerId has no room left for clips more
+// clipboards of size more bytes. Callers must hold the write lock.
+func (r *RepoMemoryClipboard) checkQuota(ownerId string, clips int64, size int64) error {
+	if ownerId == "" || r.quota == (repo.Quota{}) {
+		return nil
+	}
+
+	return r.quota.Check(r.usage(ownerId), clips, size)
+}
+
+// newerThan orders clipboards by creation time, then id, newest first
+func newerThan(clip model.Clipboard, createdAt time.Time, id string) bool {
+	if !clip.CreatedAt.Equal(createdAt) {
+		return clip.CreatedAt.After(createdAt)
+	}
+
+	return clip.Id > id
+}
+
+func (r *RepoMemoryClipboard) GetById(ctx context.Context, id string) (model.Clipboard, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	clip, ok := r.get(id)
+	if !ok {
+		return model.Clipboard{}, fmt.Errorf("no data in memory for clipboard '%s': %w", id, repo.ErrNotFound)
+	}
+
+	r.burn(clip)
+
+	return clip, nil
+}
+
+func (r *RepoMemoryClipboard) GetByIdAndOwner(ctx context.Context, id string, ownerId string) (model.Clipboard, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	clip, ok := r.get(id)
+	if !ok || clip.OwnerId != ownerId {
+		return model.Clipboard{}, fmt.Errorf("clipboard '%s': %w", id, repo.ErrNotFound)
+	}
+
+	r.burn(clip)
+
+	return clip, nil
+}
+
+func (r *RepoMemoryClipboard) GetBlobKey(ctx context.Context, id string) (string, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	clip, ok := r.get(id)
+	if !ok {
+		return "", fmt.Errorf("no data in memory for clipboard '%s': %w", id, repo.ErrNotFound)
+	}
+
+	return clip.BlobKey, nil
+}
+
+func (r *RepoMemoryClipboard) CheckOwner(ctx context.Context, id string, ownerId string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	clip, ok := r.get(id)
+	if !ok || clip.OwnerId != ownerId {
+		return fmt.Errorf("no data in memory for clipboard '%s' of owner '%s': %w", id, ownerId, repo.ErrNotFound)
+	}
+
+	return nil
+}
+
+func (r *RepoMemoryClipboard) Update(ctx context.Context, id string, content model.Content) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	clip, ok := r.get(id)
+	if !ok {
+		return fmt.Errorf("no clipboard '%s' in memory: %w", id, repo.ErrNotFound)
+	}
+
+	content = content.Normalize()
+	err := r.checkQuota(clip.OwnerId, 0, content.Size-clip.Size)
+	if err != nil {
+		return err
+	}
+
+	clip.Content = content
+	clip.UpdatedAt = time.Now()
+	r.clips[id] = clip
+
+	return nil
+}
+
+func (r *RepoMemoryClipboard) UpdateByIdAndOwner(ctx context.Context, id string, ownerId string, content model.Content) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	clip, ok := r.get(id)
+	if !ok || clip.OwnerId != ownerId {
+		return fmt.Errorf("clipboard '%s': %w", id, repo.ErrNotFound)
+	}
+
+	content = content.Normalize()
+	err := r.checkQuota(clip.OwnerId, 0, content.Size-clip.Size)
+	if err != nil {
+		return err
+	}
+
+	clip.Content = content
+	clip.UpdatedAt = time.Now()
+	r.clips[id] = clip
+
+	return nil
+}
+
+func (r *RepoMemoryClipboard) CompareAndSwapContent(ctx context.Context, id string, old model.Content, new model.Content) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	clip, ok := r.get(id)
+	if !ok {
+		return fmt.Errorf("no clipboard '%s' in memory: %w", id, repo.ErrNotFound)
+	}
+
+	if clip.Checksum != old.Checksum || clip.KeyVersion != old.KeyVersion || clip.DataKey != old.DataKey {
+		return fmt.Errorf("clipboard '%s' changed: %w", id, repo.ErrConflict)
+	}
+
+	clip.Content = new.Normalize()
+	r.clips[id] = clip
+
+	return nil
+}
+
+func (r *RepoMemoryClipboard) Delete(ctx context.Context, id string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	delete(r.clips, id)
+
+	return nil
+}
+
+func (r *RepoMemoryClipboard) DeleteExpired(ctx context.Context) (int, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	now := time.Now()
+	deleted := 0
+	for id, clip := range r.clips {
+		if !alive(clip, now) {
+			delete(r.clips, id)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (r *RepoMemoryClipboard) DeleteByIdAndOwner(ctx context.Context, id string, ownerId string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	clip, ok := r.get(id)
+	if !ok || clip.OwnerId != ownerId {
+		return fmt.Errorf("clipboard '%s': %w", id, repo.ErrNotFound)
+	}
+
+	delete(r.clips, id)
+
+	return nil
+}
+
+// get returns clipboard id, and deletes it if it has expired.
+// Callers must hold the write lock.
+func (r *RepoMemoryClipboard) get(id string) (model.Clipboard, bool) {
+	clip, ok := r.clips[id]
+	if !ok {
+		return model.Clipboard{}, false
+	}
+
+	if !alive(clip, time.Now()) {
+		delete(r.clips, id)
+		return model.Clipboard{}, false
+	}
+
+	return clip, true
+}
+
+// burn deletes burn-after-read clip once it's read.
+// Callers must hold the write lock.
+func (r *RepoMemoryClipboard) burn(clip model.Clipboard) {
+	if clip.BurnAfterRead {
+		delete(r.clips, clip.Id)
+	}
+}
+
+func alive(clip model.Clipboard, now time.Time) bool {
+	return clip.ExpiresAt.IsZero() || now.Before(clip.ExpiresAt)
+}
@@ -0,0 +1,104 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoMemoryDevice struct {
+	mut     sync.RWMutex
+	devices map[string]model.Device
+}
+
+func NewDevice() repo.RepositoryDevice {
+	return &RepoMemoryDevice{devices: make(map[string]model.Device)}
+}
+
+func (r *RepoMemoryDevice) Create(ctx context.Context, device model.Device) error {
+	if device.Id == "" || device.UserId == "" {
+		return fmt.Errorf("empty device id or user: %w", repo.ErrInvalid)
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	if _, ok := r.devices[device.Id]; ok {
+		return fmt.Errorf("device id '%s' is already taken: %w", device.Id, repo.ErrConflict)
+	}
+
+	if device.CreatedAt.IsZero() {
+		device.CreatedAt = time.Now()
+	}
+	if device.LastSeenAt.IsZero() {
+		device.LastSeenAt = device.CreatedAt
+	}
+
+	r.devices[device.Id] = device
+
+	return nil
+}
+
+func (r *RepoMemoryDevice) GetById(ctx context.Context, id string) (model.Device, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	device, ok := r.devices[id]
+	if !ok {
+		return model.Device{}, fmt.Errorf("no device '%s' in memory: %w", id, repo.ErrNotFound)
+	}
+
+	return device, nil
+}
+
+func (r *RepoMemoryDevice) GetAllByUser(ctx context.Context, userId string) ([]model.Device, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	devices := []model.Device{}
+	for _, device := range r.devices {
+		if device.UserId == userId {
+			devices = append(devices, device)
+		}
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].CreatedAt.Before(devices[j].CreatedAt)
+	})
+
+	return devices, nil
+}
+
+func (r *RepoMemoryDevice) UpdateLastSeen(ctx context.Context, id string, t time.Time) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	device, ok := r.devices[id]
+	if !ok {
+		return fmt.Errorf("no device '%s' in memory: %w", id, repo.ErrNotFound)
+	}
+
+	device.LastSeenAt = t
+	r.devices[id] = device
+
+	return nil
+}
+
+func (r *RepoMemoryDevice) DeleteByIdAndUser(ctx context.Context, id string, userId string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	device, ok := r.devices[id]
+	if !ok || device.UserId != userId {
+		return fmt.Errorf("no device '%s' of user '%s' in memory: %w", id, userId, repo.ErrNotFound)
+	}
+
+	delete(r.devices, id)
+
+	return nil
+}
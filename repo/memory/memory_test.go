@@ -0,0 +1,70 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/eymyong/drop/repo"
+	"github.com/eymyong/drop/repo/repotest"
+)
+
+func TestConformanceClipboard(t *testing.T) {
+	repotest.TestClipboard(t, func(t *testing.T) repo.RepositoryClipboard {
+		return NewClipboard()
+	})
+}
+
+func TestConformanceQuota(t *testing.T) {
+	repotest.TestQuota(t, func(t *testing.T, quota repo.Quota) repo.RepositoryClipboard {
+		return NewClipboardWithQuota(quota)
+	})
+}
+
+func TestConformanceDeleteExpired(t *testing.T) {
+	repotest.TestDeleteExpired(t, func(t *testing.T) (repo.RepositoryClipboard, func(string) bool) {
+		r := NewClipboard().(*RepoMemoryClipboard)
+
+		return r, func(id string) bool {
+			r.mut.RLock()
+			defer r.mut.RUnlock()
+
+			_, ok := r.clips[id]
+			return ok
+		}
+	})
+}
+
+func TestConformanceUser(t *testing.T) {
+	repotest.TestUser(t, func(t *testing.T) repo.RepositoryUser {
+		return NewUser()
+	})
+}
+
+func TestConformanceSession(t *testing.T) {
+	repotest.TestSession(t, func(t *testing.T) repo.RepositorySession {
+		return NewSession()
+	})
+}
+
+func TestConformanceShare(t *testing.T) {
+	repotest.TestShare(t, func(t *testing.T) repo.RepositoryShare {
+		return NewShare()
+	})
+}
+
+func TestConformanceSpace(t *testing.T) {
+	repotest.TestSpace(t, func(t *testing.T) repo.RepositorySpace {
+		return NewSpace()
+	})
+}
+
+func TestConformanceDevice(t *testing.T) {
+	repotest.TestDevice(t, func(t *testing.T) repo.RepositoryDevice {
+		return NewDevice()
+	})
+}
+
+func TestConformanceTicket(t *testing.T) {
+	repotest.TestTicket(t, func(t *testing.T) repo.RepositoryTicket {
+		return NewTicket()
+	})
+}
@@ -0,0 +1,85 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoMemorySession struct {
+	mut      sync.RWMutex
+	sessions map[string]model.Session
+}
+
+func NewSession() repo.RepositorySession {
+	return &RepoMemorySession{sessions: make(map[string]model.Session)}
+}
+
+func (r *RepoMemorySession) Create(ctx context.Context, session model.Session) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.sessions[session.Id] = session
+
+	return nil
+}
+
+func (r *RepoMemorySession) GetById(ctx context.Context, id string) (model.Session, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	// Expired sessions are treated as missing, like Redis EXPIREAT
+	session, ok := r.sessions[id]
+	if !ok || !time.Now().Before(session.ExpiresAt) {
+		return model.Session{}, fmt.Errorf("no session '%s' in memory: %w", id, repo.ErrNotFound)
+	}
+
+	return session, nil
+}
+
+func (r *RepoMemorySession) Update(ctx context.Context, session model.Session, oldHash string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	old, ok := r.sessions[session.Id]
+	if !ok || !time.Now().Before(old.ExpiresAt) {
+		return fmt.Errorf("no session '%s' in memory: %w", session.Id, repo.ErrNotFound)
+	}
+
+	if old.RefreshHash != oldHash {
+		return fmt.Errorf("session '%s' was updated: %w", session.Id, repo.ErrConflict)
+	}
+
+	old.RefreshHash = session.RefreshHash
+	old.ExpiresAt = session.ExpiresAt
+	old.DeviceId = session.DeviceId
+	r.sessions[session.Id] = old
+
+	return nil
+}
+
+func (r *RepoMemorySession) Delete(ctx context.Context, id string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	delete(r.sessions, id)
+
+	return nil
+}
+
+func (r *RepoMemorySession) DeleteByUserId(ctx context.Context, userId string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	for id, session := range r.sessions {
+		if session.UserId == userId {
+			delete(r.sessions, id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoMemoryShare struct {
+	mut    sync.Mutex
+	shares map[string]model.Share
+}
+
+func NewShare() repo.RepositoryShare {
+	return &RepoMemoryShare{shares: make(map[string]model.Share)}
+}
+
+func (r *RepoMemoryShare) Create(ctx context.Context, share model.Share) error {
+	if share.Token == "" || share.ClipboardId == "" || share.MaxViews < 0 {
+		return fmt.Errorf("bad share: %w", repo.ErrInvalid)
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	if _, ok := r.get(share.Token); ok {
+		return fmt.Errorf("share token '%s' is already taken: %w", share.Token, repo.ErrConflict)
+	}
+
+	if share.CreatedAt.IsZero() {
+		share.CreatedAt = time.Now()
+	}
+	share.ViewsLeft = share.MaxViews
+	r.shares[share.Token] = share
+
+	return nil
+}
+
+// get returns live share token, deleting it if it's expired. r.mut must be held.
+func (r *RepoMemoryShare) get(token string) (model.Share, bool) {
+	share, ok := r.shares[token]
+	if !ok {
+		return model.Share{}, false
+	}
+
+	if !share.ExpiresAt.IsZero() && !time.Now().Before(share.ExpiresAt) {
+		delete(r.shares, token)
+		return model.Share{}, false
+	}
+
+	return share, true
+}
+
+func (r *RepoMemoryShare) GetByToken(ctx context.Context, token string) (model.Share, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	share, ok := r.get(token)
+	if !ok {
+		return model.Share{}, fmt.Errorf("no share '%s' in memory: %w", token, repo.ErrNotFound)
+	}
+
+	return share, nil
+}
+
+func (r *RepoMemoryShare) GetAllByClipboard(ctx context.Context, clipboardId string, ownerId string) ([]model.Share, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	shares := []model.Share{}
+	for token := range r.shares {
+		share, ok := r.get(token)
+		if ok && share.ClipboardId == clipboardId && share.OwnerId == ownerId {
+			shares = append(shares, share)
+		}
+	}
+
+	return shares, nil
+}
+
+func (r *RepoMemoryShare) View(ctx context.Context, token string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	share, ok := r.get(token)
+	if !ok {
+		return fmt.Errorf("no share '%s' in memory: %w", token, repo.ErrNotFound)
+	}
+
+	share.FailedAttempts = 0
+	share.LockedUntil = time.Time{}
+	if share.MaxViews == 0 {
+		r.shares[token] = share
+		return nil
+	}
+
+	share.ViewsLeft--
+	if share.ViewsLeft <= 0 {
+		delete(r.shares, token)
+		return nil
+	}
+
+	r.shares[token] = share
+
+	return nil
+}
+
+func (r *RepoMemoryShare) Attempt(ctx context.Context, token string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	share, ok := r.get(token)
+	if !ok {
+		return fmt.Errorf("no share '%s' in memory: %w", token, repo.ErrNotFound)
+	}
+
+	now := time.Now()
+	if now.Before(share.LockedUntil) {
+		return fmt.Errorf("share '%s' until %s: %w", token, share.LockedUntil.Format(time.RFC3339), repo.ErrLocked)
+	}
+
+	share.FailedAttempts++
+	share.LockedUntil = now.Add(model.ShareLockout(share.FailedAttempts))
+	r.shares[token] = share
+
+	return nil
+}
+
+func (r *RepoMemoryShare) DeleteByTokenAndOwner(ctx context.Context, token string, ownerId string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	share, ok := r.get(token)
+	if !ok || share.OwnerId != ownerId {
+		return fmt.Errorf("no share '%s' of owner '%s' in memory: %w", token, ownerId, repo.ErrNotFound)
+	}
+
+	delete(r.shares, token)
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoMemorySpace struct {
+	mut    sync.RWMutex
+	spaces map[string]model.Space
+	// members maps space id to roles by user id
+	members map[string]map[string]string
+}
+
+func NewSpace() repo.RepositorySpace {
+	return &RepoMemorySpace{
+		spaces:  make(map[string]model.Space),
+		members: make(map[string]map[string]string),
+	}
+}
+
+func (r *RepoMemorySpace) Create(ctx context.Context, space model.Space) error {
+	if space.Id == "" || space.OwnerId == "" {
+		return fmt.Errorf("empty space id or owner: %w", repo.ErrInvalid)
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	if _, ok := r.spaces[space.Id]; ok {
+		return fmt.Errorf("space id '%s' is already taken: %w", space.Id, repo.ErrConflict)
+	}
+
+	if space.CreatedAt.IsZero() {
+		space.CreatedAt = time.Now()
+	}
+
+	r.spaces[space.Id] = space
+	r.members[space.Id] = map[string]string{space.OwnerId: model.RoleOwner}
+
+	return nil
+}
+
+func (r *RepoMemorySpace) GetById(ctx context.Context, id string) (model.Space, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	space, ok := r.spaces[id]
+	if !ok {
+		return model.Space{}, fmt.Errorf("no space '%s' in memory: %w", id, repo.ErrNotFound)
+	}
+
+	return space, nil
+}
+
+func (r *RepoMemorySpace) GetAllByMember(ctx context.Context, userId string) ([]model.Space, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	spaces := []model.Space{}
+	for id, members := range r.members {
+		if _, ok := members[userId]; ok {
+			spaces = append(spaces, r.spaces[id])
+		}
+	}
+
+	return spaces, nil
+}
+
+func (r *RepoMemorySpace) GetMember(ctx context.Context, spaceId string, userId string) (model.Member, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	role, ok := r.members[spaceId][userId]
+	if !ok {
+		return model.Member{}, fmt.Errorf("no member '%s' of space '%s' in memory: %w", userId, spaceId, repo.ErrNotFound)
+	}
+
+	return model.Member{SpaceId: spaceId, UserId: userId, Role: role}, nil
+}
+
+func (r *RepoMemorySpace) GetMembers(ctx context.Context, spaceId string) ([]model.Member, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	members := []model.Member{}
+	for userId, role := range r.members[spaceId] {
+		members = append(members, model.Member{SpaceId: spaceId, UserId: userId, Role: role})
+	}
+
+	return members, nil
+}
+
+func (r *RepoMemorySpace) PutMember(ctx context.Context, member model.Member) error {
+	if member.UserId == "" || !model.ValidRole(member.Role) {
+		return fmt.Errorf("bad member: %w", repo.ErrInvalid)
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	members, ok := r.members[member.SpaceId]
+	if !ok {
+		return fmt.Errorf("no space '%s' in memory: %w", member.SpaceId, repo.ErrNotFound)
+	}
+
+	members[member.UserId] = member.Role
+
+	return nil
+}
+
+func (r *RepoMemorySpace) DeleteMember(ctx context.Context, spaceId string, userId string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	if _, ok := r.members[spaceId][userId]; !ok {
+		return fmt.Errorf("no member '%s' of space '%s' in memory: %w", userId, spaceId, repo.ErrNotFound)
+	}
+
+	delete(r.members[spaceId], userId)
+
+	return nil
+}
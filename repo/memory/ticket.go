@@ -0,0 +1,41 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eymyong/drop/repo"
+)
+
+// RepoMemoryTicket only remembers tickets used with this instance,
+// which is all there is with the memory backend
+type RepoMemoryTicket struct {
+	mut  sync.Mutex
+	used map[string]time.Time
+}
+
+func NewTicket() repo.RepositoryTicket {
+	return &RepoMemoryTicket{used: make(map[string]time.Time)}
+}
+
+func (r *RepoMemoryTicket) Use(ctx context.Context, id string, expiresAt time.Time) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	now := time.Now()
+	for usedId, exp := range r.used {
+		if !now.Before(exp) {
+			delete(r.used, usedId)
+		}
+	}
+
+	if _, ok := r.used[id]; ok {
+		return fmt.Errorf("ticket '%s' is already used: %w", id, repo.ErrConflict)
+	}
+
+	r.used[id] = expiresAt
+
+	return nil
+}
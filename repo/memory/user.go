@@ -0,0 +1,141 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoMemoryUser struct {
+	mut   sync.RWMutex
+	users map[string]model.User
+	// logins maps username to user id
+	logins map[string]string
+}
+
+func NewUser() repo.RepositoryUser {
+	return &RepoMemoryUser{
+		users:  make(map[string]model.User),
+		logins: make(map[string]string),
+	}
+}
+
+func (r *RepoMemoryUser) Create(ctx context.Context, user model.User) (model.User, error) {
+	if user.Id == "" || user.Username == "" {
+		return model.User{}, fmt.Errorf("empty user id or username: %w", repo.ErrInvalid)
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	if _, ok := r.users[user.Id]; ok {
+		return model.User{}, fmt.Errorf("the new user id is already taken: %w", repo.ErrConflict)
+	}
+
+	if _, ok := r.logins[user.Username]; ok {
+		return model.User{}, fmt.Errorf("username '%s' is already taken: %w", user.Username, repo.ErrConflict)
+	}
+
+	r.users[user.Id] = user
+	r.logins[user.Username] = user.Id
+
+	return user, nil
+}
+
+func (r *RepoMemoryUser) GetPassword(ctx context.Context, username string) ([]byte, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	id, ok := r.logins[username]
+	if !ok {
+		return nil, fmt.Errorf("failed to get password for username '%s': %w", username, repo.ErrNotFound)
+	}
+
+	return []byte(r.users[id].Password), nil
+}
+
+func (r *RepoMemoryUser) GetByUsername(ctx context.Context, username string) (model.User, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	id, ok := r.logins[username]
+	if !ok {
+		return model.User{}, fmt.Errorf("username '%s': %w", username, repo.ErrNotFound)
+	}
+
+	return r.users[id], nil
+}
+
+func (r *RepoMemoryUser) GetById(ctx context.Context, id string) (model.User, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return model.User{}, fmt.Errorf("no user '%s' in memory: %w", id, repo.ErrNotFound)
+	}
+
+	return user, nil
+}
+
+func (r *RepoMemoryUser) UpdateUsername(ctx context.Context, id string, newUsername string) error {
+	if newUsername == "" {
+		return fmt.Errorf("empty username: %w", repo.ErrInvalid)
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return fmt.Errorf("user id '%s': %w", id, repo.ErrNotFound)
+	}
+
+	if user.Username == newUsername {
+		return nil
+	}
+
+	if _, ok := r.logins[newUsername]; ok {
+		return fmt.Errorf("username %s is already taken: %w", newUsername, repo.ErrConflict)
+	}
+
+	delete(r.logins, user.Username)
+	r.logins[newUsername] = id
+	user.Username = newUsername
+	r.users[id] = user
+
+	return nil
+}
+
+func (r *RepoMemoryUser) UpdatePassword(ctx context.Context, id string, newPassword string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return fmt.Errorf("failed to update password for user id '%s': %w", id, repo.ErrNotFound)
+	}
+
+	user.Password = newPassword
+	r.users[id] = user
+
+	return nil
+}
+
+func (r *RepoMemoryUser) Delete(ctx context.Context, id string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return fmt.Errorf("0 user deleted for id '%s': %w", id, repo.ErrNotFound)
+	}
+
+	delete(r.users, id)
+	delete(r.logins, user.Username)
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package repo
+
+import (
+	"fmt"
+
+	"github.com/eymyong/drop/model"
+)
+
+// Quota limits the storage of each owner of clipboards,
+// zero fields are unlimited
+type Quota struct {
+	MaxBytes int64 `json:"max_bytes"`
+	MaxClips int64 `json:"max_clips"`
+}
+
+// Check returns ErrQuotaClips or ErrQuotaBytes if usage leaves no room
+// for clips more clipboards of size more bytes in total
+func (q Quota) Check(usage model.Usage, clips int64, size int64) error {
+	if q.MaxClips > 0 && clips > 0 && usage.Clips+clips > q.MaxClips {
+		return fmt.Errorf("%d of %d clipboards: %w", usage.Clips, q.MaxClips, ErrQuotaClips)
+	}
+
+	if q.MaxBytes > 0 && size > 0 && usage.Bytes+size > q.MaxBytes {
+		return fmt.Errorf("%d of %d bytes: %w", usage.Bytes, q.MaxBytes, ErrQuotaBytes)
+	}
+
+	return nil
+}
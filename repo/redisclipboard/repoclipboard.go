@@ -2,7 +2,12 @@ package redisclipboard
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/eymyong/drop/model"
 	"github.com/eymyong/drop/repo"
@@ -10,105 +15,1156 @@ import (
 )
 
 type RepoRedis struct {
-	rd *redis.Client
+	rd    *redis.Client
+	quota repo.Quota
 }
 
+var _ repo.ClipboardEvents = (*RepoRedis)(nil)
+
 func keyRedisClipboard(id string) string {
 	return "clipboard:" + id
 }
 
+// keyRedisHistory is a sorted set of clipboard ids owned by ownerId,
+// scored by creation time in unix microseconds
+func keyRedisHistory(ownerId string) string {
+	return "clipboard-history:" + ownerId
+}
+
+// keyRedisDeviceHistory is like keyRedisHistory, but only of clipboards
+// created from deviceId. Deleted clipboards are removed from it lazily.
+func keyRedisDeviceHistory(ownerId, deviceId string) string {
+	return "clipboard-history-device:" + ownerId + ":" + deviceId
+}
+
+// keyRedisUsage is a hash of the number and total size of clipboards
+// owned by ownerId, in fields "clips" and "bytes"
+func keyRedisUsage(ownerId string) string {
+	return "clipboard-usage:" + ownerId
+}
+
+// keyRedisExpiring is a sorted set of expiring clipboards owned by ownerId
+// as "<size>:<id>", scored by expiry time in unix microseconds, so that
+// they can be taken out of usage once Redis has deleted them
+func keyRedisExpiring(ownerId string) string {
+	return "clipboard-usage-expiring:" + ownerId
+}
+
+// keyRedisEvents is the Pub/Sub channel of events of clipboards owned by ownerId
+func keyRedisEvents(ownerId string) string {
+	return "clipboard-events:" + ownerId
+}
+
+// keyRedisFeed is a stream of recent events of clipboards owned by ownerId
+func keyRedisFeed(ownerId string) string {
+	return "clipboard-feed:" + ownerId
+}
+
+const (
+	// feedMaxLen is roughly how many events are kept for resuming subscribers
+	feedMaxLen = 1000
+	// feedTTL is how long the feed of an idle owner is kept
+	feedTTL = 7 * 24 * time.Hour
+	// maxRetries is how many times a transaction is retried
+	// when the keys it watches are changed by another client
+	maxRetries = 10
+)
+
+func score(t time.Time) float64 {
+	return float64(t.UnixMicro())
+}
+
 func New(addr string, db int) repo.RepositoryClipboard {
+	return NewWithQuota(addr, db, repo.Quota{})
+}
+
+func NewWithQuota(addr string, db int, quota repo.Quota) repo.RepositoryClipboard {
 	rd := redis.NewClient(&redis.Options{
 		Addr: addr,
 		DB:   db,
 	})
 
-	return &RepoRedis{rd: rd}
+	return &RepoRedis{rd: rd, quota: quota}
+}
+
+// watch runs fn in a transaction watching keys like redis.Client.Watch,
+// and retries it if the keys are changed before it commits
+func (r *RepoRedis) watch(ctx context.Context, fn func(*redis.Tx) error, keys ...string) error {
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		err = r.rd.Watch(ctx, fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+
+	return err
 }
 
 func (r *RepoRedis) Create(ctx context.Context, clip model.Clipboard) error {
-	err := r.rd.HSet(ctx, keyRedisClipboard(clip.Id), "id", clip.Id, "text", clip.Text).Err()
+	if clip.Id == "" {
+		return fmt.Errorf("empty clipboard id: %w", repo.ErrInvalid)
+	}
+
+	now := time.Now()
+	if clip.CreatedAt.IsZero() {
+		clip.CreatedAt = now
+	}
+	if clip.UpdatedAt.IsZero() {
+		clip.UpdatedAt = clip.CreatedAt
+	}
+
+	clip.Content = clip.Content.Normalize()
+	fields := contentFields(clip.Content)
+	fields["id"] = clip.Id
+	fields["owner_id"] = clip.OwnerId
+	fields["created_at"] = clip.CreatedAt.Format(time.RFC3339Nano)
+	fields["updated_at"] = clip.UpdatedAt.Format(time.RFC3339Nano)
+	if clip.Filename != "" {
+		fields["filename"] = clip.Filename
+	}
+	if clip.BurnAfterRead {
+		fields["burn_after_read"] = "1"
+	}
+	if clip.DeviceId != "" {
+		fields["device_id"] = clip.DeviceId
+	}
+	if !clip.ExpiresAt.IsZero() {
+		fields["expires_at"] = clip.ExpiresAt.Format(time.RFC3339Nano)
+	}
+
+	key := keyRedisClipboard(clip.Id)
+	err := r.watch(ctx, func(tx *redis.Tx) error {
+		c, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("redis exists err: %w", err)
+		}
+
+		if c != 0 {
+			return fmt.Errorf("clipboard id '%s' is already taken: %w", clip.Id, repo.ErrConflict)
+		}
+
+		var usage *ownerUsage
+		if clip.OwnerId != "" {
+			usage, err = readUsage(ctx, tx, clip.OwnerId)
+			if err != nil {
+				return err
+			}
+
+			err = r.checkQuota(usage, 1, clip.Size)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, fields)
+			if !clip.ExpiresAt.IsZero() {
+				pipe.ExpireAt(ctx, key, clip.ExpiresAt)
+			}
+
+			// Expired and burnt clipboards are removed from history
+			// lazily, next time the history is read
+			if clip.OwnerId != "" {
+				z := redis.Z{Score: score(clip.CreatedAt), Member: clip.Id}
+				pipe.ZAdd(ctx, keyRedisHistory(clip.OwnerId), z)
+				if clip.DeviceId != "" {
+					pipe.ZAdd(ctx, keyRedisDeviceHistory(clip.OwnerId, clip.DeviceId), z)
+				}
+
+				usage.write(ctx, pipe, 1, clip.Size)
+				stored := clipUsage{ownerId: clip.OwnerId, size: clip.Size, expiresAt: clip.ExpiresAt}
+				stored.addExpiring(ctx, pipe, clip.Id)
+			}
+
+			publish(ctx, pipe, model.EventCreate, clip.Id, clip.OwnerId)
+
+			return nil
+		})
+
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return fmt.Errorf("clipboard '%s' is written concurrently: %w", clip.Id, repo.ErrConflict)
+	}
 	if err != nil {
-		return fmt.Errorf("hset redis err: %w", err)
+		return fmt.Errorf("create clipboard redis err: %w", err)
 	}
+
 	return nil
 }
 
+// GetAll uses SCAN instead of KEYS so that it does not block Redis
 func (r *RepoRedis) GetAll(ctx context.Context) ([]model.Clipboard, error) {
-	keyClipboards, err := r.rd.Keys(ctx, "clipboard:*").Result()
+	clipboards := []model.Clipboard{}
+
+	var cursor uint64
+	for {
+		keys, next, err := r.rd.Scan(ctx, cursor, keyRedisClipboard("*"), 100).Result()
+		if err != nil {
+			return []model.Clipboard{}, fmt.Errorf("scan redis err: %w", err)
+		}
+
+		clips, err := r.getAllKeys(ctx, keys)
+		if err != nil {
+			return []model.Clipboard{}, err
+		}
+
+		clipboards = append(clipboards, clips...)
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	return clipboards, nil
+}
+
+func (r *RepoRedis) GetAllByOwner(ctx context.Context, ownerId string) ([]model.Clipboard, error) {
+	ids, err := r.rd.ZRange(ctx, keyRedisHistory(ownerId), 0, -1).Result()
 	if err != nil {
-		return []model.Clipboard{}, fmt.Errorf("keys redis err: %w", err)
+		return []model.Clipboard{}, fmt.Errorf("zrange redis err: %w", err)
 	}
 
-	clipboards := []model.Clipboard{}
-	for _, v := range keyClipboards {
-		data, err := r.rd.HGetAll(ctx, v).Result()
+	return r.getHistory(ctx, keyRedisHistory(ownerId), ids)
+}
+
+func (r *RepoRedis) ListByOwner(ctx context.Context, ownerId string, limit int, cursor string) ([]model.Clipboard, string, error) {
+	return r.listHistory(ctx, keyRedisHistory(ownerId), limit, cursor)
+}
+
+func (r *RepoRedis) ListByDevice(ctx context.Context, ownerId string, deviceId string, limit int, cursor string) ([]model.Clipboard, string, error) {
+	return r.listHistory(ctx, keyRedisDeviceHistory(ownerId, deviceId), limit, cursor)
+}
+
+// listHistory pages through history sorted set key, newest first
+func (r *RepoRedis) listHistory(ctx context.Context, key string, limit int, cursor string) ([]model.Clipboard, string, error) {
+	if limit <= 0 {
+		return []model.Clipboard{}, "", fmt.Errorf("bad limit %d: %w", limit, repo.ErrInvalid)
+	}
+
+	max := "+inf"
+
+	var (
+		afterScore float64
+		afterId    string
+		ties       int64
+	)
+
+	if cursor != "" {
+		createdAt, id, err := repo.DecodeCursor(cursor)
 		if err != nil {
-			return []model.Clipboard{}, fmt.Errorf("hgetall redis err: %w", err)
+			return []model.Clipboard{}, "", err
 		}
 
-		clipboard := model.Clipboard{}
-		for k, v := range data {
-			switch k {
-			case "id":
-				clipboard.Id = v
-			case "text":
-				clipboard.Text = v
-			}
+		afterScore, afterId = score(createdAt), id
+		max = strconv.FormatFloat(afterScore, 'f', -1, 64)
+
+		// Clipboards created in the same microsecond as the cursor
+		// are ordered by id, so we fetch them all and skip the ones
+		// we have already returned
+		ties, err = r.rd.ZCount(ctx, key, max, max).Result()
+		if err != nil {
+			return []model.Clipboard{}, "", fmt.Errorf("zcount redis err: %w", err)
 		}
-		clipboards = append(clipboards, clipboard)
 	}
 
-	return clipboards, nil
+	zs, err := r.rd.ZRevRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Max:   max,
+		Min:   "-inf",
+		Count: int64(limit) + 1 + ties,
+	}).Result()
+	if err != nil {
+		return []model.Clipboard{}, "", fmt.Errorf("zrevrangebyscore redis err: %w", err)
+	}
+
+	page := make([]redis.Z, 0, limit+1)
+	for _, z := range zs {
+		if cursor != "" && z.Score == afterScore && z.Member.(string) >= afterId {
+			continue
+		}
+
+		page = append(page, z)
+	}
+
+	next := ""
+	if len(page) > limit {
+		page = page[:limit]
+		last := page[limit-1]
+		next = repo.EncodeCursor(time.UnixMicro(int64(last.Score)), last.Member.(string))
+	}
+
+	ids := make([]string, len(page))
+	for i := range page {
+		ids[i] = page[i].Member.(string)
+	}
+
+	clipboards, err := r.getHistory(ctx, key, ids)
+	if err != nil {
+		return []model.Clipboard{}, "", err
+	}
+
+	return clipboards, next, nil
 }
 
-func (r *RepoRedis) GetById(ctx context.Context, id string) (model.Clipboard, error) {
-	data, err := r.rd.HGetAll(ctx, keyRedisClipboard(id)).Result()
+func (r *RepoRedis) GetByOwnerInRange(ctx context.Context, ownerId string, from, to time.Time, limit int) ([]model.Clipboard, error) {
+	return r.historyInRange(ctx, keyRedisHistory(ownerId), from, to, limit)
+}
+
+func (r *RepoRedis) GetByDeviceInRange(ctx context.Context, ownerId string, deviceId string, from, to time.Time, limit int) ([]model.Clipboard, error) {
+	return r.historyInRange(ctx, keyRedisDeviceHistory(ownerId, deviceId), from, to, limit)
+}
+
+// historyInRange returns at most limit clipboards of history sorted set key
+// created in [from, to), newest first
+func (r *RepoRedis) historyInRange(ctx context.Context, key string, from, to time.Time, limit int) ([]model.Clipboard, error) {
+	if limit <= 0 {
+		return []model.Clipboard{}, fmt.Errorf("bad limit %d: %w", limit, repo.ErrInvalid)
+	}
+
+	min, max := "-inf", "+inf"
+	if !from.IsZero() {
+		min = strconv.FormatInt(from.UnixMicro(), 10)
+	}
+	if !to.IsZero() {
+		max = "(" + strconv.FormatInt(to.UnixMicro(), 10)
+	}
+
+	ids, err := r.rd.ZRevRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min:   min,
+		Max:   max,
+		Count: int64(limit),
+	}).Result()
 	if err != nil {
-		return model.Clipboard{}, fmt.Errorf("hgetall redis err: %w", err)
+		return []model.Clipboard{}, fmt.Errorf("zrevrangebyscore redis err: %w", err)
 	}
 
-	if len(data) == 0 {
-		return model.Clipboard{}, fmt.Errorf("no data in redis")
+	return r.getHistory(ctx, key, ids)
+}
+
+// scriptGet returns all fields of clipboard KEYS[1], and deletes it
+// if it's burn-after-read, along with its id in history KEYS[2] and
+// device history KEYS[5], and its usage in KEYS[3] and KEYS[4].
+// These keys are of owner ARGV[1] and device ARGV[2], as read before
+// the script runs, so that it only touches keys it's given. Clipboards
+// of another owner, which would not match the keys, are not returned.
+var scriptGet = redis.NewScript(`
+local data = redis.call("HGETALL", KEYS[1])
+if #data == 0 then
+	return data
+end
+
+local id, owner, device, burn, size = "", "", "", "0", nil
+for i = 1, #data, 2 do
+	if data[i] == "id" then
+		id = data[i + 1]
+	elseif data[i] == "owner_id" then
+		owner = data[i + 1]
+	elseif data[i] == "device_id" then
+		device = data[i + 1]
+	elseif data[i] == "burn_after_read" then
+		burn = data[i + 1]
+	elseif data[i] == "size" then
+		size = data[i + 1]
+	end
+end
+
+if owner ~= ARGV[1] or device ~= ARGV[2] then
+	return {}
+end
+
+if burn == "1" then
+	if size == nil then
+		size = tostring(redis.call("HSTRLEN", KEYS[1], "text"))
+	end
+
+	redis.call("DEL", KEYS[1])
+	if owner ~= "" then
+		redis.call("ZREM", KEYS[2], id)
+		redis.call("ZREM", KEYS[4], size .. ":" .. id)
+		if redis.call("EXISTS", KEYS[3]) == 1 then
+			redis.call("HINCRBY", KEYS[3], "clips", -1)
+			redis.call("HINCRBY", KEYS[3], "bytes", -tonumber(size))
+		end
+		if device ~= "" then
+			redis.call("ZREM", KEYS[5], id)
+		end
+	end
+end
+
+return data
+`)
+
+// UsageByOwner reads usage kept along with clipboards of ownerId,
+// after taking out clipboards that have expired since it was last written
+func (r *RepoRedis) UsageByOwner(ctx context.Context, ownerId string) (model.Usage, error) {
+	var usage model.Usage
+	err := r.watch(ctx, func(tx *redis.Tx) error {
+		u, err := readUsage(ctx, tx, ownerId)
+		if err != nil {
+			return err
+		}
+
+		usage = u.live
+		if !u.changed() {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			u.write(ctx, pipe, 0, 0)
+			return nil
+		})
+
+		return err
+	})
+	if err != nil {
+		return model.Usage{}, fmt.Errorf("get usage redis err: %w", err)
 	}
 
-	clipboard := model.Clipboard{}
-	for k, v := range data {
-		switch k {
-		case "id":
-			clipboard.Id = v
-		case "text":
-			clipboard.Text = v
+	return usage, nil
+}
+
+// ownerUsage is usage of an owner read in a transaction by readUsage
+type ownerUsage struct {
+	ownerId string
+	// live is usage without clipboards deleted by Redis on expiry
+	live model.Usage
+	// delta is the change from the stored usage to live
+	delta model.Usage
+	// expired are members of keyRedisExpiring already deleted by Redis
+	expired []interface{}
+	// backfilled is set if usage was not stored yet,
+	// with members of keyRedisExpiring found by counting history
+	backfilled bool
+	expiring   []redis.Z
+}
+
+// readUsage watches and reads usage of ownerId in tx. Usage of owners
+// with clipboards created before usage was stored is counted once
+// from their history.
+func readUsage(ctx context.Context, tx *redis.Tx, ownerId string) (*ownerUsage, error) {
+	usageKey, expiringKey := keyRedisUsage(ownerId), keyRedisExpiring(ownerId)
+	err := tx.Watch(ctx, usageKey, expiringKey, keyRedisHistory(ownerId)).Err()
+	if err != nil {
+		return nil, fmt.Errorf("watch redis err: %w", err)
+	}
+
+	u := &ownerUsage{ownerId: ownerId}
+	vals, err := tx.HMGet(ctx, usageKey, "clips", "bytes").Result()
+	if err != nil {
+		return nil, fmt.Errorf("hmget redis err: %w", err)
+	}
+
+	if vals[0] == nil {
+		return u, u.backfill(ctx, tx)
+	}
+
+	for i, n := range []*int64{&u.live.Clips, &u.live.Bytes} {
+		if s, ok := vals[i].(string); ok {
+			*n, _ = strconv.ParseInt(s, 10, 64)
 		}
 	}
 
-	return clipboard, nil
+	members, err := tx.ZRangeByScore(ctx, expiringKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().UnixMicro(), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("zrangebyscore redis err: %w", err)
+	}
+
+	for _, member := range members {
+		size, _, _ := strings.Cut(member, ":")
+		n, _ := strconv.ParseInt(size, 10, 64)
+
+		u.delta.Clips--
+		u.delta.Bytes -= n
+		u.expired = append(u.expired, member)
+	}
+
+	u.live.Clips += u.delta.Clips
+	u.live.Bytes += u.delta.Bytes
+
+	return u, nil
 }
 
-func (r *RepoRedis) Update(ctx context.Context, id string, newdata string) error {
+// backfill counts live clipboards in history of the owner
+func (u *ownerUsage) backfill(ctx context.Context, tx *redis.Tx) error {
+	ids, err := tx.ZRange(ctx, keyRedisHistory(u.ownerId), 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("zrange redis err: %w", err)
+	}
+
+	clips := make([]clipUsage, len(ids))
+	found := make([]bool, len(ids))
+	for i := range ids {
+		clips[i], found[i], err = readClipUsage(ctx, tx, keyRedisClipboard(ids[i]))
+		if err != nil {
+			return err
+		}
+	}
+
+	u.backfilled = true
+	for i := range ids {
+		if !found[i] {
+			continue
+		}
+
+		u.live.Clips++
+		u.live.Bytes += clips[i].size
+		if !clips[i].expiresAt.IsZero() {
+			u.expiring = append(u.expiring, clips[i].expiringZ(ids[i]))
+		}
+	}
+
+	u.delta = u.live
+
+	return nil
+}
+
+func (u *ownerUsage) changed() bool {
+	return u.backfilled || len(u.expired) != 0
+}
+
+// write queues usage changed by clips more clipboards of size more bytes
+// into pipe, with HINCRBY so that usage written by scriptGet is kept
+func (u *ownerUsage) write(ctx context.Context, pipe redis.Pipeliner, clips int64, size int64) {
+	usageKey, expiringKey := keyRedisUsage(u.ownerId), keyRedisExpiring(u.ownerId)
+	pipe.HIncrBy(ctx, usageKey, "clips", u.delta.Clips+clips)
+	pipe.HIncrBy(ctx, usageKey, "bytes", u.delta.Bytes+size)
+
+	if len(u.expired) != 0 {
+		pipe.ZRem(ctx, expiringKey, u.expired...)
+	}
+
+	if u.backfilled {
+		pipe.Del(ctx, expiringKey)
+		if len(u.expiring) != 0 {
+			pipe.ZAdd(ctx, expiringKey, u.expiring...)
+		}
+	}
+}
+
+func (r *RepoRedis) checkQuota(u *ownerUsage, clips int64, size int64) error {
+	if r.quota == (repo.Quota{}) {
+		return nil
+	}
+
+	return r.quota.Check(u.live, clips, size)
+}
+
+// clipUsage is what a stored clipboard counts towards usage of its owner
+type clipUsage struct {
+	ownerId   string
+	size      int64
+	expiresAt time.Time
+}
+
+// readClipUsage reads usage of clipboard key in tx,
+// and returns false if it does not exist
+func readClipUsage(ctx context.Context, tx *redis.Tx, key string) (clipUsage, bool, error) {
+	vals, err := tx.HMGet(ctx, key, "owner_id", "size", "expires_at").Result()
+	if err != nil {
+		return clipUsage{}, false, fmt.Errorf("hmget redis err: %w", err)
+	}
+
+	if vals[0] == nil {
+		return clipUsage{}, false, nil
+	}
+
+	clip := clipUsage{}
+	clip.ownerId, _ = vals[0].(string)
+	if s, ok := vals[2].(string); ok {
+		clip.expiresAt, _ = time.Parse(time.RFC3339Nano, s)
+	}
+
+	if s, ok := vals[1].(string); ok {
+		clip.size, _ = strconv.ParseInt(s, 10, 64)
+		return clip, true, nil
+	}
+
+	// Clipboards created before sizes were stored
+	cmd := redis.NewIntCmd(ctx, "HSTRLEN", key, "text")
+	err = tx.Process(ctx, cmd)
+	if err != nil {
+		return clipUsage{}, false, fmt.Errorf("hstrlen redis err: %w", err)
+	}
+
+	clip.size = cmd.Val()
+	return clip, true, nil
+}
+
+func (c clipUsage) expiringZ(id string) redis.Z {
+	return redis.Z{
+		Score:  score(c.expiresAt),
+		Member: strconv.FormatInt(c.size, 10) + ":" + id,
+	}
+}
+
+// addExpiring and removeExpiring queue changes of keyRedisExpiring
+// of clipboard id into pipe, if it expires
+func (c clipUsage) addExpiring(ctx context.Context, pipe redis.Pipeliner, id string) {
+	if !c.expiresAt.IsZero() {
+		pipe.ZAdd(ctx, keyRedisExpiring(c.ownerId), c.expiringZ(id))
+	}
+}
+
+func (c clipUsage) removeExpiring(ctx context.Context, pipe redis.Pipeliner, id string) {
+	if !c.expiresAt.IsZero() {
+		pipe.ZRem(ctx, keyRedisExpiring(c.ownerId), c.expiringZ(id).Member)
+	}
+}
+
+func (r *RepoRedis) GetById(ctx context.Context, id string) (model.Clipboard, error) {
+	clip, ok, err := r.get(ctx, id, false, "")
+	if err != nil {
+		return model.Clipboard{}, err
+	}
+
+	if !ok {
+		return model.Clipboard{}, fmt.Errorf("no data in redis for clipboard '%s': %w", id, repo.ErrNotFound)
+	}
+
+	return clip, nil
+}
+
+func (r *RepoRedis) GetByIdAndOwner(ctx context.Context, id string, ownerId string) (model.Clipboard, error) {
+	clip, ok, err := r.get(ctx, id, true, ownerId)
+	if err != nil {
+		return model.Clipboard{}, err
+	}
+
+	if !ok {
+		return model.Clipboard{}, fmt.Errorf("clipboard '%s': %w", id, repo.ErrNotFound)
+	}
+
+	return clip, nil
+}
+
+func (r *RepoRedis) GetBlobKey(ctx context.Context, id string) (string, error) {
+	vals, err := r.rd.HMGet(ctx, keyRedisClipboard(id), "id", "blob_key").Result()
+	if err != nil {
+		return "", fmt.Errorf("hmget redis err: %w", err)
+	}
+
+	if vals[0] == nil {
+		return "", fmt.Errorf("no data in redis for clipboard '%s': %w", id, repo.ErrNotFound)
+	}
+
+	key, _ := vals[1].(string)
+	return key, nil
+}
+
+func (r *RepoRedis) CheckOwner(ctx context.Context, id string, ownerId string) error {
+	owner, err := r.rd.HGet(ctx, keyRedisClipboard(id), "owner_id").Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("hget redis err: %w", err)
+	}
+
+	if err == redis.Nil || owner != ownerId {
+		return fmt.Errorf("no data in redis for clipboard '%s' of owner '%s': %w", id, ownerId, repo.ErrNotFound)
+	}
+
+	return nil
+}
+
+func (r *RepoRedis) get(ctx context.Context, id string, checkOwner bool, ownerId string) (model.Clipboard, bool, error) {
 	key := keyRedisClipboard(id)
-	c, err := r.rd.Exists(ctx, key).Result()
+
+	// Owner and device are read first for the keys of scriptGet,
+	// which checks they are still the same
+	vals, err := r.rd.HMGet(ctx, key, "id", "owner_id", "device_id").Result()
 	if err != nil {
-		return fmt.Errorf("redis exists err: %w", err)
+		return model.Clipboard{}, false, fmt.Errorf("hmget redis err: %w", err)
 	}
 
-	if c != 1 {
-		return fmt.Errorf("unexpected length of redis keys %s: %d", key, c)
+	owner, _ := vals[1].(string)
+	device, _ := vals[2].(string)
+	if vals[0] == nil || (checkOwner && owner != ownerId) {
+		return model.Clipboard{}, false, nil
 	}
 
-	err = r.rd.HSet(ctx, key, "text", newdata).Err()
+	keys := []string{
+		key,
+		keyRedisHistory(owner),
+		keyRedisUsage(owner),
+		keyRedisExpiring(owner),
+		keyRedisDeviceHistory(owner, device),
+	}
+
+	result, err := scriptGet.Run(ctx, r.rd, keys, owner, device).StringSlice()
 	if err != nil {
-		return fmt.Errorf("hset redis err: %w", err)
+		return model.Clipboard{}, false, fmt.Errorf("get script redis err: %w", err)
+	}
+
+	if len(result) == 0 {
+		return model.Clipboard{}, false, nil
+	}
+
+	data := make(map[string]string, len(result)/2)
+	for i := 0; i+1 < len(result); i += 2 {
+		data[result[i]] = result[i+1]
+	}
+
+	clip := parseClipboard(data)
+	if clip.BurnAfterRead && clip.OwnerId != "" {
+		_, err = r.rd.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			publish(ctx, pipe, model.EventDelete, clip.Id, clip.OwnerId)
+			return nil
+		})
+		if err != nil {
+			return model.Clipboard{}, false, fmt.Errorf("publish redis err: %w", err)
+		}
+	}
+
+	return clip, true, nil
+}
+
+func (r *RepoRedis) Update(ctx context.Context, id string, content model.Content) error {
+	return r.update(ctx, id, false, "", content)
+}
+
+func (r *RepoRedis) UpdateByIdAndOwner(ctx context.Context, id string, ownerId string, content model.Content) error {
+	return r.update(ctx, id, true, ownerId, content)
+}
+
+func (r *RepoRedis) update(ctx context.Context, id string, checkOwner bool, ownerId string, content model.Content) error {
+	key := keyRedisClipboard(id)
+	content = content.Normalize()
+
+	// WATCH the clipboard so that we never write to a clipboard
+	// deleted or re-owned after the owner check
+	err := r.watch(ctx, func(tx *redis.Tx) error {
+		old, ok, err := readClipUsage(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if !ok || (checkOwner && old.ownerId != ownerId) {
+			return fmt.Errorf("clipboard '%s': %w", id, repo.ErrNotFound)
+		}
+
+		var usage *ownerUsage
+		if old.ownerId != "" {
+			usage, err = readUsage(ctx, tx, old.ownerId)
+			if err != nil {
+				return err
+			}
+
+			err = r.checkQuota(usage, 0, content.Size-old.size)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, updateFields(content))
+			if usage != nil {
+				usage.write(ctx, pipe, 0, content.Size-old.size)
+
+				new := old
+				new.size = content.Size
+				old.removeExpiring(ctx, pipe, id)
+				new.addExpiring(ctx, pipe, id)
+			}
+
+			publish(ctx, pipe, model.EventUpdate, id, old.ownerId)
+
+			return nil
+		})
+
+		return err
+	}, key)
+	if err != nil {
+		return fmt.Errorf("update clipboard redis err: %w", err)
 	}
 
 	return nil
 }
 
 func (r *RepoRedis) Delete(ctx context.Context, id string) error {
-	err := r.rd.Del(ctx, keyRedisClipboard(id)).Err()
+	return r.delete(ctx, id, false, "")
+}
+
+// DeleteExpired does nothing, as clipboards are deleted by Redis EXPIREAT
+func (r *RepoRedis) DeleteExpired(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (r *RepoRedis) DeleteByIdAndOwner(ctx context.Context, id string, ownerId string) error {
+	return r.delete(ctx, id, true, ownerId)
+}
+
+// delete deletes clipboard id if it's owned by ownerId when checkOwner
+// is true. Without checkOwner, deleting a missing clipboard is not an error.
+func (r *RepoRedis) delete(ctx context.Context, id string, checkOwner bool, ownerId string) error {
+	key := keyRedisClipboard(id)
+	err := r.watch(ctx, func(tx *redis.Tx) error {
+		old, ok, err := readClipUsage(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if checkOwner && (!ok || old.ownerId != ownerId) {
+			return fmt.Errorf("clipboard '%s': %w", id, repo.ErrNotFound)
+		}
+		if !ok {
+			return nil
+		}
+
+		var usage *ownerUsage
+		if old.ownerId != "" {
+			usage, err = readUsage(ctx, tx, old.ownerId)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			if usage != nil {
+				pipe.ZRem(ctx, keyRedisHistory(old.ownerId), id)
+				usage.write(ctx, pipe, -1, -old.size)
+				old.removeExpiring(ctx, pipe, id)
+				publish(ctx, pipe, model.EventDelete, id, old.ownerId)
+			}
+
+			return nil
+		})
+
+		return err
+	}, key)
 	if err != nil {
 		return fmt.Errorf("del redis err: %w", err)
 	}
 
 	return nil
 }
+
+func (r *RepoRedis) CompareAndSwapContent(ctx context.Context, id string, old model.Content, new model.Content) error {
+	key := keyRedisClipboard(id)
+
+	err := r.rd.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.HMGet(ctx, key, "id", "checksum", "key_version", "data_key").Result()
+		if err != nil {
+			return fmt.Errorf("hmget redis err: %w", err)
+		}
+
+		if current[0] == nil {
+			return fmt.Errorf("clipboard '%s': %w", id, repo.ErrNotFound)
+		}
+
+		// Missing fields are nil, which is not the same as empty strings
+		field := func(i int) string {
+			s, _ := current[i].(string)
+			return s
+		}
+		// Clipboards created before checksums were stored
+		// have never been updated since
+		version, _ := strconv.Atoi(field(2))
+		if (field(1) != old.Checksum && field(1) != "") || version != old.KeyVersion || field(3) != old.DataKey {
+			return fmt.Errorf("clipboard '%s' changed: %w", id, repo.ErrConflict)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, contentFields(new))
+			return nil
+		})
+
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return fmt.Errorf("clipboard '%s' changed: %w", id, repo.ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("swap clipboard content redis err: %w", err)
+	}
+
+	return nil
+}
+
+// publish queues event of clipboard id into the feed of ownerId in pipe,
+// and wakes up its subscribers.
+// Expired clipboards are removed by Redis without any event.
+func publish(ctx context.Context, pipe redis.Pipeliner, eventType string, id string, ownerId string) {
+	if ownerId == "" {
+		return
+	}
+
+	b, err := json.Marshal(model.ClipboardEvent{
+		Type:        eventType,
+		ClipboardId: id,
+		OwnerId:     ownerId,
+		Time:        time.Now(),
+	})
+	if err != nil {
+		return
+	}
+
+	key := keyRedisFeed(ownerId)
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: key,
+		MaxLen: feedMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{"event": b},
+	})
+	pipe.Expire(ctx, key, feedTTL)
+	pipe.Publish(ctx, keyRedisEvents(ownerId), b)
+}
+
+func (r *RepoRedis) Subscribe(ctx context.Context, ownerId string) (<-chan model.ClipboardEvent, error) {
+	return r.SubscribeAfter(ctx, ownerId, "")
+}
+
+// SubscribeAfter reads events from the feed of ownerId, which only keeps
+// about the last feedMaxLen events. Pub/Sub messages only wake up
+// the reader, so that events from all API instances arrive in feed order.
+func (r *RepoRedis) SubscribeAfter(ctx context.Context, ownerId string, lastId string) (<-chan model.ClipboardEvent, error) {
+	if lastId != "" && !validStreamId(lastId) {
+		return nil, fmt.Errorf("bad event id '%s': %w", lastId, repo.ErrInvalid)
+	}
+
+	sub := r.rd.Subscribe(ctx, keyRedisEvents(ownerId))
+
+	// Wait for the subscription to be confirmed,
+	// so that no event published after we return is missed
+	_, err := sub.Receive(ctx)
+	if err != nil {
+		sub.Close()
+		return nil, fmt.Errorf("subscribe redis err: %w", err)
+	}
+
+	key := keyRedisFeed(ownerId)
+	if lastId == "" {
+		latest, err := r.rd.XRevRangeN(ctx, key, "+", "-", 1).Result()
+		if err != nil {
+			sub.Close()
+			return nil, fmt.Errorf("xrevrange redis err: %w", err)
+		}
+
+		lastId = "0-0"
+		if len(latest) != 0 {
+			lastId = latest[0].ID
+		}
+	}
+
+	events := make(chan model.ClipboardEvent, 16)
+	go func() {
+		defer close(events)
+		defer sub.Close()
+
+		wake := sub.Channel()
+		for {
+			messages, err := r.rd.XRange(ctx, key, "("+lastId, "+").Result()
+			if err != nil {
+				return
+			}
+
+			for _, msg := range messages {
+				lastId = msg.ID
+
+				event, ok := parseEvent(msg)
+				if !ok {
+					continue
+				}
+
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+
+			case _, ok := <-wake:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+func parseEvent(msg redis.XMessage) (model.ClipboardEvent, bool) {
+	data, ok := msg.Values["event"].(string)
+	if !ok {
+		return model.ClipboardEvent{}, false
+	}
+
+	var event model.ClipboardEvent
+	err := json.Unmarshal([]byte(data), &event)
+	if err != nil {
+		return model.ClipboardEvent{}, false
+	}
+
+	event.Id = msg.ID
+
+	return event, true
+}
+
+// validStreamId reports whether id is a Redis stream id, i.e. ms or ms-seq
+func validStreamId(id string) bool {
+	ms, seq, ok := strings.Cut(id, "-")
+	_, err := strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	if ok {
+		_, err = strconv.ParseUint(seq, 10, 64)
+	}
+
+	return err == nil
+}
+
+// getHistory gets clipboards ids from history sorted set key,
+// and removes ids of expired or burnt clipboards from the history
+func (r *RepoRedis) getHistory(ctx context.Context, key string, ids []string) ([]model.Clipboard, error) {
+	keys := make([]string, len(ids))
+	for i := range ids {
+		keys[i] = keyRedisClipboard(ids[i])
+	}
+
+	clipboards, err := r.getAllKeys(ctx, keys)
+	if err != nil {
+		return []model.Clipboard{}, err
+	}
+
+	if len(clipboards) == len(ids) {
+		return clipboards, nil
+	}
+
+	found := make(map[string]bool, len(clipboards))
+	for i := range clipboards {
+		found[clipboards[i].Id] = true
+	}
+
+	gone := []interface{}{}
+	for _, id := range ids {
+		if !found[id] {
+			gone = append(gone, id)
+		}
+	}
+
+	err = r.rd.ZRem(ctx, key, gone...).Err()
+	if err != nil {
+		return []model.Clipboard{}, fmt.Errorf("zrem redis err: %w", err)
+	}
+
+	return clipboards, nil
+}
+
+// getAllKeys gets clipboards in keys with pipelined HGETALLs,
+// keeping the order of keys and skipping missing ones
+func (r *RepoRedis) getAllKeys(ctx context.Context, keys []string) ([]model.Clipboard, error) {
+	if len(keys) == 0 {
+		return []model.Clipboard{}, nil
+	}
+
+	cmds := make([]*redis.MapStringStringCmd, len(keys))
+	_, err := r.rd.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range keys {
+			cmds[i] = pipe.HGetAll(ctx, keys[i])
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []model.Clipboard{}, fmt.Errorf("hgetall redis err: %w", err)
+	}
+
+	clipboards := []model.Clipboard{}
+	for _, cmd := range cmds {
+		data := cmd.Val()
+		if len(data) == 0 {
+			continue
+		}
+
+		clipboards = append(clipboards, parseClipboard(data))
+	}
+
+	return clipboards, nil
+}
+
+// contentFields are the hash fields of normalized content
+func contentFields(content model.Content) map[string]interface{} {
+	content = content.Normalize()
+
+	// Always set, so that replacing encrypted content clears its envelope
+	envelope := ""
+	if content.Envelope != nil {
+		envelope = content.Envelope.String()
+	}
+
+	return map[string]interface{}{
+		"text":        content.Text,
+		"mime_type":   content.MimeType,
+		"size":        content.Size,
+		"checksum":    content.Checksum,
+		"blob_key":    content.BlobKey,
+		"envelope":    envelope,
+		"key_version": content.KeyVersion,
+		"data_key":    content.DataKey,
+	}
+}
+
+// updateFields are the hash fields to set when clipboard content is replaced
+func updateFields(content model.Content) map[string]interface{} {
+	fields := contentFields(content)
+	fields["updated_at"] = time.Now().Format(time.RFC3339Nano)
+
+	return fields
+}
+
+func parseClipboard(data map[string]string) model.Clipboard {
+	clipboard := model.Clipboard{}
+	for k, v := range data {
+		switch k {
+		case "id":
+			clipboard.Id = v
+		case "text":
+			clipboard.Text = v
+		case "mime_type":
+			clipboard.MimeType = v
+		case "size":
+			clipboard.Size, _ = strconv.ParseInt(v, 10, 64)
+		case "checksum":
+			clipboard.Checksum = v
+		case "blob_key":
+			clipboard.BlobKey = v
+		case "key_version":
+			clipboard.KeyVersion, _ = strconv.Atoi(v)
+		case "data_key":
+			clipboard.DataKey = v
+		case "envelope":
+			if envelope, err := model.ParseEnvelope(v); err == nil {
+				clipboard.Envelope = &envelope
+			}
+		case "filename":
+			clipboard.Filename = v
+		case "owner_id":
+			clipboard.OwnerId = v
+		case "device_id":
+			clipboard.DeviceId = v
+		case "created_at":
+			clipboard.CreatedAt, _ = time.Parse(time.RFC3339Nano, v)
+		case "updated_at":
+			clipboard.UpdatedAt, _ = time.Parse(time.RFC3339Nano, v)
+		case "expires_at":
+			clipboard.ExpiresAt, _ = time.Parse(time.RFC3339Nano, v)
+		case "burn_after_read":
+			clipboard.BurnAfterRead = v == "1"
+		}
+	}
+
+	// Clipboards created before MIME types were stored are plain text
+	if clipboard.Checksum == "" {
+		clipboard.Content = model.NewContent(clipboard.Text, clipboard.MimeType)
+	}
+
+	return clipboard
+}
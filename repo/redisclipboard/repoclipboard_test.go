@@ -0,0 +1,266 @@
+package redisclipboard
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+	"github.com/eymyong/drop/repo/repotest"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.TestClipboard(t, func(t *testing.T) repo.RepositoryClipboard {
+		return New(miniredis.RunT(t).Addr(), 0)
+	})
+}
+
+func TestConformanceQuota(t *testing.T) {
+	repotest.TestQuota(t, func(t *testing.T, quota repo.Quota) repo.RepositoryClipboard {
+		return NewWithQuota(miniredis.RunT(t).Addr(), 0, quota)
+	})
+}
+
+func TestConformanceDeleteExpired(t *testing.T) {
+	repotest.TestDeleteExpired(t, func(t *testing.T) (repo.RepositoryClipboard, func(string) bool) {
+		mr := miniredis.RunT(t)
+
+		return New(mr.Addr(), 0), func(id string) bool {
+			return mr.Exists(keyRedisClipboard(id))
+		}
+	})
+}
+
+func TestExpire(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r := New(mr.Addr(), 0)
+	ctx := context.Background()
+
+	err := r.Create(ctx, model.Clipboard{Id: "clip-1", Content: model.Content{Text: "1"}, OwnerId: "yong", ExpiresAt: time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mr.FastForward(2 * time.Minute)
+
+	_, err = r.GetById(ctx, "clip-1")
+	if !errors.Is(err, repo.ErrNotFound) {
+		t.Fatalf("expected repo.ErrNotFound, got %v", err)
+	}
+
+	clips, _, err := r.ListByOwner(ctx, "yong", 10, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(clips) != 0 {
+		t.Fatalf("expected expired clipboard to be gone, got %+v", clips)
+	}
+
+	// Expired ids are removed from history as it's read
+	if mr.Exists(keyRedisHistory("yong")) {
+		t.Fatalf("expected history to be cleaned up")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r := New(mr.Addr(), 0)
+	ctx := context.Background()
+
+	for _, id := range []string{"clip-1", "clip-2"} {
+		err := r.Create(ctx, model.Clipboard{Id: id, Content: model.Content{Text: "12345"}, OwnerId: "yong", ExpiresAt: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// Usage is kept by writes, not counted from history
+	if clips, bytes := mr.HGet(keyRedisUsage("yong"), "clips"), mr.HGet(keyRedisUsage("yong"), "bytes"); clips != "2" || bytes != "10" {
+		t.Fatalf("expected stored usage of 2 clips and 10 bytes, got %s and %s", clips, bytes)
+	}
+
+	// Clipboards created before usage and sizes were stored are counted once
+	mr.Del(keyRedisUsage("yong"))
+	mr.Del(keyRedisExpiring("yong"))
+	mr.HDel(keyRedisClipboard("clip-1"), "size")
+
+	expectUsage(t, r, "yong", model.Usage{Clips: 2, Bytes: 10})
+	if !mr.Exists(keyRedisUsage("yong")) {
+		t.Fatal("expected usage to be stored")
+	}
+
+	members, err := mr.ZMembers(keyRedisExpiring("yong"))
+	if err != nil || len(members) != 2 {
+		t.Fatalf("expected expiring clipboards to be stored, got %v %v", members, err)
+	}
+
+	err = r.DeleteByIdAndOwner(ctx, "clip-1", "yong")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectUsage(t, r, "yong", model.Usage{Clips: 1, Bytes: 5})
+}
+
+func TestBurn(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r := New(mr.Addr(), 0)
+	ctx := context.Background()
+
+	err := r.Create(ctx, model.Clipboard{Id: "burn", Content: model.Content{Text: "secret"}, OwnerId: "yong", DeviceId: "phone", BurnAfterRead: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = r.GetByIdAndOwner(ctx, "burn", "other")
+	if !errors.Is(err, repo.ErrNotFound) {
+		t.Fatalf("expected repo.ErrNotFound, got %v", err)
+	}
+
+	_, err = r.GetByIdAndOwner(ctx, "burn", "yong")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Burnt clipboards are gone from all histories right away
+	for _, key := range []string{keyRedisClipboard("burn"), keyRedisHistory("yong"), keyRedisDeviceHistory("yong", "phone")} {
+		if mr.Exists(key) {
+			t.Fatalf("expected %s to be deleted", key)
+		}
+	}
+
+	expectUsage(t, r, "yong", model.Usage{})
+}
+
+func expectUsage(t *testing.T, r repo.RepositoryClipboard, ownerId string, expected model.Usage) {
+	t.Helper()
+
+	usage, err := r.UsageByOwner(context.Background(), ownerId)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if usage != expected {
+		t.Fatalf("expected usage %+v, got %+v", expected, usage)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	r := New(miniredis.RunT(t).Addr(), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := r.(repo.ClipboardEvents).Subscribe(ctx, "yong")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = r.Create(ctx, model.Clipboard{Id: "clip-1", Content: model.Content{Text: "1"}, OwnerId: "yong"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = r.Create(ctx, model.Clipboard{Id: "clip-2", Content: model.Content{Text: "2"}, OwnerId: "other"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = r.UpdateByIdAndOwner(ctx, "clip-1", "yong", model.NewContent("11", ""))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = r.DeleteByIdAndOwner(ctx, "clip-1", "yong")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, expected := range []string{model.EventCreate, model.EventUpdate, model.EventDelete} {
+		select {
+		case event := <-events:
+			if event.Type != expected || event.ClipboardId != "clip-1" || event.OwnerId != "yong" {
+				t.Fatalf("expected %s event of clip-1, got %+v", expected, event)
+			}
+
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s event", expected)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatalf("expected no more events")
+		}
+
+	case <-time.After(time.Second):
+		t.Fatalf("expected events to be closed")
+	}
+}
+
+func TestEventsResume(t *testing.T) {
+	r := New(miniredis.RunT(t).Addr(), 0)
+	events := r.(repo.ClipboardEvents)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := events.SubscribeAfter(ctx, "yong", "not-an-id")
+	if !errors.Is(err, repo.ErrInvalid) {
+		t.Fatalf("expected repo.ErrInvalid, got %v", err)
+	}
+
+	for _, id := range []string{"clip-1", "clip-2", "clip-3"} {
+		err := r.Create(ctx, model.Clipboard{Id: id, Content: model.Content{Text: id}, OwnerId: "yong"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	all, err := events.SubscribeAfter(ctx, "yong", "0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := expectEvent(t, all, "clip-1")
+	expectEvent(t, all, "clip-2")
+	expectEvent(t, all, "clip-3")
+
+	// Resuming after clip-1 replays missed events, then new ones
+	resumed, err := events.SubscribeAfter(ctx, "yong", first.Id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = r.Delete(ctx, "clip-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	second := expectEvent(t, resumed, "clip-2")
+	third := expectEvent(t, resumed, "clip-3")
+	deleted := expectEvent(t, resumed, "clip-1")
+	if deleted.Type != model.EventDelete {
+		t.Fatalf("expected delete event, got %+v", deleted)
+	}
+	if !(first.Id < second.Id && second.Id < third.Id) {
+		t.Fatalf("expected increasing event ids, got %s %s %s", first.Id, second.Id, third.Id)
+	}
+}
+
+func expectEvent(t *testing.T, events <-chan model.ClipboardEvent, clipboardId string) model.ClipboardEvent {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		if event.ClipboardId != clipboardId || event.Id == "" {
+			t.Fatalf("expected event of %s, got %+v", clipboardId, event)
+		}
+
+		return event
+
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for event of %s", clipboardId)
+	}
+
+	return model.ClipboardEvent{}
+}
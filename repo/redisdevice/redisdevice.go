@@ -0,0 +1,224 @@
+package redisdevice
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoRedisDevice struct {
+	rd *redis.Client
+}
+
+func keyDevices(id string) string {
+	return "devices:" + id
+}
+
+// keyUserDevices is a set of device ids of userId
+func keyUserDevices(userId string) string {
+	return "devices-user:" + userId
+}
+
+func New(addr string, db int) repo.RepositoryDevice {
+	rd := redis.NewClient(&redis.Options{
+		Addr: addr,
+		DB:   db,
+	})
+
+	return &RepoRedisDevice{rd: rd}
+}
+
+func (r *RepoRedisDevice) Create(ctx context.Context, device model.Device) error {
+	if device.Id == "" || device.UserId == "" {
+		return fmt.Errorf("empty device id or user: %w", repo.ErrInvalid)
+	}
+
+	if device.CreatedAt.IsZero() {
+		device.CreatedAt = time.Now()
+	}
+	if device.LastSeenAt.IsZero() {
+		device.LastSeenAt = device.CreatedAt
+	}
+
+	key := keyDevices(device.Id)
+	err := r.rd.Watch(ctx, func(tx *redis.Tx) error {
+		c, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("redis exists err: %w", err)
+		}
+
+		if c != 0 {
+			return fmt.Errorf("device id '%s' is already taken: %w", device.Id, repo.ErrConflict)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, map[string]interface{}{
+				"id":           device.Id,
+				"user_id":      device.UserId,
+				"name":         device.Name,
+				"platform":     device.Platform,
+				"created_at":   device.CreatedAt.UnixNano(),
+				"last_seen_at": device.LastSeenAt.UnixNano(),
+			})
+			pipe.SAdd(ctx, keyUserDevices(device.UserId), device.Id)
+
+			return nil
+		})
+
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return fmt.Errorf("device id '%s' is already taken: %w", device.Id, repo.ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("create device redis err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoRedisDevice) GetById(ctx context.Context, id string) (model.Device, error) {
+	data, err := r.rd.HGetAll(ctx, keyDevices(id)).Result()
+	if err != nil {
+		return model.Device{}, fmt.Errorf("hgetall redis err: %w", err)
+	}
+
+	if len(data) == 0 {
+		return model.Device{}, fmt.Errorf("no device '%s' in redis: %w", id, repo.ErrNotFound)
+	}
+
+	return parseDevice(data)
+}
+
+func (r *RepoRedisDevice) GetAllByUser(ctx context.Context, userId string) ([]model.Device, error) {
+	ids, err := r.rd.SMembers(ctx, keyUserDevices(userId)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("smembers redis err: %w", err)
+	}
+
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err = r.rd.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range ids {
+			cmds[i] = pipe.HGetAll(ctx, keyDevices(ids[i]))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("hgetall redis err: %w", err)
+	}
+
+	devices := []model.Device{}
+	for i := range cmds {
+		data := cmds[i].Val()
+		if len(data) == 0 {
+			continue
+		}
+
+		device, err := parseDevice(data)
+		if err != nil {
+			return nil, err
+		}
+
+		devices = append(devices, device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].CreatedAt.Before(devices[j].CreatedAt)
+	})
+
+	return devices, nil
+}
+
+func (r *RepoRedisDevice) UpdateLastSeen(ctx context.Context, id string, t time.Time) error {
+	key := keyDevices(id)
+
+	// WATCH so that a revoked device is not brought back
+	// as a hash with only last_seen_at
+	err := r.rd.Watch(ctx, func(tx *redis.Tx) error {
+		c, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("redis exists err: %w", err)
+		}
+
+		if c != 1 {
+			return fmt.Errorf("no device '%s' in redis: %w", id, repo.ErrNotFound)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, "last_seen_at", t.UnixNano())
+
+			return nil
+		})
+
+		return err
+	}, key)
+	if err != nil {
+		return fmt.Errorf("update device redis err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoRedisDevice) DeleteByIdAndUser(ctx context.Context, id string, userId string) error {
+	key := keyDevices(id)
+	err := r.rd.Watch(ctx, func(tx *redis.Tx) error {
+		owner, err := tx.HGet(ctx, key, "user_id").Result()
+		if err == redis.Nil || (err == nil && owner != userId) {
+			return fmt.Errorf("no device '%s' of user '%s' in redis: %w", id, userId, repo.ErrNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("hget redis err: %w", err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.SRem(ctx, keyUserDevices(userId), id)
+
+			return nil
+		})
+
+		return err
+	}, key)
+	if err != nil {
+		return fmt.Errorf("delete device redis err: %w", err)
+	}
+
+	return nil
+}
+
+func parseDevice(data map[string]string) (model.Device, error) {
+	device := model.Device{}
+	for k, v := range data {
+		switch k {
+		case "id":
+			device.Id = v
+		case "user_id":
+			device.UserId = v
+		case "name":
+			device.Name = v
+		case "platform":
+			device.Platform = v
+		case "created_at", "last_seen_at":
+			nano, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return model.Device{}, fmt.Errorf("bad %s '%s': %w", k, v, err)
+			}
+
+			if k == "created_at" {
+				device.CreatedAt = time.Unix(0, nano)
+			} else {
+				device.LastSeenAt = time.Unix(0, nano)
+			}
+		}
+	}
+
+	return device, nil
+}
@@ -0,0 +1,179 @@
+package redissession
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoRedisSession struct {
+	rd *redis.Client
+}
+
+func keySessions(id string) string {
+	return "sessions:" + id
+}
+
+// keyUserSessions is a set of session ids of userId
+func keyUserSessions(userId string) string {
+	return "sessions-user:" + userId
+}
+
+func New(addr string, db int) repo.RepositorySession {
+	rd := redis.NewClient(&redis.Options{
+		Addr: addr,
+		DB:   db,
+	})
+
+	return &RepoRedisSession{rd: rd}
+}
+
+func (r *RepoRedisSession) Create(ctx context.Context, session model.Session) error {
+	key := keySessions(session.Id)
+	_, err := r.rd.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, map[string]interface{}{
+			"id":           session.Id,
+			"user_id":      session.UserId,
+			"refresh_hash": session.RefreshHash,
+			"expires_at":   session.ExpiresAt.Unix(),
+			"device_id":    session.DeviceId,
+		})
+		pipe.ExpireAt(ctx, key, session.ExpiresAt)
+		pipe.SAdd(ctx, keyUserSessions(session.UserId), session.Id)
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("create session redis err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoRedisSession) GetById(ctx context.Context, id string) (model.Session, error) {
+	data, err := r.rd.HGetAll(ctx, keySessions(id)).Result()
+	if err != nil {
+		return model.Session{}, fmt.Errorf("hgetall redis err: %w", err)
+	}
+
+	if len(data) == 0 {
+		return model.Session{}, fmt.Errorf("no session '%s' in redis: %w", id, repo.ErrNotFound)
+	}
+
+	return parseSession(data)
+}
+
+func (r *RepoRedisSession) Update(ctx context.Context, session model.Session, oldHash string) error {
+	key := keySessions(session.Id)
+
+	// WATCH so that a session deleted by logout or password change
+	// can't be brought back by a concurrent refresh, and so that
+	// only one of concurrent refreshes swaps the old hash
+	err := r.rd.Watch(ctx, func(tx *redis.Tx) error {
+		hash, err := tx.HGet(ctx, key, "refresh_hash").Result()
+		if err == redis.Nil {
+			return fmt.Errorf("no session '%s' in redis: %w", session.Id, repo.ErrNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("redis hget err: %w", err)
+		}
+
+		if hash != oldHash {
+			return fmt.Errorf("session '%s' was updated: %w", session.Id, repo.ErrConflict)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, map[string]interface{}{
+				"refresh_hash": session.RefreshHash,
+				"expires_at":   session.ExpiresAt.Unix(),
+				"device_id":    session.DeviceId,
+			})
+			pipe.ExpireAt(ctx, key, session.ExpiresAt)
+
+			return nil
+		})
+
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return fmt.Errorf("session '%s' was updated: %w", session.Id, repo.ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("update session redis err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoRedisSession) Delete(ctx context.Context, id string) error {
+	key := keySessions(id)
+	userId, err := r.rd.HGet(ctx, key, "user_id").Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("hget redis err: %w", err)
+	}
+
+	_, err = r.rd.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		if userId != "" {
+			pipe.SRem(ctx, keyUserSessions(userId), id)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("del redis err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoRedisSession) DeleteByUserId(ctx context.Context, userId string) error {
+	keyUser := keyUserSessions(userId)
+	ids, err := r.rd.SMembers(ctx, keyUser).Result()
+	if err != nil {
+		return fmt.Errorf("smembers redis err: %w", err)
+	}
+
+	keys := []string{keyUser}
+	for i := range ids {
+		keys = append(keys, keySessions(ids[i]))
+	}
+
+	err = r.rd.Del(ctx, keys...).Err()
+	if err != nil {
+		return fmt.Errorf("del redis err: %w", err)
+	}
+
+	return nil
+}
+
+func parseSession(data map[string]string) (model.Session, error) {
+	session := model.Session{}
+	for k, v := range data {
+		switch k {
+		case "id":
+			session.Id = v
+		case "user_id":
+			session.UserId = v
+		case "refresh_hash":
+			session.RefreshHash = v
+		case "device_id":
+			session.DeviceId = v
+		case "expires_at":
+			exp, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return model.Session{}, fmt.Errorf("bad expires_at '%s': %w", v, err)
+			}
+
+			session.ExpiresAt = time.Unix(exp, 0)
+		}
+	}
+
+	return session, nil
+}
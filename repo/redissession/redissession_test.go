@@ -0,0 +1,16 @@
+package redissession
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/eymyong/drop/repo"
+	"github.com/eymyong/drop/repo/repotest"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.TestSession(t, func(t *testing.T) repo.RepositorySession {
+		return New(miniredis.RunT(t).Addr(), 0)
+	})
+}
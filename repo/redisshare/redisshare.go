@@ -0,0 +1,306 @@
+package redisshare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoRedisShare struct {
+	rd *redis.Client
+}
+
+func keyShares(token string) string {
+	return "shares:" + token
+}
+
+// keyClipboardShares is a set of share tokens of clipboardId.
+// Tokens of expired or used up shares are removed lazily on reads.
+func keyClipboardShares(clipboardId string) string {
+	return "shares-clipboard:" + clipboardId
+}
+
+func New(addr string, db int) repo.RepositoryShare {
+	rd := redis.NewClient(&redis.Options{
+		Addr: addr,
+		DB:   db,
+	})
+
+	return &RepoRedisShare{rd: rd}
+}
+
+func (r *RepoRedisShare) Create(ctx context.Context, share model.Share) error {
+	if share.Token == "" || share.ClipboardId == "" || share.MaxViews < 0 {
+		return fmt.Errorf("bad share: %w", repo.ErrInvalid)
+	}
+
+	if share.CreatedAt.IsZero() {
+		share.CreatedAt = time.Now()
+	}
+
+	var expiresAt int64
+	if !share.ExpiresAt.IsZero() {
+		expiresAt = share.ExpiresAt.UnixNano()
+	}
+
+	key := keyShares(share.Token)
+	err := r.rd.Watch(ctx, func(tx *redis.Tx) error {
+		c, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("redis exists err: %w", err)
+		}
+
+		if c != 0 {
+			return fmt.Errorf("share token '%s' is already taken: %w", share.Token, repo.ErrConflict)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, map[string]interface{}{
+				"token":         share.Token,
+				"clipboard_id":  share.ClipboardId,
+				"owner_id":      share.OwnerId,
+				"password_hash": share.PasswordHash,
+				"created_at":    share.CreatedAt.UnixNano(),
+				"expires_at":    expiresAt,
+				"max_views":     share.MaxViews,
+				"views_left":    share.MaxViews,
+			})
+			if expiresAt != 0 {
+				pipe.ExpireAt(ctx, key, share.ExpiresAt)
+			}
+			pipe.SAdd(ctx, keyClipboardShares(share.ClipboardId), share.Token)
+
+			return nil
+		})
+
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return fmt.Errorf("share token '%s' is already taken: %w", share.Token, repo.ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("create share redis err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoRedisShare) GetByToken(ctx context.Context, token string) (model.Share, error) {
+	data, err := r.rd.HGetAll(ctx, keyShares(token)).Result()
+	if err != nil {
+		return model.Share{}, fmt.Errorf("hgetall redis err: %w", err)
+	}
+
+	share, err := parseShare(data)
+	if err != nil {
+		return model.Share{}, err
+	}
+
+	if !live(share) {
+		return model.Share{}, fmt.Errorf("no share '%s' in redis: %w", token, repo.ErrNotFound)
+	}
+
+	return share, nil
+}
+
+func (r *RepoRedisShare) GetAllByClipboard(ctx context.Context, clipboardId string, ownerId string) ([]model.Share, error) {
+	keySet := keyClipboardShares(clipboardId)
+	tokens, err := r.rd.SMembers(ctx, keySet).Result()
+	if err != nil {
+		return nil, fmt.Errorf("smembers redis err: %w", err)
+	}
+
+	shares := []model.Share{}
+	for _, token := range tokens {
+		share, err := r.GetByToken(ctx, token)
+		if errors.Is(err, repo.ErrNotFound) {
+			r.rd.SRem(ctx, keySet, token)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if share.OwnerId == ownerId {
+			shares = append(shares, share)
+		}
+	}
+
+	return shares, nil
+}
+
+// scriptView counts down views_left of a limited share, deleting it
+// after its last view, and resets its password attempts.
+// It returns -1 if the share is missing or used up.
+var scriptView = redis.NewScript(`
+local max = redis.call('HGET', KEYS[1], 'max_views')
+if not max then
+	return -1
+end
+
+redis.call('HSET', KEYS[1], 'failed_attempts', 0, 'locked_until', 0)
+if max == '0' then
+	return 0
+end
+
+local left = redis.call('HINCRBY', KEYS[1], 'views_left', -1)
+if left <= 0 then
+	redis.call('DEL', KEYS[1])
+end
+
+if left < 0 then
+	return -1
+end
+
+return left
+`)
+
+func (r *RepoRedisShare) View(ctx context.Context, token string) error {
+	// Expired shares are already gone by EXPIREAT
+	left, err := scriptView.Run(ctx, r.rd, []string{keyShares(token)}).Int()
+	if err != nil {
+		return fmt.Errorf("view share redis err: %w", err)
+	}
+
+	if left < 0 {
+		return fmt.Errorf("no share '%s' in redis: %w", token, repo.ErrNotFound)
+	}
+
+	return nil
+}
+
+// Attempt is a transaction on the share hash, so that concurrent attempts
+// can't both pass. The losers of a race are locked out too.
+func (r *RepoRedisShare) Attempt(ctx context.Context, token string) error {
+	key := keyShares(token)
+	err := r.rd.Watch(ctx, func(tx *redis.Tx) error {
+		data, err := tx.HGetAll(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("hgetall redis err: %w", err)
+		}
+
+		share, err := parseShare(data)
+		if err != nil {
+			return err
+		}
+
+		if !live(share) {
+			return fmt.Errorf("no share '%s' in redis: %w", token, repo.ErrNotFound)
+		}
+
+		now := time.Now()
+		if now.Before(share.LockedUntil) {
+			return fmt.Errorf("share '%s' until %s: %w", token, share.LockedUntil.Format(time.RFC3339), repo.ErrLocked)
+		}
+
+		failed := share.FailedAttempts + 1
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key,
+				"failed_attempts", failed,
+				"locked_until", now.Add(model.ShareLockout(failed)).UnixNano(),
+			)
+
+			return nil
+		})
+
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return fmt.Errorf("share '%s' has concurrent attempts: %w", token, repo.ErrLocked)
+	}
+	if err != nil && !errors.Is(err, repo.ErrNotFound) && !errors.Is(err, repo.ErrLocked) {
+		return fmt.Errorf("attempt share redis err: %w", err)
+	}
+
+	return err
+}
+
+func (r *RepoRedisShare) DeleteByTokenAndOwner(ctx context.Context, token string, ownerId string) error {
+	share, err := r.GetByToken(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if share.OwnerId != ownerId {
+		return fmt.Errorf("no share '%s' of owner '%s' in redis: %w", token, ownerId, repo.ErrNotFound)
+	}
+
+	_, err = r.rd.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keyShares(token))
+		pipe.SRem(ctx, keyClipboardShares(share.ClipboardId), token)
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("del redis err: %w", err)
+	}
+
+	return nil
+}
+
+// live reports whether share is still there, and not expired nor used up
+func live(share model.Share) bool {
+	if share.Token == "" {
+		return false
+	}
+
+	if !share.ExpiresAt.IsZero() && !time.Now().Before(share.ExpiresAt) {
+		return false
+	}
+
+	return share.MaxViews == 0 || share.ViewsLeft > 0
+}
+
+func parseShare(data map[string]string) (model.Share, error) {
+	share := model.Share{}
+	for k, v := range data {
+		switch k {
+		case "token":
+			share.Token = v
+		case "clipboard_id":
+			share.ClipboardId = v
+		case "owner_id":
+			share.OwnerId = v
+		case "password_hash":
+			share.PasswordHash = v
+		case "created_at", "expires_at", "locked_until":
+			nano, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return model.Share{}, fmt.Errorf("bad %s '%s': %w", k, v, err)
+			}
+
+			switch {
+			case k == "created_at":
+				share.CreatedAt = time.Unix(0, nano)
+			case nano == 0:
+			case k == "expires_at":
+				share.ExpiresAt = time.Unix(0, nano)
+			default:
+				share.LockedUntil = time.Unix(0, nano)
+			}
+		case "max_views", "views_left", "failed_attempts":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return model.Share{}, fmt.Errorf("bad %s '%s': %w", k, v, err)
+			}
+
+			switch k {
+			case "max_views":
+				share.MaxViews = n
+			case "views_left":
+				share.ViewsLeft = n
+			default:
+				share.FailedAttempts = n
+			}
+		}
+	}
+
+	return share, nil
+}
@@ -0,0 +1,234 @@
+package redisspace
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoRedisSpace struct {
+	rd *redis.Client
+}
+
+func keySpaces(id string) string {
+	return "spaces:" + id
+}
+
+// keySpaceMembers is a hash of member roles by user id of spaceId
+func keySpaceMembers(spaceId string) string {
+	return "space-members:" + spaceId
+}
+
+// keyUserSpaces is a set of ids of spaces userId is a member of
+func keyUserSpaces(userId string) string {
+	return "spaces-user:" + userId
+}
+
+func New(addr string, db int) repo.RepositorySpace {
+	rd := redis.NewClient(&redis.Options{
+		Addr: addr,
+		DB:   db,
+	})
+
+	return &RepoRedisSpace{rd: rd}
+}
+
+func (r *RepoRedisSpace) Create(ctx context.Context, space model.Space) error {
+	if space.Id == "" || space.OwnerId == "" {
+		return fmt.Errorf("empty space id or owner: %w", repo.ErrInvalid)
+	}
+
+	if space.CreatedAt.IsZero() {
+		space.CreatedAt = time.Now()
+	}
+
+	key := keySpaces(space.Id)
+	err := r.rd.Watch(ctx, func(tx *redis.Tx) error {
+		c, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("redis exists err: %w", err)
+		}
+
+		if c != 0 {
+			return fmt.Errorf("space id '%s' is already taken: %w", space.Id, repo.ErrConflict)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, map[string]interface{}{
+				"id":         space.Id,
+				"name":       space.Name,
+				"owner_id":   space.OwnerId,
+				"created_at": space.CreatedAt.UnixNano(),
+			})
+			pipe.HSet(ctx, keySpaceMembers(space.Id), space.OwnerId, model.RoleOwner)
+			pipe.SAdd(ctx, keyUserSpaces(space.OwnerId), space.Id)
+
+			return nil
+		})
+
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return fmt.Errorf("space id '%s' is already taken: %w", space.Id, repo.ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("create space redis err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoRedisSpace) GetById(ctx context.Context, id string) (model.Space, error) {
+	data, err := r.rd.HGetAll(ctx, keySpaces(id)).Result()
+	if err != nil {
+		return model.Space{}, fmt.Errorf("hgetall redis err: %w", err)
+	}
+
+	if len(data) == 0 {
+		return model.Space{}, fmt.Errorf("no space '%s' in redis: %w", id, repo.ErrNotFound)
+	}
+
+	return parseSpace(data)
+}
+
+func (r *RepoRedisSpace) GetAllByMember(ctx context.Context, userId string) ([]model.Space, error) {
+	ids, err := r.rd.SMembers(ctx, keyUserSpaces(userId)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("smembers redis err: %w", err)
+	}
+
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err = r.rd.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range ids {
+			cmds[i] = pipe.HGetAll(ctx, keySpaces(ids[i]))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("hgetall redis err: %w", err)
+	}
+
+	spaces := []model.Space{}
+	for i := range cmds {
+		data := cmds[i].Val()
+		if len(data) == 0 {
+			continue
+		}
+
+		space, err := parseSpace(data)
+		if err != nil {
+			return nil, err
+		}
+
+		spaces = append(spaces, space)
+	}
+
+	return spaces, nil
+}
+
+func (r *RepoRedisSpace) GetMember(ctx context.Context, spaceId string, userId string) (model.Member, error) {
+	role, err := r.rd.HGet(ctx, keySpaceMembers(spaceId), userId).Result()
+	if err == redis.Nil {
+		return model.Member{}, fmt.Errorf("no member '%s' of space '%s' in redis: %w", userId, spaceId, repo.ErrNotFound)
+	}
+	if err != nil {
+		return model.Member{}, fmt.Errorf("hget redis err: %w", err)
+	}
+
+	return model.Member{SpaceId: spaceId, UserId: userId, Role: role}, nil
+}
+
+func (r *RepoRedisSpace) GetMembers(ctx context.Context, spaceId string) ([]model.Member, error) {
+	roles, err := r.rd.HGetAll(ctx, keySpaceMembers(spaceId)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("hgetall redis err: %w", err)
+	}
+
+	members := []model.Member{}
+	for userId, role := range roles {
+		members = append(members, model.Member{SpaceId: spaceId, UserId: userId, Role: role})
+	}
+
+	return members, nil
+}
+
+func (r *RepoRedisSpace) PutMember(ctx context.Context, member model.Member) error {
+	if member.UserId == "" || !model.ValidRole(member.Role) {
+		return fmt.Errorf("bad member: %w", repo.ErrInvalid)
+	}
+
+	key := keySpaces(member.SpaceId)
+	err := r.rd.Watch(ctx, func(tx *redis.Tx) error {
+		c, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("redis exists err: %w", err)
+		}
+
+		if c != 1 {
+			return fmt.Errorf("no space '%s' in redis: %w", member.SpaceId, repo.ErrNotFound)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, keySpaceMembers(member.SpaceId), member.UserId, member.Role)
+			pipe.SAdd(ctx, keyUserSpaces(member.UserId), member.SpaceId)
+
+			return nil
+		})
+
+		return err
+	}, key)
+	if err != nil {
+		return fmt.Errorf("put space member redis err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoRedisSpace) DeleteMember(ctx context.Context, spaceId string, userId string) error {
+	var hdel *redis.IntCmd
+	_, err := r.rd.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		hdel = pipe.HDel(ctx, keySpaceMembers(spaceId), userId)
+		pipe.SRem(ctx, keyUserSpaces(userId), spaceId)
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("delete space member redis err: %w", err)
+	}
+
+	if hdel.Val() == 0 {
+		return fmt.Errorf("no member '%s' of space '%s' in redis: %w", userId, spaceId, repo.ErrNotFound)
+	}
+
+	return nil
+}
+
+func parseSpace(data map[string]string) (model.Space, error) {
+	space := model.Space{}
+	for k, v := range data {
+		switch k {
+		case "id":
+			space.Id = v
+		case "name":
+			space.Name = v
+		case "owner_id":
+			space.OwnerId = v
+		case "created_at":
+			nano, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return model.Space{}, fmt.Errorf("bad created_at '%s': %w", v, err)
+			}
+
+			space.CreatedAt = time.Unix(0, nano)
+		}
+	}
+
+	return space, nil
+}
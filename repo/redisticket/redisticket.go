@@ -0,0 +1,47 @@
+package redisticket
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoRedisTicket struct {
+	rd *redis.Client
+}
+
+// keyUsedTickets expires with the ticket, after which it can't be used anyway
+func keyUsedTickets(id string) string {
+	return "tickets-used:" + id
+}
+
+func New(addr string, db int) repo.RepositoryTicket {
+	rd := redis.NewClient(&redis.Options{
+		Addr: addr,
+		DB:   db,
+	})
+
+	return &RepoRedisTicket{rd: rd}
+}
+
+func (r *RepoRedisTicket) Use(ctx context.Context, id string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+
+	ok, err := r.rd.SetNX(ctx, keyUsedTickets(id), 1, ttl).Result()
+	if err != nil {
+		return fmt.Errorf("setnx redis err: %w", err)
+	}
+
+	if !ok {
+		return fmt.Errorf("ticket '%s' is already used: %w", id, repo.ErrConflict)
+	}
+
+	return nil
+}
@@ -13,7 +13,8 @@ import (
 )
 
 const (
-	keyLogins = "clipboard-logins"
+	keyLogins   = "clipboard-logins"
+	keyLoginIds = "clipboard-login-ids"
 )
 
 type RepoRedisUser struct {
@@ -40,38 +41,44 @@ func New(addr string, db int) repo.RepositoryUser {
 	return &RepoRedisUser{rd: rd}
 }
 
-func (r *RepoRedisUser) Create(ctx context.Context, user model.User) (model.User, error) {
-	dup, err := r.duplicateUserId(ctx, user.Id)
-	if err != nil {
-		return model.User{}, errors.Wrap(err, "failed to check for duplicate user id")
-	}
+// scriptCreate adds user KEYS[1] with id ARGV[1], username ARGV[2]
+// and password ARGV[3] to users, logins and login ids hashes in one go,
+// so that concurrent registrations of the same username can't both succeed.
+//
+// Returns 1 on success, -1 if the user id is taken,
+// and -2 if the username is taken.
+var scriptCreate = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return -1
+end
 
-	if dup {
-		return model.User{}, errors.New("the new user id is already taken")
-	}
+if redis.call("HEXISTS", KEYS[2], ARGV[2]) == 1 then
+	return -2
+end
 
-	dup, err = r.duplicateUsername(ctx, user.Username)
-	if err != nil {
-		return model.User{}, errors.Wrapf(err, "failed to check forr duplicate username '%s'", user.Username)
-	}
+redis.call("HSET", KEYS[1], "id", ARGV[1], "username", ARGV[2], "password", ARGV[3])
+redis.call("HSET", KEYS[2], ARGV[2], ARGV[3])
+redis.call("HSET", KEYS[3], ARGV[2], ARGV[1])
+
+return 1
+`)
 
-	if dup {
-		return model.User{}, fmt.Errorf("username '%s' is already taken", user.Username)
+func (r *RepoRedisUser) Create(ctx context.Context, user model.User) (model.User, error) {
+	if user.Id == "" || user.Username == "" {
+		return model.User{}, fmt.Errorf("empty user id or username: %w", repo.ErrInvalid)
 	}
 
-	key := keyUsers(user.Id)
-	err = r.rd.HSet(ctx, key, map[string]interface{}{
-		"id":       user.Id,
-		"username": user.Username,
-		"password": user.Password,
-	}).Err()
+	keys := []string{keyUsers(user.Id), keyLogins, keyLoginIds}
+	result, err := scriptCreate.Run(ctx, r.rd, keys, user.Id, user.Username, user.Password).Int()
 	if err != nil {
-		return model.User{}, errors.Wrapf(err, "failed to register user '%s", user.Username)
+		return model.User{}, errors.Wrapf(err, "failed to register user '%s'", user.Username)
 	}
 
-	err = r.rd.HSet(ctx, keyLogins, user.Username, user.Password).Err()
-	if err != nil {
-		return model.User{}, errors.Wrapf(err, "failed to create logins for user '%s", user.Username)
+	switch result {
+	case -1:
+		return model.User{}, fmt.Errorf("the new user id is already taken: %w", repo.ErrConflict)
+	case -2:
+		return model.User{}, fmt.Errorf("username '%s' is already taken: %w", user.Username, repo.ErrConflict)
 	}
 
 	return user, nil
@@ -79,6 +86,9 @@ func (r *RepoRedisUser) Create(ctx context.Context, user model.User) (model.User
 
 func (r *RepoRedisUser) GetPassword(ctx context.Context, username string) ([]byte, error) {
 	pass, err := r.rd.HGet(ctx, keyLogins, username).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("username '%s': %w", username, repo.ErrNotFound)
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get password for username '%s'", username)
 	}
@@ -86,9 +96,44 @@ func (r *RepoRedisUser) GetPassword(ctx context.Context, username string) ([]byt
 	return []byte(pass), nil
 }
 
+func (r *RepoRedisUser) GetByUsername(ctx context.Context, username string) (model.User, error) {
+	id, err := r.loginId(ctx, username)
+	if err != nil {
+		return model.User{}, errors.Wrapf(err, "failed to get id for username '%s'", username)
+	}
+
+	return r.GetById(ctx, id)
+}
+
+// loginId looks up user id of username. Users missing from the
+// username -> id index, e.g. registered before it existed or by an older
+// server during a rolling deploy, are looked up and added to it on a miss.
+func (r *RepoRedisUser) loginId(ctx context.Context, username string) (string, error) {
+	id, err := r.rd.HGet(ctx, keyLoginIds, username).Result()
+	if err != redis.Nil {
+		return id, err
+	}
+
+	// Only scan for usernames that can login,
+	// so that misses of unknown usernames stay cheap
+	exists, err := r.rd.HExists(ctx, keyLogins, username).Result()
+	if err != nil {
+		return "", fmt.Errorf("hexists redis err: %w", err)
+	}
+
+	if !exists {
+		return "", fmt.Errorf("username '%s': %w", username, repo.ErrNotFound)
+	}
+
+	return r.indexLoginId(ctx, username)
+}
+
 func (r *RepoRedisUser) GetById(ctx context.Context, id string) (model.User, error) {
 	key := keyUsers(id)
 	username, err := r.rd.HGet(ctx, key, "username").Result()
+	if err == redis.Nil {
+		return model.User{}, fmt.Errorf("user id '%s': %w", id, repo.ErrNotFound)
+	}
 	if err != nil {
 		return model.User{}, fmt.Errorf("get redis err: %w", err)
 	}
@@ -107,32 +152,92 @@ func (r *RepoRedisUser) GetById(ctx context.Context, id string) (model.User, err
 	return user, nil
 }
 
-func (r *RepoRedisUser) UpdateUsername(ctx context.Context, id string, newUsername string) error {
-	key := keyUsers(id)
+// scriptRename moves username of KEYS[1] to ARGV[1] in users, logins
+// and login ids hashes in one go, so that the new username can be used
+// to login right away and the old one is freed.
+//
+// Returns 1 on success, 0 if the user does not exist,
+// and -1 if the new username is taken.
+var scriptRename = redis.NewScript(`
+local old = redis.call("HGET", KEYS[1], "username")
+if not old then
+	return 0
+end
+
+if old == ARGV[1] then
+	return 1
+end
+
+if redis.call("HEXISTS", KEYS[2], ARGV[1]) == 1 then
+	return -1
+end
+
+local password = redis.call("HGET", KEYS[1], "password")
+local id = redis.call("HGET", KEYS[1], "id")
+
+redis.call("HDEL", KEYS[2], old)
+redis.call("HSET", KEYS[2], ARGV[1], password)
+redis.call("HDEL", KEYS[3], old)
+redis.call("HSET", KEYS[3], ARGV[1], id)
+redis.call("HSET", KEYS[1], "username", ARGV[1])
+
+return 1
+`)
 
-	dup, err := r.duplicateUsername(ctx, newUsername)
-	if err != nil {
-		return errors.Wrapf(err, "failed to check for duplicate new username '%s'", newUsername)
+func (r *RepoRedisUser) UpdateUsername(ctx context.Context, id string, newUsername string) error {
+	if newUsername == "" {
+		return fmt.Errorf("empty username: %w", repo.ErrInvalid)
 	}
 
-	if dup {
-		return fmt.Errorf("username %s is already taken", newUsername)
+	keys := []string{keyUsers(id), keyLogins, keyLoginIds}
+	result, err := scriptRename.Run(ctx, r.rd, keys, newUsername).Int()
+	if err != nil {
+		return fmt.Errorf("rename script redis err: %w", err)
 	}
 
-	err = r.rd.HSet(ctx, key, "username", newUsername).Err()
-	if err != nil {
-		return fmt.Errorf("hset new username redis err: %w", err)
+	switch result {
+	case 0:
+		return fmt.Errorf("user id '%s': %w", id, repo.ErrNotFound)
+	case -1:
+		return fmt.Errorf("username %s is already taken: %w", newUsername, repo.ErrConflict)
 	}
 
 	return nil
 }
 
 func (r *RepoRedisUser) UpdatePassword(ctx context.Context, id string, newPassword string) error {
-	panic("not implemented")
+	key := keyUsers(id)
+
+	err := r.rd.Watch(ctx, func(tx *redis.Tx) error {
+		username, err := tx.HGet(ctx, key, "username").Result()
+		if err == redis.Nil {
+			return fmt.Errorf("user id '%s': %w", id, repo.ErrNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get username: %w", err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, "password", newPassword)
+			pipe.HSet(ctx, keyLogins, username, newPassword)
+
+			return nil
+		})
+
+		return err
+	}, key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to update password for user id '%s'", id)
+	}
+
+	return nil
 }
 
 func (r *RepoRedisUser) Delete(ctx context.Context, id string) error {
 	username, err := r.rd.HGet(ctx, keyUsers(id), "username").Result()
+	if err == redis.Nil {
+		return fmt.Errorf("user id '%s': %w", id, repo.ErrNotFound)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get username: %w", err)
 	}
@@ -143,7 +248,7 @@ func (r *RepoRedisUser) Delete(ctx context.Context, id string) error {
 	}
 
 	if count == 0 {
-		return fmt.Errorf("0 user deleted for id '%s'", id)
+		return fmt.Errorf("0 user deleted for id '%s': %w", id, repo.ErrNotFound)
 	}
 
 	count, err = r.rd.HDel(ctx, keyLogins, username).Result()
@@ -152,27 +257,48 @@ func (r *RepoRedisUser) Delete(ctx context.Context, id string) error {
 	}
 
 	if count == 0 {
-		return fmt.Errorf("0 logins deleted for id '%s'", id)
+		return fmt.Errorf("0 logins deleted for id '%s': %w", id, repo.ErrNotFound)
 	}
 
-	return nil
-}
-
-func (r *RepoRedisUser) duplicateUserId(ctx context.Context, id string) (bool, error) {
-	key := keyUsers(id)
-	count, err := r.rd.Exists(ctx, key).Result()
+	err = r.rd.HDel(ctx, keyLoginIds, username).Err()
 	if err != nil {
-		return false, err
+		return fmt.Errorf("del keyloginids redis err: %w", err)
 	}
 
-	return count > 0, nil
+	return nil
 }
 
-func (r *RepoRedisUser) duplicateUsername(ctx context.Context, username string) (bool, error) {
-	exists, err := r.rd.HExists(ctx, keyLogins, username).Result()
+// indexLoginId scans users for username, and adds it to the
+// username -> id index
+func (r *RepoRedisUser) indexLoginId(ctx context.Context, username string) (string, error) {
+	iter := r.rd.Scan(ctx, 0, keyUsers("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		name, err := r.rd.HGet(ctx, key, "username").Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("hget redis err: %w", err)
+		}
+
+		if name != username {
+			continue
+		}
+
+		id := keyToName(key)
+		err = r.rd.HSetNX(ctx, keyLoginIds, name, id).Err()
+		if err != nil {
+			return "", fmt.Errorf("hsetnx redis err: %w", err)
+		}
+
+		return id, nil
+	}
+
+	err := iter.Err()
 	if err != nil {
-		return false, fmt.Errorf("hgetall redis err: %w", err)
+		return "", fmt.Errorf("scan redis err: %w", err)
 	}
 
-	return exists, nil
+	return "", fmt.Errorf("username '%s': %w", username, repo.ErrNotFound)
 }
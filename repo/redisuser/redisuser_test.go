@@ -0,0 +1,127 @@
+package redisuser
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+	"github.com/eymyong/drop/repo/repotest"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.TestUser(t, func(t *testing.T) repo.RepositoryUser {
+		return New(miniredis.RunT(t).Addr(), 0)
+	})
+}
+
+func TestUpdateUsername(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r := New(mr.Addr(), 0)
+	ctx := context.Background()
+
+	yong := model.User{Id: "id-yong", Username: "yong", Password: "pass-yong"}
+	_, err := r.Create(ctx, yong)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = r.Create(ctx, model.User{Id: "id-taken", Username: "taken", Password: "pass-taken"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = r.UpdateUsername(ctx, yong.Id, "taken")
+	if err == nil {
+		t.Fatal("expected error when renaming to a taken username")
+	}
+
+	err = r.UpdateUsername(ctx, "id-missing", "nobody")
+	if err == nil {
+		t.Fatal("expected error when renaming a missing user")
+	}
+
+	err = r.UpdateUsername(ctx, yong.Id, "yong2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Login looks up password and user id by username
+	password, err := r.GetPassword(ctx, "yong2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(password) != yong.Password {
+		t.Fatalf("unexpected password '%s'", password)
+	}
+
+	user, err := r.GetByUsername(ctx, "yong2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if user.Id != yong.Id {
+		t.Fatalf("unexpected id '%s'", user.Id)
+	}
+	if user.Username != "yong2" {
+		t.Fatalf("unexpected username '%s'", user.Username)
+	}
+
+	_, err = r.GetPassword(ctx, "yong")
+	if err == nil {
+		t.Fatal("expected error when logging in with old username")
+	}
+
+	// Old username is free to register again
+	_, err = r.Create(ctx, model.User{Id: "id-new-yong", Username: "yong", Password: "pass-new-yong"})
+	if err != nil {
+		t.Fatalf("unexpected error registering old username: %v", err)
+	}
+}
+
+func TestGetByUsernameLegacy(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r := New(mr.Addr(), 0)
+	ctx := context.Background()
+
+	// Users registered before the username -> id index
+	mr.HSet(keyUsers("id-old"), "id", "id-old", "username", "old", "password", "pass-old")
+	mr.HSet(keyLogins, "old", "pass-old")
+
+	user, err := r.GetByUsername(ctx, "old")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if user.Id != "id-old" {
+		t.Fatalf("unexpected id '%s'", user.Id)
+	}
+
+	if id := mr.HGet(keyLoginIds, "old"); id != "id-old" {
+		t.Fatalf("expected index to be backfilled, got '%s'", id)
+	}
+
+	_, err = r.GetByUsername(ctx, "nobody")
+	if !errors.Is(err, repo.ErrNotFound) {
+		t.Fatalf("expected not found error for missing username, got %v", err)
+	}
+
+	// Users written without index later, e.g. by an older server
+	// during a rolling deploy, are found too
+	mr.HSet(keyUsers("id-later"), "id", "id-later", "username", "later", "password", "pass-later")
+	mr.HSet(keyLogins, "later", "pass-later")
+	for _, r := range []repo.RepositoryUser{r, New(mr.Addr(), 0)} {
+		user, err = r.GetByUsername(ctx, "later")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if user.Id != "id-later" {
+			t.Fatalf("unexpected id '%s'", user.Id)
+		}
+	}
+
+	if id := mr.HGet(keyLoginIds, "later"); id != "id-later" {
+		t.Fatalf("expected later user to be indexed, got '%s'", id)
+	}
+}
@@ -2,23 +2,203 @@ package repo
 
 import (
 	"context"
+	"errors"
+	"io"
+	"time"
 
 	"github.com/eymyong/drop/model"
 )
 
+// Repository implementations wrap these errors, so that callers
+// can tell them apart with errors.Is.
+var (
+	// ErrNotFound is returned when the data does not exist,
+	// or is not owned by the caller.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when the data clashes with existing data,
+	// e.g. a username that is already taken.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalid is returned when the input data is invalid,
+	// e.g. an empty id or username.
+	ErrInvalid = errors.New("invalid")
+	// ErrQuotaClips and ErrQuotaBytes are returned when a write would take
+	// clipboards of an owner over the Quota of the repository.
+	ErrQuotaClips = errors.New("quota of clipboard count exceeded")
+	ErrQuotaBytes = errors.New("quota of clipboard bytes exceeded")
+	// ErrLocked is returned when a share is locked out
+	// after too many password attempts.
+	ErrLocked = errors.New("locked out")
+)
+
 type RepositoryClipboard interface {
+	// Create stores clip, which expires at clip.ExpiresAt if it's not zero.
+	// clip.Content is normalized with model.Content.Normalize.
+	// It returns ErrConflict if clip.Id is already taken, and ErrQuotaClips
+	// or ErrQuotaBytes if clip.OwnerId has no room left for it.
 	Create(ctx context.Context, clip model.Clipboard) error
 	GetAll(ctx context.Context) ([]model.Clipboard, error)
+	// GetById and GetByIdAndOwner atomically delete BurnAfterRead clipboards
+	// as they return them, so only the first read succeeds.
 	GetById(ctx context.Context, id string) (model.Clipboard, error)
-	Update(ctx context.Context, id string, newdata string) error
+	// GetBlobKey returns BlobKey of clipboard id without reading it,
+	// so BurnAfterRead clipboards are not burnt
+	GetBlobKey(ctx context.Context, id string) (string, error)
+	// CheckOwner is ErrNotFound if clipboard id does not exist, or is not
+	// owned by ownerId. Like GetBlobKey, it does not read the clipboard.
+	CheckOwner(ctx context.Context, id string, ownerId string) error
+	// Update and UpdateByIdAndOwner replace clipboard content,
+	// normalized with model.Content.Normalize. They return ErrQuotaBytes
+	// if the owner has no room left for the new content.
+	Update(ctx context.Context, id string, content model.Content) error
 	Delete(ctx context.Context, id string) error
+	// DeleteExpired deletes expired clipboards, which are otherwise only
+	// hidden, and returns how many were deleted. Backends that delete
+	// expired clipboards by themselves return 0.
+	DeleteExpired(ctx context.Context) (int, error)
+
+	// Owner-scoped methods only see clipboards owned by ownerId,
+	// and return ErrNotFound for clipboards owned by other users.
+	GetAllByOwner(ctx context.Context, ownerId string) ([]model.Clipboard, error)
+	// ListByOwner returns a page of at most limit clipboards of ownerId,
+	// newest first, after cursor. Empty cursor starts from the newest clipboard,
+	// and the returned next cursor is empty on the last page.
+	ListByOwner(ctx context.Context, ownerId string, limit int, cursor string) (clips []model.Clipboard, next string, err error)
+	// ListByDevice is like ListByOwner, but only with clipboards
+	// created from deviceId
+	ListByDevice(ctx context.Context, ownerId string, deviceId string, limit int, cursor string) (clips []model.Clipboard, next string, err error)
+	// GetByOwnerInRange returns at most limit clipboards of ownerId created
+	// in [from, to), newest first. Zero from or to leaves that end unbounded.
+	GetByOwnerInRange(ctx context.Context, ownerId string, from, to time.Time, limit int) ([]model.Clipboard, error)
+	// GetByDeviceInRange is like GetByOwnerInRange, but only with clipboards
+	// created from deviceId
+	GetByDeviceInRange(ctx context.Context, ownerId string, deviceId string, from, to time.Time, limit int) ([]model.Clipboard, error)
+	GetByIdAndOwner(ctx context.Context, id string, ownerId string) (model.Clipboard, error)
+	// UsageByOwner returns the number and total size of live clipboards of ownerId,
+	// which is what Create and Update check against the Quota of the repository
+	UsageByOwner(ctx context.Context, ownerId string) (model.Usage, error)
+	UpdateByIdAndOwner(ctx context.Context, id string, ownerId string, content model.Content) error
+	DeleteByIdAndOwner(ctx context.Context, id string, ownerId string) error
+	// CompareAndSwapContent replaces content of clipboard id with new if it's
+	// still old, i.e. with the same Checksum, KeyVersion and DataKey.
+	// It's ErrConflict otherwise. Unlike Update, UpdatedAt is kept as it is,
+	// as it's meant for maintenance like re-encryption.
+	CompareAndSwapContent(ctx context.Context, id string, old model.Content, new model.Content) error
+}
+
+// RepositoryClipboardStream is a RepositoryClipboard that streams
+// clipboard content, which may be kept in a BlobStore instead of
+// model.Content.Text.
+type RepositoryClipboardStream interface {
+	RepositoryClipboard
+	// CreateFrom creates clip with content read from r,
+	// and returns clip with its content metadata
+	CreateFrom(ctx context.Context, clip model.Clipboard, r io.Reader) (model.Clipboard, error)
+	// UpdateFrom is like UpdateByIdAndOwner with content read from r,
+	// keeping MimeType and Envelope of content, and returns the new content metadata
+	UpdateFrom(ctx context.Context, id string, ownerId string, content model.Content, r io.Reader) (model.Content, error)
+	// Open returns a reader of clip content
+	Open(ctx context.Context, clip model.Clipboard) (io.ReadCloser, error)
+}
+
+// ClipboardEvents publishes changes of clipboards to subscribers
+type ClipboardEvents interface {
+	// Subscribe returns a channel of events of clipboards owned by ownerId,
+	// which is closed once ctx is done
+	Subscribe(ctx context.Context, ownerId string) (<-chan model.ClipboardEvent, error)
+
+	// SubscribeAfter is like Subscribe, but first replays retained events
+	// after event lastId. Empty lastId replays nothing.
+	// Malformed lastId is ErrInvalid.
+	SubscribeAfter(ctx context.Context, ownerId string, lastId string) (<-chan model.ClipboardEvent, error)
+}
+
+// BlobStore stores clipboard content that is too large for the repositories
+type BlobStore interface {
+	// Put stores content read from r at key, replacing any existing blob,
+	// and returns the number of bytes written
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Get returns ErrNotFound if there's no blob at key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete does not return error if there's no blob at key
+	Delete(ctx context.Context, key string) error
+	// Keys returns keys of blobs last written before t
+	Keys(ctx context.Context, before time.Time) ([]string, error)
+}
+
+// RepositoryShare stores share links of clipboards. Expired shares,
+// and shares with no views left, are treated as missing.
+type RepositoryShare interface {
+	// Create stores share with ViewsLeft set to its MaxViews,
+	// and deletes it at share.ExpiresAt if it's not zero
+	Create(ctx context.Context, share model.Share) error
+	GetByToken(ctx context.Context, token string) (model.Share, error)
+	// GetAllByClipboard returns shares of clipboardId owned by ownerId
+	GetAllByClipboard(ctx context.Context, clipboardId string, ownerId string) ([]model.Share, error)
+	// View atomically counts a view of share token, deleting it after
+	// its last view. It's ErrNotFound if there's no view left, so that
+	// concurrent viewers can't go over MaxViews.
+	View(ctx context.Context, token string) error
+	// Attempt atomically counts a password attempt of share token,
+	// which locks it out for model.ShareLockout of the attempts counted
+	// so far, and is ErrLocked while it's locked out. Attempts are counted
+	// before passwords are verified, so that concurrent guesses are limited too,
+	// and View resets them.
+	Attempt(ctx context.Context, token string) error
+	DeleteByTokenAndOwner(ctx context.Context, token string, ownerId string) error
+}
+
+// RepositorySpace stores spaces and their members
+type RepositorySpace interface {
+	// Create stores space, with its owner as member of role model.RoleOwner
+	Create(ctx context.Context, space model.Space) error
+	GetById(ctx context.Context, id string) (model.Space, error)
+	// GetAllByMember returns spaces userId is a member of
+	GetAllByMember(ctx context.Context, userId string) ([]model.Space, error)
+
+	// GetMember is ErrNotFound if userId is not a member of spaceId
+	GetMember(ctx context.Context, spaceId string, userId string) (model.Member, error)
+	GetMembers(ctx context.Context, spaceId string) ([]model.Member, error)
+	// PutMember adds member to its space, or changes its role.
+	// It's ErrNotFound if the space does not exist.
+	PutMember(ctx context.Context, member model.Member) error
+	DeleteMember(ctx context.Context, spaceId string, userId string) error
 }
 
 type RepositoryUser interface {
 	Create(ctx context.Context, user model.User) (model.User, error)
 	GetPassword(ctx context.Context, username string) ([]byte, error)
+	GetByUsername(ctx context.Context, username string) (model.User, error)
 	GetById(ctx context.Context, id string) (model.User, error)
 	UpdateUsername(ctx context.Context, id string, newUsername string) error
 	UpdatePassword(ctx context.Context, id string, newPassword string) error
 	Delete(ctx context.Context, id string) error
 }
+
+type RepositorySession interface {
+	Create(ctx context.Context, session model.Session) error
+	GetById(ctx context.Context, id string) (model.Session, error)
+	// Update replaces RefreshHash, ExpiresAt and DeviceId of a live session,
+	// only if its RefreshHash is still oldHash. It's ErrConflict otherwise,
+	// so that of concurrent rotations of the same refresh token, only one wins.
+	Update(ctx context.Context, session model.Session, oldHash string) error
+	Delete(ctx context.Context, id string) error
+	DeleteByUserId(ctx context.Context, userId string) error
+}
+
+// RepositoryTicket remembers ids of used one-time tickets, so that
+// API instances sharing the repository only accept each ticket once
+type RepositoryTicket interface {
+	// Use marks ticket id as used until expiresAt, after which the ticket
+	// can't be used anyway and is forgotten. It's ErrConflict if id
+	// is already used.
+	Use(ctx context.Context, id string, expiresAt time.Time) error
+}
+
+type RepositoryDevice interface {
+	Create(ctx context.Context, device model.Device) error
+	GetById(ctx context.Context, id string) (model.Device, error)
+	GetAllByUser(ctx context.Context, userId string) ([]model.Device, error)
+	// UpdateLastSeen sets LastSeenAt of device id to t
+	UpdateLastSeen(ctx context.Context, id string, t time.Time) error
+	DeleteByIdAndUser(ctx context.Context, id string, userId string) error
+}
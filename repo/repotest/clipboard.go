@@ -0,0 +1,660 @@
+package repotest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+func TestClipboard(t *testing.T, newRepo func(t *testing.T) repo.RepositoryClipboard) {
+	ctx := context.Background()
+
+	t.Run("create and get", func(t *testing.T) {
+		r := newRepo(t)
+
+		_, err := r.GetById(ctx, "missing")
+		mustNotFound(t, err, "get missing clipboard")
+
+		err = r.Create(ctx, model.Clipboard{Content: model.Content{Text: "no id"}})
+		mustInvalid(t, err, "create clipboard without id")
+
+		clip := model.Clipboard{Id: "clip-1", Content: model.Content{Text: "hello"}, OwnerId: "yong"}
+		mustNil(t, r.Create(ctx, clip))
+
+		got, err := r.GetById(ctx, clip.Id)
+		mustNil(t, err)
+		if got.Id != clip.Id || got.Text != clip.Text || got.OwnerId != clip.OwnerId {
+			t.Fatalf("unexpected clipboard: %+v", got)
+		}
+		if got.CreatedAt.IsZero() || got.UpdatedAt.IsZero() {
+			t.Fatalf("expected timestamps to be set: %+v", got)
+		}
+
+		err = r.Create(ctx, model.Clipboard{Id: clip.Id, Content: model.Content{Text: "taken"}, OwnerId: "other"})
+		mustConflict(t, err, "create clipboard with taken id")
+
+		got, err = r.GetById(ctx, clip.Id)
+		mustNil(t, err)
+		if got.Text != clip.Text || got.OwnerId != clip.OwnerId {
+			t.Fatalf("expected clipboard not to be overwritten, got %+v", got)
+		}
+	})
+
+	t.Run("get all", func(t *testing.T) {
+		r := newRepo(t)
+
+		all, err := r.GetAll(ctx)
+		mustNil(t, err)
+		if len(all) != 0 {
+			t.Fatalf("expected empty repo, got %d clipboards", len(all))
+		}
+
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-1", Content: model.Content{Text: "1"}, OwnerId: "yong"}))
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-2", Content: model.Content{Text: "2"}, OwnerId: "yong"}))
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-3", Content: model.Content{Text: "3"}, OwnerId: "other"}))
+
+		all, err = r.GetAll(ctx)
+		mustNil(t, err)
+		expectIds(t, all, "clip-1", "clip-2", "clip-3")
+
+		mine, err := r.GetAllByOwner(ctx, "yong")
+		mustNil(t, err)
+		expectIds(t, mine, "clip-1", "clip-2")
+
+		none, err := r.GetAllByOwner(ctx, "nobody")
+		mustNil(t, err)
+		expectIds(t, none)
+	})
+
+	t.Run("update", func(t *testing.T) {
+		r := newRepo(t)
+
+		err := r.Update(ctx, "missing", model.NewContent("foo", ""))
+		mustNotFound(t, err, "update missing clipboard")
+
+		_, err = r.GetById(ctx, "missing")
+		mustNotFound(t, err, "update must not create clipboard")
+
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-1", Content: model.Content{Text: "old"}, OwnerId: "yong"}))
+		mustNil(t, r.Update(ctx, "clip-1", model.NewContent("new", "")))
+
+		got, err := r.GetById(ctx, "clip-1")
+		mustNil(t, err)
+		if got.Text != "new" || got.OwnerId != "yong" {
+			t.Fatalf("unexpected clipboard after update: %+v", got)
+		}
+		if got.UpdatedAt.Before(got.CreatedAt) {
+			t.Fatalf("updated_at before created_at: %+v", got)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-1", Content: model.Content{Text: "1"}, OwnerId: "yong"}))
+		mustNil(t, r.Delete(ctx, "clip-1"))
+
+		_, err := r.GetById(ctx, "clip-1")
+		mustNotFound(t, err, "get deleted clipboard")
+
+		mine, err := r.GetAllByOwner(ctx, "yong")
+		mustNil(t, err)
+		expectIds(t, mine)
+
+		// Deleting missing clipboards is not an error
+		mustNil(t, r.Delete(ctx, "missing"))
+	})
+
+	t.Run("list by owner", func(t *testing.T) {
+		testListByOwner(t, newRepo(t))
+	})
+
+	t.Run("list by device", func(t *testing.T) {
+		testListByDevice(t, newRepo(t))
+	})
+
+	t.Run("get by owner in range", func(t *testing.T) {
+		testGetByOwnerInRange(t, newRepo(t))
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "expired", Content: model.Content{Text: "1"}, OwnerId: "yong", ExpiresAt: time.Now().Add(-time.Second)}))
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "alive", Content: model.Content{Text: "2"}, OwnerId: "yong", ExpiresAt: time.Now().Add(time.Hour)}))
+
+		_, err := r.GetById(ctx, "expired")
+		mustNotFound(t, err, "get expired clipboard")
+
+		_, err = r.GetByIdAndOwner(ctx, "expired", "yong")
+		mustNotFound(t, err, "get expired clipboard")
+
+		err = r.UpdateByIdAndOwner(ctx, "expired", "yong", model.NewContent("new", ""))
+		mustNotFound(t, err, "update expired clipboard")
+
+		got, err := r.GetById(ctx, "alive")
+		mustNil(t, err)
+		if got.ExpiresAt.IsZero() {
+			t.Fatalf("expected expires_at to be set: %+v", got)
+		}
+
+		mine, err := r.GetAllByOwner(ctx, "yong")
+		mustNil(t, err)
+		expectIds(t, mine, "alive")
+
+		page, _, err := r.ListByOwner(ctx, "yong", 10, "")
+		mustNil(t, err)
+		expectIds(t, page, "alive")
+	})
+
+	t.Run("burn after read", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "burn-1", Content: model.Content{Text: "secret"}, OwnerId: "yong", BurnAfterRead: true}))
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "burn-2", Content: model.Content{Text: "secret"}, OwnerId: "yong", BurnAfterRead: true}))
+
+		// Listing does not burn
+		mine, err := r.GetAllByOwner(ctx, "yong")
+		mustNil(t, err)
+		expectIds(t, mine, "burn-1", "burn-2")
+
+		got, err := r.GetById(ctx, "burn-1")
+		mustNil(t, err)
+		if got.Text != "secret" || !got.BurnAfterRead {
+			t.Fatalf("unexpected clipboard: %+v", got)
+		}
+
+		_, err = r.GetById(ctx, "burn-1")
+		mustNotFound(t, err, "second read of burn-after-read clipboard")
+
+		// Nor does getting its blob key, or checking its owner
+		_, err = r.GetBlobKey(ctx, "burn-2")
+		mustNil(t, err)
+		mustNil(t, r.CheckOwner(ctx, "burn-2", "yong"))
+		mustNotFound(t, r.CheckOwner(ctx, "burn-2", "other"), "check owner of other user's clipboard")
+		mustNotFound(t, r.CheckOwner(ctx, "missing", "yong"), "check owner of missing clipboard")
+
+		// Other users can't burn it
+		_, err = r.GetByIdAndOwner(ctx, "burn-2", "other")
+		mustNotFound(t, err, "get other user's clipboard")
+
+		got, err = r.GetByIdAndOwner(ctx, "burn-2", "yong")
+		mustNil(t, err)
+		if got.Text != "secret" {
+			t.Fatalf("unexpected clipboard: %+v", got)
+		}
+
+		_, err = r.GetByIdAndOwner(ctx, "burn-2", "yong")
+		mustNotFound(t, err, "second read of burn-after-read clipboard")
+
+		mine, err = r.GetAllByOwner(ctx, "yong")
+		mustNil(t, err)
+		expectIds(t, mine)
+	})
+
+	t.Run("content", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "text", Content: model.Content{Text: "hello"}, OwnerId: "yong"}))
+
+		got, err := r.GetById(ctx, "text")
+		mustNil(t, err)
+		expectContent(t, got, "hello", model.DefaultMimeType)
+
+		// Not valid UTF-8, and with NUL bytes
+		png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\xff\xfe"
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "binary", Content: model.Content{Text: png, MimeType: "image/png"}, Filename: "cat.png", OwnerId: "yong"}))
+
+		got, err = r.GetByIdAndOwner(ctx, "binary", "yong")
+		mustNil(t, err)
+		expectContent(t, got, png, "image/png")
+		if got.Filename != "cat.png" {
+			t.Fatalf("unexpected filename: %+v", got)
+		}
+
+		mustNil(t, r.UpdateByIdAndOwner(ctx, "binary", "yong", model.NewContent("<b>hi</b>", "text/html")))
+
+		got, err = r.GetById(ctx, "binary")
+		mustNil(t, err)
+		expectContent(t, got, "<b>hi</b>", "text/html")
+
+		mustNil(t, r.Update(ctx, "binary", model.NewContent(png, "")))
+
+		got, err = r.GetById(ctx, "binary")
+		mustNil(t, err)
+		expectContent(t, got, png, model.DefaultMimeType)
+
+		mine, err := r.GetAllByOwner(ctx, "yong")
+		mustNil(t, err)
+		for i := range mine {
+			if mine[i].Id == "binary" {
+				expectContent(t, mine[i], png, model.DefaultMimeType)
+			}
+		}
+
+		// Size and checksum of content kept in blob store are stored as they are
+		blob := model.Content{MimeType: "video/mp4", Size: 1 << 30, Checksum: model.Checksum("large"), BlobKey: "blob"}
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "blob", Content: blob, OwnerId: "yong"}))
+
+		got, err = r.GetById(ctx, "blob")
+		mustNil(t, err)
+		if got.Content != blob {
+			t.Fatalf("expected blob content %+v, got %+v", blob, got.Content)
+		}
+
+		key, err := r.GetBlobKey(ctx, "blob")
+		mustNil(t, err)
+		if key != blob.BlobKey {
+			t.Fatalf("expected blob key '%s', got '%s'", blob.BlobKey, key)
+		}
+
+		_, err = r.GetBlobKey(ctx, "missing")
+		mustNotFound(t, err, "get blob key of missing clipboard")
+
+		mustNil(t, r.Update(ctx, "blob", model.NewContent("small", "")))
+
+		got, err = r.GetById(ctx, "blob")
+		mustNil(t, err)
+		expectContent(t, got, "small", model.DefaultMimeType)
+		if got.BlobKey != "" {
+			t.Fatalf("expected blob key to be cleared: %+v", got)
+		}
+
+		key, err = r.GetBlobKey(ctx, "text")
+		mustNil(t, err)
+		if key != "" {
+			t.Fatalf("expected no blob key of text clipboard, got '%s'", key)
+		}
+	})
+
+	t.Run("envelope", func(t *testing.T) {
+		r := newRepo(t)
+
+		envelope := model.Envelope{Version: 1, Alg: model.EnvelopeAlg, KeyId: "k1", Nonce: "AAECAwQFBgcICQoL"}
+		ciphertext := "\x00\xffciphertext"
+		content := model.Content{Text: ciphertext, MimeType: "application/octet-stream", Envelope: &envelope}
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "secret", Content: content, OwnerId: "yong"}))
+
+		got, err := r.GetById(ctx, "secret")
+		mustNil(t, err)
+		expectContent(t, got, ciphertext, "application/octet-stream")
+		if got.Envelope == nil || *got.Envelope != envelope {
+			t.Fatalf("expected envelope %+v, got %+v", envelope, got.Envelope)
+		}
+
+		envelope.Nonce = "CwoJCAcGBQQDAgEA"
+		mustNil(t, r.UpdateByIdAndOwner(ctx, "secret", "yong", model.Content{Text: "new", Envelope: &envelope}))
+
+		got, err = r.GetById(ctx, "secret")
+		mustNil(t, err)
+		if got.Envelope == nil || *got.Envelope != envelope {
+			t.Fatalf("expected updated envelope %+v, got %+v", envelope, got.Envelope)
+		}
+
+		// Plaintext content replacing encrypted content has no envelope
+		mustNil(t, r.Update(ctx, "secret", model.NewContent("plain", "")))
+
+		got, err = r.GetById(ctx, "secret")
+		mustNil(t, err)
+		if got.Envelope != nil {
+			t.Fatalf("expected envelope to be cleared: %+v", got.Envelope)
+		}
+	})
+
+	t.Run("compare and swap content", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip", Content: model.Content{Text: "plain"}, OwnerId: "yong", UpdatedAt: time.Now().Add(-time.Hour)}))
+
+		old, err := r.GetById(ctx, "clip")
+		mustNil(t, err)
+
+		encrypted := model.Content{Text: "\x01ciphertext", MimeType: old.MimeType, Size: old.Size, Checksum: old.Checksum, KeyVersion: 2, DataKey: "key-1"}
+		stale := old.Content
+		stale.Checksum = model.Checksum("other")
+		mustConflict(t, r.CompareAndSwapContent(ctx, "clip", stale, encrypted), "swap of stale content")
+
+		mustNil(t, r.CompareAndSwapContent(ctx, "clip", old.Content, encrypted))
+
+		got, err := r.GetById(ctx, "clip")
+		mustNil(t, err)
+		if got.Content != encrypted {
+			t.Fatalf("expected content %+v, got %+v", encrypted, got.Content)
+		}
+		if !got.UpdatedAt.Equal(old.UpdatedAt) {
+			t.Fatalf("expected UpdatedAt %v to be kept, got %v", old.UpdatedAt, got.UpdatedAt)
+		}
+
+		// Swapping again from the same old content fails, as the key has changed
+		mustConflict(t, r.CompareAndSwapContent(ctx, "clip", old.Content, encrypted), "second swap")
+		mustErr(t, r.CompareAndSwapContent(ctx, "missing", old.Content, encrypted), "swap of missing clipboard")
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		r := newRepo(t)
+
+		usage, err := r.UsageByOwner(ctx, "yong")
+		mustNil(t, err)
+		if usage != (model.Usage{}) {
+			t.Fatalf("expected no usage, got %+v", usage)
+		}
+
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-1", Content: model.Content{Text: "12345"}, OwnerId: "yong"}))
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-2", Content: model.Content{Text: "123"}, OwnerId: "yong"}))
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-3", Content: model.Content{Text: "1"}, OwnerId: "other"}))
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "expired", Content: model.Content{Text: "1"}, OwnerId: "yong", ExpiresAt: time.Now().Add(-time.Second)}))
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "blob", Content: model.Content{Size: 100, Checksum: model.Checksum("blob"), BlobKey: "blob"}, OwnerId: "yong"}))
+
+		usage, err = r.UsageByOwner(ctx, "yong")
+		mustNil(t, err)
+		if usage != (model.Usage{Clips: 3, Bytes: 108}) {
+			t.Fatalf("unexpected usage: %+v", usage)
+		}
+
+		mustNil(t, r.UpdateByIdAndOwner(ctx, "clip-1", "yong", model.NewContent("1", "")))
+		mustNil(t, r.DeleteByIdAndOwner(ctx, "clip-2", "yong"))
+
+		usage, err = r.UsageByOwner(ctx, "yong")
+		mustNil(t, err)
+		if usage != (model.Usage{Clips: 2, Bytes: 101}) {
+			t.Fatalf("unexpected usage after update and delete: %+v", usage)
+		}
+	})
+
+	t.Run("owner scoped", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-1", Content: model.Content{Text: "1"}, OwnerId: "yong"}))
+
+		_, err := r.GetByIdAndOwner(ctx, "clip-1", "other")
+		mustNotFound(t, err, "get other user's clipboard")
+
+		_, err = r.GetByIdAndOwner(ctx, "missing", "yong")
+		mustNotFound(t, err, "get missing clipboard")
+
+		got, err := r.GetByIdAndOwner(ctx, "clip-1", "yong")
+		mustNil(t, err)
+		if got.Text != "1" {
+			t.Fatalf("unexpected clipboard: %+v", got)
+		}
+
+		err = r.UpdateByIdAndOwner(ctx, "clip-1", "other", model.NewContent("hacked", ""))
+		mustNotFound(t, err, "update other user's clipboard")
+
+		err = r.UpdateByIdAndOwner(ctx, "missing", "yong", model.NewContent("foo", ""))
+		mustNotFound(t, err, "update missing clipboard")
+
+		mustNil(t, r.UpdateByIdAndOwner(ctx, "clip-1", "yong", model.NewContent("2", "")))
+
+		got, err = r.GetById(ctx, "clip-1")
+		mustNil(t, err)
+		if got.Text != "2" {
+			t.Fatalf("unexpected clipboard after update: %+v", got)
+		}
+
+		err = r.DeleteByIdAndOwner(ctx, "clip-1", "other")
+		mustNotFound(t, err, "delete other user's clipboard")
+
+		_, err = r.GetById(ctx, "clip-1")
+		mustNil(t, err)
+
+		mustNil(t, r.DeleteByIdAndOwner(ctx, "clip-1", "yong"))
+
+		err = r.DeleteByIdAndOwner(ctx, "clip-1", "yong")
+		mustNotFound(t, err, "delete deleted clipboard")
+
+		mine, err := r.GetAllByOwner(ctx, "yong")
+		mustNil(t, err)
+		expectIds(t, mine)
+	})
+}
+
+func testListByOwner(t *testing.T, r repo.RepositoryClipboard) {
+	ctx := context.Background()
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	create := func(id string, createdAt time.Time, owner string) {
+		t.Helper()
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: id, Content: model.Content{Text: id}, OwnerId: owner, CreatedAt: createdAt}))
+	}
+
+	create("clip-0", base, "yong")
+	create("clip-2", base.Add(2*time.Second), "yong")
+	create("clip-1", base.Add(time.Second), "yong")
+	create("clip-4", base.Add(4*time.Second), "yong")
+	create("clip-3", base.Add(3*time.Second), "yong")
+	// Same creation time as clip-2
+	create("clip-2a", base.Add(2*time.Second), "yong")
+	create("clip-2b", base.Add(2*time.Second), "yong")
+	create("other", base.Add(5*time.Second), "other")
+
+	expected := []string{"clip-4", "clip-3", "clip-2b", "clip-2a", "clip-2", "clip-1", "clip-0"}
+
+	for _, limit := range []int{1, 2, 3, 7, 100} {
+		got := []string{}
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(expected) {
+				t.Fatalf("limit %d: too many pages", limit)
+			}
+
+			clips, next, err := r.ListByOwner(ctx, "yong", limit, cursor)
+			mustNil(t, err)
+
+			if len(clips) > limit {
+				t.Fatalf("limit %d: got %d clipboards", limit, len(clips))
+			}
+
+			for i := range clips {
+				got = append(got, clips[i].Id)
+			}
+
+			if next == "" {
+				break
+			}
+
+			cursor = next
+		}
+
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Fatalf("limit %d: expected %v, got %v", limit, expected, got)
+		}
+	}
+
+	clips, next, err := r.ListByOwner(ctx, "nobody", 10, "")
+	mustNil(t, err)
+	if len(clips) != 0 || next != "" {
+		t.Fatalf("unexpected page for owner without clipboards: %v '%s'", clips, next)
+	}
+
+	_, _, err = r.ListByOwner(ctx, "yong", 10, "not a cursor")
+	mustInvalid(t, err, "bad cursor")
+
+	_, _, err = r.ListByOwner(ctx, "yong", 0, "")
+	mustInvalid(t, err, "zero limit")
+}
+
+func testGetByOwnerInRange(t *testing.T, r repo.RepositoryClipboard) {
+	ctx := context.Background()
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("clip-%d", i)
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: id, Content: model.Content{Text: id}, OwnerId: "yong", CreatedAt: base.Add(time.Duration(i) * time.Second)}))
+	}
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "other", Content: model.Content{Text: "other"}, OwnerId: "other", CreatedAt: base.Add(2 * time.Second)}))
+
+	tests := []struct {
+		from, to time.Time
+		limit    int
+		expected []string
+	}{
+		{limit: 100, expected: []string{"clip-4", "clip-3", "clip-2", "clip-1", "clip-0"}},
+		{limit: 2, expected: []string{"clip-4", "clip-3"}},
+		{from: base.Add(time.Second), to: base.Add(3 * time.Second), limit: 100, expected: []string{"clip-2", "clip-1"}},
+		{from: base.Add(3 * time.Second), limit: 100, expected: []string{"clip-4", "clip-3"}},
+		{to: base.Add(time.Second), limit: 100, expected: []string{"clip-0"}},
+		{from: base.Add(time.Minute), limit: 100, expected: []string{}},
+	}
+
+	for i, tc := range tests {
+		clips, err := r.GetByOwnerInRange(ctx, "yong", tc.from, tc.to, tc.limit)
+		mustNil(t, err)
+
+		got := []string{}
+		for i := range clips {
+			got = append(got, clips[i].Id)
+		}
+
+		if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+			t.Fatalf("case %d: expected %v, got %v", i, tc.expected, got)
+		}
+	}
+
+	_, err := r.GetByOwnerInRange(ctx, "yong", time.Time{}, time.Time{}, 0)
+	mustInvalid(t, err, "zero limit")
+}
+
+func testListByDevice(t *testing.T, r repo.RepositoryClipboard) {
+	ctx := context.Background()
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	create := func(id string, createdAt time.Time, owner string, device string) {
+		t.Helper()
+		mustNil(t, r.Create(ctx, model.Clipboard{Id: id, Content: model.Content{Text: id}, OwnerId: owner, DeviceId: device, CreatedAt: createdAt}))
+	}
+
+	create("phone-0", base, "yong", "phone")
+	create("laptop-0", base.Add(time.Second), "yong", "laptop")
+	create("phone-1", base.Add(2*time.Second), "yong", "phone")
+	create("none", base.Add(3*time.Second), "yong", "")
+	create("phone-2", base.Add(4*time.Second), "yong", "phone")
+	create("phone-2a", base.Add(4*time.Second), "yong", "phone")
+	// Device ids are only unique per owner in this test
+	create("other", base.Add(5*time.Second), "other", "phone")
+
+	got, err := r.GetById(ctx, "laptop-0")
+	mustNil(t, err)
+	if got.DeviceId != "laptop" {
+		t.Fatalf("expected device id laptop, got %+v", got)
+	}
+
+	mustNil(t, r.Delete(ctx, "phone-1"))
+
+	expected := []string{"phone-2a", "phone-2", "phone-0"}
+	for _, limit := range []int{1, 2, 3, 100} {
+		got := []string{}
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(expected) {
+				t.Fatalf("limit %d: too many pages", limit)
+			}
+
+			clips, next, err := r.ListByDevice(ctx, "yong", "phone", limit, cursor)
+			mustNil(t, err)
+
+			if len(clips) > limit {
+				t.Fatalf("limit %d: got %d clipboards", limit, len(clips))
+			}
+
+			for i := range clips {
+				got = append(got, clips[i].Id)
+			}
+
+			if next == "" {
+				break
+			}
+
+			cursor = next
+		}
+
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Fatalf("limit %d: expected %v, got %v", limit, expected, got)
+		}
+	}
+
+	clips, next, err := r.ListByDevice(ctx, "yong", "tablet", 10, "")
+	mustNil(t, err)
+	if len(clips) != 0 || next != "" {
+		t.Fatalf("unexpected page for device without clipboards: %v '%s'", clips, next)
+	}
+
+	_, _, err = r.ListByDevice(ctx, "yong", "phone", 0, "")
+	mustInvalid(t, err, "list with zero limit")
+
+	tests := []struct {
+		device   string
+		from, to time.Time
+		limit    int
+		expected []string
+	}{
+		{device: "phone", limit: 100, expected: []string{"phone-2a", "phone-2", "phone-0"}},
+		{device: "phone", limit: 1, expected: []string{"phone-2a"}},
+		{device: "phone", from: base.Add(time.Second), limit: 100, expected: []string{"phone-2a", "phone-2"}},
+		{device: "phone", to: base.Add(4 * time.Second), limit: 100, expected: []string{"phone-0"}},
+		{device: "laptop", to: base.Add(4 * time.Second), limit: 100, expected: []string{"laptop-0"}},
+		{device: "tablet", limit: 100, expected: []string{}},
+	}
+
+	for i, tc := range tests {
+		clips, err := r.GetByDeviceInRange(ctx, "yong", tc.device, tc.from, tc.to, tc.limit)
+		mustNil(t, err)
+
+		got := []string{}
+		for i := range clips {
+			got = append(got, clips[i].Id)
+		}
+
+		if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+			t.Fatalf("range case %d: expected %v, got %v", i, tc.expected, got)
+		}
+	}
+
+	_, err = r.GetByDeviceInRange(ctx, "yong", "phone", time.Time{}, time.Time{}, 0)
+	mustInvalid(t, err, "get in range with zero limit")
+}
+
+func expectIds(t *testing.T, clips []model.Clipboard, ids ...string) {
+	t.Helper()
+
+	got := make([]string, len(clips))
+	for i := range clips {
+		got[i] = clips[i].Id
+	}
+
+	sort.Strings(got)
+	sort.Strings(ids)
+
+	if len(got) != len(ids) {
+		t.Fatalf("expected clipboards %v, got %v", ids, got)
+	}
+
+	for i := range ids {
+		if got[i] != ids[i] {
+			t.Fatalf("expected clipboards %v, got %v", ids, got)
+		}
+	}
+}
+
+func expectContent(t *testing.T, clip model.Clipboard, text string, mimeType string) {
+	t.Helper()
+
+	if clip.Text != text {
+		t.Fatalf("expected text %q, got %q", text, clip.Text)
+	}
+	if clip.MimeType != mimeType {
+		t.Fatalf("expected mime type %q, got %q", mimeType, clip.MimeType)
+	}
+	if clip.Size != int64(len(text)) {
+		t.Fatalf("expected size %d, got %d", len(text), clip.Size)
+	}
+	if clip.Checksum != model.Checksum(text) {
+		t.Fatalf("expected checksum %s, got %s", model.Checksum(text), clip.Checksum)
+	}
+}
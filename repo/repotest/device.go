@@ -0,0 +1,89 @@
+package repotest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+func TestDevice(t *testing.T, newRepo func(t *testing.T) repo.RepositoryDevice) {
+	ctx := context.Background()
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	t.Run("create and get", func(t *testing.T) {
+		r := newRepo(t)
+
+		_, err := r.GetById(ctx, "missing")
+		mustNotFound(t, err, "get missing device")
+
+		mustInvalid(t, r.Create(ctx, model.Device{UserId: "yong", Name: "phone"}), "create device without id")
+		mustInvalid(t, r.Create(ctx, model.Device{Id: "d1", Name: "phone"}), "create device without user")
+
+		device := model.Device{Id: "d1", UserId: "yong", Name: "phone", Platform: "android", CreatedAt: base}
+		mustNil(t, r.Create(ctx, device))
+		mustConflict(t, r.Create(ctx, device), "create device with taken id")
+
+		got, err := r.GetById(ctx, "d1")
+		mustNil(t, err)
+		if got.Id != device.Id || got.UserId != device.UserId || got.Name != device.Name || got.Platform != device.Platform ||
+			!got.CreatedAt.Equal(base) || !got.LastSeenAt.Equal(base) {
+			t.Fatalf("unexpected device: %+v", got)
+		}
+
+		seen := base.Add(time.Minute)
+		mustNil(t, r.UpdateLastSeen(ctx, "d1", seen))
+
+		got, err = r.GetById(ctx, "d1")
+		mustNil(t, err)
+		if !got.LastSeenAt.Equal(seen) || got.Name != device.Name {
+			t.Fatalf("unexpected device after update: %+v", got)
+		}
+
+		mustNotFound(t, r.UpdateLastSeen(ctx, "missing", seen), "update missing device")
+	})
+
+	t.Run("get all by user", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Device{Id: "d2", UserId: "yong", Name: "laptop", CreatedAt: base.Add(time.Second)}))
+		mustNil(t, r.Create(ctx, model.Device{Id: "d1", UserId: "yong", Name: "phone", CreatedAt: base}))
+		mustNil(t, r.Create(ctx, model.Device{Id: "d3", UserId: "other", Name: "phone", CreatedAt: base}))
+
+		devices, err := r.GetAllByUser(ctx, "yong")
+		mustNil(t, err)
+		if len(devices) != 2 || devices[0].Id != "d1" || devices[1].Id != "d2" {
+			t.Fatalf("expected devices d1 and d2 oldest first, got %+v", devices)
+		}
+
+		devices, err = r.GetAllByUser(ctx, "nobody")
+		mustNil(t, err)
+		if len(devices) != 0 {
+			t.Fatalf("expected no devices, got %+v", devices)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Device{Id: "d1", UserId: "yong", Name: "phone"}))
+
+		mustNotFound(t, r.DeleteByIdAndUser(ctx, "d1", "other"), "delete other user's device")
+		mustNotFound(t, r.DeleteByIdAndUser(ctx, "missing", "yong"), "delete missing device")
+
+		mustNil(t, r.DeleteByIdAndUser(ctx, "d1", "yong"))
+
+		_, err := r.GetById(ctx, "d1")
+		mustNotFound(t, err, "get deleted device")
+
+		mustNotFound(t, r.UpdateLastSeen(ctx, "d1", time.Now()), "update deleted device")
+
+		devices, err := r.GetAllByUser(ctx, "yong")
+		mustNil(t, err)
+		if len(devices) != 0 {
+			t.Fatalf("expected no devices, got %+v", devices)
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package repotest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+// TestDeleteExpired checks that expired clipboards are deleted from storage,
+// not only hidden by queries. stored reports whether clipboard id is still
+// in the backend storage, bypassing the repository.
+func TestDeleteExpired(t *testing.T, newRepo func(t *testing.T) (r repo.RepositoryClipboard, stored func(id string) bool)) {
+	ctx := context.Background()
+	r, stored := newRepo(t)
+
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "expired", Content: model.Content{Text: "secret"}, OwnerId: "yong", ExpiresAt: time.Now().Add(-time.Second)}))
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "alive", Content: model.Content{Text: "alive"}, OwnerId: "yong", ExpiresAt: time.Now().Add(time.Hour)}))
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "forever", Content: model.Content{Text: "forever"}, OwnerId: "yong"}))
+
+	_, err := r.DeleteExpired(ctx)
+	mustNil(t, err)
+
+	if stored("expired") {
+		t.Fatal("expected expired clipboard to be deleted from storage")
+	}
+
+	for _, id := range []string{"alive", "forever"} {
+		if !stored(id) {
+			t.Fatalf("expected clipboard %s to be kept", id)
+		}
+
+		_, err = r.GetById(ctx, id)
+		mustNil(t, err)
+	}
+
+	deleted, err := r.DeleteExpired(ctx)
+	mustNil(t, err)
+	if deleted != 0 {
+		t.Fatalf("expected nothing left to delete, got %d", deleted)
+	}
+}
@@ -0,0 +1,99 @@
+package repotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+// TestQuota checks that writes are checked against quota by the repository,
+// counting only live clipboards of each owner
+func TestQuota(t *testing.T, newRepo func(t *testing.T, quota repo.Quota) repo.RepositoryClipboard) {
+	ctx := context.Background()
+	r := newRepo(t, repo.Quota{MaxClips: 3, MaxBytes: 10})
+
+	text := func(n int) model.Content {
+		return model.NewContent(strings.Repeat("x", n), "")
+	}
+
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-1", Content: text(4), OwnerId: "yong"}))
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-2", Content: text(4), OwnerId: "yong"}))
+
+	err := r.Create(ctx, model.Clipboard{Id: "clip-3", Content: text(3), OwnerId: "yong"})
+	mustIs(t, err, repo.ErrQuotaBytes, "create over bytes quota")
+
+	err = r.UpdateByIdAndOwner(ctx, "clip-1", "yong", text(7))
+	mustIs(t, err, repo.ErrQuotaBytes, "update over bytes quota")
+
+	// The old content of clip-1 is not counted twice
+	mustNil(t, r.Update(ctx, "clip-1", text(6)))
+	expectUsage(t, r, "yong", model.Usage{Clips: 2, Bytes: 10})
+
+	// Shrinking is always allowed
+	mustNil(t, r.UpdateByIdAndOwner(ctx, "clip-1", "yong", text(1)))
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-3", Content: text(1), OwnerId: "yong"}))
+
+	err = r.Create(ctx, model.Clipboard{Id: "clip-4", Content: text(1), OwnerId: "yong"})
+	mustIs(t, err, repo.ErrQuotaClips, "create over clips quota")
+
+	// Other owners, and clipboards without owner, have their own quota
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "other", Content: text(10), OwnerId: "other"}))
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "anonymous", Content: text(20)}))
+
+	// Deleted, burnt and expired clipboards free their space
+	mustNil(t, r.DeleteByIdAndOwner(ctx, "clip-2", "yong"))
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "burn", Content: text(4), OwnerId: "yong", BurnAfterRead: true}))
+	_, err = r.GetById(ctx, "burn")
+	mustNil(t, err)
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "expired", Content: text(8), OwnerId: "yong", ExpiresAt: time.Now().Add(-time.Second)}))
+	expectUsage(t, r, "yong", model.Usage{Clips: 2, Bytes: 2})
+
+	mustNil(t, r.Create(ctx, model.Clipboard{Id: "clip-4", Content: text(8), OwnerId: "yong"}))
+	expectUsage(t, r, "yong", model.Usage{Clips: 3, Bytes: 10})
+
+	// Concurrent writers can't go over quota together
+	var (
+		wg      sync.WaitGroup
+		created atomic.Int64
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			err := r.Create(ctx, model.Clipboard{Id: fmt.Sprintf("race-%d", i), Content: text(1), OwnerId: "race"})
+			if err == nil {
+				created.Add(1)
+				return
+			}
+			if !errors.Is(err, repo.ErrQuotaClips) && !errors.Is(err, repo.ErrConflict) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	n := created.Load()
+	if n == 0 || n > 3 {
+		t.Fatalf("expected 1 to 3 clipboards created, got %d", n)
+	}
+	expectUsage(t, r, "race", model.Usage{Clips: n, Bytes: n})
+}
+
+func expectUsage(t *testing.T, r repo.RepositoryClipboard, ownerId string, expected model.Usage) {
+	t.Helper()
+
+	usage, err := r.UsageByOwner(context.Background(), ownerId)
+	mustNil(t, err)
+	if usage != expected {
+		t.Fatalf("expected usage %+v, got %+v", expected, usage)
+	}
+}
@@ -0,0 +1,59 @@
+// Package repotest is a behavioural test suite shared by all implementations
+// of repo.RepositoryClipboard, repo.RepositoryUser, repo.RepositorySession,
+// repo.RepositoryShare, repo.RepositorySpace and repo.RepositoryDevice.
+//
+// Each implementation calls the suite from its own tests with a constructor
+// returning a fresh, empty repository:
+//
+//	func TestConformance(t *testing.T) {
+//		repotest.TestClipboard(t, func(t *testing.T) repo.RepositoryClipboard {
+//			return memory.NewClipboard()
+//		})
+//	}
+//
+// Clipboard repositories also run TestDeleteExpired and TestQuota,
+// which need hooks into their storage and quota.
+package repotest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/eymyong/drop/repo"
+)
+
+func mustNil(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func mustErr(t *testing.T, err error, what string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected error: %s", what)
+	}
+}
+
+func mustIs(t *testing.T, err error, target error, what string) {
+	t.Helper()
+	if !errors.Is(err, target) {
+		t.Fatalf("expected %v for %s, got %v", target, what, err)
+	}
+}
+
+func mustNotFound(t *testing.T, err error, what string) {
+	t.Helper()
+	mustIs(t, err, repo.ErrNotFound, what)
+}
+
+func mustConflict(t *testing.T, err error, what string) {
+	t.Helper()
+	mustIs(t, err, repo.ErrConflict, what)
+}
+
+func mustInvalid(t *testing.T, err error, what string) {
+	t.Helper()
+	mustIs(t, err, repo.ErrInvalid, what)
+}
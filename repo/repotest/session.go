@@ -0,0 +1,156 @@
+package repotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+func TestSession(t *testing.T, newRepo func(t *testing.T) repo.RepositorySession) {
+	ctx := context.Background()
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	t.Run("create, update and delete", func(t *testing.T) {
+		r := newRepo(t)
+
+		_, err := r.GetById(ctx, "missing")
+		mustNotFound(t, err, "get missing session")
+
+		session := model.Session{Id: "s1", UserId: "yong", RefreshHash: "hash-1", ExpiresAt: exp}
+		mustNil(t, r.Create(ctx, session))
+
+		got, err := r.GetById(ctx, session.Id)
+		mustNil(t, err)
+		if got.Id != session.Id || got.UserId != session.UserId || got.RefreshHash != session.RefreshHash || !got.ExpiresAt.Equal(exp) {
+			t.Fatalf("unexpected session: %+v", got)
+		}
+
+		session.RefreshHash = "hash-2"
+		session.ExpiresAt = exp.Add(time.Hour)
+		session.DeviceId = "phone"
+		mustNil(t, r.Update(ctx, session, "hash-1"))
+
+		got, err = r.GetById(ctx, session.Id)
+		mustNil(t, err)
+		if got.RefreshHash != "hash-2" || !got.ExpiresAt.Equal(session.ExpiresAt) || got.DeviceId != "phone" {
+			t.Fatalf("unexpected session after update: %+v", got)
+		}
+
+		mustNil(t, r.Delete(ctx, session.Id))
+
+		_, err = r.GetById(ctx, session.Id)
+		mustErr(t, err, "get deleted session")
+
+		err = r.Update(ctx, session, "hash-2")
+		mustNotFound(t, err, "update must not bring back deleted session")
+
+		_, err = r.GetById(ctx, session.Id)
+		mustErr(t, err, "get deleted session after update")
+	})
+
+	t.Run("stale hash", func(t *testing.T) {
+		r := newRepo(t)
+
+		session := model.Session{Id: "s1", UserId: "yong", RefreshHash: "hash-1", ExpiresAt: exp}
+		mustNil(t, r.Create(ctx, session))
+
+		session.RefreshHash = "hash-2"
+		mustNil(t, r.Update(ctx, session, "hash-1"))
+
+		// The old refresh token was already rotated
+		session.RefreshHash = "hash-3"
+		mustConflict(t, r.Update(ctx, session, "hash-1"), "update with stale hash")
+
+		got, err := r.GetById(ctx, session.Id)
+		mustNil(t, err)
+		if got.RefreshHash != "hash-2" {
+			t.Fatalf("expected hash-2 to be kept, got %+v", got)
+		}
+	})
+
+	t.Run("concurrent reuse", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Session{Id: "s1", UserId: "yong", RefreshHash: "hash", ExpiresAt: exp}))
+
+		var (
+			wg      sync.WaitGroup
+			mut     sync.Mutex
+			rotated []string
+		)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				hash := fmt.Sprintf("hash-%d", i)
+				err := r.Update(ctx, model.Session{Id: "s1", UserId: "yong", RefreshHash: hash, ExpiresAt: exp}, "hash")
+				if err == nil {
+					mut.Lock()
+					rotated = append(rotated, hash)
+					mut.Unlock()
+				} else if !errors.Is(err, repo.ErrConflict) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if len(rotated) != 1 {
+			t.Fatalf("expected refresh token to be rotated once, got %d", len(rotated))
+		}
+
+		got, err := r.GetById(ctx, "s1")
+		mustNil(t, err)
+		if got.RefreshHash != rotated[0] {
+			t.Fatalf("expected hash of the winner %s, got %+v", rotated[0], got)
+		}
+	})
+
+	t.Run("device", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Session{Id: "s1", UserId: "yong", RefreshHash: "h", ExpiresAt: exp, DeviceId: "phone"}))
+
+		got, err := r.GetById(ctx, "s1")
+		mustNil(t, err)
+		if got.DeviceId != "phone" {
+			t.Fatalf("expected device id phone, got %+v", got)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		r := newRepo(t)
+
+		session := model.Session{Id: "s1", UserId: "yong", RefreshHash: "hash", ExpiresAt: time.Now().Add(-time.Minute)}
+		mustNil(t, r.Create(ctx, session))
+
+		_, err := r.GetById(ctx, session.Id)
+		mustErr(t, err, "get expired session")
+	})
+
+	t.Run("delete by user id", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Session{Id: "s1", UserId: "yong", RefreshHash: "h", ExpiresAt: exp}))
+		mustNil(t, r.Create(ctx, model.Session{Id: "s2", UserId: "yong", RefreshHash: "h", ExpiresAt: exp}))
+		mustNil(t, r.Create(ctx, model.Session{Id: "s3", UserId: "other", RefreshHash: "h", ExpiresAt: exp}))
+
+		mustNil(t, r.DeleteByUserId(ctx, "yong"))
+
+		_, err := r.GetById(ctx, "s1")
+		mustErr(t, err, "get deleted session s1")
+
+		_, err = r.GetById(ctx, "s2")
+		mustErr(t, err, "get deleted session s2")
+
+		_, err = r.GetById(ctx, "s3")
+		mustNil(t, err)
+	})
+}
@@ -0,0 +1,208 @@
+package repotest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+func TestShare(t *testing.T, newRepo func(t *testing.T) repo.RepositoryShare) {
+	ctx := context.Background()
+
+	t.Run("create, get and delete", func(t *testing.T) {
+		r := newRepo(t)
+
+		_, err := r.GetByToken(ctx, "missing")
+		mustNotFound(t, err, "get missing share")
+
+		mustInvalid(t, r.Create(ctx, model.Share{ClipboardId: "clip", OwnerId: "yong"}), "create share without token")
+		mustInvalid(t, r.Create(ctx, model.Share{Token: "t", OwnerId: "yong"}), "create share without clipboard")
+		mustInvalid(t, r.Create(ctx, model.Share{Token: "t", ClipboardId: "clip", OwnerId: "yong", MaxViews: -1}), "create share with negative max views")
+
+		exp := time.Now().Add(time.Hour).Truncate(time.Second)
+		share := model.Share{Token: "t1", ClipboardId: "clip", OwnerId: "yong", PasswordHash: "hash", ExpiresAt: exp, MaxViews: 3}
+		mustNil(t, r.Create(ctx, share))
+		mustConflict(t, r.Create(ctx, share), "create share with taken token")
+
+		got, err := r.GetByToken(ctx, "t1")
+		mustNil(t, err)
+		if got.ClipboardId != "clip" || got.OwnerId != "yong" || got.PasswordHash != "hash" || !got.ExpiresAt.Equal(exp) || got.MaxViews != 3 || got.ViewsLeft != 3 {
+			t.Fatalf("unexpected share: %+v", got)
+		}
+		if got.CreatedAt.IsZero() {
+			t.Fatalf("expected CreatedAt to be set: %+v", got)
+		}
+
+		mustNil(t, r.Create(ctx, model.Share{Token: "t2", ClipboardId: "clip", OwnerId: "yong"}))
+		mustNil(t, r.Create(ctx, model.Share{Token: "t3", ClipboardId: "other", OwnerId: "yong"}))
+
+		shares, err := r.GetAllByClipboard(ctx, "clip", "yong")
+		mustNil(t, err)
+		expectTokens(t, shares, "t1", "t2")
+
+		shares, err = r.GetAllByClipboard(ctx, "clip", "other")
+		mustNil(t, err)
+		expectTokens(t, shares)
+
+		mustNotFound(t, r.DeleteByTokenAndOwner(ctx, "t1", "other"), "delete share of other user")
+		mustNil(t, r.DeleteByTokenAndOwner(ctx, "t1", "yong"))
+		mustNotFound(t, r.DeleteByTokenAndOwner(ctx, "t1", "yong"), "delete deleted share")
+
+		_, err = r.GetByToken(ctx, "t1")
+		mustNotFound(t, err, "get deleted share")
+
+		shares, err = r.GetAllByClipboard(ctx, "clip", "yong")
+		mustNil(t, err)
+		expectTokens(t, shares, "t2")
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Share{Token: "t", ClipboardId: "clip", OwnerId: "yong", ExpiresAt: time.Now().Add(-time.Second)}))
+
+		_, err := r.GetByToken(ctx, "t")
+		mustNotFound(t, err, "get expired share")
+		mustNotFound(t, r.View(ctx, "t"), "view expired share")
+
+		shares, err := r.GetAllByClipboard(ctx, "clip", "yong")
+		mustNil(t, err)
+		expectTokens(t, shares)
+	})
+
+	t.Run("view", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNotFound(t, r.View(ctx, "missing"), "view missing share")
+
+		mustNil(t, r.Create(ctx, model.Share{Token: "limited", ClipboardId: "clip", OwnerId: "yong", MaxViews: 2}))
+		mustNil(t, r.Create(ctx, model.Share{Token: "unlimited", ClipboardId: "clip", OwnerId: "yong"}))
+
+		mustNil(t, r.View(ctx, "limited"))
+
+		got, err := r.GetByToken(ctx, "limited")
+		mustNil(t, err)
+		if got.ViewsLeft != 1 {
+			t.Fatalf("expected 1 view left, got %d", got.ViewsLeft)
+		}
+
+		mustNil(t, r.View(ctx, "limited"))
+		mustNotFound(t, r.View(ctx, "limited"), "view used up share")
+
+		_, err = r.GetByToken(ctx, "limited")
+		mustNotFound(t, err, "get used up share")
+
+		for i := 0; i < 5; i++ {
+			mustNil(t, r.View(ctx, "unlimited"))
+		}
+	})
+
+	t.Run("concurrent views", func(t *testing.T) {
+		r := newRepo(t)
+
+		const maxViews = 5
+		mustNil(t, r.Create(ctx, model.Share{Token: "t", ClipboardId: "clip", OwnerId: "yong", MaxViews: maxViews}))
+
+		var (
+			wg    sync.WaitGroup
+			mut   sync.Mutex
+			views int
+		)
+		for i := 0; i < 4*maxViews; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				if r.View(ctx, "t") == nil {
+					mut.Lock()
+					views++
+					mut.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if views != maxViews {
+			t.Fatalf("expected %d views, got %d", maxViews, views)
+		}
+	})
+
+	t.Run("password attempts", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNotFound(t, r.Attempt(ctx, "missing"), "attempt missing share")
+
+		mustNil(t, r.Create(ctx, model.Share{Token: "t", ClipboardId: "clip", OwnerId: "yong", PasswordHash: "hash"}))
+
+		// The first attempt over the free ones locks the share out
+		for i := 0; i <= model.ShareFreeAttempts; i++ {
+			mustNil(t, r.Attempt(ctx, "t"))
+		}
+		mustIs(t, r.Attempt(ctx, "t"), repo.ErrLocked, "attempt locked out share")
+
+		got, err := r.GetByToken(ctx, "t")
+		mustNil(t, err)
+		if got.FailedAttempts != model.ShareFreeAttempts+1 || !got.LockedUntil.After(time.Now()) {
+			t.Fatalf("expected share to be locked out, got %+v", got)
+		}
+
+		// Views reset attempts
+		mustNil(t, r.View(ctx, "t"))
+
+		got, err = r.GetByToken(ctx, "t")
+		mustNil(t, err)
+		if got.FailedAttempts != 0 || !got.LockedUntil.IsZero() {
+			t.Fatalf("expected attempts to be reset, got %+v", got)
+		}
+
+		mustNil(t, r.Attempt(ctx, "t"))
+	})
+
+	t.Run("concurrent attempts", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Share{Token: "t", ClipboardId: "clip", OwnerId: "yong", PasswordHash: "hash"}))
+
+		var (
+			wg       sync.WaitGroup
+			mut      sync.Mutex
+			attempts int
+		)
+		for i := 0; i < 4*model.ShareFreeAttempts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				err := r.Attempt(ctx, "t")
+				if err == nil {
+					mut.Lock()
+					attempts++
+					mut.Unlock()
+				} else if !errors.Is(err, repo.ErrLocked) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if attempts == 0 || attempts > model.ShareFreeAttempts+1 {
+			t.Fatalf("expected at most %d attempts, got %d", model.ShareFreeAttempts+1, attempts)
+		}
+	})
+}
+
+func expectTokens(t *testing.T, shares []model.Share, tokens ...string) {
+	t.Helper()
+
+	got := make([]string, len(shares))
+	for i := range shares {
+		got[i] = shares[i].Token
+	}
+
+	expectStrings(t, got, tokens)
+}
@@ -0,0 +1,123 @@
+package repotest
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+func TestSpace(t *testing.T, newRepo func(t *testing.T) repo.RepositorySpace) {
+	ctx := context.Background()
+
+	t.Run("create and get", func(t *testing.T) {
+		r := newRepo(t)
+
+		_, err := r.GetById(ctx, "missing")
+		mustNotFound(t, err, "get missing space")
+
+		mustInvalid(t, r.Create(ctx, model.Space{Name: "team", OwnerId: "yong"}), "create space without id")
+		mustInvalid(t, r.Create(ctx, model.Space{Id: "s1", Name: "team"}), "create space without owner")
+
+		space := model.Space{Id: "s1", Name: "team", OwnerId: "yong"}
+		mustNil(t, r.Create(ctx, space))
+		mustConflict(t, r.Create(ctx, space), "create space with taken id")
+
+		got, err := r.GetById(ctx, "s1")
+		mustNil(t, err)
+		if got.Id != space.Id || got.Name != space.Name || got.OwnerId != space.OwnerId || got.CreatedAt.IsZero() {
+			t.Fatalf("unexpected space: %+v", got)
+		}
+
+		member, err := r.GetMember(ctx, "s1", "yong")
+		mustNil(t, err)
+		if member.Role != model.RoleOwner {
+			t.Fatalf("expected owner to be member of role owner, got %+v", member)
+		}
+	})
+
+	t.Run("members", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Create(ctx, model.Space{Id: "s1", Name: "team", OwnerId: "yong"}))
+		mustNil(t, r.Create(ctx, model.Space{Id: "s2", Name: "other team", OwnerId: "other"}))
+
+		_, err := r.GetMember(ctx, "s1", "bob")
+		mustNotFound(t, err, "get non-member")
+
+		mustNotFound(t, r.PutMember(ctx, model.Member{SpaceId: "missing", UserId: "bob", Role: model.RoleReader}), "add member to missing space")
+		mustInvalid(t, r.PutMember(ctx, model.Member{SpaceId: "s1", UserId: "bob", Role: "admin"}), "add member with bad role")
+
+		mustNil(t, r.PutMember(ctx, model.Member{SpaceId: "s1", UserId: "bob", Role: model.RoleReader}))
+		mustNil(t, r.PutMember(ctx, model.Member{SpaceId: "s1", UserId: "bob", Role: model.RoleWriter}))
+		mustNil(t, r.PutMember(ctx, model.Member{SpaceId: "s2", UserId: "bob", Role: model.RoleReader}))
+
+		member, err := r.GetMember(ctx, "s1", "bob")
+		mustNil(t, err)
+		if member.Role != model.RoleWriter {
+			t.Fatalf("expected role to be changed to writer, got %+v", member)
+		}
+
+		members, err := r.GetMembers(ctx, "s1")
+		mustNil(t, err)
+		expectMembers(t, members, "bob:writer", "yong:owner")
+
+		spaces, err := r.GetAllByMember(ctx, "bob")
+		mustNil(t, err)
+		expectSpaces(t, spaces, "s1", "s2")
+
+		mustNil(t, r.DeleteMember(ctx, "s1", "bob"))
+		mustNotFound(t, r.DeleteMember(ctx, "s1", "bob"), "delete non-member")
+
+		_, err = r.GetMember(ctx, "s1", "bob")
+		mustNotFound(t, err, "get removed member")
+
+		spaces, err = r.GetAllByMember(ctx, "bob")
+		mustNil(t, err)
+		expectSpaces(t, spaces, "s2")
+
+		spaces, err = r.GetAllByMember(ctx, "nobody")
+		mustNil(t, err)
+		expectSpaces(t, spaces)
+	})
+}
+
+func expectMembers(t *testing.T, members []model.Member, expected ...string) {
+	t.Helper()
+
+	got := make([]string, len(members))
+	for i := range members {
+		got[i] = members[i].UserId + ":" + members[i].Role
+	}
+
+	expectStrings(t, got, expected)
+}
+
+func expectSpaces(t *testing.T, spaces []model.Space, ids ...string) {
+	t.Helper()
+
+	got := make([]string, len(spaces))
+	for i := range spaces {
+		got[i] = spaces[i].Id
+	}
+
+	expectStrings(t, got, ids)
+}
+
+func expectStrings(t *testing.T, got []string, expected []string) {
+	t.Helper()
+
+	sort.Strings(got)
+	sort.Strings(expected)
+
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+}
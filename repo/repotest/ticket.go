@@ -0,0 +1,64 @@
+package repotest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eymyong/drop/repo"
+)
+
+func TestTicket(t *testing.T, newRepo func(t *testing.T) repo.RepositoryTicket) {
+	ctx := context.Background()
+	exp := time.Now().Add(time.Minute)
+
+	t.Run("use once", func(t *testing.T) {
+		r := newRepo(t)
+
+		mustNil(t, r.Use(ctx, "t1", exp))
+		mustConflict(t, r.Use(ctx, "t1", exp), "use used ticket")
+		mustNil(t, r.Use(ctx, "t2", exp))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		r := newRepo(t)
+
+		// Expired tickets are rejected before they're used,
+		// so there's no need to remember them
+		past := time.Now().Add(-time.Second)
+		mustNil(t, r.Use(ctx, "t1", past))
+		mustNil(t, r.Use(ctx, "t1", exp))
+	})
+
+	t.Run("concurrent use", func(t *testing.T) {
+		r := newRepo(t)
+
+		var (
+			wg   sync.WaitGroup
+			mut  sync.Mutex
+			used int
+		)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				err := r.Use(ctx, "t", exp)
+				if err == nil {
+					mut.Lock()
+					used++
+					mut.Unlock()
+				} else if !errors.Is(err, repo.ErrConflict) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if used != 1 {
+			t.Fatalf("expected ticket to be used once, got %d", used)
+		}
+	})
+}
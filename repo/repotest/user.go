@@ -0,0 +1,203 @@
+package repotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+func TestUser(t *testing.T, newRepo func(t *testing.T) repo.RepositoryUser) {
+	ctx := context.Background()
+	yong := model.User{Id: "id-yong", Username: "yong", Password: "pass-yong"}
+
+	t.Run("create and get", func(t *testing.T) {
+		r := newRepo(t)
+
+		_, err := r.GetById(ctx, yong.Id)
+		mustNotFound(t, err, "get missing user")
+
+		_, err = r.GetPassword(ctx, yong.Username)
+		mustNotFound(t, err, "get password of missing user")
+
+		_, err = r.Create(ctx, model.User{Id: "id-empty", Password: "pass"})
+		mustInvalid(t, err, "create user with empty username")
+
+		_, err = r.GetByUsername(ctx, yong.Username)
+		mustNotFound(t, err, "get missing username")
+
+		created, err := r.Create(ctx, yong)
+		mustNil(t, err)
+		if created != yong {
+			t.Fatalf("unexpected created user: %+v", created)
+		}
+
+		got, err := r.GetById(ctx, yong.Id)
+		mustNil(t, err)
+		if got != yong {
+			t.Fatalf("unexpected user: %+v", got)
+		}
+
+		got, err = r.GetByUsername(ctx, yong.Username)
+		mustNil(t, err)
+		if got != yong {
+			t.Fatalf("unexpected user: %+v", got)
+		}
+
+		password, err := r.GetPassword(ctx, yong.Username)
+		mustNil(t, err)
+		if string(password) != yong.Password {
+			t.Fatalf("unexpected password '%s'", password)
+		}
+	})
+
+	t.Run("create duplicate", func(t *testing.T) {
+		r := newRepo(t)
+
+		_, err := r.Create(ctx, yong)
+		mustNil(t, err)
+
+		_, err = r.Create(ctx, model.User{Id: yong.Id, Username: "other", Password: "pass"})
+		mustConflict(t, err, "create duplicate user id")
+
+		_, err = r.Create(ctx, model.User{Id: "id-other", Username: yong.Username, Password: "pass"})
+		mustConflict(t, err, "create duplicate username")
+
+		_, err = r.GetById(ctx, "id-other")
+		mustNotFound(t, err, "duplicate user must not be created")
+	})
+
+	t.Run("concurrent create", func(t *testing.T) {
+		r := newRepo(t)
+
+		var (
+			wg      sync.WaitGroup
+			mut     sync.Mutex
+			created []model.User
+		)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				user := model.User{Id: fmt.Sprintf("id-%d", i), Username: "yong", Password: fmt.Sprintf("pass-%d", i)}
+				_, err := r.Create(ctx, user)
+				if err == nil {
+					mut.Lock()
+					created = append(created, user)
+					mut.Unlock()
+				} else if !errors.Is(err, repo.ErrConflict) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if len(created) != 1 {
+			t.Fatalf("expected username to be registered once, got %d", len(created))
+		}
+
+		got, err := r.GetByUsername(ctx, "yong")
+		mustNil(t, err)
+		if got != created[0] {
+			t.Fatalf("expected the registered user %+v, got %+v", created[0], got)
+		}
+
+		password, err := r.GetPassword(ctx, "yong")
+		mustNil(t, err)
+		if string(password) != created[0].Password {
+			t.Fatalf("expected password of the registered user, got '%s'", password)
+		}
+	})
+
+	t.Run("update username", func(t *testing.T) {
+		r := newRepo(t)
+
+		_, err := r.Create(ctx, yong)
+		mustNil(t, err)
+
+		_, err = r.Create(ctx, model.User{Id: "id-taken", Username: "taken", Password: "pass"})
+		mustNil(t, err)
+
+		err = r.UpdateUsername(ctx, yong.Id, "taken")
+		mustConflict(t, err, "rename to taken username")
+
+		err = r.UpdateUsername(ctx, yong.Id, "")
+		mustInvalid(t, err, "rename to empty username")
+
+		err = r.UpdateUsername(ctx, "id-missing", "nobody")
+		mustNotFound(t, err, "rename missing user")
+
+		mustNil(t, r.UpdateUsername(ctx, yong.Id, "yong2"))
+
+		got, err := r.GetByUsername(ctx, "yong2")
+		mustNil(t, err)
+		if got.Id != yong.Id || got.Username != "yong2" {
+			t.Fatalf("unexpected user after rename: %+v", got)
+		}
+
+		password, err := r.GetPassword(ctx, "yong2")
+		mustNil(t, err)
+		if string(password) != yong.Password {
+			t.Fatalf("unexpected password after rename '%s'", password)
+		}
+
+		_, err = r.GetPassword(ctx, yong.Username)
+		mustNotFound(t, err, "login with old username")
+
+		_, err = r.Create(ctx, model.User{Id: "id-new", Username: yong.Username, Password: "pass"})
+		mustNil(t, err)
+	})
+
+	t.Run("update password", func(t *testing.T) {
+		r := newRepo(t)
+
+		err := r.UpdatePassword(ctx, yong.Id, "foo")
+		mustNotFound(t, err, "update password of missing user")
+
+		_, err = r.Create(ctx, yong)
+		mustNil(t, err)
+
+		mustNil(t, r.UpdatePassword(ctx, yong.Id, "new-pass"))
+
+		password, err := r.GetPassword(ctx, yong.Username)
+		mustNil(t, err)
+		if string(password) != "new-pass" {
+			t.Fatalf("unexpected password after update '%s'", password)
+		}
+
+		got, err := r.GetById(ctx, yong.Id)
+		mustNil(t, err)
+		if got.Password != "new-pass" {
+			t.Fatalf("unexpected user after update: %+v", got)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		r := newRepo(t)
+
+		err := r.Delete(ctx, yong.Id)
+		mustNotFound(t, err, "delete missing user")
+
+		_, err = r.Create(ctx, yong)
+		mustNil(t, err)
+
+		mustNil(t, r.Delete(ctx, yong.Id))
+
+		_, err = r.GetById(ctx, yong.Id)
+		mustNotFound(t, err, "get deleted user")
+
+		_, err = r.GetPassword(ctx, yong.Username)
+		mustNotFound(t, err, "login with deleted user")
+
+		_, err = r.GetByUsername(ctx, yong.Username)
+		mustNotFound(t, err, "get deleted username")
+
+		_, err = r.Create(ctx, yong)
+		mustNil(t, err)
+	})
+}
@@ -0,0 +1,491 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoSqliteClipboard struct {
+	db    *sql.DB
+	quota repo.Quota
+}
+
+func NewClipboard(db *sql.DB) repo.RepositoryClipboard {
+	return NewClipboardWithQuota(db, repo.Quota{})
+}
+
+func NewClipboardWithQuota(db *sql.DB, quota repo.Quota) repo.RepositoryClipboard {
+	return &RepoSqliteClipboard{db: db, quota: quota}
+}
+
+const (
+	columnsClipboard = "id, text, mime_type, size, checksum, blob_key, envelope, key_version, data_key, filename, owner_id, device_id, created_at, updated_at, expires_at, burn_after_read"
+	// notExpired filters out expired clipboards, it takes current unix nano time
+	notExpired = "(expires_at = 0 OR expires_at > ?)"
+	// swapContent sets text, mime_type, size, checksum, blob_key, envelope, key_version and data_key
+	swapContent = "text = ?, mime_type = ?, size = ?, checksum = ?, blob_key = ?, envelope = ?, key_version = ?, data_key = ?"
+	// setContent sets content like swapContent, and updated_at
+	setContent = swapContent + ", updated_at = ?"
+	// sizeOf is the size of a clipboard, falling back to length of text
+	// for clipboards created before sizes were stored
+	sizeOf = "CASE WHEN checksum = '' THEN length(CAST(text AS BLOB)) ELSE size END"
+)
+
+func (r *RepoSqliteClipboard) Create(ctx context.Context, clip model.Clipboard) error {
+	if clip.Id == "" {
+		return fmt.Errorf("empty clipboard id: %w", repo.ErrInvalid)
+	}
+
+	now := time.Now()
+	if clip.CreatedAt.IsZero() {
+		clip.CreatedAt = now
+	}
+	if clip.UpdatedAt.IsZero() {
+		clip.UpdatedAt = clip.CreatedAt
+	}
+
+	clip.Content = clip.Content.Normalize()
+
+	var expiresAt int64
+	if !clip.ExpiresAt.IsZero() {
+		expiresAt = clip.ExpiresAt.UnixNano()
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin sqlite err: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = r.checkQuota(ctx, tx, clip.OwnerId, 1, clip.Size)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO clipboards ("+columnsClipboard+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		clip.Id, clip.Text, clip.MimeType, clip.Size, clip.Checksum, clip.BlobKey, envelopeString(clip.Envelope), clip.KeyVersion, clip.DataKey, clip.Filename, clip.OwnerId, clip.DeviceId, clip.CreatedAt.UnixNano(), clip.UpdatedAt.UnixNano(),
+		expiresAt, clip.BurnAfterRead,
+	)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("clipboard id '%s' is already taken: %w", clip.Id, repo.ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("insert clipboard sqlite err: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit clipboard sqlite err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoSqliteClipboard) GetAll(ctx context.Context) ([]model.Clipboard, error) {
+	return r.query(ctx,
+		"SELECT "+columnsClipboard+" FROM clipboards WHERE "+notExpired+" ORDER BY created_at",
+		time.Now().UnixNano(),
+	)
+}
+
+func (r *RepoSqliteClipboard) GetAllByOwner(ctx context.Context, ownerId string) ([]model.Clipboard, error) {
+	return r.query(ctx,
+		"SELECT "+columnsClipboard+" FROM clipboards WHERE owner_id = ? AND "+notExpired+" ORDER BY created_at",
+		ownerId, time.Now().UnixNano(),
+	)
+}
+
+func (r *RepoSqliteClipboard) ListByOwner(ctx context.Context, ownerId string, limit int, cursor string) ([]model.Clipboard, string, error) {
+	return r.list(ctx, "owner_id = ?", []interface{}{ownerId}, limit, cursor)
+}
+
+func (r *RepoSqliteClipboard) ListByDevice(ctx context.Context, ownerId string, deviceId string, limit int, cursor string) ([]model.Clipboard, string, error) {
+	return r.list(ctx, "owner_id = ? AND device_id = ?", []interface{}{ownerId, deviceId}, limit, cursor)
+}
+
+// list pages through unexpired clipboards matching where, newest first
+func (r *RepoSqliteClipboard) list(ctx context.Context, where string, args []interface{}, limit int, cursor string) ([]model.Clipboard, string, error) {
+	if limit <= 0 {
+		return []model.Clipboard{}, "", fmt.Errorf("bad limit %d: %w", limit, repo.ErrInvalid)
+	}
+
+	query := "SELECT " + columnsClipboard + " FROM clipboards WHERE " + where + " AND " + notExpired
+	args = append(args, time.Now().UnixNano())
+
+	if cursor != "" {
+		afterTime, afterId, err := repo.DecodeCursor(cursor)
+		if err != nil {
+			return []model.Clipboard{}, "", err
+		}
+
+		query += " AND (created_at < ? OR (created_at = ? AND id < ?))"
+		args = append(args, afterTime.UnixNano(), afterTime.UnixNano(), afterId)
+	}
+
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	page, err := r.query(ctx, query, args...)
+	if err != nil {
+		return []model.Clipboard{}, "", err
+	}
+
+	next := ""
+	if len(page) > limit {
+		page = page[:limit]
+		last := page[limit-1]
+		next = repo.EncodeCursor(last.CreatedAt, last.Id)
+	}
+
+	return page, next, nil
+}
+
+func (r *RepoSqliteClipboard) GetByOwnerInRange(ctx context.Context, ownerId string, from, to time.Time, limit int) ([]model.Clipboard, error) {
+	return r.inRange(ctx, "owner_id = ?", []interface{}{ownerId}, from, to, limit)
+}
+
+func (r *RepoSqliteClipboard) GetByDeviceInRange(ctx context.Context, ownerId string, deviceId string, from, to time.Time, limit int) ([]model.Clipboard, error) {
+	return r.inRange(ctx, "owner_id = ? AND device_id = ?", []interface{}{ownerId, deviceId}, from, to, limit)
+}
+
+// inRange returns at most limit unexpired clipboards matching where,
+// created in [from, to), newest first
+func (r *RepoSqliteClipboard) inRange(ctx context.Context, where string, args []interface{}, from, to time.Time, limit int) ([]model.Clipboard, error) {
+	if limit <= 0 {
+		return []model.Clipboard{}, fmt.Errorf("bad limit %d: %w", limit, repo.ErrInvalid)
+	}
+
+	query := "SELECT " + columnsClipboard + " FROM clipboards WHERE " + where + " AND " + notExpired
+	args = append(args, time.Now().UnixNano())
+
+	if !from.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, from.UnixNano())
+	}
+	if !to.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, to.UnixNano())
+	}
+
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	return r.query(ctx, query, args...)
+}
+
+func (r *RepoSqliteClipboard) UsageByOwner(ctx context.Context, ownerId string) (model.Usage, error) {
+	return usageByOwner(ctx, r.db, ownerId)
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func usageByOwner(ctx context.Context, q querier, ownerId string) (model.Usage, error) {
+	usage := model.Usage{}
+	err := q.QueryRowContext(ctx,
+		"SELECT COUNT(*), COALESCE(SUM("+sizeOf+"), 0) FROM clipboards WHERE owner_id = ? AND "+notExpired,
+		ownerId, time.Now().UnixNano(),
+	).Scan(&usage.Clips, &usage.Bytes)
+	if err != nil {
+		return model.Usage{}, fmt.Errorf("select usage sqlite err: %w", err)
+	}
+
+	return usage, nil
+}
+
+// checkQuota returns error if ownerId has no room left for clips more
+// clipboards of size more bytes. It's atomic with writes in tx,
+// as the database only has 1 connection.
+func (r *RepoSqliteClipboard) checkQuota(ctx context.Context, tx *sql.Tx, ownerId string, clips int64, size int64) error {
+	if ownerId == "" || r.quota == (repo.Quota{}) {
+		return nil
+	}
+
+	usage, err := usageByOwner(ctx, tx, ownerId)
+	if err != nil {
+		return err
+	}
+
+	return r.quota.Check(usage, clips, size)
+}
+
+func (r *RepoSqliteClipboard) GetById(ctx context.Context, id string) (model.Clipboard, error) {
+	clip, err := r.get(ctx, "id = ?", id)
+	if err == sql.ErrNoRows {
+		return model.Clipboard{}, fmt.Errorf("no data in sqlite for clipboard '%s': %w", id, repo.ErrNotFound)
+	}
+	if err != nil {
+		return model.Clipboard{}, fmt.Errorf("select clipboard sqlite err: %w", err)
+	}
+
+	return clip, nil
+}
+
+func (r *RepoSqliteClipboard) GetByIdAndOwner(ctx context.Context, id string, ownerId string) (model.Clipboard, error) {
+	clip, err := r.get(ctx, "id = ? AND owner_id = ?", id, ownerId)
+	if err == sql.ErrNoRows {
+		return model.Clipboard{}, fmt.Errorf("clipboard '%s': %w", id, repo.ErrNotFound)
+	}
+	if err != nil {
+		return model.Clipboard{}, fmt.Errorf("select clipboard sqlite err: %w", err)
+	}
+
+	return clip, nil
+}
+
+func (r *RepoSqliteClipboard) GetBlobKey(ctx context.Context, id string) (string, error) {
+	var key string
+	err := r.db.QueryRowContext(ctx, "SELECT blob_key FROM clipboards WHERE id = ? AND "+notExpired, id, time.Now().UnixNano()).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("no clipboard '%s' in sqlite: %w", id, repo.ErrNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("select blob key sqlite err: %w", err)
+	}
+
+	return key, nil
+}
+
+func (r *RepoSqliteClipboard) CheckOwner(ctx context.Context, id string, ownerId string) error {
+	var one int
+	err := r.db.QueryRowContext(ctx,
+		"SELECT 1 FROM clipboards WHERE id = ? AND owner_id = ? AND "+notExpired,
+		id, ownerId, time.Now().UnixNano(),
+	).Scan(&one)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no clipboard '%s' of owner '%s' in sqlite: %w", id, ownerId, repo.ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("select clipboard owner sqlite err: %w", err)
+	}
+
+	return nil
+}
+
+// get selects 1 clipboard matching where, and deletes it
+// in the same transaction if it's burn-after-read
+func (r *RepoSqliteClipboard) get(ctx context.Context, where string, args ...interface{}) (model.Clipboard, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Clipboard{}, err
+	}
+	defer tx.Rollback()
+
+	args = append(args, time.Now().UnixNano())
+	row := tx.QueryRowContext(ctx, "SELECT "+columnsClipboard+" FROM clipboards WHERE "+where+" AND "+notExpired, args...)
+	clip, err := scanClipboard(row)
+	if err != nil {
+		return model.Clipboard{}, err
+	}
+
+	if clip.BurnAfterRead {
+		_, err = tx.ExecContext(ctx, "DELETE FROM clipboards WHERE id = ?", clip.Id)
+		if err != nil {
+			return model.Clipboard{}, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return model.Clipboard{}, err
+	}
+
+	return clip, nil
+}
+
+func (r *RepoSqliteClipboard) Update(ctx context.Context, id string, content model.Content) error {
+	return r.update(ctx, id, false, "", content)
+}
+
+func (r *RepoSqliteClipboard) UpdateByIdAndOwner(ctx context.Context, id string, ownerId string, content model.Content) error {
+	return r.update(ctx, id, true, ownerId, content)
+}
+
+// update replaces content of clipboard id, if it's owned by ownerId
+// when checkOwner is true, and if its owner has room left for it
+func (r *RepoSqliteClipboard) update(ctx context.Context, id string, checkOwner bool, ownerId string, content model.Content) error {
+	content = content.Normalize()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin sqlite err: %w", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		owner string
+		size  int64
+	)
+	now := time.Now().UnixNano()
+	err = tx.QueryRowContext(ctx, "SELECT owner_id, "+sizeOf+" FROM clipboards WHERE id = ? AND "+notExpired, id, now).Scan(&owner, &size)
+	if err == sql.ErrNoRows || (err == nil && checkOwner && owner != ownerId) {
+		return fmt.Errorf("clipboard '%s': %w", id, repo.ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("select clipboard sqlite err: %w", err)
+	}
+
+	err = r.checkQuota(ctx, tx, owner, 0, content.Size-size)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE clipboards SET "+setContent+" WHERE id = ?",
+		content.Text, content.MimeType, content.Size, content.Checksum, content.BlobKey, envelopeString(content.Envelope), content.KeyVersion, content.DataKey, now, id,
+	)
+	if err != nil {
+		return fmt.Errorf("update clipboard sqlite err: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit clipboard sqlite err: %w", err)
+	}
+
+	return nil
+}
+
+// CompareAndSwapContent treats rows without checksum as unchanged,
+// as they were created before checksums were stored, and never updated since
+func (r *RepoSqliteClipboard) CompareAndSwapContent(ctx context.Context, id string, old model.Content, new model.Content) error {
+	new = new.Normalize()
+
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE clipboards SET "+swapContent+" WHERE id = ? AND (checksum = ? OR checksum = '') AND key_version = ? AND data_key = ?",
+		new.Text, new.MimeType, new.Size, new.Checksum, new.BlobKey, envelopeString(new.Envelope), new.KeyVersion, new.DataKey,
+		id, old.Checksum, old.KeyVersion, old.DataKey,
+	)
+	if err != nil {
+		return fmt.Errorf("swap clipboard content sqlite err: %w", err)
+	}
+
+	return expectOneRow(res, fmt.Errorf("clipboard '%s' changed or deleted: %w", id, repo.ErrConflict))
+}
+
+func (r *RepoSqliteClipboard) Delete(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM clipboards WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("delete clipboard sqlite err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoSqliteClipboard) DeleteExpired(ctx context.Context) (int, error) {
+	res, err := r.db.ExecContext(ctx,
+		"DELETE FROM clipboards WHERE NOT "+notExpired, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired clipboards sqlite err: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("rows affected sqlite err: %w", err)
+	}
+
+	return int(n), nil
+}
+
+func (r *RepoSqliteClipboard) DeleteByIdAndOwner(ctx context.Context, id string, ownerId string) error {
+	res, err := r.db.ExecContext(ctx,
+		"DELETE FROM clipboards WHERE id = ? AND owner_id = ? AND "+notExpired,
+		id, ownerId, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("delete clipboard sqlite err: %w", err)
+	}
+
+	return expectOneRow(res, fmt.Errorf("clipboard '%s': %w", id, repo.ErrNotFound))
+}
+
+func (r *RepoSqliteClipboard) query(ctx context.Context, query string, args ...interface{}) ([]model.Clipboard, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return []model.Clipboard{}, fmt.Errorf("select clipboards sqlite err: %w", err)
+	}
+	defer rows.Close()
+
+	clipboards := []model.Clipboard{}
+	for rows.Next() {
+		clip, err := scanClipboard(rows)
+		if err != nil {
+			return []model.Clipboard{}, fmt.Errorf("scan clipboard sqlite err: %w", err)
+		}
+
+		clipboards = append(clipboards, clip)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return []model.Clipboard{}, fmt.Errorf("iterate clipboards sqlite err: %w", err)
+	}
+
+	return clipboards, nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanClipboard(row scanner) (model.Clipboard, error) {
+	var (
+		clip                            model.Clipboard
+		envelope                        string
+		createdAt, updatedAt, expiresAt int64
+	)
+
+	err := row.Scan(&clip.Id, &clip.Text, &clip.MimeType, &clip.Size, &clip.Checksum, &clip.BlobKey, &envelope, &clip.KeyVersion, &clip.DataKey, &clip.Filename, &clip.OwnerId, &clip.DeviceId, &createdAt, &updatedAt, &expiresAt, &clip.BurnAfterRead)
+	if err != nil {
+		return model.Clipboard{}, err
+	}
+
+	clip.CreatedAt = time.Unix(0, createdAt)
+	clip.UpdatedAt = time.Unix(0, updatedAt)
+	if expiresAt != 0 {
+		clip.ExpiresAt = time.Unix(0, expiresAt)
+	}
+
+	if clip.Checksum == "" {
+		clip.Content = model.NewContent(clip.Text, clip.MimeType)
+	}
+
+	if envelope != "" {
+		e, err := model.ParseEnvelope(envelope)
+		if err == nil {
+			clip.Envelope = &e
+		}
+	}
+
+	return clip, nil
+}
+
+// envelopeString is the envelope column of e, empty for plaintext content
+func envelopeString(e *model.Envelope) string {
+	if e == nil {
+		return ""
+	}
+
+	return e.String()
+}
+
+func expectOneRow(res sql.Result, errNoRows error) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected sqlite err: %w", err)
+	}
+
+	if n != 1 {
+		return errNoRows
+	}
+
+	return nil
+}
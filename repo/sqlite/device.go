@@ -0,0 +1,127 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoSqliteDevice struct {
+	db *sql.DB
+}
+
+func NewDevice(db *sql.DB) repo.RepositoryDevice {
+	return &RepoSqliteDevice{db: db}
+}
+
+const columnsDevice = "id, user_id, name, platform, created_at, last_seen_at"
+
+func (r *RepoSqliteDevice) Create(ctx context.Context, device model.Device) error {
+	if device.Id == "" || device.UserId == "" {
+		return fmt.Errorf("empty device id or user: %w", repo.ErrInvalid)
+	}
+
+	if device.CreatedAt.IsZero() {
+		device.CreatedAt = time.Now()
+	}
+	if device.LastSeenAt.IsZero() {
+		device.LastSeenAt = device.CreatedAt
+	}
+
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO devices ("+columnsDevice+") VALUES (?, ?, ?, ?, ?, ?)",
+		device.Id, device.UserId, device.Name, device.Platform, device.CreatedAt.UnixNano(), device.LastSeenAt.UnixNano(),
+	)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("device id '%s' is already taken: %w", device.Id, repo.ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("insert device sqlite err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoSqliteDevice) GetById(ctx context.Context, id string) (model.Device, error) {
+	device, err := scanDevice(r.db.QueryRowContext(ctx,
+		"SELECT "+columnsDevice+" FROM devices WHERE id = ?", id,
+	))
+	if err == sql.ErrNoRows {
+		return model.Device{}, fmt.Errorf("no device '%s' in sqlite: %w", id, repo.ErrNotFound)
+	}
+	if err != nil {
+		return model.Device{}, fmt.Errorf("select device sqlite err: %w", err)
+	}
+
+	return device, nil
+}
+
+func (r *RepoSqliteDevice) GetAllByUser(ctx context.Context, userId string) ([]model.Device, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+columnsDevice+" FROM devices WHERE user_id = ? ORDER BY created_at", userId,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select devices sqlite err: %w", err)
+	}
+	defer rows.Close()
+
+	devices := []model.Device{}
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan device sqlite err: %w", err)
+		}
+
+		devices = append(devices, device)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("iterate devices sqlite err: %w", err)
+	}
+
+	return devices, nil
+}
+
+func (r *RepoSqliteDevice) UpdateLastSeen(ctx context.Context, id string, t time.Time) error {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE devices SET last_seen_at = ? WHERE id = ?", t.UnixNano(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("update device sqlite err: %w", err)
+	}
+
+	return expectOneRow(res, fmt.Errorf("no device '%s' in sqlite: %w", id, repo.ErrNotFound))
+}
+
+func (r *RepoSqliteDevice) DeleteByIdAndUser(ctx context.Context, id string, userId string) error {
+	res, err := r.db.ExecContext(ctx,
+		"DELETE FROM devices WHERE id = ? AND user_id = ?", id, userId,
+	)
+	if err != nil {
+		return fmt.Errorf("delete device sqlite err: %w", err)
+	}
+
+	return expectOneRow(res, fmt.Errorf("no device '%s' of user '%s' in sqlite: %w", id, userId, repo.ErrNotFound))
+}
+
+func scanDevice(row scanner) (model.Device, error) {
+	var (
+		device                model.Device
+		createdAt, lastSeenAt int64
+	)
+
+	err := row.Scan(&device.Id, &device.UserId, &device.Name, &device.Platform, &createdAt, &lastSeenAt)
+	if err != nil {
+		return model.Device{}, err
+	}
+
+	device.CreatedAt = time.Unix(0, createdAt)
+	device.LastSeenAt = time.Unix(0, lastSeenAt)
+
+	return device, nil
+}
@@ -0,0 +1,103 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoSqliteSession struct {
+	db *sql.DB
+}
+
+func NewSession(db *sql.DB) repo.RepositorySession {
+	return &RepoSqliteSession{db: db}
+}
+
+func (r *RepoSqliteSession) Create(ctx context.Context, session model.Session) error {
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO sessions (id, user_id, refresh_hash, expires_at, device_id) VALUES (?, ?, ?, ?, ?)",
+		session.Id, session.UserId, session.RefreshHash, session.ExpiresAt.Unix(), session.DeviceId,
+	)
+	if err != nil {
+		return fmt.Errorf("insert session sqlite err: %w", err)
+	}
+
+	return nil
+}
+
+// GetById treats expired sessions as missing, like Redis EXPIREAT
+func (r *RepoSqliteSession) GetById(ctx context.Context, id string) (model.Session, error) {
+	var (
+		session   model.Session
+		expiresAt int64
+	)
+
+	err := r.db.QueryRowContext(ctx,
+		"SELECT id, user_id, refresh_hash, expires_at, device_id FROM sessions WHERE id = ? AND expires_at > ?",
+		id, time.Now().Unix(),
+	).Scan(&session.Id, &session.UserId, &session.RefreshHash, &expiresAt, &session.DeviceId)
+	if err == sql.ErrNoRows {
+		return model.Session{}, fmt.Errorf("no session '%s' in sqlite: %w", id, repo.ErrNotFound)
+	}
+	if err != nil {
+		return model.Session{}, fmt.Errorf("select session sqlite err: %w", err)
+	}
+
+	session.ExpiresAt = time.Unix(expiresAt, 0)
+
+	return session, nil
+}
+
+func (r *RepoSqliteSession) Update(ctx context.Context, session model.Session, oldHash string) error {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE sessions SET refresh_hash = ?, expires_at = ?, device_id = ? WHERE id = ? AND refresh_hash = ? AND expires_at > ?",
+		session.RefreshHash, session.ExpiresAt.Unix(), session.DeviceId, session.Id, oldHash, time.Now().Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("update session sqlite err: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected sqlite err: %w", err)
+	}
+
+	if n == 1 {
+		return nil
+	}
+
+	// Tell a missing session from one updated since it was read
+	_, err = r.GetById(ctx, session.Id)
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("session '%s' was updated: %w", session.Id, repo.ErrConflict)
+}
+
+func (r *RepoSqliteSession) Delete(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("delete session sqlite err: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteByUserId also cleans up expired sessions of all users
+func (r *RepoSqliteSession) DeleteByUserId(ctx context.Context, userId string) error {
+	_, err := r.db.ExecContext(ctx,
+		"DELETE FROM sessions WHERE user_id = ? OR expires_at <= ?",
+		userId, time.Now().Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("delete sessions sqlite err: %w", err)
+	}
+
+	return nil
+}
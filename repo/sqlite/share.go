@@ -0,0 +1,210 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoSqliteShare struct {
+	db *sql.DB
+}
+
+func NewShare(db *sql.DB) repo.RepositoryShare {
+	return &RepoSqliteShare{db: db}
+}
+
+const (
+	columnsShare = "token, clipboard_id, owner_id, password_hash, created_at, expires_at, max_views, views_left, failed_attempts, locked_until"
+	// liveShare filters out expired and used up shares, it takes current unix nano time
+	liveShare = "(expires_at = 0 OR expires_at > ?) AND (max_views = 0 OR views_left > 0)"
+)
+
+func (r *RepoSqliteShare) Create(ctx context.Context, share model.Share) error {
+	if share.Token == "" || share.ClipboardId == "" || share.MaxViews < 0 {
+		return fmt.Errorf("bad share: %w", repo.ErrInvalid)
+	}
+
+	if share.CreatedAt.IsZero() {
+		share.CreatedAt = time.Now()
+	}
+
+	var expiresAt int64
+	if !share.ExpiresAt.IsZero() {
+		expiresAt = share.ExpiresAt.UnixNano()
+	}
+
+	// Clean up dead shares first, so that their tokens can't clash
+	_, err := r.db.ExecContext(ctx,
+		"DELETE FROM shares WHERE token = ? AND NOT "+liveShare,
+		share.Token, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("delete dead share sqlite err: %w", err)
+	}
+
+	_, err = r.db.ExecContext(ctx,
+		"INSERT INTO shares ("+columnsShare+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0, 0)",
+		share.Token, share.ClipboardId, share.OwnerId, share.PasswordHash, share.CreatedAt.UnixNano(), expiresAt,
+		share.MaxViews, share.MaxViews,
+	)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("share token '%s' is already taken: %w", share.Token, repo.ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("insert share sqlite err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoSqliteShare) GetByToken(ctx context.Context, token string) (model.Share, error) {
+	share, err := scanShare(r.db.QueryRowContext(ctx,
+		"SELECT "+columnsShare+" FROM shares WHERE token = ? AND "+liveShare,
+		token, time.Now().UnixNano(),
+	))
+	if err == sql.ErrNoRows {
+		return model.Share{}, fmt.Errorf("no share '%s' in sqlite: %w", token, repo.ErrNotFound)
+	}
+	if err != nil {
+		return model.Share{}, fmt.Errorf("select share sqlite err: %w", err)
+	}
+
+	return share, nil
+}
+
+func (r *RepoSqliteShare) GetAllByClipboard(ctx context.Context, clipboardId string, ownerId string) ([]model.Share, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+columnsShare+" FROM shares WHERE clipboard_id = ? AND owner_id = ? AND "+liveShare+" ORDER BY created_at",
+		clipboardId, ownerId, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select shares sqlite err: %w", err)
+	}
+	defer rows.Close()
+
+	shares := []model.Share{}
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan share sqlite err: %w", err)
+		}
+
+		shares = append(shares, share)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("iterate shares sqlite err: %w", err)
+	}
+
+	return shares, nil
+}
+
+// View counts down views_left in a single UPDATE, so that concurrent views
+// can't both take the last one
+func (r *RepoSqliteShare) View(ctx context.Context, token string) error {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE shares SET views_left = CASE WHEN max_views = 0 THEN 0 ELSE views_left - 1 END, failed_attempts = 0, locked_until = 0 WHERE token = ? AND "+liveShare,
+		token, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("update share sqlite err: %w", err)
+	}
+
+	err = expectOneRow(res, fmt.Errorf("no share '%s' in sqlite: %w", token, repo.ErrNotFound))
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(ctx, "DELETE FROM shares WHERE token = ? AND max_views > 0 AND views_left <= 0", token)
+	if err != nil {
+		return fmt.Errorf("delete used up share sqlite err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoSqliteShare) Attempt(ctx context.Context, token string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin sqlite err: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var (
+		failed      int
+		lockedUntil int64
+	)
+	err = tx.QueryRowContext(ctx,
+		"SELECT failed_attempts, locked_until FROM shares WHERE token = ? AND "+liveShare,
+		token, now.UnixNano(),
+	).Scan(&failed, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no share '%s' in sqlite: %w", token, repo.ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("select share sqlite err: %w", err)
+	}
+
+	if now.UnixNano() < lockedUntil {
+		return fmt.Errorf("share '%s' until %s: %w", token, time.Unix(0, lockedUntil).Format(time.RFC3339), repo.ErrLocked)
+	}
+
+	failed++
+	_, err = tx.ExecContext(ctx,
+		"UPDATE shares SET failed_attempts = ?, locked_until = ? WHERE token = ?",
+		failed, now.Add(model.ShareLockout(failed)).UnixNano(), token,
+	)
+	if err != nil {
+		return fmt.Errorf("update share sqlite err: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit sqlite err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoSqliteShare) DeleteByTokenAndOwner(ctx context.Context, token string, ownerId string) error {
+	res, err := r.db.ExecContext(ctx,
+		"DELETE FROM shares WHERE token = ? AND owner_id = ? AND "+liveShare,
+		token, ownerId, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("delete share sqlite err: %w", err)
+	}
+
+	return expectOneRow(res, fmt.Errorf("no share '%s' of owner '%s' in sqlite: %w", token, ownerId, repo.ErrNotFound))
+}
+
+func scanShare(row scanner) (model.Share, error) {
+	var (
+		share       model.Share
+		createdAt   int64
+		expiresAt   int64
+		lockedUntil int64
+	)
+
+	err := row.Scan(&share.Token, &share.ClipboardId, &share.OwnerId, &share.PasswordHash, &createdAt, &expiresAt, &share.MaxViews, &share.ViewsLeft, &share.FailedAttempts, &lockedUntil)
+	if err != nil {
+		return model.Share{}, err
+	}
+
+	share.CreatedAt = time.Unix(0, createdAt)
+	if expiresAt != 0 {
+		share.ExpiresAt = time.Unix(0, expiresAt)
+	}
+	if lockedUntil != 0 {
+		share.LockedUntil = time.Unix(0, lockedUntil)
+	}
+
+	return share, nil
+}
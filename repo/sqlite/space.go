@@ -0,0 +1,194 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoSqliteSpace struct {
+	db *sql.DB
+}
+
+func NewSpace(db *sql.DB) repo.RepositorySpace {
+	return &RepoSqliteSpace{db: db}
+}
+
+func (r *RepoSqliteSpace) Create(ctx context.Context, space model.Space) error {
+	if space.Id == "" || space.OwnerId == "" {
+		return fmt.Errorf("empty space id or owner: %w", repo.ErrInvalid)
+	}
+
+	if space.CreatedAt.IsZero() {
+		space.CreatedAt = time.Now()
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin sqlite err: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO spaces (id, name, owner_id, created_at) VALUES (?, ?, ?, ?)",
+		space.Id, space.Name, space.OwnerId, space.CreatedAt.UnixNano(),
+	)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("space id '%s' is already taken: %w", space.Id, repo.ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("insert space sqlite err: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO space_members (space_id, user_id, role) VALUES (?, ?, ?)",
+		space.Id, space.OwnerId, model.RoleOwner,
+	)
+	if err != nil {
+		return fmt.Errorf("insert space member sqlite err: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit sqlite err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoSqliteSpace) GetById(ctx context.Context, id string) (model.Space, error) {
+	space, err := scanSpace(r.db.QueryRowContext(ctx,
+		"SELECT id, name, owner_id, created_at FROM spaces WHERE id = ?", id,
+	))
+	if err == sql.ErrNoRows {
+		return model.Space{}, fmt.Errorf("no space '%s' in sqlite: %w", id, repo.ErrNotFound)
+	}
+	if err != nil {
+		return model.Space{}, fmt.Errorf("select space sqlite err: %w", err)
+	}
+
+	return space, nil
+}
+
+func (r *RepoSqliteSpace) GetAllByMember(ctx context.Context, userId string) ([]model.Space, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT s.id, s.name, s.owner_id, s.created_at FROM spaces s
+		JOIN space_members m ON m.space_id = s.id
+		WHERE m.user_id = ? ORDER BY s.created_at`,
+		userId,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select spaces sqlite err: %w", err)
+	}
+	defer rows.Close()
+
+	spaces := []model.Space{}
+	for rows.Next() {
+		space, err := scanSpace(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan space sqlite err: %w", err)
+		}
+
+		spaces = append(spaces, space)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("iterate spaces sqlite err: %w", err)
+	}
+
+	return spaces, nil
+}
+
+func (r *RepoSqliteSpace) GetMember(ctx context.Context, spaceId string, userId string) (model.Member, error) {
+	member := model.Member{SpaceId: spaceId, UserId: userId}
+	err := r.db.QueryRowContext(ctx,
+		"SELECT role FROM space_members WHERE space_id = ? AND user_id = ?", spaceId, userId,
+	).Scan(&member.Role)
+	if err == sql.ErrNoRows {
+		return model.Member{}, fmt.Errorf("no member '%s' of space '%s' in sqlite: %w", userId, spaceId, repo.ErrNotFound)
+	}
+	if err != nil {
+		return model.Member{}, fmt.Errorf("select space member sqlite err: %w", err)
+	}
+
+	return member, nil
+}
+
+func (r *RepoSqliteSpace) GetMembers(ctx context.Context, spaceId string) ([]model.Member, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT user_id, role FROM space_members WHERE space_id = ?", spaceId,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select space members sqlite err: %w", err)
+	}
+	defer rows.Close()
+
+	members := []model.Member{}
+	for rows.Next() {
+		member := model.Member{SpaceId: spaceId}
+		err := rows.Scan(&member.UserId, &member.Role)
+		if err != nil {
+			return nil, fmt.Errorf("scan space member sqlite err: %w", err)
+		}
+
+		members = append(members, member)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("iterate space members sqlite err: %w", err)
+	}
+
+	return members, nil
+}
+
+func (r *RepoSqliteSpace) PutMember(ctx context.Context, member model.Member) error {
+	if member.UserId == "" || !model.ValidRole(member.Role) {
+		return fmt.Errorf("bad member: %w", repo.ErrInvalid)
+	}
+
+	// INSERT ... SELECT inserts nothing if the space does not exist
+	res, err := r.db.ExecContext(ctx,
+		`INSERT INTO space_members (space_id, user_id, role)
+		SELECT id, ?, ? FROM spaces WHERE id = ?
+		ON CONFLICT (space_id, user_id) DO UPDATE SET role = excluded.role`,
+		member.UserId, member.Role, member.SpaceId,
+	)
+	if err != nil {
+		return fmt.Errorf("upsert space member sqlite err: %w", err)
+	}
+
+	return expectOneRow(res, fmt.Errorf("no space '%s' in sqlite: %w", member.SpaceId, repo.ErrNotFound))
+}
+
+func (r *RepoSqliteSpace) DeleteMember(ctx context.Context, spaceId string, userId string) error {
+	res, err := r.db.ExecContext(ctx,
+		"DELETE FROM space_members WHERE space_id = ? AND user_id = ?", spaceId, userId,
+	)
+	if err != nil {
+		return fmt.Errorf("delete space member sqlite err: %w", err)
+	}
+
+	return expectOneRow(res, fmt.Errorf("no member '%s' of space '%s' in sqlite: %w", userId, spaceId, repo.ErrNotFound))
+}
+
+func scanSpace(row scanner) (model.Space, error) {
+	var (
+		space     model.Space
+		createdAt int64
+	)
+
+	err := row.Scan(&space.Id, &space.Name, &space.OwnerId, &createdAt)
+	if err != nil {
+		return model.Space{}, err
+	}
+
+	space.CreatedAt = time.Unix(0, createdAt)
+
+	return space, nil
+}
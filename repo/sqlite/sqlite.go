@@ -0,0 +1,168 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order on startup. The number of migrations
+// already applied is kept in SQLite's user_version, so never edit or
+// reorder existing entries, only append new ones.
+var migrations = []string{
+	`CREATE TABLE users (
+		id       TEXT PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE,
+		password TEXT NOT NULL
+	);
+
+	CREATE TABLE clipboards (
+		id         TEXT PRIMARY KEY,
+		text       TEXT NOT NULL,
+		owner_id   TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX clipboards_owner ON clipboards (owner_id, created_at);
+
+	CREATE TABLE sessions (
+		id           TEXT PRIMARY KEY,
+		user_id      TEXT NOT NULL,
+		refresh_hash TEXT NOT NULL,
+		expires_at   INTEGER NOT NULL
+	);
+
+	CREATE INDEX sessions_user ON sessions (user_id);`,
+
+	`ALTER TABLE clipboards ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE clipboards ADD COLUMN burn_after_read INTEGER NOT NULL DEFAULT 0;`,
+
+	// checksum of older clipboards is filled in when they are read
+	`ALTER TABLE clipboards ADD COLUMN mime_type TEXT NOT NULL DEFAULT '';
+	ALTER TABLE clipboards ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE clipboards ADD COLUMN checksum TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE clipboards ADD COLUMN filename TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE clipboards ADD COLUMN blob_key TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE clipboards ADD COLUMN envelope TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE clipboards ADD COLUMN key_version INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE clipboards ADD COLUMN data_key TEXT NOT NULL DEFAULT '';`,
+
+	`CREATE TABLE shares (
+		token         TEXT PRIMARY KEY,
+		clipboard_id  TEXT NOT NULL,
+		owner_id      TEXT NOT NULL,
+		password_hash TEXT NOT NULL DEFAULT '',
+		created_at    INTEGER NOT NULL,
+		expires_at    INTEGER NOT NULL DEFAULT 0,
+		max_views     INTEGER NOT NULL DEFAULT 0,
+		views_left    INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE INDEX shares_clipboard ON shares (clipboard_id, owner_id);`,
+
+	`CREATE TABLE spaces (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		owner_id   TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE space_members (
+		space_id TEXT NOT NULL REFERENCES spaces (id),
+		user_id  TEXT NOT NULL,
+		role     TEXT NOT NULL,
+		PRIMARY KEY (space_id, user_id)
+	);
+
+	CREATE INDEX space_members_user ON space_members (user_id);`,
+
+	`CREATE TABLE devices (
+		id           TEXT PRIMARY KEY,
+		user_id      TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		platform     TEXT NOT NULL DEFAULT '',
+		created_at   INTEGER NOT NULL,
+		last_seen_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX devices_user ON devices (user_id);
+
+	ALTER TABLE sessions ADD COLUMN device_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE clipboards ADD COLUMN device_id TEXT NOT NULL DEFAULT '';
+
+	CREATE INDEX clipboards_device ON clipboards (owner_id, device_id, created_at);`,
+
+	`ALTER TABLE shares ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE shares ADD COLUMN locked_until INTEGER NOT NULL DEFAULT 0;`,
+
+	`CREATE TABLE used_tickets (
+		id         TEXT PRIMARY KEY,
+		expires_at INTEGER NOT NULL
+	);`,
+}
+
+// Open opens SQLite database at path and migrates it to the latest schema
+func Open(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite err: %w", err)
+	}
+
+	// SQLite only allows 1 writer anyway
+	db.SetMaxOpenConns(1)
+
+	err = migrate(context.Background(), db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	var version int
+	err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("get sqlite user_version err: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("begin migration %d err: %w", i+1, err)
+		}
+
+		_, err = tx.ExecContext(ctx, migrations[i])
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d err: %w", i+1, err)
+		}
+
+		// PRAGMA does not take bind parameters
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("set sqlite user_version err: %w", err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("commit migration %d err: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
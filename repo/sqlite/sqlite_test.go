@@ -0,0 +1,97 @@
+package sqlite
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/eymyong/drop/repo"
+	"github.com/eymyong/drop/repo/repotest"
+)
+
+func openTest(t *testing.T) *sql.DB {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestConformanceClipboard(t *testing.T) {
+	repotest.TestClipboard(t, func(t *testing.T) repo.RepositoryClipboard {
+		return NewClipboard(openTest(t))
+	})
+}
+
+func TestConformanceQuota(t *testing.T) {
+	repotest.TestQuota(t, func(t *testing.T, quota repo.Quota) repo.RepositoryClipboard {
+		return NewClipboardWithQuota(openTest(t), quota)
+	})
+}
+
+func TestConformanceDeleteExpired(t *testing.T) {
+	repotest.TestDeleteExpired(t, func(t *testing.T) (repo.RepositoryClipboard, func(string) bool) {
+		db := openTest(t)
+
+		return NewClipboard(db), func(id string) bool {
+			var n int
+			err := db.QueryRow("SELECT COUNT(*) FROM clipboards WHERE id = ?", id).Scan(&n)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			return n != 0
+		}
+	})
+}
+
+func TestConformanceUser(t *testing.T) {
+	repotest.TestUser(t, func(t *testing.T) repo.RepositoryUser {
+		return NewUser(openTest(t))
+	})
+}
+
+func TestConformanceSession(t *testing.T) {
+	repotest.TestSession(t, func(t *testing.T) repo.RepositorySession {
+		return NewSession(openTest(t))
+	})
+}
+
+func TestConformanceShare(t *testing.T) {
+	repotest.TestShare(t, func(t *testing.T) repo.RepositoryShare {
+		return NewShare(openTest(t))
+	})
+}
+
+func TestConformanceSpace(t *testing.T) {
+	repotest.TestSpace(t, func(t *testing.T) repo.RepositorySpace {
+		return NewSpace(openTest(t))
+	})
+}
+
+func TestConformanceDevice(t *testing.T) {
+	repotest.TestDevice(t, func(t *testing.T) repo.RepositoryDevice {
+		return NewDevice(openTest(t))
+	})
+}
+
+func TestConformanceTicket(t *testing.T) {
+	repotest.TestTicket(t, func(t *testing.T) repo.RepositoryTicket {
+		return NewTicket(openTest(t))
+	})
+}
+
+func TestMigrateTwice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	for i := 0; i < 2; i++ {
+		db, err := Open(path)
+		if err != nil {
+			t.Fatalf("failed to open sqlite #%d: %v", i, err)
+		}
+
+		db.Close()
+	}
+}
@@ -0,0 +1,52 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoSqliteTicket struct {
+	db *sql.DB
+}
+
+func NewTicket(db *sql.DB) repo.RepositoryTicket {
+	return &RepoSqliteTicket{db: db}
+}
+
+// Use also cleans up tickets that expired
+func (r *RepoSqliteTicket) Use(ctx context.Context, id string, expiresAt time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin sqlite err: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM used_tickets WHERE expires_at <= ?", time.Now().UnixNano())
+	if err != nil {
+		return fmt.Errorf("delete used tickets sqlite err: %w", err)
+	}
+
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO used_tickets (id, expires_at) VALUES (?, ?) ON CONFLICT (id) DO NOTHING",
+		id, expiresAt.UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("insert used ticket sqlite err: %w", err)
+	}
+
+	err = expectOneRow(res, fmt.Errorf("ticket '%s' is already used: %w", id, repo.ErrConflict))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit sqlite err: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/eymyong/drop/model"
+	"github.com/eymyong/drop/repo"
+)
+
+type RepoSqliteUser struct {
+	db *sql.DB
+}
+
+func NewUser(db *sql.DB) repo.RepositoryUser {
+	return &RepoSqliteUser{db: db}
+}
+
+func (r *RepoSqliteUser) Create(ctx context.Context, user model.User) (model.User, error) {
+	if user.Id == "" || user.Username == "" {
+		return model.User{}, fmt.Errorf("empty user id or username: %w", repo.ErrInvalid)
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.User{}, fmt.Errorf("begin sqlite err: %w", err)
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE id = ?", user.Id).Scan(&count)
+	if err != nil {
+		return model.User{}, fmt.Errorf("failed to check for duplicate user id: %w", err)
+	}
+
+	if count > 0 {
+		return model.User{}, fmt.Errorf("the new user id is already taken: %w", repo.ErrConflict)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO users (id, username, password) VALUES (?, ?, ?)",
+		user.Id, user.Username, user.Password,
+	)
+	if isUniqueViolation(err) {
+		return model.User{}, fmt.Errorf("username '%s' is already taken: %w", user.Username, repo.ErrConflict)
+	}
+	if err != nil {
+		return model.User{}, fmt.Errorf("failed to register user '%s': %w", user.Username, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return model.User{}, fmt.Errorf("commit sqlite err: %w", err)
+	}
+
+	return user, nil
+}
+
+func (r *RepoSqliteUser) GetPassword(ctx context.Context, username string) ([]byte, error) {
+	var password string
+	err := r.db.QueryRowContext(ctx, "SELECT password FROM users WHERE username = ?", username).Scan(&password)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("username '%s': %w", username, repo.ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get password for username '%s': %w", username, err)
+	}
+
+	return []byte(password), nil
+}
+
+func (r *RepoSqliteUser) GetByUsername(ctx context.Context, username string) (model.User, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT id, username, password FROM users WHERE username = ?", username)
+	user, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return model.User{}, fmt.Errorf("username '%s': %w", username, repo.ErrNotFound)
+	}
+	if err != nil {
+		return model.User{}, fmt.Errorf("select user sqlite err: %w", err)
+	}
+
+	return user, nil
+}
+
+func (r *RepoSqliteUser) GetById(ctx context.Context, id string) (model.User, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT id, username, password FROM users WHERE id = ?", id)
+	user, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return model.User{}, fmt.Errorf("no user '%s' in sqlite: %w", id, repo.ErrNotFound)
+	}
+	if err != nil {
+		return model.User{}, fmt.Errorf("select user sqlite err: %w", err)
+	}
+
+	return user, nil
+}
+
+func (r *RepoSqliteUser) UpdateUsername(ctx context.Context, id string, newUsername string) error {
+	if newUsername == "" {
+		return fmt.Errorf("empty username: %w", repo.ErrInvalid)
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin sqlite err: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET username = ? WHERE id = ?", newUsername, id)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("username %s is already taken: %w", newUsername, repo.ErrConflict)
+	}
+	if err != nil {
+		return fmt.Errorf("update username sqlite err: %w", err)
+	}
+
+	err = expectOneRow(res, fmt.Errorf("user id '%s': %w", id, repo.ErrNotFound))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit sqlite err: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RepoSqliteUser) UpdatePassword(ctx context.Context, id string, newPassword string) error {
+	res, err := r.db.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", newPassword, id)
+	if err != nil {
+		return fmt.Errorf("update password sqlite err: %w", err)
+	}
+
+	return expectOneRow(res, fmt.Errorf("failed to update password for user id '%s': %w", id, repo.ErrNotFound))
+}
+
+func (r *RepoSqliteUser) Delete(ctx context.Context, id string) error {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM users WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("delete user sqlite err: %w", err)
+	}
+
+	return expectOneRow(res, fmt.Errorf("0 user deleted for id '%s': %w", id, repo.ErrNotFound))
+}
+
+func scanUser(row scanner) (model.User, error) {
+	var user model.User
+	err := row.Scan(&user.Id, &user.Username, &user.Password)
+	if err != nil {
+		return model.User{}, err
+	}
+
+	return user, nil
+}